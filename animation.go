@@ -0,0 +1,230 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "io"
+    "bytes"
+    "time"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    "image/draw"
+    "image/color"
+    //------------------------------
+    //errors
+    //------------------------------
+    "errors"
+)
+
+// AnimationEncoder encodes a WebP animation one frame at a time.
+//
+// Unlike EncodeAll, which needs every frame in memory before it starts, an AnimationEncoder
+// compresses each frame to VP8L as soon as it is added and only keeps the compressed data.
+// The RIFF, VP8X and ANIM headers are written to the underlying io.Writer when Close is called,
+// once the canvas size and alpha flag of the full animation are known.
+//
+// Frame timing follows libwebp's WebPAnimEncoderAdd: every frame is added with the timestamp at
+// which it should be shown, and the duration of a frame is the difference between its timestamp
+// and the timestamp of the next frame. Calling AddFrame with a nil image marks the end timestamp
+// of the last frame.
+type AnimationEncoder struct {
+    w                   io.Writer
+    options             *Options
+    loopCount           uint16
+    backgroundColor     uint32
+
+    frames              *bytes.Buffer
+    bounds              image.Rectangle
+    hasAlpha            bool
+
+    pending             *bytes.Buffer
+    pendingBounds       image.Rectangle
+    pendingTimestamp    time.Duration
+
+    totalDuration       uint
+    count               int
+    lastTimestamp       time.Duration
+    hasEnd              bool
+    closed              bool
+}
+
+// NewAnimationEncoder returns an AnimationEncoder that writes a WebP animation to w.
+//
+// Parameters:
+//   w               - The destination writer where the encoded WebP animation will be written.
+//   loopCount       - Number of times the animation should loop (0 = infinite).
+//   backgroundColor - Background color for the canvas in BGRA order, used when clearing.
+//   o               - Pointer to Options containing additional encoding settings, may be nil.
+//
+// Returns:
+//   A new AnimationEncoder, ready to accept frames.
+func NewAnimationEncoder(w io.Writer, loopCount uint16, backgroundColor uint32, o *Options) *AnimationEncoder {
+    return &AnimationEncoder{
+        w:                  w,
+        options:            o,
+        loopCount:          loopCount,
+        backgroundColor:    backgroundColor,
+        frames:             &bytes.Buffer{},
+    }
+}
+
+// AddFrame compresses img and appends it to the animation.
+//
+// The timestamp is the moment, relative to the start of the animation, at which the frame
+// should be displayed. Timestamps must not decrease between calls. Passing a nil image
+// records the end timestamp of the last frame instead of adding a new frame; no more
+// frames may be added after that.
+//
+// Parameters:
+//   img       - The frame to add, positioned on the canvas by its bounds, or nil to end the animation.
+//   timestamp - The display time of the frame.
+//
+// Returns:
+//   An error if the timestamp is invalid, the encoder is closed, the frame has a negative offset
+//   or exceeds the maximum canvas size, or the frame fails to encode.
+func (e *AnimationEncoder) AddFrame(img image.Image, timestamp time.Duration) error {
+    if e.closed || e.hasEnd {
+        return errors.New("animation encoder is closed")
+    }
+
+    if timestamp < 0 || (e.count > 0 && timestamp < e.lastTimestamp) {
+        return errors.New("timestamps must not decrease")
+    }
+
+    if img == nil {
+        if e.count == 0 {
+            return errors.New("must provide at least one image")
+        }
+
+        if err := e.flushPending(timestamp); err != nil {
+            return err
+        }
+
+        e.hasEnd = true
+        return nil
+    }
+
+    if err := validateFrameBounds(img.Bounds()); err != nil {
+        return err
+    }
+
+    b := getBuffers(nil)
+    stream, alpha, err := writeBitStream(img, e.options, b)
+    putBuffers(nil, b)
+
+    if err != nil {
+        return err
+    }
+
+    if e.pending != nil {
+        if err := e.flushPending(timestamp); err != nil {
+            return err
+        }
+    }
+
+    e.pending = stream
+    e.pendingBounds = img.Bounds()
+    e.pendingTimestamp = timestamp
+
+    e.hasAlpha = e.hasAlpha || alpha
+    e.bounds.Max.X = max(img.Bounds().Max.X, e.bounds.Max.X)
+    e.bounds.Max.Y = max(img.Bounds().Max.Y, e.bounds.Max.Y)
+
+    e.count++
+    e.lastTimestamp = timestamp
+
+    return nil
+}
+
+// Close writes the animation to the underlying io.Writer.
+//
+// If no end timestamp was given with AddFrame(nil, timestamp), the last frame is shown for
+// the average duration of the preceding frames, or 100 milliseconds if it is the only frame.
+// Close does not close the underlying io.Writer.
+//
+// Returns:
+//   An error if no frames were added or the encoder was already closed,
+//   or a *WriteError if writing to the io.Writer fails.
+func (e *AnimationEncoder) Close() error {
+    if e.closed {
+        return errors.New("animation encoder is closed")
+    }
+
+    if e.count == 0 {
+        return errors.New("must provide at least one image")
+    }
+
+    if e.pending != nil {
+        duration := uint(100)
+        if e.count > 1 {
+            duration = e.totalDuration / uint(e.count - 1)
+        }
+
+        err := writeChunkANMF(e.frames, e.pending, e.pendingBounds, min(duration, 1 << 24 - 1), 0, 0)
+        if err != nil {
+            return err
+        }
+
+        e.pending = nil
+    }
+
+    e.closed = true
+
+    _, err := writeAnimation(e.w, e.bounds, e.hasAlpha, e.backgroundColor, e.loopCount, e.frames)
+    return err
+}
+
+func (e *AnimationEncoder) flushPending(timestamp time.Duration) error {
+    // durations are derived from millisecond timestamps so rounding errors do not accumulate
+    duration := uint(timestamp.Milliseconds() - e.pendingTimestamp.Milliseconds())
+    e.totalDuration += duration
+
+    if err := writeChunkANMF(e.frames, e.pending, e.pendingBounds, min(duration, 1 << 24 - 1), 0, 0); err != nil {
+        return err
+    }
+
+    e.pending = nil
+    return nil
+}
+
+// compositeFrame draws a frame onto the canvas the way a WebP decoder does,
+// either alpha-blending the frame onto the canvas or overwriting it.
+func compositeFrame(canvas *image.NRGBA, frame image.Image, blend bool) {
+    r := frame.Bounds().Intersect(canvas.Bounds())
+
+    for y := r.Min.Y; y < r.Max.Y; y++ {
+        for x := r.Min.X; x < r.Max.X; x++ {
+            src := color.NRGBAModel.Convert(frame.At(x, y)).(color.NRGBA)
+
+            i := canvas.PixOffset(x, y)
+            d := canvas.Pix[i : i + 4 : i + 4]
+
+            if !blend || src.A == 255 {
+                d[0], d[1], d[2], d[3] = src.R, src.G, src.B, src.A
+                continue
+            }
+
+            // alpha-blending formula for non-premultiplied colors comes from the WebP specs
+            dstA := uint32(d[3]) * (255 - uint32(src.A)) / 255
+            a := uint32(src.A) + dstA
+            if a == 0 {
+                d[0], d[1], d[2], d[3] = 0, 0, 0, 0
+                continue
+            }
+
+            d[0] = uint8((uint32(src.R) * uint32(src.A) + uint32(d[0]) * dstA) / a)
+            d[1] = uint8((uint32(src.G) * uint32(src.A) + uint32(d[1]) * dstA) / a)
+            d[2] = uint8((uint32(src.B) * uint32(src.A) + uint32(d[2]) * dstA) / a)
+            d[3] = uint8(a)
+        }
+    }
+}
+
+// clearFrame fills the area of a frame on the canvas with transparent pixels,
+// which is how decoders dispose a frame to the background.
+func clearFrame(canvas *image.NRGBA, r image.Rectangle) {
+    draw.Draw(canvas, r, image.Transparent, image.Point{}, draw.Src)
+}
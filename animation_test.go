@@ -0,0 +1,178 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "bytes"
+    "time"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    //------------------------------
+    //testing
+    //------------------------------
+    "testing"
+)
+
+func TestAnimationEncoder(t *testing.T) {
+    frame1 := generateTestImageNRGBA(4, 4, 64, true)
+    frame2 := generateTestImageNRGBA(8, 8, 64, false)
+    frame3 := generateTestImageNRGBA(6, 6, 32, true)
+
+    for id, tt := range []struct {
+        images              []image.Image
+        timestamps          []time.Duration
+        end                 time.Duration
+        expectedDurations   []uint
+    }{
+        {   // single frame without end timestamp
+            []image.Image{frame1},
+            []time.Duration{0},
+            -1,
+            []uint{100},
+        },
+        {   // single frame with end timestamp
+            []image.Image{frame1},
+            []time.Duration{0},
+            250 * time.Millisecond,
+            []uint{250},
+        },
+        {   // last frame uses the average duration
+            []image.Image{frame1, frame2, frame3},
+            []time.Duration{0, 100 * time.Millisecond, 300 * time.Millisecond},
+            -1,
+            []uint{100, 200, 150},
+        },
+        {   // sub-millisecond timestamps do not accumulate rounding errors
+            []image.Image{frame1, frame2, frame3},
+            []time.Duration{
+                500 * time.Microsecond,
+                33500 * time.Microsecond,
+                66900 * time.Microsecond,
+            },
+            100 * time.Millisecond,
+            []uint{33, 33, 34},
+        },
+    }{
+        b := &bytes.Buffer{}
+        e := NewAnimationEncoder(b, 3, 0xff00ff00, nil)
+
+        for i, img := range tt.images {
+            if err := e.AddFrame(img, tt.timestamps[i]); err != nil {
+                t.Fatalf("test %v: unexpected error %v", id, err)
+            }
+        }
+
+        if tt.end >= 0 {
+            if err := e.AddFrame(nil, tt.end); err != nil {
+                t.Fatalf("test %v: unexpected error %v", id, err)
+            }
+        }
+
+        if err := e.Close(); err != nil {
+            t.Fatalf("test %v: unexpected error %v", id, err)
+        }
+
+        // the streaming encoder must produce the same file as EncodeAll
+        expected := &bytes.Buffer{}
+        err := EncodeAll(expected, &Animation{
+            Images:             tt.images,
+            Durations:          tt.expectedDurations,
+            Disposals:          make([]uint, len(tt.images)),
+            LoopCount:          3,
+            BackgroundColor:    0xff00ff00,
+        }, nil)
+        if err != nil {
+            t.Fatalf("test %v: unexpected error %v", id, err)
+        }
+
+        if !bytes.Equal(b.Bytes(), expected.Bytes()) {
+            t.Errorf("test %v: output mismatch expected %v got %v", id, expected.Bytes(), b.Bytes())
+        }
+    }
+}
+
+func TestAnimationEncoderErrors(t *testing.T) {
+    frame := generateTestImageNRGBA(4, 4, 64, true)
+
+    for id, tt := range []struct {
+        run             func(e *AnimationEncoder) error
+        expectedMsg     string
+    }{
+        {
+            func(e *AnimationEncoder) error {
+                return e.Close()
+            },
+            "must provide at least one image",
+        },
+        {
+            func(e *AnimationEncoder) error {
+                return e.AddFrame(nil, 0)
+            },
+            "must provide at least one image",
+        },
+        {
+            func(e *AnimationEncoder) error {
+                return e.AddFrame(image.NewNRGBA(image.Rectangle{}), 0)
+            },
+            "invalid image size",
+        },
+        {
+            func(e *AnimationEncoder) error {
+                return e.AddFrame(image.NewNRGBA(image.Rect(-2, -2, 2, 2)), 0)
+            },
+            "frame offsets must not be negative",
+        },
+        {
+            func(e *AnimationEncoder) error {
+                e.AddFrame(frame, 0)
+                return e.AddFrame(image.NewNRGBA(image.Rect(1 << 26, 0, 1 << 26 + 4, 4)), 100 * time.Millisecond)
+            },
+            "frame exceeds the maximum canvas size",
+        },
+        {
+            func(e *AnimationEncoder) error {
+                return e.AddFrame(frame, -time.Millisecond)
+            },
+            "timestamps must not decrease",
+        },
+        {
+            func(e *AnimationEncoder) error {
+                e.AddFrame(frame, 100 * time.Millisecond)
+                return e.AddFrame(frame, 50 * time.Millisecond)
+            },
+            "timestamps must not decrease",
+        },
+        {
+            func(e *AnimationEncoder) error {
+                e.AddFrame(frame, 0)
+                e.AddFrame(nil, 100 * time.Millisecond)
+                return e.AddFrame(frame, 200 * time.Millisecond)
+            },
+            "animation encoder is closed",
+        },
+        {
+            func(e *AnimationEncoder) error {
+                e.AddFrame(frame, 0)
+                e.Close()
+                return e.Close()
+            },
+            "animation encoder is closed",
+        },
+    }{
+        e := NewAnimationEncoder(&bytes.Buffer{}, 0, 0, nil)
+
+        err := tt.run(e)
+        if err == nil {
+            t.Errorf("test %v: expected error %v got nil", id, tt.expectedMsg)
+            continue
+        }
+
+        if err.Error() != tt.expectedMsg {
+            t.Errorf("test %v: expected error %v got %v", id, tt.expectedMsg, err)
+            continue
+        }
+    }
+}
@@ -0,0 +1,63 @@
+package nativewebp
+
+// bitReader reads a VP8L bitstream, which packs values starting at the least significant bit.
+//
+// Reading past the end of the data does not fail immediately, missing bits read as zero and
+// the eos flag is set, so callers can check for truncation once per pixel instead of per read.
+type bitReader struct {
+    data        []byte
+    pos         int
+    bits        uint64
+    nbits       uint
+    eos         bool
+}
+
+func (r *bitReader) fill() {
+    for r.nbits <= 56 && r.pos < len(r.data) {
+        r.bits |= uint64(r.data[r.pos]) << r.nbits
+        r.pos++
+        r.nbits += 8
+    }
+}
+
+// consumed returns the number of bits read so far.
+func (r *bitReader) consumed() int {
+    return r.pos * 8 - int(r.nbits)
+}
+
+// seek continues reading data at the given bit, which must have been reached by reading data
+// or a shorter slice holding the same bytes.
+func (r *bitReader) seek(data []byte, bit int) {
+    *r = bitReader{data: data, pos: bit >> 3}
+    r.fill()
+    r.skipBits(uint(bit & 7))
+}
+
+// peekBits returns the next n bits without consuming them, n must be at most 32.
+func (r *bitReader) peekBits(n uint) uint32 {
+    if r.nbits < n {
+        r.fill()
+    }
+
+    return uint32(r.bits & (1 << n - 1))
+}
+
+// skipBits consumes n bits that were returned by peekBits.
+func (r *bitReader) skipBits(n uint) {
+    if r.nbits < n {
+        r.eos = true
+        r.bits = 0
+        r.nbits = 0
+        return
+    }
+
+    r.bits >>= n
+    r.nbits -= n
+}
+
+// readBits consumes and returns the next n bits, n must be at most 32.
+func (r *bitReader) readBits(n uint) uint32 {
+    v := r.peekBits(n)
+    r.skipBits(n)
+    return v
+}
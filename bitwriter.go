@@ -4,27 +4,59 @@ import (
     //------------------------------
     //general
     //------------------------------
-    "bytes"
+    "encoding/binary"
+    //------------------------------
+    //errors
+    //------------------------------
+    "errors"
 )
 
+// bitWriter packs values least significant bit first, as required by the VP8L bitstream. Bits are
+// gathered in a 64-bit word that is appended to Buffer once it is full, so up to 63 bits are held
+// back until alignByte is called.
+//
+// Fields:
+//   - Buffer: The bytes written so far, grown as needed.
+//   - BitBuffer, BitBufferSize: Bits that are not yet in Buffer and their count.
+//   - Err: The first invalid call to writeBits, the bitstream is unusable once it is set.
 type bitWriter struct {
-    Buffer          *bytes.Buffer
+    Buffer          []byte
     BitBuffer       uint64
     BitBufferSize   int
+    Err             error
 }
 
 func (w *bitWriter) writeBits(value uint64, n int) {
+    if w.Err != nil {
+        return
+    }
+
     if n < 0 || n > 64 {
-        panic("Invalid bit count: must be between 1 and 64")
+        w.Err = errors.New("invalid bit count: must be between 0 and 64")
+        return
     }
 
-    if value >= (1 << n) {
-        panic("too many bits for the given value")
+    if n < 64 && value >> n != 0 {
+        w.Err = errors.New("too many bits for the given value")
+        return
     }
-    
-    w.BitBuffer |= (value << w.BitBufferSize)
+
+    w.putBits(value, n)
+}
+
+// putBits is writeBits without the checks, value must fit in n bits and n must be at most 64.
+func (w *bitWriter) putBits(value uint64, n int) {
+    w.BitBuffer |= value << w.BitBufferSize
     w.BitBufferSize += n
-    w.writeThrough()
+    if w.BitBufferSize < 64 {
+        return
+    }
+
+    w.Buffer = binary.LittleEndian.AppendUint64(w.Buffer, w.BitBuffer)
+    w.BitBufferSize -= 64
+
+    // the bits of value that did not fit in the word, shifting by 64 yields 0
+    w.BitBuffer = value >> (n - w.BitBufferSize)
 }
 
 func (w *bitWriter) writeBytes(values []byte) {
@@ -33,19 +65,13 @@ func (w *bitWriter) writeBytes(values []byte) {
     }
 }
 
+// writeCode writes a Huffman code, its bits are already in bitstream order, see buildhuffmanCodes.
 func (w *bitWriter) writeCode(code huffmanCode) {
     if code.Depth <= 0 {
         return
     }
 
-    value := uint64(code.Bits)
-    reversed := uint64(0)
-    for i := 0; i < code.Depth; i++ {
-        reversed = (reversed << 1) | (value & 1)
-        value >>= 1
-    }
-
-    w.writeBits(reversed, code.Depth)
+    w.putBits(uint64(code.Bits), code.Depth)
 }
 
 func (w *bitWriter) alignByte() {
@@ -53,9 +79,10 @@ func (w *bitWriter) alignByte() {
     w.writeThrough()
 }
 
+// writeThrough moves the whole bytes of the bit buffer to Buffer.
 func (w *bitWriter) writeThrough() {
     for w.BitBufferSize >= 8 {
-        w.Buffer.WriteByte(byte(w.BitBuffer & 0xFF))
+        w.Buffer = append(w.Buffer, byte(w.BitBuffer))
         w.BitBuffer >>= 8
         w.BitBufferSize -= 8
     }
@@ -21,61 +21,93 @@ func TestWriteBits(t *testing.T) {
         expectedBuffer  []byte
         expectedBitBuf  uint64
         expectedBufSize int
-        expectPanic     bool
+        expectErr       bool
     }{
         // Valid cases
         {nil, 0, 0, 0b1, 1, nil, 0b1, 1, false},                                                // Write 1 bit
-        {nil, 0, 0, 0b11010101, 8, []byte{0b11010101}, 0, 0, false},                            // Write 8 bits, flush to buffer
-        {nil, 0, 0, 0xFFFF, 16, []byte{0xFF, 0xFF}, 0, 0, false},                               // Write 16 bits, flush to buffer
+        {nil, 0, 0, 0b11010101, 8, nil, 0b11010101, 8, false},                                  // Write 8 bits, kept until the word is full
+        {nil, 0, 0, 0xFFFF, 16, nil, 0xFFFF, 16, false},                                        // Write 16 bits
         {nil, 0, 0, 0b101, 3, nil, 0b101, 3, false},                                            // Write 3 bits
         {nil, 0b1, 1, 0b10, 2, nil, 0b101, 3, false},                                           // Append 2 bits
         {nil, 0b101, 3, 0b1111, 4, nil, 0b1111101, 7, false},                                   // Append 4 bits
         {[]byte{0xFF}, 0, 0, 0b101, 3, []byte{0xFF}, 0b101, 3, false},                          // Preserve buffer
-        // Multiple writes, testing flush
-        {nil, 0, 0, 0b1101, 4, nil, 0b1101, 4, false},                                          // First write
-        {[]byte{}, 0b1101, 4, 0b1111, 4, []byte{0xFD}, 0, 0, false},                            // Flush to buffer (8 bits)
-        {[]byte{0xAB}, 0, 0, 0b1010101010101010, 16, []byte{0xAB, 0xAA, 0xAA}, 0, 0, false},    // Write 16 bits after flush
-        // Invalid cases (expect panic)
-        {nil, 0, 0, 0b101, 0, nil, 0, 0, true},                                                 // Bit count is 0
+        {nil, 0b1, 1, 0, 0, nil, 0b1, 1, false},                                                // Write 0 bits
+        // Full words
+        {nil, 0xFFFFFFFF, 32, 0x12345678, 32, []byte{0xFF, 0xFF, 0xFF, 0xFF, 0x78, 0x56, 0x34, 0x12}, 0, 0, false},            // Fill a word exactly
+        {nil, 0xFFFFFFFFFFFFFF, 56, 0xABC, 12, []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xBC}, 0xA, 4, false},         // Bits beyond the word are kept
+        {[]byte{0xAB}, 0, 0, 0x0123456789ABCDEF, 64, []byte{0xAB, 0xEF, 0xCD, 0xAB, 0x89, 0x67, 0x45, 0x23, 0x01}, 0, 0, false}, // Write 64 bits
+        {nil, 0b1010, 4, 0xFFFFFFFFFFFFFFFF, 64, []byte{0xFA, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, 0xF, 4, false},       // Write 64 bits after 4 bits
+        // Invalid cases
+        {nil, 0, 0, 0b101, 0, nil, 0, 0, true},                                                 // Value too large for 0 bits
         {nil, 0, 0, 0b101, 65, nil, 0, 0, true},                                                // Bit count exceeds 64
-        {nil, 0, 0, 0b101, -1, nil, 0, 0, true},                                                // Bit count exceeds 64
-        {nil, 0, 0, 0b101, 2, nil, 0, 0, true},                                                 // Value too large for bit count
+        {nil, 0, 0, 0b101, -1, nil, 0, 0, true},                                                // Negative bit count
+        {nil, 0b1, 1, 0b101, 2, nil, 0b1, 1, true},                                             // Value too large for bit count
     } {
-        // Use defer to catch panics
-        func() {
-            defer func() {
-                if r := recover(); r != nil {
-                    if !tt.expectPanic {
-                        t.Errorf("test %v: unexpected panic: %v", id, r)
-                    }
-                } else if tt.expectPanic {
-                    t.Errorf("test %v: expected panic but did not occur", id)
-                }
-            }()
-
-            buffer := &bytes.Buffer{}
-            buffer.Write(tt.initialBuffer)
-            writer := bitWriter{
-                Buffer:        buffer,
-                BitBuffer:     tt.initialBitBuf,
-                BitBufferSize: tt.initialBufSize,
-            }
-
-            writer.writeBits(tt.value, tt.bitCount)
-
-            // Validate state
-            if !tt.expectPanic {
-                if !bytes.Equal(writer.Buffer.Bytes(), tt.expectedBuffer) {
-                    t.Errorf("test %v: buffer mismatch: expected %v, got %v", id, tt.expectedBuffer, writer.Buffer.Bytes())
-                }
-                if writer.BitBuffer != tt.expectedBitBuf {
-                    t.Errorf("test %v: bit buffer mismatch: expected %v, got %v", id, tt.expectedBitBuf, writer.BitBuffer)
-                }
-                if writer.BitBufferSize != tt.expectedBufSize {
-                    t.Errorf("test %v: bit buffer size mismatch: expected %v, got %v", id, tt.expectedBufSize, writer.BitBufferSize)
-                }
-            }
-        }()
+        writer := bitWriter{
+            Buffer:        append([]byte(nil), tt.initialBuffer...),
+            BitBuffer:     tt.initialBitBuf,
+            BitBufferSize: tt.initialBufSize,
+        }
+
+        writer.writeBits(tt.value, tt.bitCount)
+
+        if tt.expectErr && writer.Err == nil {
+            t.Errorf("test %v: expected error but got nil", id)
+        } else if !tt.expectErr && writer.Err != nil {
+            t.Errorf("test %v: unexpected error: %v", id, writer.Err)
+        }
+
+        // once an error is recorded further writes are ignored
+        if tt.expectErr {
+            writer.writeBits(1, 1)
+        }
+
+        if !bytes.Equal(writer.Buffer, tt.expectedBuffer) {
+            t.Errorf("test %v: buffer mismatch: expected %v, got %v", id, tt.expectedBuffer, writer.Buffer)
+        }
+
+        if writer.BitBuffer != tt.expectedBitBuf {
+            t.Errorf("test %v: bit buffer mismatch: expected %v, got %v", id, tt.expectedBitBuf, writer.BitBuffer)
+        }
+
+        if writer.BitBufferSize != tt.expectedBufSize {
+            t.Errorf("test %v: bit buffer size mismatch: expected %v, got %v", id, tt.expectedBufSize, writer.BitBufferSize)
+        }
+    }
+}
+
+func TestWriteBitsSequence(t *testing.T) {
+    // values of every width are written across word boundaries and read back
+    pattern := func(n int) uint64 {
+        return 0xA5C3A5C3A5C3A5C3 >> (64 - n)
+    }
+
+    writer := &bitWriter{}
+    for n := 0; n <= 64; n++ {
+        writer.writeBits(pattern(n), n)
+    }
+    writer.alignByte()
+
+    if writer.Err != nil {
+        t.Fatalf("unexpected error: %v", writer.Err)
+    }
+
+    if len(writer.Buffer) != (64 * 65 / 2 + 7) / 8 {
+        t.Fatalf("expected %v bytes got %v", (64 * 65 / 2 + 7) / 8, len(writer.Buffer))
+    }
+
+    br := &bitReader{data: writer.Buffer}
+    for n := 1; n <= 64; n++ {
+        // the reader takes at most 32 bits at a time
+        lo := uint64(br.readBits(uint(min(n, 32))))
+        hi := uint64(0)
+        if n > 32 {
+            hi = uint64(br.readBits(uint(n - 32)))
+        }
+
+        if v := hi << 32 | lo; v != pattern(n) {
+            t.Errorf("value of %v bits: expected %x got %x", n, pattern(n), v)
+        }
     }
 }
 
@@ -89,25 +121,24 @@ func TestWriteBytes(t *testing.T) {
         expectedBitBuf  uint64
         expectedBufSize int
     }{
-        {nil, 0, 0, []byte{0xFF}, []byte{0xFF}, 0, 0},                      // Write single byte
-        {nil, 0, 0, []byte{0x12, 0x34}, []byte{0x12, 0x34}, 0, 0},          // Write two bytes
-        {[]byte{0xAB}, 0, 0, []byte{0xCD}, []byte{0xAB, 0xCD}, 0, 0},       // Preserve existing buffer
-        {nil, 0b1, 1, []byte{0x80}, []byte{0x01}, 0b1, 1},                  // Partial bit buffer (1 bit) + new byte
-        {[]byte{0x00}, 0b1111, 4, []byte{0x0F}, []byte{0x00, 0xFF}, 0, 4},  // Partial + full flush
-        {nil, 0, 0, nil, nil, 0, 0},                                        // No values to write
+        {nil, 0, 0, []byte{0xFF}, nil, 0xFF, 8},                                            // Write single byte
+        {nil, 0, 0, []byte{0x12, 0x34}, nil, 0x3412, 16},                                   // Write two bytes
+        {[]byte{0xAB}, 0, 0, []byte{0xCD}, []byte{0xAB}, 0xCD, 8},                          // Preserve existing buffer
+        {nil, 0b1, 1, []byte{0x80}, nil, 0x101, 9},                                         // Partial bit buffer (1 bit) + new byte
+        {[]byte{0x00}, 0b1111, 4, []byte{0x0F}, []byte{0x00}, 0xFF, 12},                    // Partial + full byte
+        {nil, 0, 0, []byte("VP8LVP8L!"), []byte("VP8LVP8L"), '!', 8},                       // Full word written to the buffer
+        {nil, 0, 0, nil, nil, 0, 0},                                                        // No values to write
     } {
-        buffer := &bytes.Buffer{}
-        buffer.Write(tt.initialBuffer)
         writer := bitWriter{
-            Buffer:        buffer,
+            Buffer:        append([]byte(nil), tt.initialBuffer...),
             BitBuffer:     tt.initialBitBuf,
             BitBufferSize: tt.initialBufSize,
         }
 
         writer.writeBytes(tt.values)
 
-        if !bytes.Equal(writer.Buffer.Bytes(), tt.expectedBuffer) {
-            t.Errorf("test %v: buffer mismatch: expected %v, got %v", id, tt.expectedBuffer, writer.Buffer.Bytes())
+        if !bytes.Equal(writer.Buffer, tt.expectedBuffer) {
+            t.Errorf("test %v: buffer mismatch: expected %v, got %v", id, tt.expectedBuffer, writer.Buffer)
         }
 
         if writer.BitBuffer != tt.expectedBitBuf {
@@ -130,34 +161,27 @@ func TestWriteCode(t *testing.T) {
         expectedBitBuf  uint64
         expectedBufSize int
     }{
+        // codes are stored reversed by buildhuffmanCodes and written as is
         {nil, 0, 0, huffmanCode{Bits: 0b101, Depth: 3}, nil, 0b101, 3},                             // Basic 3-bit code
-        {nil, 0, 0, huffmanCode{Bits: 0b10, Depth: 2}, nil, 0b01, 2},                               // 2-bit code, reversed
-        {nil, 0, 0, huffmanCode{Bits: 0b1011, Depth: 4}, nil, 0b1101, 4},                           // 4-bit code, reversed
-        {nil, 0b1, 1, huffmanCode{Bits: 0b10, Depth: 2}, nil, 0b011, 3},                            // Append 2 bits to existing buffer
+        {nil, 0, 0, huffmanCode{Bits: 0b01, Depth: 2}, nil, 0b01, 2},                               // 2-bit code
+        {nil, 0, 0, huffmanCode{Bits: 0b1101, Depth: 4}, nil, 0b1101, 4},                           // 4-bit code
+        {nil, 0b1, 1, huffmanCode{Bits: 0b01, Depth: 2}, nil, 0b011, 3},                            // Append 2 bits to existing buffer
         {nil, 0, 0, huffmanCode{Bits: 0, Depth: 0}, nil, 0, 0},                                     // Zero-Depth: code, no operation
-        {nil, 0b10101010, 8, huffmanCode{Bits: 0b1111, Depth: 4}, []byte{0b10101010}, 0b1111, 4},   // Flush full byte, 4 bits remaining
-        {nil, 0, 0, huffmanCode{Bits: 0b10011, Depth: 5}, nil, 0b11001, 5},                         // 5-bit code, reversed
+        {nil, 0b10101010, 8, huffmanCode{Bits: 0b1111, Depth: 4}, nil, 0b111110101010, 12},         // Append to a full byte
+        {nil, 0, 0, huffmanCode{Bits: 0b11001, Depth: 5}, nil, 0b11001, 5},                         // 5-bit code
         {nil, 0, 0, huffmanCode{Bits: 0b1, Depth: -1}, nil, 0, 0},                                  // Negative Depth:, no operation
+        {nil, 1 << 62 - 1, 62, huffmanCode{Bits: 0b0110, Depth: 4}, []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xBF}, 0b01, 2}, // Code across a word boundary
     } {
-        buffer := &bytes.Buffer{}
-        buffer.Write(tt.initialBuffer)
         writer := bitWriter{
-            Buffer:        buffer,
+            Buffer:        append([]byte(nil), tt.initialBuffer...),
             BitBuffer:     tt.initialBitBuf,
             BitBufferSize: tt.initialBufSize,
         }
 
-        func() {
-            defer func() {
-                if r := recover(); r != nil {
-                    t.Errorf("test %v: unexpected panic: %v", id, r)
-                }
-            }()
-            writer.writeCode(tt.code)
-        }()
+        writer.writeCode(tt.code)
 
-        if !bytes.Equal(writer.Buffer.Bytes(), tt.expectedBuffer) {
-            t.Errorf("test %v: buffer mismatch: expected %v, got %v", id, tt.expectedBuffer, writer.Buffer.Bytes())
+        if !bytes.Equal(writer.Buffer, tt.expectedBuffer) {
+            t.Errorf("test %v: buffer mismatch: expected %v, got %v", id, tt.expectedBuffer, writer.Buffer)
         }
 
         if writer.BitBuffer != tt.expectedBitBuf {
@@ -186,18 +210,16 @@ func TestWriteThrough(t *testing.T) {
         {[]byte{0xAB}, 0b11010101, 8, []byte{0xAB, 0xD5}, 0, 0},                    // Preserves existing buffer contents
         {[]byte{0xAB}, 0b1010101010101010, 12, []byte{0xAB, 0xAA}, 0b10101010, 4},  // Mixed existing buffer and partial flush
     } {
-        buffer := &bytes.Buffer{}
-        buffer.Write(tt.initialBuffer)
         writer := bitWriter{
-            Buffer:        buffer,
+            Buffer:        append([]byte(nil), tt.initialBuffer...),
             BitBuffer:     tt.initialBitBuf,
             BitBufferSize: tt.initialBufSize,
         }
 
         writer.writeThrough()
 
-        if !bytes.Equal(writer.Buffer.Bytes(), tt.expectedBuffer) {
-            t.Errorf("test %v: buffer mismatch: expected %v, got %v", id, tt.expectedBuffer, writer.Buffer.Bytes())
+        if !bytes.Equal(writer.Buffer, tt.expectedBuffer) {
+            t.Errorf("test %v: buffer mismatch: expected %v, got %v", id, tt.expectedBuffer, writer.Buffer)
         }
 
         if writer.BitBuffer != tt.expectedBitBuf {
@@ -226,18 +248,16 @@ func TestAlignByte(t *testing.T) {
         {[]byte{0xAB}, 0b1010101010101010, 10, []byte{0xAB, 0xAA, 0xAA}, 0, 0}, // Align 10 bits
         {nil, 0, 0, nil, 0, 0},                                                 // Empty buffer
     } {
-        buffer := &bytes.Buffer{}
-        buffer.Write(tt.initialBuffer)
         writer := bitWriter{
-            Buffer:        buffer,
+            Buffer:        append([]byte(nil), tt.initialBuffer...),
             BitBuffer:     tt.initialBitBuf,
             BitBufferSize: tt.initialBufSize,
         }
 
         writer.alignByte()
 
-        if !bytes.Equal(writer.Buffer.Bytes(), tt.expectedBuffer) {
-            t.Errorf("test %v: buffer mismatch: expected %v, got %v", id, tt.expectedBuffer, writer.Buffer.Bytes())
+        if !bytes.Equal(writer.Buffer, tt.expectedBuffer) {
+            t.Errorf("test %v: buffer mismatch: expected %v, got %v", id, tt.expectedBuffer, writer.Buffer)
         }
 
         if writer.BitBuffer != tt.expectedBitBuf {
@@ -0,0 +1,155 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "io"
+    "fmt"
+    "bytes"
+    "encoding/binary"
+    //------------------------------
+    //errors
+    //------------------------------
+    "errors"
+)
+
+var (
+    // ErrInvalidRIFF is returned when the input does not start with a RIFF header of the WEBP form type.
+    ErrInvalidRIFF      = errors.New("invalid RIFF header")
+    // ErrTruncated is returned when the input ends before the size given in its RIFF header.
+    ErrTruncated        = errors.New("truncated data")
+    // ErrInvalidChunk is returned when a chunk header or payload does not fit in the data that contains it.
+    ErrInvalidChunk     = errors.New("invalid chunk size")
+)
+
+// Chunk describes a single RIFF chunk of a WebP file.
+//
+// Fields:
+//   - FourCC: The four character code identifying the chunk, such as "VP8X" or "ANMF".
+//   - Offset: Position of the chunk header in the file, in bytes.
+//   - Size: Size of the chunk payload in bytes, excluding the padding byte of odd sized chunks.
+type Chunk struct {
+    FourCC  string
+    Offset  int64
+    Size    uint32
+
+    data    []byte
+}
+
+// Payload returns the payload of the chunk, excluding the padding byte.
+// The returned slice shares memory with the parsed file and must not be modified.
+func (c Chunk) Payload() []byte {
+    return c.data
+}
+
+// ParseChunks reads a WebP file from the provided io.Reader and returns its top-level chunks.
+//
+// Only the RIFF container is parsed, chunk payloads are not interpreted. Use the Payload method
+// to access the data of a chunk, or ReadInfo for a structured description of the file.
+//
+// Parameters:
+//   r - The source io.Reader containing the WebP file.
+//
+// Returns:
+//   The chunks in file order or an error if the RIFF container is malformed.
+func ParseChunks(r io.Reader) ([]Chunk, error) {
+    data, err := readRIFF(r, 0)
+    if err != nil {
+        return nil, err
+    }
+
+    return parseRIFF(data)
+}
+
+// readRIFF reads a RIFF file from r, stopping at the end given by its RIFF header so that
+// trailing data is never read and the amount read is bounded by the header. If maxBytes is
+// positive, files larger than maxBytes are rejected before their payload is read.
+//
+// On error the bytes read so far are returned as well, so that a broken file can still be inspected.
+func readRIFF(r io.Reader, maxBytes int64) ([]byte, error) {
+    header := make([]byte, 12)
+    if n, err := io.ReadFull(r, header); err != nil {
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            return header[:n], ErrInvalidRIFF
+        }
+
+        return header[:n], err
+    }
+
+    if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WEBP" {
+        return header, ErrInvalidRIFF
+    }
+
+    size := int64(binary.LittleEndian.Uint32(header[4:8]))
+    if size < 4 {
+        return header, ErrInvalidRIFF
+    }
+
+    if maxBytes > 0 && size + 8 > maxBytes {
+        return header, fmt.Errorf("%w: file size of %v bytes exceeds MaxInputBytes of %v", ErrLimitExceeded, size + 8, maxBytes)
+    }
+
+    buf := bytes.NewBuffer(header)
+    n, err := buf.ReadFrom(io.LimitReader(r, size - 4))
+    if err != nil {
+        return buf.Bytes(), err
+    }
+
+    if n < size - 4 {
+        return buf.Bytes(), ErrTruncated
+    }
+
+    return buf.Bytes(), nil
+}
+
+// parseRIFF checks the RIFF header of a WebP file and returns the chunks it contains.
+func parseRIFF(data []byte) ([]Chunk, error) {
+    if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+        return nil, ErrInvalidRIFF
+    }
+
+    size := int64(binary.LittleEndian.Uint32(data[4:8]))
+    if size < 4 {
+        return nil, ErrInvalidRIFF
+    }
+
+    if size > int64(len(data) - 8) {
+        return nil, ErrTruncated
+    }
+
+    return parseChunks(data[12 : 8 + size], 12)
+}
+
+// parseChunks splits a list of RIFF chunks, offset is the position of the list in the file.
+func parseChunks(data []byte, offset int64) ([]Chunk, error) {
+    var chunks []Chunk
+
+    for i := 0; i < len(data); {
+        if len(data) - i < 8 {
+            return nil, ErrInvalidChunk
+        }
+
+        // sizes are compared as 64 bit integers so crafted sizes cannot overflow
+        size := int64(binary.LittleEndian.Uint32(data[i + 4 : i + 8]))
+        if size > int64(len(data) - i - 8) {
+            return nil, ErrInvalidChunk
+        }
+
+        chunks = append(chunks, Chunk{
+            FourCC: string(data[i : i + 4]),
+            Offset: offset + int64(i),
+            Size:   uint32(size),
+            data:   data[i + 8 : i + 8 + int(size)],
+        })
+
+        // chunks with an odd size are followed by a padding byte
+        i += 8 + int(size) + int(size & 1)
+    }
+
+    return chunks, nil
+}
+
+func read24(b []byte) uint32 {
+    return uint32(b[0]) | uint32(b[1]) << 8 | uint32(b[2]) << 16
+}
@@ -0,0 +1,179 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "bytes"
+    //------------------------------
+    //testing
+    //------------------------------
+    "testing"
+)
+
+func TestParseRIFF(t *testing.T) {
+    for id, tt := range []struct {
+        input           []byte
+        expectedFourCCs []string
+        expectedMsg     string
+    }{
+        {
+            []byte("RIFF\x16\x00\x00\x00WEBPVP8L\x01\x00\x00\x00\x2f\x00ABCD\x00\x00\x00\x00"),
+            []string{"VP8L", "ABCD"},
+            "",
+        },
+        {   // data after the RIFF size is ignored
+            []byte("RIFF\x0c\x00\x00\x00WEBPABCD\x00\x00\x00\x00trailing"),
+            []string{"ABCD"},
+            "",
+        },
+        {
+            []byte("RIFX\x04\x00\x00\x00WEBP"),
+            nil,
+            "invalid RIFF header",
+        },
+        {
+            []byte("RIFF\x04\x00\x00\x00WEBM"),
+            nil,
+            "invalid RIFF header",
+        },
+        {
+            []byte("RIFF\xff\xff\xff\xffWEBP"),
+            nil,
+            "truncated data",
+        },
+        {
+            []byte("RIFF\x08\x00\x00\x00WEBPABCD"),
+            nil,
+            "invalid chunk size",
+        },
+        {
+            []byte("RIFF\x0c\x00\x00\x00WEBPABCD\xff\xff\xff\xff"),
+            nil,
+            "invalid chunk size",
+        },
+    }{
+        chunks, err := parseRIFF(tt.input)
+        if tt.expectedMsg != "" {
+            if err == nil || err.Error() != tt.expectedMsg {
+                t.Errorf("test %v: expected error %v got %v", id, tt.expectedMsg, err)
+            }
+            continue
+        }
+
+        if err != nil {
+            t.Errorf("test %v: unexpected error %v", id, err)
+            continue
+        }
+
+        if len(chunks) != len(tt.expectedFourCCs) {
+            t.Errorf("test %v: expected %v chunks got %v", id, len(tt.expectedFourCCs), len(chunks))
+            continue
+        }
+
+        for i, c := range chunks {
+            if c.FourCC != tt.expectedFourCCs[i] {
+                t.Errorf("test %v: expected chunk %v got %v", id, tt.expectedFourCCs[i], c.FourCC)
+            }
+        }
+    }
+}
+
+func TestParseChunks(t *testing.T) {
+    data := []byte("ABCD\x03\x00\x00\x00xyz\x00EFGH\x02\x00\x00\x00uv")
+
+    chunks, err := parseChunks(data, 12)
+    if err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    if len(chunks) != 2 {
+        t.Fatalf("expected 2 chunks got %v", len(chunks))
+    }
+
+    // the padding byte after an odd sized chunk is skipped
+    if chunks[0].Offset != 12 || !bytes.Equal(chunks[0].Payload(), []byte("xyz")) {
+        t.Errorf("expected chunk at 12 with data xyz got %v with %q", chunks[0].Offset, chunks[0].Payload())
+    }
+
+    if chunks[1].Offset != 24 || !bytes.Equal(chunks[1].Payload(), []byte("uv")) {
+        t.Errorf("expected chunk at 24 with data uv got %v with %q", chunks[1].Offset, chunks[1].Payload())
+    }
+}
+
+func TestParseChunksFile(t *testing.T) {
+    buf := &bytes.Buffer{}
+    Encode(buf, generateTestImageNRGBA(8, 8, 64, true), &Options{UseExtendedFormat: true})
+
+    chunks, err := ParseChunks(bytes.NewReader(buf.Bytes()))
+    if err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    if len(chunks) != 2 || chunks[0].FourCC != "VP8X" || chunks[1].FourCC != "VP8L" {
+        t.Fatalf("expected chunks VP8X and VP8L got %v", chunks)
+    }
+
+    if chunks[0].Offset != 12 || chunks[0].Size != 10 || len(chunks[0].Payload()) != 10 {
+        t.Errorf("expected VP8X chunk at 12 with size 10 got %v with size %v", chunks[0].Offset, chunks[0].Size)
+    }
+
+    if chunks[1].Offset != 30 || int(chunks[1].Size) != buf.Len() - 38 {
+        t.Errorf("expected VP8L chunk at 30 with size %v got %v with size %v", buf.Len() - 38, chunks[1].Offset, chunks[1].Size)
+    }
+
+    if !bytes.Equal(chunks[1].Payload(), buf.Bytes()[38:]) {
+        t.Errorf("VP8L payload mismatch")
+    }
+}
+
+func TestReadRIFF(t *testing.T) {
+    for id, tt := range []struct {
+        input       []byte
+        expected    []byte
+        expectedMsg string
+    }{
+        {   // reading stops at the end given by the RIFF header
+            []byte("RIFF\x0c\x00\x00\x00WEBPABCD\x00\x00\x00\x00trailing"),
+            []byte("RIFF\x0c\x00\x00\x00WEBPABCD\x00\x00\x00\x00"),
+            "",
+        },
+        {   // the bytes read so far are returned with the error
+            []byte("RIFF\x0c\x00\x00"),
+            []byte("RIFF\x0c\x00\x00"),
+            "invalid RIFF header",
+        },
+        {
+            []byte("RIFF\x03\x00\x00\x00WEBP"),
+            []byte("RIFF\x03\x00\x00\x00WEBP"),
+            "invalid RIFF header",
+        },
+        {
+            []byte("RIFF\x0c\x00\x00\x00WEBPABCD"),
+            []byte("RIFF\x0c\x00\x00\x00WEBPABCD"),
+            "truncated data",
+        },
+    }{
+        r := bytes.NewReader(tt.input)
+        data, err := readRIFF(r, 0)
+        if tt.expectedMsg != "" {
+            if err == nil || err.Error() != tt.expectedMsg {
+                t.Errorf("test %v: expected error %v got %v", id, tt.expectedMsg, err)
+            }
+
+            if !bytes.Equal(data, tt.expected) {
+                t.Errorf("test %v: expected %q got %q", id, tt.expected, data)
+            }
+            continue
+        }
+
+        if err != nil {
+            t.Errorf("test %v: unexpected error %v", id, err)
+            continue
+        }
+
+        if !bytes.Equal(data, tt.expected) || r.Len() != len(tt.input) - len(tt.expected) {
+            t.Errorf("test %v: expected %q got %q", id, tt.expected, data)
+        }
+    }
+}
@@ -0,0 +1,351 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "io"
+    "encoding/binary"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    "image/color"
+    //------------------------------
+    //errors
+    //------------------------------
+    "errors"
+)
+
+// ConfigEx extends image.Config with the format, animation and metadata details of a WebP file.
+//
+// Fields:
+//   - Config: The color model and canvas size, as returned by DecodeConfig.
+//   - Lossless: True if every frame is encoded with VP8L.
+//   - Lossy: True if at least one frame is encoded with VP8.
+//   - Animated: True if the file is an animation.
+//   - HasAlpha: True if the VP8X alpha flag is set or a frame has an ALPH chunk or the VP8L alpha hint.
+//   - FrameCount: Number of frames, 1 for a still image.
+//   - LoopCount: Number of times an animation repeats; 0 means infinite looping.
+//   - BackgroundColor: Canvas background color of an animation in BGRA order.
+//   - HasICC, HasEXIF, HasXMP: True if the file contains an ICCP, EXIF or XMP chunk.
+type ConfigEx struct {
+    image.Config
+    Lossless            bool
+    Lossy               bool
+    Animated            bool
+    HasAlpha            bool
+    FrameCount          int
+    LoopCount           uint16
+    BackgroundColor     uint32
+    HasICC              bool
+    HasEXIF             bool
+    HasXMP              bool
+}
+
+// DecodeConfigExtended reads the configuration of a WebP file from the provided io.Reader without decoding it.
+//
+// Only chunk headers, the VP8X, ANIM and ANMF headers and the first bytes of each bitstream are read,
+// all other payloads are skipped. If r implements io.Seeker payloads are skipped by seeking,
+// otherwise they are read and discarded.
+//
+// Parameters:
+//   r - The source io.Reader containing the WebP file.
+//
+// Returns:
+//   A ConfigEx describing the file or an error if the file is malformed.
+func DecodeConfigExtended(r io.Reader) (ConfigEx, error) {
+    h := &headerReader{r: r}
+    return h.config()
+}
+
+// config reads the configuration of a WebP file, checking each header against the limits of h
+// before the payload that follows it is read.
+func (h *headerReader) config() (ConfigEx, error) {
+    var cfg ConfigEx
+
+    header, err := h.read(12)
+    if err != nil {
+        if err == ErrTruncated {
+            err = ErrInvalidRIFF
+        }
+        return cfg, err
+    }
+
+    if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WEBP" {
+        return cfg, ErrInvalidRIFF
+    }
+
+    size := int64(binary.LittleEndian.Uint32(header[4:8]))
+    if size < 4 {
+        return cfg, ErrInvalidRIFF
+    }
+
+    if err := h.limits.checkInput(size + 8); err != nil {
+        return cfg, err
+    }
+
+    var flags byte
+    var extended bool
+    err = h.walk(size - 4, func(fourCC string, size int64) (int64, error) {
+        switch fourCC {
+        case "VP8X":
+            if size < 10 {
+                return 0, errors.New("invalid VP8X chunk")
+            }
+
+            d, err := h.read(10)
+            if err != nil {
+                return 0, err
+            }
+
+            extended = true
+            flags = d[0]
+            cfg.Animated = flags & vp8xAnimation != 0
+            cfg.Width = int(read24(d[4:7])) + 1
+            cfg.Height = int(read24(d[7:10])) + 1
+            return 10, h.limits.checkCanvas(cfg.Width, cfg.Height)
+        case "ICCP":
+            cfg.HasICC = true
+        case "EXIF":
+            cfg.HasEXIF = true
+        case "XMP ":
+            cfg.HasXMP = true
+        case "ANIM":
+            if size < 6 {
+                return 0, errors.New("invalid ANIM chunk")
+            }
+
+            d, err := h.read(6)
+            if err != nil {
+                return 0, err
+            }
+
+            cfg.BackgroundColor = binary.LittleEndian.Uint32(d[0:4])
+            cfg.LoopCount = binary.LittleEndian.Uint16(d[4:6])
+            return 6, nil
+        case "ANMF":
+            if !cfg.Animated {
+                break
+            }
+
+            if size < 16 {
+                return 0, errors.New("invalid ANMF chunk")
+            }
+
+            if err := h.limits.checkFrames(cfg.FrameCount + 1); err != nil {
+                return 0, err
+            }
+
+            if _, err := h.read(16); err != nil {
+                return 0, err
+            }
+
+            frame := &ConfigEx{}
+            if err := h.walk(size - 16, frame.readImage(h)); err != nil {
+                return 0, err
+            }
+
+            if frame.FrameCount == 0 {
+                return 0, errors.New("missing image data")
+            }
+
+            cfg.addFrame(frame)
+            return size, nil
+        case "ALPH", "VP8 ", "VP8L":
+            if !cfg.Animated {
+                n, err := cfg.readImage(h)(fourCC, size)
+                if err == nil && !extended {
+                    // without a VP8X chunk the canvas is the size of the image
+                    err = h.limits.checkCanvas(cfg.Width, cfg.Height)
+                }
+
+                return n, err
+            }
+        }
+
+        return 0, nil
+    })
+
+    if err != nil {
+        return ConfigEx{}, err
+    }
+
+    if cfg.FrameCount == 0 {
+        return ConfigEx{}, errors.New("missing image data")
+    }
+
+    if !cfg.Animated {
+        cfg.Lossy = !cfg.Lossless
+    }
+
+    if extended && flags & vp8xAlpha != 0 {
+        cfg.HasAlpha = true
+    }
+
+    switch {
+    case cfg.Animated || cfg.Lossless:
+        cfg.ColorModel = color.NRGBAModel
+    case cfg.HasAlpha:
+        cfg.ColorModel = color.NYCbCrAModel
+    default:
+        cfg.ColorModel = color.YCbCrModel
+    }
+
+    return cfg, nil
+}
+
+// readImage returns a chunk callback that describes the ALPH, VP8 and VP8L chunks of a single image.
+// The size of the image is stored in cfg unless it already holds a VP8X canvas size.
+func (cfg *ConfigEx) readImage(h *headerReader) func(fourCC string, size int64) (int64, error) {
+    return func(fourCC string, size int64) (int64, error) {
+        if cfg.FrameCount > 0 {
+            return 0, nil
+        }
+
+        switch fourCC {
+        case "ALPH":
+            cfg.HasAlpha = true
+        case "VP8 ":
+            d, err := h.read(int(min(size, 10)))
+            if err != nil {
+                return 0, err
+            }
+
+            w, height, err := parseVP8Header(d)
+            if err != nil {
+                return 0, err
+            }
+
+            if err := h.limits.checkPixels(w, height); err != nil {
+                return 0, err
+            }
+
+            if cfg.Width == 0 {
+                cfg.Width, cfg.Height = w, height
+            }
+
+            cfg.FrameCount = 1
+            return int64(len(d)), nil
+        case "VP8L":
+            d, err := h.read(int(min(size, 5)))
+            if err != nil {
+                return 0, err
+            }
+
+            header, err := parseVP8LHeader(d)
+            if err != nil {
+                return 0, err
+            }
+
+            if err := h.limits.checkPixels(header.Width, header.Height); err != nil {
+                return 0, err
+            }
+
+            if cfg.Width == 0 {
+                cfg.Width, cfg.Height = header.Width, header.Height
+            }
+
+            cfg.Lossless = true
+            cfg.HasAlpha = cfg.HasAlpha || header.AlphaHint
+            cfg.FrameCount = 1
+            return int64(len(d)), nil
+        }
+
+        return 0, nil
+    }
+}
+
+// addFrame merges the description of a single frame into cfg.
+func (cfg *ConfigEx) addFrame(frame *ConfigEx) {
+    if cfg.FrameCount == 0 {
+        cfg.Lossless = true
+    }
+
+    cfg.FrameCount++
+    cfg.Lossless = cfg.Lossless && frame.Lossless
+    cfg.Lossy = cfg.Lossy || !frame.Lossless
+    cfg.HasAlpha = cfg.HasAlpha || frame.HasAlpha
+}
+
+// headerReader reads chunk headers from a stream and skips the payloads that are not needed.
+// If limits is not nil the headers are checked against it as they are read.
+type headerReader struct {
+    r       io.Reader
+    limits  *DecodeOptions
+}
+
+// read reads exactly n bytes, an early end of the stream is reported as ErrTruncated.
+func (h *headerReader) read(n int) ([]byte, error) {
+    buf := make([]byte, n)
+    if _, err := io.ReadFull(h.r, buf); err != nil {
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            return nil, ErrTruncated
+        }
+
+        return nil, err
+    }
+
+    return buf, nil
+}
+
+// skip discards the next n bytes, an early end of the stream is reported as ErrTruncated.
+func (h *headerReader) skip(n int64) error {
+    if n <= 0 {
+        return nil
+    }
+
+    // seeking past the end of the stream succeeds, so the last byte of the
+    // range is read to detect a truncated stream
+    if s, ok := h.r.(io.Seeker); ok {
+        if _, err := s.Seek(n - 1, io.SeekCurrent); err != nil {
+            return err
+        }
+
+        _, err := h.read(1)
+        return err
+    }
+
+    copied, err := io.CopyN(io.Discard, h.r, n)
+    if copied < n {
+        return ErrTruncated
+    }
+
+    return err
+}
+
+// walk reads a list of chunks of the given size and calls fn for each chunk. fn may read from
+// the start of the payload and returns the number of bytes it read, the rest is skipped.
+// Sizes are compared as 64 bit integers so crafted sizes cannot overflow.
+func (h *headerReader) walk(size int64, fn func(fourCC string, size int64) (int64, error)) error {
+    for size > 0 {
+        if size < 8 {
+            return ErrInvalidChunk
+        }
+
+        d, err := h.read(8)
+        if err != nil {
+            return err
+        }
+
+        chunkSize := int64(binary.LittleEndian.Uint32(d[4:8]))
+        if chunkSize > size - 8 {
+            return ErrInvalidChunk
+        }
+
+        n, err := fn(string(d[0:4]), chunkSize)
+        if err != nil {
+            return err
+        }
+
+        // chunks with an odd size are followed by a padding byte, unless the list ends
+        padded := min(chunkSize + chunkSize & 1, size - 8)
+        if err := h.skip(padded - n); err != nil {
+            return err
+        }
+
+        size -= 8 + padded
+    }
+
+    return nil
+}
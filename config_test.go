@@ -0,0 +1,156 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "io"
+    "bytes"
+    "encoding/binary"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    "image/color"
+    //------------------------------
+    //testing
+    //------------------------------
+    "testing"
+)
+
+func TestDecodeConfigExtended(t *testing.T) {
+    still := &bytes.Buffer{}
+    Encode(still, generateTestImageNRGBA(8, 16, 64, false), nil)
+
+    extended := &bytes.Buffer{}
+    Encode(extended, generateTestImageNRGBA(8, 16, 64, true), &Options{UseExtendedFormat: true})
+
+    animated := &bytes.Buffer{}
+    EncodeAll(animated, &Animation{
+        Images:             []image.Image{
+            generateTestImageNRGBA(8, 8, 64, false),
+            generateTestImageNRGBA(4, 4, 64, false),
+            generateTestImageNRGBA(4, 4, 64, false),
+        },
+        Durations:          []uint{100, 100, 100},
+        Disposals:          []uint{0, 0, 0},
+        LoopCount:          4,
+        BackgroundColor:    0xff102030,
+    }, nil)
+
+    // a lossy image with an ALPH chunk and metadata, only the VP8 frame header is needed
+    buf := &bytes.Buffer{}
+    writeChunkVP8XFlags(buf, image.Rect(0, 0, 20, 10), vp8xAlpha | vp8xICC | vp8xEXIF | vp8xXMP)
+    writeChunk(buf, "ICCP", []byte("icc"))
+    writeChunk(buf, "ALPH", []byte{0x00})
+    writeChunk(buf, "VP8 ", []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a, 20, 0x00, 10, 0x00, 0x00})
+    writeChunk(buf, "EXIF", []byte("exif"))
+    writeChunk(buf, "XMP ", []byte("xmp"))
+    lossy := &bytes.Buffer{}
+    writeRIFF(lossy, buf)
+
+    for id, tt := range []struct {
+        input       []byte
+        expected    ConfigEx
+    }{
+        {
+            still.Bytes(),
+            ConfigEx{
+                Config:     image.Config{ColorModel: color.NRGBAModel, Width: 8, Height: 16},
+                Lossless:   true,
+                FrameCount: 1,
+            },
+        },
+        {
+            extended.Bytes(),
+            ConfigEx{
+                Config:     image.Config{ColorModel: color.NRGBAModel, Width: 8, Height: 16},
+                Lossless:   true,
+                HasAlpha:   true,
+                FrameCount: 1,
+            },
+        },
+        {
+            animated.Bytes(),
+            ConfigEx{
+                Config:             image.Config{ColorModel: color.NRGBAModel, Width: 8, Height: 8},
+                Lossless:           true,
+                Animated:           true,
+                FrameCount:         3,
+                LoopCount:          4,
+                BackgroundColor:    0xff102030,
+            },
+        },
+        {
+            lossy.Bytes(),
+            ConfigEx{
+                Config:     image.Config{ColorModel: color.NYCbCrAModel, Width: 20, Height: 10},
+                Lossy:      true,
+                HasAlpha:   true,
+                FrameCount: 1,
+                HasICC:     true,
+                HasEXIF:    true,
+                HasXMP:     true,
+            },
+        },
+    }{
+        // payloads are skipped by seeking or by reading and discarding them
+        for _, r := range []io.Reader{bytes.NewReader(tt.input), struct{ io.Reader }{bytes.NewReader(tt.input)}} {
+            cfg, err := DecodeConfigExtended(r)
+            if err != nil {
+                t.Errorf("test %v: unexpected error %v", id, err)
+                continue
+            }
+
+            if cfg != tt.expected {
+                t.Errorf("test %v: expected config as %+v got %+v", id, tt.expected, cfg)
+            }
+        }
+    }
+}
+
+func TestDecodeConfigExtendedErrors(t *testing.T) {
+    still := &bytes.Buffer{}
+    Encode(still, generateTestImageNRGBA(8, 16, 64, false), nil)
+
+    // the file ends inside a trailing chunk that is skipped
+    cut := &bytes.Buffer{}
+    writeChunk(cut, "EXIF", make([]byte, 100))
+    cutInput := append(bytes.Clone(still.Bytes()), cut.Bytes()[:10]...)
+    binary.LittleEndian.PutUint32(cutInput[4:8], uint32(len(still.Bytes()) - 8 + cut.Len()))
+
+    for id, tt := range []struct {
+        input       []byte
+        expectedMsg string
+    }{
+        {[]byte("RIFF"), "invalid RIFF header"},
+        {[]byte("RIFX\x04\x00\x00\x00WEBP"), "invalid RIFF header"},
+        {still.Bytes()[:16], "truncated data"},
+        {cutInput, "truncated data"},
+        {[]byte("RIFF\x0c\x00\x00\x00WEBPVP8L\xff\xff\xff\xff"), "invalid chunk size"},
+        {[]byte("RIFF\x0a\x00\x00\x00WEBPVP8L\x00\x00"), "invalid chunk size"},
+        {[]byte("RIFF\x0c\x00\x00\x00WEBPEXIF\x00\x00\x00\x00"), "missing image data"},
+        {[]byte("RIFF\x0d\x00\x00\x00WEBPVP8L\x01\x00\x00\x00\x2e"), "invalid VP8L header"},
+        {[]byte("RIFF\x0e\x00\x00\x00WEBPVP8X\x02\x00\x00\x00\x00\x00"), "invalid VP8X chunk"},
+        {[]byte("RIFF\x26\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00ANMF\x08\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), "invalid ANMF chunk"},
+        {[]byte("RIFF\x18\x00\x00\x00WEBPVP8 \x0a\x00\x00\x00\x10\x02\x00\x9d\x01\x2a\x00\x00\x01\x00"), "invalid VP8 header"},
+    }{
+        // seekable and plain readers must report the same error
+        for _, r := range []io.Reader{bytes.NewReader(tt.input), struct{ io.Reader }{bytes.NewReader(tt.input)}} {
+            _, err := DecodeConfigExtended(r)
+            if err == nil || err.Error() != tt.expectedMsg {
+                t.Errorf("test %v: expected error %v got %v", id, tt.expectedMsg, err)
+            }
+        }
+    }
+}
+
+func FuzzDecodeConfigExtended(f *testing.F) {
+    fuzzSeeds(f)
+    f.Fuzz(func(t *testing.T, data []byte) {
+        cfg, err := DecodeConfigExtended(bytes.NewReader(data))
+        if err == nil && (cfg.FrameCount < 1 || cfg.Width < 1 || cfg.Height < 1) {
+            t.Errorf("expected a valid config or an error got %+v", cfg)
+        }
+    })
+}
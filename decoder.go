@@ -0,0 +1,949 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "sync"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    "image/color"
+    "image/draw"
+    //------------------------------
+    //errors
+    //------------------------------
+    "errors"
+)
+
+// huffmanRootBits is the number of bits resolved by a single lookup in a huffmanDecoder,
+// longer codes are decoded one bit at a time.
+const huffmanRootBits = 8
+
+// huffmanDecoder decodes the symbols of a canonical Huffman code.
+type huffmanDecoder struct {
+    table       []uint32    // symbol << 16 | length for every code of at most huffmanRootBits bits
+    counts      [16]int
+    symbols     []uint16    // symbols sorted by code
+    single      bool        // true if the code has a single symbol, which is coded with 0 bits
+}
+
+// build sets up the decoder from the code length of every symbol of the alphabet.
+func (h *huffmanDecoder) build(lengths []uint8) error {
+    h.counts = [16]int{}
+    for _, l := range lengths {
+        h.counts[l]++
+    }
+
+    n := len(lengths) - h.counts[0]
+    if n == 0 {
+        return errors.New("invalid huffman code")
+    }
+
+    h.symbols = h.symbols[:0]
+    h.single = n == 1
+    if h.single {
+        for s, l := range lengths {
+            if l != 0 {
+                h.symbols = append(h.symbols, uint16(s))
+            }
+        }
+
+        return nil
+    }
+
+    // a canonical code must be complete; neither over-subscribed nor leaving codes unused
+    left := 1
+    for l := 1; l < 16; l++ {
+        left = left << 1 - h.counts[l]
+        if left < 0 {
+            return errors.New("invalid huffman code")
+        }
+    }
+
+    if left != 0 {
+        return errors.New("invalid huffman code")
+    }
+
+    var offsets [16]int
+    for l := 1; l < 15; l++ {
+        offsets[l + 1] = offsets[l] + h.counts[l]
+    }
+
+    h.symbols = append(h.symbols, make([]uint16, n)...)
+    for s, l := range lengths {
+        if l != 0 {
+            h.symbols[offsets[l]] = uint16(s)
+            offsets[l]++
+        }
+    }
+
+    if cap(h.table) < 1 << huffmanRootBits {
+        h.table = make([]uint32, 1 << huffmanRootBits)
+    }
+
+    h.table = h.table[:1 << huffmanRootBits]
+    clear(h.table)
+
+    code := 0
+    k := 0
+    for l := 1; l <= huffmanRootBits; l++ {
+        for i := 0; i < h.counts[l]; i++ {
+            // codes are stored most significant bit first, the reader returns them reversed
+            reversed := 0
+            for b := 0; b < l; b++ {
+                reversed |= (code >> b & 1) << (l - 1 - b)
+            }
+
+            for j := reversed; j < len(h.table); j += 1 << l {
+                h.table[j] = uint32(h.symbols[k]) << 16 | uint32(l)
+            }
+
+            code++
+            k++
+        }
+
+        code <<= 1
+    }
+
+    return nil
+}
+
+func (h *huffmanDecoder) decode(br *bitReader) uint32 {
+    if h.single {
+        return uint32(h.symbols[0])
+    }
+
+    e := h.table[br.peekBits(huffmanRootBits)]
+    if e & 0xffff != 0 {
+        br.skipBits(uint(e & 0xffff))
+        return e >> 16
+    }
+
+    // codes longer than the root table are resolved bit by bit
+    code, first, index := 0, 0, 0
+    for l := 1; l < 16; l++ {
+        code |= int(br.readBits(1))
+        if code - first < h.counts[l] {
+            return uint32(h.symbols[index + code - first])
+        }
+
+        index += h.counts[l]
+        first = (first + h.counts[l]) << 1
+        code <<= 1
+    }
+
+    return 0
+}
+
+// huffmanGroup holds the five codes used for green plus length prefixes plus cache indices,
+// red, blue, alpha and distance prefixes.
+type huffmanGroup [5]huffmanDecoder
+
+// codeLengthOrder is the order in which the code lengths of the code length code are stored.
+var codeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// distanceMap holds the (x, y) offsets of the 120 short distance codes, nearest pixels first.
+var distanceMap = [120][2]int8{
+    {0, 1},  {1, 0},  {1, 1},  {-1, 1}, {0, 2},  {2, 0},  {1, 2},  {-1, 2},
+    {2, 1},  {-2, 1}, {2, 2},  {-2, 2}, {0, 3},  {3, 0},  {1, 3},  {-1, 3},
+    {3, 1},  {-3, 1}, {2, 3},  {-2, 3}, {3, 2},  {-3, 2}, {0, 4},  {4, 0},
+    {1, 4},  {-1, 4}, {4, 1},  {-4, 1}, {3, 3},  {-3, 3}, {2, 4},  {-2, 4},
+    {4, 2},  {-4, 2}, {0, 5},  {3, 4},  {-3, 4}, {4, 3},  {-4, 3}, {5, 0},
+    {1, 5},  {-1, 5}, {5, 1},  {-5, 1}, {2, 5},  {-2, 5}, {5, 2},  {-5, 2},
+    {4, 4},  {-4, 4}, {3, 5},  {-3, 5}, {5, 3},  {-5, 3}, {0, 6},  {6, 0},
+    {1, 6},  {-1, 6}, {6, 1},  {-6, 1}, {2, 6},  {-2, 6}, {6, 2},  {-6, 2},
+    {4, 5},  {-4, 5}, {5, 4},  {-5, 4}, {3, 6},  {-3, 6}, {6, 3},  {-6, 3},
+    {0, 7},  {7, 0},  {1, 7},  {-1, 7}, {5, 5},  {-5, 5}, {7, 1},  {-7, 1},
+    {4, 6},  {-4, 6}, {6, 4},  {-6, 4}, {2, 7},  {-2, 7}, {7, 2},  {-7, 2},
+    {3, 7},  {-3, 7}, {7, 3},  {-7, 3}, {5, 6},  {-5, 6}, {6, 5},  {-6, 5},
+    {8, 0},  {4, 7},  {-4, 7}, {7, 4},  {-7, 4}, {8, 1},  {8, 2},  {6, 6},
+    {-6, 6}, {8, 3},  {5, 7},  {-5, 7}, {7, 5},  {-7, 5}, {8, 4},  {6, 7},
+    {-6, 7}, {7, 6},  {-7, 6}, {8, 5},  {7, 7},  {-7, 7}, {8, 6},  {8, 7},
+}
+
+// writeARGB copies decoded ARGB pixels into dst with their top left corner at the given point,
+// clipped to the bounds of dst.
+func writeARGB(dst draw.Image, at image.Point, pixels []uint32, width, height int) {
+    r := image.Rect(0, 0, width, height).Add(at).Intersect(dst.Bounds())
+
+    for y := r.Min.Y; y < r.Max.Y; y++ {
+        src := pixels[(y - at.Y) * width + r.Min.X - at.X:][:r.Dx()]
+
+        switch dst := dst.(type) {
+        case *image.NRGBA:
+            row := dst.Pix[dst.PixOffset(r.Min.X, y):][:4 * r.Dx()]
+            for i, p := range src {
+                row[4 * i + 0] = uint8(p >> 16)
+                row[4 * i + 1] = uint8(p >> 8)
+                row[4 * i + 2] = uint8(p)
+                row[4 * i + 3] = uint8(p >> 24)
+            }
+        case *image.RGBA:
+            // premultiplied the same way as color.NRGBA.RGBA, so the result matches draw.Draw
+            row := dst.Pix[dst.PixOffset(r.Min.X, y):][:4 * r.Dx()]
+            for i, p := range src {
+                a := p >> 24
+                a |= a << 8
+                for c, shift := range [3]int{16, 8, 0} {
+                    v := p >> shift & 0xff
+                    v |= v << 8
+                    row[4 * i + c] = uint8(v * a / 0xffff >> 8)
+                }
+                row[4 * i + 3] = uint8(p >> 24)
+            }
+        default:
+            for i, p := range src {
+                dst.Set(r.Min.X + i, y, color.NRGBA{uint8(p >> 16), uint8(p >> 8), uint8(p), uint8(p >> 24)})
+            }
+        }
+    }
+}
+
+// vp8lTransform is a transform read from a VP8L bitstream, applied in reverse order after decoding.
+type vp8lTransform struct {
+    kind        transform
+    bits        int
+    width       int         // width of the image the transform was applied to
+    data        []uint32    // the transform image, or the palette of a color indexing transform
+    colors      int         // number of palette entries of a color indexing transform
+}
+
+// vp8lDecoder decodes VP8L bitstreams into ARGB pixels.
+//
+// Decoders are reused through vp8lDecoderPool, so the pixel buffer, Huffman tables and
+// code length scratch space are only allocated when an image needs more than a previous one.
+type vp8lDecoder struct {
+    br          bitReader
+    width       int
+    height      int
+    hasAlpha    bool
+
+    pixels      []uint32
+    decoded     int         // number of pixels of the main image decoded so far
+    rows        int         // number of complete rows returned by decodeImage
+    main        mainStream
+    above       []uint32    // the last row of transformRows after the predictor transform
+    rowBuffer   []uint32
+
+    keepIndices bool        // set by the caller to keep the palette indices of the image
+    indices     []uint8     // palette indices of every pixel, valid if palette is not nil
+    palette     []uint32    // palette of the image if it is fully described by a color indexing transform
+    groups      []huffmanGroup
+    lengths     []uint8
+    cache       []uint32
+    transforms  []vp8lTransform
+}
+
+// mainStream holds the state of the entropy coded main image of a VP8L bitstream, so that an
+// image cut off by the end of the data can be continued by resume once more data has arrived.
+//
+// Fields:
+//   - started: Set once the prefix codes of the main image have been read.
+//   - width: Width of the entropy coded image, which is narrower than the image if a color
+//     indexing transform bundles several pixels.
+//   - groups, entropy, prefixBits, cacheBits: The prefix codes and the color cache of the image.
+//   - bit: Number of bits consumed before the first pixel that was not decoded.
+type mainStream struct {
+    started     bool
+    width       int
+    groups      []huffmanGroup
+    entropy     []uint32
+    prefixBits  int
+    cacheBits   int
+    bit         int
+}
+
+var vp8lDecoderPool = sync.Pool{
+    New: func() any {
+        return &vp8lDecoder{}
+    },
+}
+
+// decodeHeader reads the VP8L header and prepares the decoder for decodeImage.
+func (d *vp8lDecoder) decodeHeader(data []byte) error {
+    header, err := parseVP8LHeader(data)
+    if err != nil {
+        return err
+    }
+
+    if header.Version != 0 {
+        return errors.New("invalid VP8L version")
+    }
+
+    // skip the signature and the header fields parsed above
+    d.br = bitReader{data: data}
+    d.br.readBits(8)
+    d.br.readBits(14 + 14 + 1 + 3)
+
+    d.width = header.Width
+    d.height = header.Height
+    d.hasAlpha = header.AlphaHint
+    d.transforms = d.transforms[:0]
+    d.palette = nil
+    d.decoded = 0
+    d.rows = 0
+    d.main = mainStream{}
+
+    return nil
+}
+
+// decodeImage decodes the image after decodeHeader and returns its pixels in ARGB order.
+// The returned slice is owned by the decoder and valid until it is used again.
+//
+// If the data ends within the pixels of the main image the rows decoded so far are returned
+// together with ErrTruncated, the number of complete rows is stored in d.rows.
+func (d *vp8lDecoder) decodeImage() ([]uint32, error) {
+    err := d.decodeStreams()
+    if err != nil && (err != ErrTruncated || !d.main.started) {
+        return nil, err
+    }
+
+    // pixels are decoded in scanline order and every inverse transform only depends on the rows
+    // above, so the complete rows of a truncated stream are transformed and the rest is cleared
+    width := d.main.width
+    d.rows = d.height
+    if err == ErrTruncated {
+        d.rows = d.decoded / width
+    }
+
+    pixels := d.pixels[:d.width * d.height]
+    clear(pixels[d.rows * width:])
+    d.inverseTransforms(pixels, 0, d.rows)
+
+    return pixels, err
+}
+
+// decodeStreams reads the transforms and decodes the entropy coded main image into d.pixels.
+func (d *vp8lDecoder) decodeStreams() error {
+    width := d.width
+
+    // transforms are read before the image data, each at most once
+    var seen [4]bool
+    for d.br.readBits(1) == 1 {
+        t := transform(d.br.readBits(2))
+        if seen[t] {
+            return d.truncated(errors.New("invalid transform"))
+        }
+        seen[t] = true
+
+        tr := vp8lTransform{kind: t, width: width}
+        switch t {
+        case transformPredict, transformColor:
+            tr.bits = int(d.br.readBits(3)) + 2
+            data, err := d.decodeImageStream(subSampleSize(width, tr.bits), subSampleSize(d.height, tr.bits), false, nil)
+            if err != nil {
+                return d.truncated(err)
+            }
+
+            tr.data = data
+        case transformColorIndexing:
+            size := int(d.br.readBits(8)) + 1
+            pal, err := d.decodeImageStream(size, 1, false, nil)
+            if err != nil {
+                return d.truncated(err)
+            }
+
+            // palette entries are stored as differences to the previous entry, indices
+            // beyond the palette read as transparent black
+            tr.data = make([]uint32, 256)
+            tr.colors = size
+            tr.data[0] = pal[0]
+            for i := 1; i < size; i++ {
+                tr.data[i] = addPixels(pal[i], tr.data[i - 1])
+            }
+
+            switch {
+            case size <= 2:
+                tr.bits = 3
+            case size <= 4:
+                tr.bits = 2
+            case size <= 16:
+                tr.bits = 1
+            }
+
+            width = subSampleSize(width, tr.bits)
+        }
+
+        d.transforms = append(d.transforms, tr)
+    }
+
+    if d.br.eos {
+        return ErrTruncated
+    }
+
+    // transforms that widen the image work in place, so the buffer holds the full image
+    if cap(d.pixels) < d.width * d.height {
+        d.pixels = make([]uint32, d.width * d.height)
+    }
+
+    d.pixels = d.pixels[:d.width * d.height]
+
+    _, err := d.decodeImageStream(width, d.height, true, d.pixels)
+    return d.truncated(err)
+}
+
+// resume continues the main image after decodeStreams or an earlier resume returned ErrTruncated,
+// data must hold the data passed to decodeHeader followed by the data that has arrived since.
+func (d *vp8lDecoder) resume(data []byte) error {
+    d.br.seek(data, d.main.bit)
+
+    m := &d.main
+    pixels := d.pixels[:m.width * d.height]
+    return d.truncated(d.decodePixels(pixels, m.width, m.groups, m.entropy, m.prefixBits, m.cacheBits, d.decoded))
+}
+
+// inverseTransforms reverses the transforms of the rows [y0, y1) of the main image in place,
+// in the reverse order they were read. pixels holds the rows at the width of the entropy coded
+// image and has room for them at the full width. If y0 > 0 pixels starts with an extra row for
+// the row above y0, which the predictor transform takes from d.above. The last row left by the
+// predictor transform is stored in d.above for the next rows.
+func (d *vp8lDecoder) inverseTransforms(pixels []uint32, y0, y1 int) {
+    first := max(y0 - 1, 0)
+    rows := y1 - first
+
+    for i := len(d.transforms) - 1; i >= 0; i-- {
+        tr := d.transforms[i]
+        switch tr.kind {
+        case transformPredict:
+            // the transforms applied before may have widened the rows, so the row above is
+            // only put in place now
+            if y0 > 0 {
+                copy(pixels, d.above)
+            }
+
+            inversePredict(pixels, tr.width, y0, y1, tr.bits, tr.data)
+            if rows > 0 {
+                d.above = append(d.above[:0], pixels[(rows - 1) * tr.width : rows * tr.width]...)
+            }
+        case transformColor:
+            inverseColorTransform(pixels, tr.width, first, y1, tr.bits, tr.data)
+        case transformSubGreen:
+            inverseSubtractGreen(pixels[:tr.width * rows])
+        case transformColorIndexing:
+            // the indices only describe the final image if no other transform is applied after this one
+            if i == 0 && d.keepIndices {
+                d.indices = unpackIndices(d.indices, pixels, tr.width, rows, tr.bits)
+                d.palette = tr.data[:tr.colors]
+            }
+
+            inverseColorIndexing(pixels, tr.width, rows, tr.bits, tr.data)
+        }
+    }
+}
+
+// transformRows reverses the transforms of the decoded rows [y0, y1) of the main image without
+// changing d.pixels, so that decoding can be resumed, and returns them at the full width. The
+// rows must follow the rows of the previous call, the result is valid until the next call.
+func (d *vp8lDecoder) transformRows(y0, y1 int) []uint32 {
+    width := d.main.width
+    first := max(y0 - 1, 0)
+
+    d.rowBuffer = resizeBuffer(d.rowBuffer, (y1 - first) * d.width)
+    buf := d.rowBuffer
+
+    copy(buf[(y0 - first) * width:], d.pixels[y0 * width : y1 * width])
+    d.inverseTransforms(buf, y0, y1)
+
+    return buf[(y0 - first) * d.width : (y1 - first) * d.width]
+}
+
+// truncated replaces an error by ErrTruncated if the data ended before it was detected, as
+// the zero bits read past the end can look like an invalid code or transform.
+func (d *vp8lDecoder) truncated(err error) error {
+    if err != nil && d.br.eos {
+        return ErrTruncated
+    }
+
+    return err
+}
+
+// decodeImageStream decodes the entropy coded image of a VP8L bitstream. The main image may use
+// meta prefix codes, sub images holding transform data or palettes never do. If dst is nil a
+// new slice is allocated, otherwise dst must hold at least width * height pixels.
+func (d *vp8lDecoder) decodeImageStream(width, height int, isMain bool, dst []uint32) ([]uint32, error) {
+    var cacheBits int
+    if d.br.readBits(1) == 1 {
+        cacheBits = int(d.br.readBits(4))
+        if cacheBits < 1 || cacheBits > 11 {
+            return nil, errors.New("invalid color cache size")
+        }
+    }
+
+    var prefixBits int
+    var entropy []uint32
+    numGroups := 1
+    if isMain && d.br.readBits(1) == 1 {
+        prefixBits = int(d.br.readBits(3)) + 2
+
+        var err error
+        entropy, err = d.decodeImageStream(subSampleSize(width, prefixBits), subSampleSize(height, prefixBits), false, nil)
+        if err != nil {
+            return nil, err
+        }
+
+        for _, e := range entropy {
+            numGroups = max(numGroups, int(e >> 8 & 0xffff) + 1)
+        }
+    }
+
+    // The group indices are 16 bits, so a small entropy image can name up to 65536 groups. Groups
+    // that no tile uses must still be read, but only into a scratch group, and the used ones are
+    // renumbered so that the memory kept for groups is bounded by the number of tiles.
+    var used map[int]int
+    kept := numGroups
+    if numGroups > len(entropy) && entropy != nil {
+        used = make(map[int]int, len(entropy))
+        for i, e := range entropy {
+            g := int(e >> 8 & 0xffff)
+            k, ok := used[g]
+            if !ok {
+                k = len(used)
+                used[g] = k
+            }
+
+            entropy[i] = uint32(k) << 8
+        }
+
+        kept = len(used)
+    }
+
+    if cap(d.groups) < kept {
+        d.groups = append(d.groups[:cap(d.groups)], make([]huffmanGroup, kept - cap(d.groups))...)
+    }
+
+    groups := d.groups[:kept]
+    var unused huffmanGroup
+    for i := 0; i < numGroups; i++ {
+        g := &unused
+        if used == nil {
+            g = &groups[i]
+        } else if k, ok := used[i]; ok {
+            g = &groups[k]
+        }
+
+        for j := range g {
+            alphabet := 256
+            switch j {
+            case 0:
+                alphabet = 256 + 24
+                if cacheBits > 0 {
+                    alphabet += 1 << cacheBits
+                }
+            case 4:
+                alphabet = 40
+            }
+
+            if err := d.readHuffmanCode(&g[j], alphabet); err != nil {
+                return nil, err
+            }
+        }
+    }
+
+    if dst == nil {
+        dst = make([]uint32, width * height)
+    }
+
+    if isMain {
+        d.main = mainStream{true, width, groups, entropy, prefixBits, cacheBits, 0}
+    }
+
+    pixels := dst[:width * height]
+    if err := d.decodePixels(pixels, width, groups, entropy, prefixBits, cacheBits, 0); err != nil {
+        return nil, err
+    }
+
+    return pixels, nil
+}
+
+func (d *vp8lDecoder) readHuffmanCode(h *huffmanDecoder, alphabet int) error {
+    if cap(d.lengths) < alphabet {
+        d.lengths = make([]uint8, alphabet)
+    }
+
+    lengths := d.lengths[:alphabet]
+    clear(lengths)
+
+    if d.br.readBits(1) == 1 {
+        // simple code of one or two symbols
+        n := int(d.br.readBits(1)) + 1
+        first := d.br.readBits(uint(1 + 7 * d.br.readBits(1)))
+        if int(first) >= alphabet {
+            return errors.New("invalid huffman code")
+        }
+        lengths[first] = 1
+
+        if n == 2 {
+            second := d.br.readBits(8)
+            if int(second) >= alphabet {
+                return errors.New("invalid huffman code")
+            }
+            lengths[second] = 1
+        }
+    } else {
+        var codeLengths [19]uint8
+        n := int(d.br.readBits(4)) + 4
+        for i := 0; i < n; i++ {
+            codeLengths[codeLengthOrder[i]] = uint8(d.br.readBits(3))
+        }
+
+        var lengthCode huffmanDecoder
+        if err := lengthCode.build(codeLengths[:]); err != nil {
+            return err
+        }
+
+        maxSymbol := alphabet
+        if d.br.readBits(1) == 1 {
+            bits := 2 + 2 * d.br.readBits(3)
+            maxSymbol = 2 + int(d.br.readBits(uint(bits)))
+            if maxSymbol > alphabet {
+                return errors.New("invalid huffman code")
+            }
+        }
+
+        prev := uint8(8)
+        for s := 0; s < alphabet && maxSymbol > 0; maxSymbol-- {
+            if d.br.eos {
+                return ErrTruncated
+            }
+
+            c := lengthCode.decode(&d.br)
+            if c < 16 {
+                lengths[s] = uint8(c)
+                s++
+                if c != 0 {
+                    prev = uint8(c)
+                }
+                continue
+            }
+
+            repeat, value := 0, uint8(0)
+            switch c {
+            case 16:
+                repeat, value = 3 + int(d.br.readBits(2)), prev
+            case 17:
+                repeat = 3 + int(d.br.readBits(3))
+            default:
+                repeat = 11 + int(d.br.readBits(7))
+            }
+
+            if s + repeat > alphabet {
+                return errors.New("invalid huffman code")
+            }
+
+            for ; repeat > 0; repeat-- {
+                lengths[s] = value
+                s++
+            }
+        }
+    }
+
+    if d.br.eos {
+        return ErrTruncated
+    }
+
+    return h.build(lengths)
+}
+
+// decodePixels decodes pixels starting at pixel start, the color cache is only cleared when
+// starting at the first pixel. If the data ends the number of pixels decoded is stored in
+// d.decoded and, for the main image, the bit position of the next pixel in d.main.
+func (d *vp8lDecoder) decodePixels(pixels []uint32, width int, groups []huffmanGroup, entropy []uint32, prefixBits, cacheBits, start int) error {
+    var cache []uint32
+    if cacheBits > 0 {
+        if cap(d.cache) < 1 << cacheBits {
+            d.cache = make([]uint32, 1 << cacheBits)
+        }
+
+        cache = d.cache[:1 << cacheBits]
+        if start == 0 {
+            clear(cache)
+        }
+    }
+
+    cacheShift := uint(32 - cacheBits)
+    entropyWidth := subSampleSize(width, prefixBits)
+
+    g := &groups[0]
+    for pos, x, y := start, start % width, start / width; pos < len(pixels); {
+        bit := d.br.consumed()
+        if entropy != nil {
+            g = &groups[entropy[(y >> prefixBits) * entropyWidth + (x >> prefixBits)] >> 8 & 0xffff]
+        }
+
+        n, dist := 1, 0
+        var argb uint32
+        code := g[0].decode(&d.br)
+        switch {
+        case code < 256:
+            r := g[1].decode(&d.br)
+            b := g[2].decode(&d.br)
+            a := g[3].decode(&d.br)
+            argb = a << 24 | r << 16 | code << 8 | b
+        case code < 256 + 24:
+            n = d.prefixValue(int(code) - 256)
+            dist = planeDistance(width, d.prefixValue(int(g[4].decode(&d.br))))
+        }
+
+        // a symbol cut off by the end of the data is not validated, it is not part of the image
+        if d.br.eos {
+            d.decoded = pos
+            d.main.bit = bit
+            return ErrTruncated
+        }
+
+        switch {
+        case code < 256:
+            pixels[pos] = argb
+        case code < 256 + 24:
+            if dist > pos || n > len(pixels) - pos {
+                return errors.New("invalid backward reference")
+            }
+
+            // copies may overlap, so pixels are copied one at a time
+            for i := pos; i < pos + n; i++ {
+                pixels[i] = pixels[i - dist]
+            }
+        default:
+            index := int(code) - 256 - 24
+            if index >= len(cache) {
+                return errors.New("invalid color cache index")
+            }
+
+            pixels[pos] = cache[index]
+        }
+
+        if cache != nil {
+            for i := pos; i < pos + n; i++ {
+                cache[(pixels[i] * 0x1e35a7bd) >> cacheShift] = pixels[i]
+            }
+        }
+
+        pos += n
+        x += n
+        for x >= width {
+            x -= width
+            y++
+        }
+    }
+
+    d.decoded = len(pixels)
+    return nil
+}
+
+// prefixValue reads the extra bits of a length or distance prefix code and returns its value.
+func (d *vp8lDecoder) prefixValue(prefix int) int {
+    if prefix < 4 {
+        return prefix + 1
+    }
+
+    extra := uint(prefix - 2) >> 1
+    offset := (2 + prefix & 1) << extra
+    return offset + int(d.br.readBits(extra)) + 1
+}
+
+// planeDistance maps a distance code to a distance in pixels.
+func planeDistance(width, code int) int {
+    if code > 120 {
+        return code - 120
+    }
+
+    m := distanceMap[code - 1]
+    return max(int(m[0]) + int(m[1]) * width, 1)
+}
+
+func subSampleSize(size, bits int) int {
+    return (size + 1 << bits - 1) >> bits
+}
+
+// addPixels adds two ARGB pixels per channel, modulo 256.
+func addPixels(a, b uint32) uint32 {
+    ag := (a & 0xff00ff00) + (b & 0xff00ff00)
+    rb := (a & 0x00ff00ff) + (b & 0x00ff00ff)
+    return ag & 0xff00ff00 | rb & 0x00ff00ff
+}
+
+func average2(a, b uint32) uint32 {
+    return ((a ^ b) & 0xfefefefe) >> 1 + (a & b)
+}
+
+// inversePredict reverses the predictor transform of the rows [y0, y1). pixels starts with row y0,
+// or if y0 > 0 with the row above it, which must already be reversed.
+func inversePredict(pixels []uint32, width, y0, y1, bits int, modes []uint32) {
+    if y0 >= y1 {
+        return
+    }
+
+    tilesPerRow := subSampleSize(width, bits)
+    first := max(y0 - 1, 0)
+
+    if y0 == 0 {
+        pixels[0] = addPixels(pixels[0], 0xff000000)
+        for x := 1; x < width; x++ {
+            pixels[x] = addPixels(pixels[x], pixels[x - 1])
+        }
+    }
+
+    for y := max(y0, 1); y < y1; y++ {
+        row := (y - first) * width
+        pixels[row] = addPixels(pixels[row], pixels[row - width])
+
+        tiles := modes[(y >> bits) * tilesPerRow:]
+        for x := 1; x < width; x++ {
+            i := row + x
+
+            // the top right pixel of the last column wraps around to the first pixel of the current row
+            l, t, tl, tr := pixels[i - 1], pixels[i - width], pixels[i - width - 1], pixels[i - width + 1]
+
+            var p uint32
+            switch tiles[x >> bits] >> 8 & 0xf {
+            case 1:
+                p = l
+            case 2:
+                p = t
+            case 3:
+                p = tr
+            case 4:
+                p = tl
+            case 5:
+                p = average2(average2(l, tr), t)
+            case 6:
+                p = average2(l, tl)
+            case 7:
+                p = average2(l, t)
+            case 8:
+                p = average2(tl, t)
+            case 9:
+                p = average2(t, tr)
+            case 10:
+                p = average2(average2(l, tl), average2(t, tr))
+            case 11:
+                p = selectPredictor(l, t, tl)
+            case 12:
+                p = clampAddSubtractFull(l, t, tl)
+            case 13:
+                p = clampAddSubtractHalf(average2(l, t), tl)
+            default:
+                p = 0xff000000
+            }
+
+            pixels[i] = addPixels(pixels[i], p)
+        }
+    }
+}
+
+func selectPredictor(l, t, tl uint32) uint32 {
+    var pl, pt int
+    for shift := 0; shift < 32; shift += 8 {
+        // the prediction is l + t - tl, so its distance to l is |t - tl| and to t is |l - tl|
+        pl += abs(int(t >> shift & 0xff) - int(tl >> shift & 0xff))
+        pt += abs(int(l >> shift & 0xff) - int(tl >> shift & 0xff))
+    }
+
+    if pl < pt {
+        return l
+    }
+
+    return t
+}
+
+func clampAddSubtractFull(a, b, c uint32) uint32 {
+    var p uint32
+    for shift := 0; shift < 32; shift += 8 {
+        v := int(a >> shift & 0xff) + int(b >> shift & 0xff) - int(c >> shift & 0xff)
+        p |= uint32(max(min(v, 255), 0)) << shift
+    }
+
+    return p
+}
+
+func clampAddSubtractHalf(a, b uint32) uint32 {
+    var p uint32
+    for shift := 0; shift < 32; shift += 8 {
+        va := int(a >> shift & 0xff)
+        v := va + (va - int(b >> shift & 0xff)) / 2
+        p |= uint32(max(min(v, 255), 0)) << shift
+    }
+
+    return p
+}
+
+func abs(v int) int {
+    if v < 0 {
+        return -v
+    }
+
+    return v
+}
+
+// inverseColorTransform reverses the color transform of the rows [y0, y1), pixels starts with row y0.
+func inverseColorTransform(pixels []uint32, width, y0, y1, bits int, elements []uint32) {
+    tilesPerRow := subSampleSize(width, bits)
+
+    for y := y0; y < y1; y++ {
+        tiles := elements[(y >> bits) * tilesPerRow:]
+        row := pixels[(y - y0) * width:]
+        for x := 0; x < width; x++ {
+            e := tiles[x >> bits]
+            greenToRed := int(int8(e))
+            greenToBlue := int(int8(e >> 8))
+            redToBlue := int(int8(e >> 16))
+
+            p := row[x]
+            green := int(int8(p >> 8))
+            red := int(p >> 16 & 0xff) + (greenToRed * green) >> 5
+            blue := int(p & 0xff) + (greenToBlue * green) >> 5
+            blue += (redToBlue * int(int8(red))) >> 5
+
+            row[x] = p & 0xff00ff00 | uint32(red & 0xff) << 16 | uint32(blue & 0xff)
+        }
+    }
+}
+
+func inverseSubtractGreen(pixels []uint32) {
+    for i, p := range pixels {
+        g := p >> 8 & 0xff
+        rb := (p & 0x00ff00ff) + (g << 16 | g)
+        pixels[i] = p & 0xff00ff00 | rb & 0x00ff00ff
+    }
+}
+
+// unpackIndices returns the palette index of every pixel of an image with a color indexing
+// transform, reusing dst if it is large enough.
+func unpackIndices(dst []uint8, pixels []uint32, width, height, bits int) []uint8 {
+    if cap(dst) < width * height {
+        dst = make([]uint8, width * height)
+    }
+
+    dst = dst[:width * height]
+    packedWidth := subSampleSize(width, bits)
+    indexBits := uint(8 >> bits)
+    mask := uint32(1 << indexBits - 1)
+
+    for y := 0; y < height; y++ {
+        for x := 0; x < width; x++ {
+            packed := pixels[y * packedWidth + x >> bits] >> 8 & 0xff
+            dst[y * width + x] = uint8(packed >> (uint(x & (1 << bits - 1)) * indexBits) & mask)
+        }
+    }
+
+    return dst
+}
+
+// inverseColorIndexing replaces palette indices by colors. With bits > 0 several indices are
+// bundled in a single pixel, the image is expanded in place from the bottom right so that no
+// bundled pixel is overwritten before it is read.
+func inverseColorIndexing(pixels []uint32, width, height, bits int, palette []uint32) {
+    packedWidth := subSampleSize(width, bits)
+    indexBits := uint(8 >> bits)
+    mask := uint32(1 << indexBits - 1)
+
+    for y := height - 1; y >= 0; y-- {
+        for x := width - 1; x >= 0; x-- {
+            packed := pixels[y * packedWidth + x >> bits] >> 8 & 0xff
+            index := packed >> (uint(x & (1 << bits - 1)) * indexBits) & mask
+            pixels[y * width + x] = palette[index]
+        }
+    }
+}
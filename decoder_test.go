@@ -0,0 +1,464 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "bytes"
+    "math/rand"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    "image/color"
+    "image/draw"
+    //------------------------------
+    //errors
+    //------------------------------
+    decoderWebP "golang.org/x/image/webp"
+    //------------------------------
+    //testing
+    //------------------------------
+    "testing"
+)
+
+func generateTestImagePaletted(width, height, colors int) image.Image {
+    pal := make(color.Palette, colors)
+    for i := range pal {
+        pal[i] = color.NRGBA{uint8(i * 37), uint8(i * 91), uint8(i * 13), uint8(255 - i)}
+    }
+
+    img := image.NewPaletted(image.Rect(0, 0, width, height), pal)
+    for i := range img.Pix {
+        img.Pix[i] = uint8((i / 3 + i % 7) % colors)
+    }
+
+    return img
+}
+
+func generateTestImageNoise(width, height int, seed int64) image.Image {
+    rnd := rand.New(rand.NewSource(seed))
+
+    img := image.NewNRGBA(image.Rect(0, 0, width, height))
+    rnd.Read(img.Pix)
+
+    // repeat some rows so the stream contains backward references
+    for y := 2; y < height; y += 3 {
+        copy(img.Pix[y * img.Stride:(y + 1) * img.Stride], img.Pix[(y - 2) * img.Stride:(y - 1) * img.Stride])
+    }
+
+    return img
+}
+
+// decodeTestVP8L decodes a VP8L bitstream with the native decoder into a new image.
+func decodeTestVP8L(data []byte) (*image.NRGBA, error) {
+    d := &vp8lDecoder{}
+    if err := d.decodeHeader(data); err != nil {
+        return nil, err
+    }
+
+    pixels, err := d.decodeImage()
+    if err != nil {
+        return nil, err
+    }
+
+    img := image.NewNRGBA(image.Rect(0, 0, d.width, d.height))
+    writeARGB(img, image.Point{}, pixels, d.width, d.height)
+    return img, nil
+}
+
+func TestDecodeVP8L(t *testing.T) {
+    for id, img := range []image.Image{
+        generateTestImageNRGBA(1, 1, 64, false),
+        generateTestImageNRGBA(8, 8, 64, false),
+        generateTestImageNRGBA(37, 19, 32, true),
+        generateTestImageNRGBA(200, 3, 16, true),
+        generateTestImageNoise(33, 47, 1),
+        generateTestImageNoise(130, 70, 2),
+        generateTestImagePaletted(17, 9, 2),
+        generateTestImagePaletted(17, 9, 4),
+        generateTestImagePaletted(17, 9, 16),
+        generateTestImagePaletted(17, 9, 200),
+    }{
+        stream, _, err := writeBitStream(img, nil, nil)
+        if err != nil {
+            t.Fatalf("test %v: unexpected error %v", id, err)
+        }
+
+        result, err := decodeTestVP8L(stream.Bytes())
+        if err != nil {
+            t.Errorf("test %v: unexpected error %v", id, err)
+            continue
+        }
+
+        expected := image.NewNRGBA(img.Bounds())
+        draw.Draw(expected, expected.Bounds(), img, img.Bounds().Min, draw.Src)
+
+        if !bytes.Equal(result.Pix, expected.Pix) {
+            t.Errorf("test %v: decoded pixels do not match the encoded image", id)
+        }
+    }
+}
+
+func TestDecodeVP8LMetaPrefixCodes(t *testing.T) {
+    // the encoder never uses meta prefix codes, so a stream with a group per 4x4 tile is built by hand
+    img := generateTestImageNoise(8, 8, 3).(*image.NRGBA)
+
+    w := &bitWriter{}
+    writeBitStreamHeader(w, img.Bounds(), true)
+    w.writeBits(0, 1)       // no transforms
+    w.writeBits(0, 1)       // no color cache
+    w.writeBits(1, 1)       // meta prefix codes
+    w.writeBits(0, 3)       // 4x4 tiles
+
+    entropy := []color.NRGBA{{G: 0, A: 255}, {G: 1, A: 255}, {G: 2, A: 255}, {G: 3, A: 255}}
+    writeImageData(w, entropy, 2, 2, false, 0, 1, defaultMatchFinder, nil)
+
+    group := func(x, y int) int {
+        return y / 4 * 2 + x / 4
+    }
+
+    histos := make([][][]int, 4)
+    for g := range histos {
+        histos[g] = [][]int{make([]int, 256 + 24), make([]int, 256), make([]int, 256), make([]int, 256), make([]int, 40)}
+    }
+
+    for y := 0; y < 8; y++ {
+        for x := 0; x < 8; x++ {
+            c := img.NRGBAAt(x, y)
+            h := histos[group(x, y)]
+            h[0][c.G]++
+            h[1][c.R]++
+            h[2][c.B]++
+            h[3][c.A]++
+        }
+    }
+
+    codes := make([][][]huffmanCode, 4)
+    for g := range codes {
+        for i := 0; i < 5; i++ {
+            codes[g] = append(codes[g], buildhuffmanCodes(histos[g][i], 15))
+            writehuffmanCodes(w, codes[g][i])
+        }
+    }
+
+    for y := 0; y < 8; y++ {
+        for x := 0; x < 8; x++ {
+            c := img.NRGBAAt(x, y)
+            g := codes[group(x, y)]
+            w.writeCode(g[0][c.G])
+            w.writeCode(g[1][c.R])
+            w.writeCode(g[2][c.B])
+            w.writeCode(g[3][c.A])
+        }
+    }
+
+    w.alignByte()
+
+    result, err := decodeTestVP8L(w.Buffer)
+    if err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    if !bytes.Equal(result.Pix, img.Pix) {
+        t.Errorf("decoded pixels do not match the encoded image")
+    }
+
+    // the hand built stream is checked against the reference decoder
+    buf := &bytes.Buffer{}
+    writeChunk(buf, "VP8L", w.Buffer)
+    riff := &bytes.Buffer{}
+    writeRIFF(riff, buf)
+
+    expected, err := decoderWebP.Decode(riff)
+    if err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    if !bytes.Equal(result.Pix, expected.(*image.NRGBA).Pix) {
+        t.Errorf("decoded pixels do not match the reference decoder")
+    }
+}
+
+func TestDecodeVP8LErrors(t *testing.T) {
+    stream, _, _ := writeBitStream(generateTestImageNoise(16, 16, 4), nil, nil)
+
+    for id, tt := range []struct {
+        input       []byte
+        expectedErr string
+    }{
+        {
+            []byte{0x2e, 0x00, 0x00, 0x00, 0x00},
+            "invalid VP8L header",
+        },
+        {
+            []byte{0x2f, 0x00, 0x00, 0x00, 0x20},
+            "invalid VP8L version",
+        },
+        {
+            stream.Bytes()[:stream.Len() / 2],
+            ErrTruncated.Error(),
+        },
+        {   // a subtract green transform that is followed by a second subtract green transform
+            []byte{0x2f, 0x00, 0x00, 0x00, 0x00, 0x2d, 0x00, 0x00, 0x00},
+            "invalid transform",
+        },
+    }{
+        _, err := decodeTestVP8L(tt.input)
+        if err == nil || err.Error() != tt.expectedErr {
+            t.Errorf("test %v: expected err as %v got %v", id, tt.expectedErr, err)
+        }
+    }
+}
+
+func TestHuffmanDecoder(t *testing.T) {
+    // fibonacci weights give a maximally skewed tree with codes longer than the root table
+    histo := make([]int, 20)
+    a, b := 1, 1
+    for i := range histo {
+        histo[i] = a
+        a, b = b, a + b
+    }
+
+    codes := buildhuffmanCodes(histo, 15)
+
+    lengths := make([]uint8, len(codes))
+    for i, c := range codes {
+        lengths[i] = uint8(c.Depth)
+    }
+
+    h := &huffmanDecoder{}
+    if err := h.build(lengths); err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    w := &bitWriter{}
+    for i := range codes {
+        w.writeCode(codes[i])
+    }
+    w.alignByte()
+
+    br := &bitReader{data: w.Buffer}
+    for i := range codes {
+        if s := h.decode(br); s != uint32(i) {
+            t.Errorf("expected symbol %v got %v", i, s)
+        }
+    }
+
+    for id, tt := range []struct {
+        lengths     []uint8
+        expectedErr bool
+    }{
+        {[]uint8{0, 0, 0}, true},
+        {[]uint8{1, 1, 1}, true},       // over-subscribed
+        {[]uint8{1, 2, 0}, true},       // incomplete
+        {[]uint8{0, 3, 0}, false},      // a single symbol is coded with 0 bits
+        {[]uint8{1, 2, 2}, false},
+    }{
+        err := (&huffmanDecoder{}).build(tt.lengths)
+        if (err != nil) != tt.expectedErr {
+            t.Errorf("test %v: expected error %v got %v", id, tt.expectedErr, err)
+        }
+    }
+}
+
+func TestInverseTransforms(t *testing.T) {
+    img := generateTestImageNoise(37, 23, 5).(*image.NRGBA)
+    width, height := 37, 23
+
+    toARGB := func(pixels []color.NRGBA) []uint32 {
+        argb := make([]uint32, len(pixels))
+        for i, p := range pixels {
+            argb[i] = uint32(p.A) << 24 | uint32(p.R) << 16 | uint32(p.G) << 8 | uint32(p.B)
+        }
+        return argb
+    }
+
+    original, _ := flatten(img)
+    expected := toARGB(original)
+
+    pixels, _ := flatten(img)
+    applySubtractGreenTransform(pixels)
+    argb := toARGB(pixels)
+    inverseSubtractGreen(argb)
+    if !slicesEqual(argb, expected) {
+        t.Errorf("subtract green transform mismatch")
+    }
+
+    pixels, _ = flatten(img)
+    bits, _, _, blocks := applyColorTransform(pixels, width, height)
+    argb = toARGB(pixels)
+    inverseColorTransform(argb, width, 0, height, bits, toARGB(blocks))
+    if !slicesEqual(argb, expected) {
+        t.Errorf("color transform mismatch")
+    }
+
+    pixels, _ = flatten(img)
+    bits, _, _, blocks = applyPredictTransform(pixels, width, height, 1, nil)
+    argb = toARGB(pixels)
+    inversePredict(argb, width, 0, height, bits, toARGB(blocks))
+    if !slicesEqual(argb, expected) {
+        t.Errorf("predict transform mismatch")
+    }
+
+    // every predictor mode is checked against the filters of the encoder
+    for mode := 0; mode < 14; mode++ {
+        modes := make([]uint32, subSampleSize(width, 2) * subSampleSize(height, 2))
+        for i := range modes {
+            modes[i] = uint32(mode) << 8
+        }
+
+        pixels, _ = flatten(img)
+        residuals := make([]color.NRGBA, len(pixels))
+        for y := 0; y < height; y++ {
+            for x := 0; x < width; x++ {
+                m := mode
+                if x == 0 || y == 0 {
+                    m = 0
+                }
+
+                p := pixels[y * width + x]
+                d := applyFilter(pixels, width, x, y, m)
+                residuals[y * width + x] = color.NRGBA{p.R - d.R, p.G - d.G, p.B - d.B, p.A - d.A}
+            }
+        }
+
+        argb = toARGB(residuals)
+        inversePredict(argb, width, 0, height, 2, modes)
+        if !slicesEqual(argb, expected) {
+            t.Errorf("predict mode %v mismatch", mode)
+        }
+    }
+}
+
+func slicesEqual(a, b []uint32) bool {
+    if len(a) != len(b) {
+        return false
+    }
+
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+
+    return true
+}
+
+func TestDecodeVP8LUnusedGroups(t *testing.T) {
+    // four tiles name the highest group index, so all 65536 groups are read but only three are kept
+    img := generateTestImageNoise(8, 8, 4).(*image.NRGBA)
+    tiles := []int{0, 65535, 7, 65535}
+
+    w := &bitWriter{}
+    writeBitStreamHeader(w, img.Bounds(), true)
+    w.writeBits(0, 1)       // no transforms
+    w.writeBits(0, 1)       // no color cache
+    w.writeBits(1, 1)       // meta prefix codes
+    w.writeBits(0, 3)       // 4x4 tiles
+
+    entropy := make([]color.NRGBA, len(tiles))
+    for i, g := range tiles {
+        entropy[i] = color.NRGBA{R: uint8(g >> 8), G: uint8(g), A: 255}
+    }
+    writeImageData(w, entropy, 2, 2, false, 0, 1, defaultMatchFinder, nil)
+
+    group := func(x, y int) int {
+        return tiles[y / 4 * 2 + x / 4]
+    }
+
+    histos := map[int][][]int{}
+    for _, g := range tiles {
+        histos[g] = [][]int{make([]int, 256 + 24), make([]int, 256), make([]int, 256), make([]int, 256), make([]int, 40)}
+    }
+
+    for y := 0; y < 8; y++ {
+        for x := 0; x < 8; x++ {
+            c := img.NRGBAAt(x, y)
+            h := histos[group(x, y)]
+            h[0][c.G]++
+            h[1][c.R]++
+            h[2][c.B]++
+            h[3][c.A]++
+        }
+    }
+
+    codes := map[int][][]huffmanCode{}
+    for g := 0; g < 65536; g++ {
+        if histos[g] == nil {
+            // five simple codes of the single symbol 0
+            for i := 0; i < 5; i++ {
+                w.writeBits(0b0001, 4)
+            }
+            continue
+        }
+
+        for i := 0; i < 5; i++ {
+            codes[g] = append(codes[g], buildhuffmanCodes(histos[g][i], 15))
+            writehuffmanCodes(w, codes[g][i])
+        }
+    }
+
+    for y := 0; y < 8; y++ {
+        for x := 0; x < 8; x++ {
+            c := img.NRGBAAt(x, y)
+            g := codes[group(x, y)]
+            w.writeCode(g[0][c.G])
+            w.writeCode(g[1][c.R])
+            w.writeCode(g[2][c.B])
+            w.writeCode(g[3][c.A])
+        }
+    }
+
+    w.alignByte()
+
+    d := &vp8lDecoder{}
+    if err := d.decodeHeader(w.Buffer); err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    pixels, err := d.decodeImage()
+    if err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    result := image.NewNRGBA(img.Bounds())
+    writeARGB(result, image.Point{}, pixels, 8, 8)
+    if !bytes.Equal(result.Pix, img.Pix) {
+        t.Errorf("decoded pixels do not match the encoded image")
+    }
+
+    if cap(d.groups) > len(tiles) {
+        t.Errorf("expected at most %v groups to be kept got %v", len(tiles), cap(d.groups))
+    }
+}
+
+func TestDecodeVP8LPool(t *testing.T) {
+    // a decoder taken from the pool keeps its buffers, which must not leak into the next image
+    d := &vp8lDecoder{}
+    for id, img := range []image.Image{
+        generateTestImageNoise(64, 64, 6),
+        generateTestImagePaletted(9, 5, 4),
+        generateTestImageNRGBA(16, 8, 64, true),
+    }{
+        stream, _, _ := writeBitStream(img, nil, nil)
+        if err := d.decodeHeader(stream.Bytes()); err != nil {
+            t.Fatalf("test %v: unexpected error %v", id, err)
+        }
+
+        pixels, err := d.decodeImage()
+        if err != nil {
+            t.Fatalf("test %v: unexpected error %v", id, err)
+        }
+
+        result := image.NewNRGBA(img.Bounds())
+        writeARGB(result, image.Point{}, pixels, d.width, d.height)
+
+        expected := image.NewNRGBA(img.Bounds())
+        draw.Draw(expected, expected.Bounds(), img, img.Bounds().Min, draw.Src)
+
+        if !bytes.Equal(result.Pix, expected.Pix) {
+            t.Errorf("test %v: decoded pixels do not match the encoded image", id)
+        }
+    }
+}
@@ -0,0 +1,177 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    "image/color"
+)
+
+// Dither selects how 16-bit images are reduced to the 8 bits per channel stored by VP8L.
+type Dither int
+
+const (
+    // DitherNone truncates every channel to its 8 most significant bits, as draw.Draw does.
+    DitherNone              = Dither(0)
+    // DitherOrdered adds a fixed 8x8 Bayer threshold pattern before rounding, which keeps the
+    // output stable between similar frames.
+    DitherOrdered           = Dither(1)
+    // DitherErrorDiffusion spreads the rounding error of every pixel over its neighbours with
+    // Floyd-Steinberg weights, which gives the smoothest gradients.
+    DitherErrorDiffusion    = Dither(2)
+)
+
+// bayerMatrix is the 8x8 ordered dither matrix, holding every threshold from 0 to 63 once.
+var bayerMatrix = [8][8]uint32{
+    { 0, 32,  8, 40,  2, 34, 10, 42},
+    {48, 16, 56, 24, 50, 18, 58, 26},
+    {12, 44,  4, 36, 14, 46,  6, 38},
+    {60, 28, 52, 20, 62, 30, 54, 22},
+    { 3, 35, 11, 43,  1, 33,  9, 41},
+    {51, 19, 59, 27, 49, 17, 57, 25},
+    {15, 47,  7, 39, 13, 45,  5, 37},
+    {63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// isHighBitDepth reports whether img stores 16 bits per channel.
+func isHighBitDepth(img image.Image) bool {
+    switch img.(type) {
+    case *image.NRGBA64, *image.RGBA64, *image.Gray16:
+        return true
+    }
+
+    return false
+}
+
+// readRow16 reads row y, relative to the top of the bounds, of a 16-bit image as straight alpha
+// colors in the order red, green, blue and alpha.
+func readRow16(img image.Image, y int, dst [][4]uint32) {
+    b := img.Bounds()
+
+    switch img := img.(type) {
+    case *image.NRGBA64:
+        row := img.Pix[img.PixOffset(b.Min.X, b.Min.Y + y):][:8 * len(dst)]
+        for x := range dst {
+            s := row[8 * x : 8 * x + 8 : 8 * x + 8]
+            dst[x] = [4]uint32{
+                uint32(s[0]) << 8 | uint32(s[1]),
+                uint32(s[2]) << 8 | uint32(s[3]),
+                uint32(s[4]) << 8 | uint32(s[5]),
+                uint32(s[6]) << 8 | uint32(s[7]),
+            }
+        }
+    case *image.RGBA64:
+        row := img.Pix[img.PixOffset(b.Min.X, b.Min.Y + y):][:8 * len(dst)]
+        for x := range dst {
+            s := row[8 * x : 8 * x + 8 : 8 * x + 8]
+            a := uint32(s[6]) << 8 | uint32(s[7])
+            dst[x] = [4]uint32{0, 0, 0, a}
+            if a == 0 {
+                continue
+            }
+
+            // invalid premultiplied colors can exceed alpha, they are clamped to the largest value
+            for c := 0; c < 3; c++ {
+                dst[x][c] = min((uint32(s[2 * c]) << 8 | uint32(s[2 * c + 1])) * 0xffff / a, 0xffff)
+            }
+        }
+    case *image.Gray16:
+        row := img.Pix[img.PixOffset(b.Min.X, b.Min.Y + y):][:2 * len(dst)]
+        for x := range dst {
+            v := uint32(row[2 * x]) << 8 | uint32(row[2 * x + 1])
+            dst[x] = [4]uint32{v, v, v, 0xffff}
+        }
+    }
+}
+
+// precisionReduced reports whether a 16-bit image holds a value that 8 bits cannot represent.
+func precisionReduced(img image.Image) bool {
+    row := make([][4]uint32, img.Bounds().Dx())
+    for y := 0; y < img.Bounds().Dy(); y++ {
+        readRow16(img, y, row)
+        for _, p := range row {
+            for _, v := range p {
+                if v % 0x101 != 0 {
+                    return true
+                }
+            }
+        }
+    }
+
+    return false
+}
+
+// reduceBitDepth converts a 16-bit image to 8-bit NRGBA pixels with ordered or error diffusion
+// dithering of the color channels. Alpha is rounded to the nearest value, dithering it would add
+// noise to the edges of transparent areas.
+//
+// The pixels are stored in the scratch memory of b, which may be nil, and are valid until b is used again.
+func reduceBitDepth(img image.Image, dither Dither, b *encodeBuffers) ([]color.NRGBA, bool) {
+    if b == nil {
+        b = &encodeBuffers{}
+    }
+
+    w := img.Bounds().Dx()
+    h := img.Bounds().Dy()
+
+    b.pixels = resizeBuffer(b.pixels, w * h)
+    b.row16 = resizeBuffer(b.row16, w)
+    pixels, row := b.pixels, b.row16
+
+    // errors of the current and next row, with a pixel of margin on both sides
+    var cur, next [][3]int32
+    if dither == DitherErrorDiffusion {
+        b.diffusion[0] = resizeBuffer(b.diffusion[0], w + 2)
+        b.diffusion[1] = resizeBuffer(b.diffusion[1], w + 2)
+        cur, next = b.diffusion[0], b.diffusion[1]
+
+        clear(cur)
+        clear(next)
+    }
+
+    var reduced bool
+    for y := 0; y < h; y++ {
+        readRow16(img, y, row)
+        dst := pixels[y * w:][:w]
+
+        for x, p := range row {
+            var out [4]uint8
+            for c := 0; c < 3; c++ {
+                v := p[c]
+                reduced = reduced || v % 0x101 != 0
+
+                switch dither {
+                case DitherOrdered:
+                    // thresholds are centered in their interval so the pattern does not brighten the image
+                    t := (2 * bayerMatrix[y & 7][x & 7] + 1) * 0xffff / 128
+                    out[c] = uint8((v * 0xff + t) / 0xffff)
+                default:
+                    e := int32(v) + cur[x + 1][c]
+                    e = max(0, min(e, 0xffff))
+
+                    q := (e * 0xff + 0x7fff) / 0xffff
+                    out[c] = uint8(q)
+
+                    e -= q * 0x101
+                    cur[x + 2][c] += e * 7 / 16
+                    next[x][c] += e * 3 / 16
+                    next[x + 1][c] += e * 5 / 16
+                    next[x + 2][c] += e / 16
+                }
+            }
+
+            reduced = reduced || p[3] % 0x101 != 0
+            out[3] = uint8((p[3] * 0xff + 0x7fff) / 0xffff)
+
+            dst[x] = color.NRGBA{out[0], out[1], out[2], out[3]}
+        }
+
+        if dither == DitherErrorDiffusion {
+            cur, next = next, cur
+            clear(next)
+        }
+    }
+
+    return pixels, reduced
+}
@@ -0,0 +1,232 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "bytes"
+    "sync"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    "image/color"
+    "image/draw"
+    //------------------------------
+    //testing
+    //------------------------------
+    "testing"
+)
+
+func generateTestImageNRGBA64(width, height int, value, alpha uint16) *image.NRGBA64 {
+    img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+    for y := 0; y < height; y++ {
+        for x := 0; x < width; x++ {
+            img.SetNRGBA64(x, y, color.NRGBA64{value, value, value, alpha})
+        }
+    }
+
+    return img
+}
+
+func TestReduceBitDepth(t *testing.T) {
+    // a value halfway between two 8-bit levels must average out to the halfway point
+    half := uint16(100 * 0x101 + 0x80)
+
+    gray := image.NewGray16(image.Rect(0, 0, 16, 16))
+    for i := 0; i < len(gray.Pix); i += 2 {
+        gray.Pix[i], gray.Pix[i + 1] = uint8(half >> 8), uint8(half)
+    }
+
+    premultiplied := image.NewRGBA64(image.Rect(0, 0, 16, 16))
+    draw.Draw(premultiplied, premultiplied.Bounds(), generateTestImageNRGBA64(16, 16, half, 0x8000), image.Point{}, draw.Src)
+
+    for id, tt := range []struct {
+        img         image.Image
+        dither      Dither
+        mean        float64
+        alpha       uint8
+    }{
+        {generateTestImageNRGBA64(16, 16, half, 0xffff), DitherOrdered, 100.5, 255},
+        {generateTestImageNRGBA64(16, 16, half, 0xffff), DitherErrorDiffusion, 100.5, 255},
+        {generateTestImageNRGBA64(16, 16, half, 0x8000), DitherOrdered, 100.5, 128},
+        {gray, DitherOrdered, 100.5, 255},
+        {gray, DitherErrorDiffusion, 100.5, 255},
+        {premultiplied, DitherErrorDiffusion, 100.5, 128},
+    }{
+        pixels, reduced := reduceBitDepth(tt.img, tt.dither, nil)
+        if !reduced {
+            t.Errorf("test %v: expected reduced precision to be reported", id)
+        }
+
+        var sum float64
+        for _, p := range pixels {
+            sum += float64(p.R)
+            if p.R != p.G || p.G != p.B {
+                t.Errorf("test %v: expected equal channels got %v", id, p)
+                break
+            }
+
+            if p.A != tt.alpha {
+                t.Errorf("test %v: expected alpha as %v got %v", id, tt.alpha, p.A)
+                break
+            }
+        }
+
+        if mean := sum / float64(len(pixels)); mean < tt.mean - 0.1 || mean > tt.mean + 0.1 {
+            t.Errorf("test %v: expected mean as %v got %v", id, tt.mean, mean)
+        }
+    }
+
+    // values that fit in 8 bits are converted exactly and are not reported
+    exact := image.NewNRGBA64(image.Rect(0, 0, 37, 11))
+    source := generateTestImageNRGBA(37, 11, 64, true).(*image.NRGBA)
+    draw.Draw(exact, exact.Bounds(), source, image.Point{}, draw.Src)
+
+    for _, dither := range []Dither{DitherOrdered, DitherErrorDiffusion} {
+        pixels, reduced := reduceBitDepth(exact, dither, nil)
+        expected, _ := flatten(source)
+
+        if reduced {
+            t.Errorf("dither %v: expected no reduced precision", dither)
+        }
+
+        for i := range pixels {
+            if pixels[i] != expected[i] {
+                t.Errorf("dither %v: expected pixel %v as %v got %v", dither, i, expected[i], pixels[i])
+                break
+            }
+        }
+    }
+}
+
+func TestReduceBitDepthInvalidPremultiplied(t *testing.T) {
+    // premultiplied colors above alpha are invalid, they must saturate instead of wrapping around
+    img := image.NewRGBA64(image.Rect(0, 0, 8, 8))
+    for i := 0; i < len(img.Pix); i += 8 {
+        copy(img.Pix[i:], []byte{0xff, 0xff, 0x40, 0x00, 0x00, 0x00, 0x80, 0x00})
+    }
+
+    for _, dither := range []Dither{DitherOrdered, DitherErrorDiffusion} {
+        pixels, _ := reduceBitDepth(img, dither, nil)
+        for i, p := range pixels {
+            // green is exactly halfway between two 8-bit values and is dithered
+            if p.R != 255 || p.G < 127 || p.G > 128 || p.B != 0 || p.A != 128 {
+                t.Errorf("dither %v: expected pixel %v near %v got %v", dither, i, color.NRGBA{255, 127, 0, 128}, p)
+                break
+            }
+        }
+    }
+}
+
+func TestReduceBitDepthBuffers(t *testing.T) {
+    b := &encodeBuffers{}
+
+    // buffers left behind by larger images must not change the result of the next one
+    for id, img := range []image.Image{
+        generateTestImageNRGBA64(40, 30, 100 * 0x101 + 0x80, 0xffff),
+        generateTestImageNRGBA64(7, 5, 200 * 0x101 + 0x33, 0x8000),
+        generateTestImageNRGBA64(40, 30, 100 * 0x101 + 0x80, 0xffff),
+    }{
+        for _, dither := range []Dither{DitherOrdered, DitherErrorDiffusion} {
+            expected, _ := reduceBitDepth(img, dither, nil)
+            pixels, _ := reduceBitDepth(img, dither, b)
+
+            if !bytes.Equal(flattenBytes(pixels), flattenBytes(expected)) {
+                t.Errorf("test %v: dither %v: output differs from a conversion with new buffers", id, dither)
+            }
+        }
+    }
+}
+
+// flattenBytes returns the channels of pixels as a byte slice.
+func flattenBytes(pixels []color.NRGBA) []byte {
+    out := make([]byte, 0, 4 * len(pixels))
+    for _, p := range pixels {
+        out = append(out, p.R, p.G, p.B, p.A)
+    }
+
+    return out
+}
+
+func TestEncodeHighBitDepth(t *testing.T) {
+    gradient := image.NewNRGBA64(image.Rect(0, 0, 64, 8))
+    for y := 0; y < 8; y++ {
+        for x := 0; x < 64; x++ {
+            v := uint16(0x4000 + x * 37)
+            gradient.SetNRGBA64(x, y, color.NRGBA64{v, v / 2, 0xffff - v, 0xffff})
+        }
+    }
+
+    exact := generateTestImageNRGBA64(8, 8, 0x4040, 0xffff)
+
+    for id, tt := range []struct {
+        img         image.Image
+        dither      Dither
+        reported    bool
+    }{
+        {gradient, DitherNone, true},
+        {gradient, DitherOrdered, true},
+        {gradient, DitherErrorDiffusion, true},
+        {exact, DitherNone, false},
+        {exact, DitherErrorDiffusion, false},
+        {generateTestImageNRGBA(8, 8, 64, false), DitherOrdered, false},
+    }{
+        var reported image.Image
+        o := &Options{
+            Dither:             tt.dither,
+            OnReducedPrecision: func(img image.Image) {
+                reported = img
+            },
+        }
+
+        buf := new(bytes.Buffer)
+        if err := Encode(buf, tt.img, o); err != nil {
+            t.Fatalf("test %v: unexpected error %v", id, err)
+        }
+
+        if (reported != nil) != tt.reported || (reported != nil && reported != tt.img) {
+            t.Errorf("test %v: expected reported as %v got %v", id, tt.reported, reported != nil)
+        }
+
+        // without dithering the output matches drawing the image onto an *image.NRGBA
+        if tt.dither == DitherNone {
+            drawn := image.NewNRGBA(tt.img.Bounds())
+            draw.Draw(drawn, drawn.Bounds(), tt.img, image.Point{}, draw.Src)
+
+            expected := new(bytes.Buffer)
+            Encode(expected, drawn, nil)
+
+            if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+                t.Errorf("test %v: output does not match the truncated image", id)
+            }
+        }
+
+        if _, err := Decode(buf); err != nil {
+            t.Errorf("test %v: unexpected decode error %v", id, err)
+        }
+    }
+
+    // every frame of an animation is reported, frames are encoded concurrently
+    var mu sync.Mutex
+    var count int
+    o := &Options{
+        Dither:             DitherOrdered,
+        Concurrency:        4,
+        OnReducedPrecision: func(img image.Image) {
+            mu.Lock()
+            count++
+            mu.Unlock()
+        },
+    }
+
+    err := EncodeAll(new(bytes.Buffer), &Animation{
+        Images:     []image.Image{gradient, exact, gradient},
+        Durations:  []uint{100, 100, 100},
+        Disposals:  []uint{0, 0, 0},
+    }, o)
+
+    if err != nil || count != 2 {
+        t.Errorf("expected 2 reported frames got %v, %v", count, err)
+    }
+}
@@ -0,0 +1,56 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "io"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    //------------------------------
+    //errors
+    //------------------------------
+    "errors"
+)
+
+// AnimationEditor edits an existing WebP animation at the chunk level.
+//
+// It is a Mux read from an animated file. Frames are kept as their compressed bitstreams and
+// are copied byte-for-byte when the animation is written again, so changing the loop count,
+// retiming, dropping or reordering frames never re-encodes pixel data. Only frames added with
+// AppendFrame are encoded.
+//
+// ICC profiles, EXIF and XMP metadata and unknown chunks are preserved. Unlike a Mux read with
+// NewMux, the VP8X canvas size is recomputed from the frames when the animation is written, so
+// dropping frames shrinks the canvas.
+type AnimationEditor struct {
+    Mux
+}
+
+// AnimationFrame is a single frame of an AnimationEditor.
+type AnimationFrame = MuxFrame
+
+// NewAnimationEditor reads an animated WebP file from the provided io.Reader for editing.
+//
+// Parameters:
+//   r - The source io.Reader containing the WebP animation.
+//
+// Returns:
+//   An AnimationEditor holding the frames and settings of the animation, or an error if the
+//   input is not a valid WebP animation.
+func NewAnimationEditor(r io.Reader) (*AnimationEditor, error) {
+    m, err := NewMux(r)
+    if err != nil {
+        return nil, err
+    }
+
+    if !m.Animated {
+        return nil, errors.New("not an animated WebP")
+    }
+
+    m.canvas = image.Rectangle{}
+
+    return &AnimationEditor{Mux: *m}, nil
+}
@@ -0,0 +1,263 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "bytes"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    //------------------------------
+    //testing
+    //------------------------------
+    "testing"
+)
+
+func generateTestAnimation(t *testing.T, ani *Animation) []byte {
+    b := &bytes.Buffer{}
+    if err := EncodeAll(b, ani, nil); err != nil {
+        t.Fatalf("EncodeAll: unexpected error %v", err)
+    }
+
+    return b.Bytes()
+}
+
+func TestAnimationEditor(t *testing.T) {
+    frame1 := generateTestImageNRGBA(4, 4, 64, false)
+    frame2 := generateTestImageNRGBA(8, 8, 64, true)
+    frame3 := generateTestImageNRGBA(6, 6, 32, false)
+
+    original := &Animation{
+        Images:             []image.Image{frame1, frame2, frame3},
+        Durations:          []uint{100, 200, 300},
+        Disposals:          []uint{0, 1, 0},
+        Blends:             []uint{1, 0, 0},
+        LoopCount:          2,
+        BackgroundColor:    0xff0000ff,
+    }
+
+    for id, tt := range []struct {
+        edit        func(e *AnimationEditor) error
+        expected    *Animation
+    }{
+        {   // no changes
+            func(e *AnimationEditor) error {
+                return nil
+            },
+            original,
+        },
+        {   // loop count, background and timing
+            func(e *AnimationEditor) error {
+                e.LoopCount = 0
+                e.BackgroundColor = 0xffffffff
+                e.Frames[1].Duration = 50
+                e.Frames[2].Disposal = 1
+                return nil
+            },
+            &Animation{
+                Images:             []image.Image{frame1, frame2, frame3},
+                Durations:          []uint{100, 50, 300},
+                Disposals:          []uint{0, 1, 1},
+                Blends:             []uint{1, 0, 0},
+                LoopCount:          0,
+                BackgroundColor:    0xffffffff,
+            },
+        },
+        {   // drop and reorder frames, which also shrinks the canvas and drops the alpha flag
+            func(e *AnimationEditor) error {
+                e.Frames = []*AnimationFrame{e.Frames[2], e.Frames[0]}
+                return nil
+            },
+            &Animation{
+                Images:             []image.Image{frame3, frame1},
+                Durations:          []uint{300, 100},
+                Disposals:          []uint{0, 0},
+                Blends:             []uint{0, 1},
+                LoopCount:          2,
+                BackgroundColor:    0xff0000ff,
+            },
+        },
+        {   // append a new frame
+            func(e *AnimationEditor) error {
+                return e.AppendFrame(frame2, 40, 1, 1)
+            },
+            &Animation{
+                Images:             []image.Image{frame1, frame2, frame3, frame2},
+                Durations:          []uint{100, 200, 300, 40},
+                Disposals:          []uint{0, 1, 0, 1},
+                Blends:             []uint{1, 0, 0, 1},
+                LoopCount:          2,
+                BackgroundColor:    0xff0000ff,
+            },
+        },
+    }{
+        e, err := NewAnimationEditor(bytes.NewReader(generateTestAnimation(t, original)))
+        if err != nil {
+            t.Errorf("test %v: unexpected error %v", id, err)
+            continue
+        }
+
+        if err := tt.edit(e); err != nil {
+            t.Errorf("test %v: unexpected error %v", id, err)
+            continue
+        }
+
+        b := &bytes.Buffer{}
+        if err := e.Encode(b); err != nil {
+            t.Errorf("test %v: unexpected error %v", id, err)
+            continue
+        }
+
+        // untouched frames are copied, so the result must match a full encode
+        expected := generateTestAnimation(t, tt.expected)
+        if !bytes.Equal(b.Bytes(), expected) {
+            t.Errorf("test %v: output mismatch expected %v got %v", id, expected, b.Bytes())
+        }
+    }
+}
+
+func TestAnimationEditorMetadata(t *testing.T) {
+    data := generateTestAnimation(t, &Animation{
+        Images:     []image.Image{generateTestImageNRGBA(4, 4, 64, false)},
+        Durations:  []uint{100},
+        Disposals:  []uint{0},
+    })
+
+    // insert an ICC profile after VP8X, and EXIF plus an unknown chunk at the end
+    chunks, err := parseRIFF(data)
+    if err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    buf := &bytes.Buffer{}
+    writeChunk(buf, chunks[0].FourCC, chunks[0].Payload())
+    writeChunk(buf, "ICCP", []byte("profile"))
+    for _, c := range chunks[1:] {
+        writeChunk(buf, c.FourCC, c.Payload())
+    }
+    writeChunk(buf, "EXIF", []byte("exif"))
+    writeChunk(buf, "ABCD", []byte("unknown"))
+
+    input := &bytes.Buffer{}
+    writeRIFF(input, buf)
+
+    e, err := NewAnimationEditor(input)
+    if err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    e.LoopCount = 5
+
+    output := &bytes.Buffer{}
+    if err := e.Encode(output); err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    result, err := parseRIFF(output.Bytes())
+    if err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    var fourCCs []string
+    for _, c := range result {
+        fourCCs = append(fourCCs, c.FourCC)
+    }
+
+    expected := []string{"VP8X", "ICCP", "ANIM", "ANMF", "EXIF", "ABCD"}
+    if len(fourCCs) != len(expected) {
+        t.Fatalf("expected chunks %v got %v", expected, fourCCs)
+    }
+
+    for i := range expected {
+        if fourCCs[i] != expected[i] {
+            t.Fatalf("expected chunks %v got %v", expected, fourCCs)
+        }
+    }
+
+    if flags := result[0].Payload()[0]; flags != vp8xAnimation | vp8xICC | vp8xEXIF {
+        t.Errorf("expected VP8X flags %08b got %08b", vp8xAnimation | vp8xICC | vp8xEXIF, flags)
+    }
+
+    if string(result[5].Payload()) != "unknown" {
+        t.Errorf("expected unknown chunk to be preserved got %q", result[5].Payload())
+    }
+}
+
+func TestAnimationEditorErrors(t *testing.T) {
+    still := &bytes.Buffer{}
+    Encode(still, generateTestImageNRGBA(4, 4, 64, false), &Options{UseExtendedFormat: true})
+
+    ani := generateTestAnimation(t, &Animation{
+        Images:     []image.Image{generateTestImageNRGBA(4, 4, 64, false)},
+        Durations:  []uint{100},
+        Disposals:  []uint{0},
+    })
+
+    chunks, _ := parseRIFF(ani)
+
+    withoutANIM := &bytes.Buffer{}
+    buf := &bytes.Buffer{}
+    writeChunk(buf, chunks[0].FourCC, chunks[0].Payload())
+    writeChunk(buf, chunks[2].FourCC, chunks[2].Payload())
+    writeRIFF(withoutANIM, buf)
+
+    shortFrame := &bytes.Buffer{}
+    buf = &bytes.Buffer{}
+    writeChunk(buf, chunks[0].FourCC, chunks[0].Payload())
+    writeChunk(buf, chunks[1].FourCC, chunks[1].Payload())
+    writeChunk(buf, "ANMF", chunks[2].Payload()[:15])
+    writeRIFF(shortFrame, buf)
+
+    for id, tt := range []struct {
+        input       []byte
+        expectedMsg string
+    }{
+        {
+            []byte("not a WebP file!"),
+            "invalid RIFF header",
+        },
+        {
+            still.Bytes(),
+            "not an animated WebP",
+        },
+        {
+            withoutANIM.Bytes(),
+            "missing ANIM chunk",
+        },
+        {
+            shortFrame.Bytes(),
+            "invalid ANMF chunk",
+        },
+    }{
+        _, err := NewAnimationEditor(bytes.NewReader(tt.input))
+        if err == nil || err.Error() != tt.expectedMsg {
+            t.Errorf("test %v: expected error %v got %v", id, tt.expectedMsg, err)
+        }
+    }
+
+    e, err := NewAnimationEditor(bytes.NewReader(ani))
+    if err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    e.Frames[0].Offset = image.Pt(1, 0)
+    if err := e.Encode(&bytes.Buffer{}); err == nil || err.Error() != "frame offsets must be even and positive" {
+        t.Errorf("expected error frame offsets must be even and positive got %v", err)
+    }
+
+    e.Frames[0].Offset = image.Pt(1 << 26, 0)
+    if err := e.Encode(&bytes.Buffer{}); err == nil || err.Error() != "frame exceeds the maximum canvas size" {
+        t.Errorf("expected error frame exceeds the maximum canvas size got %v", err)
+    }
+
+    e.Frames = nil
+    if err := e.Encode(&bytes.Buffer{}); err == nil || err.Error() != "must provide at least one image" {
+        t.Errorf("expected error must provide at least one image got %v", err)
+    }
+
+    if err := e.AppendFrame(nil, 0, 0, 0); err == nil || err.Error() != "image is nil" {
+        t.Errorf("expected error image is nil got %v", err)
+    }
+}
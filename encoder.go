@@ -0,0 +1,183 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "io"
+    "sync"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    "image/color"
+)
+
+// Encoder encodes WebP images with a fixed set of options and reuses its scratch memory between calls.
+//
+// The package level Encode and EncodeAll functions use an Encoder with the default pool, so an
+// Encoder only needs to be created to share a custom BufferPool.
+//
+// Fields:
+//   - Options: Encoding settings used for every image, may be nil for the defaults.
+//   - BufferPool: Optional pool for the scratch memory of the encoder. If nil, buffers are taken
+//     from a package level pool shared with Encode and EncodeAll.
+type Encoder struct {
+    Options     *Options
+    BufferPool  EncoderBufferPool
+}
+
+// EncoderBufferPool is an interface for getting and returning temporary instances of the
+// EncoderBuffer struct, like png.EncoderBufferPool. This can be used to reuse buffers when
+// encoding many images.
+//
+// Get may return nil, in which case a new EncoderBuffer is allocated. Buffers returned by Get
+// are used by a single encode at a time and are handed back through Put once it is done.
+type EncoderBufferPool interface {
+    Get() *EncoderBuffer
+    Put(*EncoderBuffer)
+}
+
+// EncoderBuffer holds the buffers used for encoding WebP images.
+type EncoderBuffer encodeBuffers
+
+// encodeBuffers holds the scratch memory of a single encode. Every buffer is resized with
+// resizeBuffer before use, so buffers from a larger image are reused by smaller ones.
+//
+// Fields:
+//   - pixels: The flattened pixels of the image.
+//   - row16, diffusion: A row of a 16-bit image and the error diffusion rows of reduceBitDepth.
+//   - head, prev: Hash chains of the backward reference search.
+//   - cache: Color cache of the backward reference search.
+//   - tokens: Token stream written by encodeImageData.
+//   - histos: Symbol histograms of the five prefix codes.
+//   - chunkHistos: Histograms of the token chunks counted in parallel, except the first.
+//   - deltas, residuals: Picked residuals and the residuals of every predictor mode for a row of tiles.
+type encodeBuffers struct {
+    pixels      []color.NRGBA
+    row16       [][4]uint32
+    diffusion   [2][][3]int32
+    head        []int32
+    prev        []int32
+    cache       []color.NRGBA
+    tokens      []uint32
+    histos      [5][]int
+    chunkHistos [][5][]int
+    deltas      []color.NRGBA
+    residuals   [14][]color.NRGBA
+}
+
+// syncBufferPool is an EncoderBufferPool backed by a sync.Pool.
+type syncBufferPool struct {
+    pool    sync.Pool
+}
+
+func (p *syncBufferPool) Get() *EncoderBuffer {
+    b, _ := p.pool.Get().(*EncoderBuffer)
+    return b
+}
+
+func (p *syncBufferPool) Put(b *EncoderBuffer) {
+    p.pool.Put(b)
+}
+
+var defaultBufferPool EncoderBufferPool = &syncBufferPool{}
+
+// Encode writes the image img to w in WebP format, see the package level Encode.
+//
+// Parameters:
+//   w   - The destination writer where the encoded WebP image will be written.
+//   img - The input image to be encoded.
+//
+// Returns:
+//   An error if encoding fails, or a *WriteError if writing to the io.Writer fails.
+func (e *Encoder) Encode(w io.Writer, img image.Image) error {
+    _, err := e.EncodeTo(w, img)
+    return err
+}
+
+// EncodeTo is Encode, also reporting the number of bytes written like io.WriterTo.
+//
+// Parameters:
+//   w   - The destination writer where the encoded WebP image will be written.
+//   img - The input image to be encoded.
+//
+// Returns:
+//   The number of bytes written to w, which is 0 if encoding fails and the bytes written before
+//   the failure if writing fails, and an error as returned by Encode.
+func (e *Encoder) EncodeTo(w io.Writer, img image.Image) (int64, error) {
+    b := getBuffers(e.BufferPool)
+    stream, hasAlpha, err := writeBitStream(img, e.Options, b)
+    putBuffers(e.BufferPool, b)
+
+    if err != nil {
+        return 0, err
+    }
+
+    m := &Mux{Extended: e.Options != nil && e.Options.UseExtendedFormat}
+    return m.write(w, img.Bounds(), hasAlpha, chunkHeader("VP8L", stream.Len()), stream.Bytes())
+}
+
+// EncodeAll writes the animation ani to w in WebP format, see the package level EncodeAll.
+// Every frame encoded in parallel takes its own buffer from the pool.
+//
+// Parameters:
+//   w   - The destination writer where the encoded WebP animation will be written.
+//   ani - Pointer to Animation containing the frames and animation settings.
+//
+// Returns:
+//   An error if encoding fails, or a *WriteError if writing to the io.Writer fails.
+func (e *Encoder) EncodeAll(w io.Writer, ani *Animation) error {
+    _, err := e.EncodeAllTo(w, ani)
+    return err
+}
+
+// EncodeAllTo is EncodeAll, also reporting the number of bytes written like io.WriterTo.
+//
+// Parameters:
+//   w   - The destination writer where the encoded WebP animation will be written.
+//   ani - Pointer to Animation containing the frames and animation settings.
+//
+// Returns:
+//   The number of bytes written to w, which is 0 if encoding fails and the bytes written before
+//   the failure if writing fails, and an error as returned by EncodeAll.
+func (e *Encoder) EncodeAllTo(w io.Writer, ani *Animation) (int64, error) {
+    frames, alpha, err := writeFrames(ani, e.Options, e.BufferPool)
+    if err != nil {
+        return 0, err
+    }
+
+    return writeAnimation(w, canvasBounds(ani.Images), alpha, ani.BackgroundColor, ani.LoopCount, frames)
+}
+
+// getBuffers takes scratch memory from pool, or from the default pool if pool is nil.
+func getBuffers(pool EncoderBufferPool) *encodeBuffers {
+    if pool == nil {
+        pool = defaultBufferPool
+    }
+
+    if b := pool.Get(); b != nil {
+        return (*encodeBuffers)(b)
+    }
+
+    return &encodeBuffers{}
+}
+
+// putBuffers returns scratch memory taken with getBuffers to its pool.
+func putBuffers(pool EncoderBufferPool, b *encodeBuffers) {
+    if pool == nil {
+        pool = defaultBufferPool
+    }
+
+    pool.Put((*EncoderBuffer)(b))
+}
+
+// resizeBuffer returns buf with length n, reallocating only if its capacity is too small.
+// The contents are not cleared.
+func resizeBuffer[T any](buf []T, n int) []T {
+    if cap(buf) < n {
+        return make([]T, n)
+    }
+
+    return buf[:n]
+}
@@ -0,0 +1,195 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "bytes"
+    "io"
+    "sync"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    //------------------------------
+    //errors
+    //------------------------------
+    "errors"
+    //------------------------------
+    //testing
+    //------------------------------
+    "testing"
+)
+
+// testBufferPool hands out a single buffer when possible and counts the calls to Get and Put.
+type testBufferPool struct {
+    mu      sync.Mutex
+    buffers []*EncoderBuffer
+    gets    int
+    puts    int
+    fresh   bool
+}
+
+func (p *testBufferPool) Get() *EncoderBuffer {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    p.gets++
+    if p.fresh || len(p.buffers) == 0 {
+        return nil
+    }
+
+    b := p.buffers[len(p.buffers) - 1]
+    p.buffers = p.buffers[:len(p.buffers) - 1]
+    return b
+}
+
+func (p *testBufferPool) Put(b *EncoderBuffer) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    p.puts++
+    p.buffers = append(p.buffers, b)
+}
+
+func TestEncoder(t *testing.T) {
+    pool := &testBufferPool{}
+    e := &Encoder{Options: &Options{UseExtendedFormat: true}, BufferPool: pool}
+
+    // buffers left behind by larger images and other image types must not leak into the next image
+    for id, img := range []image.Image{
+        generateTestImageNoise(130, 70, 1),
+        generateTestImageNRGBA(8, 8, 64, true),
+        generateTestImagePaletted(33, 21, 4),
+        generateTestImageNoise(31, 17, 2),
+        generateTestImageNRGBA(1, 1, 64, false),
+        generateTestImageNoise(130, 70, 1),
+    }{
+        expected := new(bytes.Buffer)
+        if err := (&Encoder{Options: e.Options, BufferPool: &testBufferPool{fresh: true}}).Encode(expected, img); err != nil {
+            t.Fatalf("test %v: unexpected error %v", id, err)
+        }
+
+        buf := new(bytes.Buffer)
+        if err := e.Encode(buf, img); err != nil {
+            t.Fatalf("test %v: unexpected error %v", id, err)
+        }
+
+        if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+            t.Errorf("test %v: output differs from an encode with new buffers", id)
+        }
+    }
+
+    if pool.gets != 6 || pool.puts != 6 || len(pool.buffers) != 1 {
+        t.Errorf("expected 6 gets and puts of 1 buffer got %v gets, %v puts and %v buffers", pool.gets, pool.puts, len(pool.buffers))
+    }
+
+    if err := e.Encode(new(bytes.Buffer), nil); err == nil {
+        t.Errorf("expected error for nil image")
+    }
+
+    if pool.gets != pool.puts {
+        t.Errorf("expected every buffer to be returned got %v gets and %v puts", pool.gets, pool.puts)
+    }
+}
+
+func TestEncoderEncodeAll(t *testing.T) {
+    ani := &Animation{
+        Images:     []image.Image{
+            generateTestImageNoise(40, 30, 3),
+            generateTestImageNRGBA(16, 16, 64, true),
+            generateTestImagePaletted(20, 10, 16),
+            generateTestImageNoise(40, 30, 4),
+            generateTestImageNRGBA(40, 30, 32, false),
+        },
+        Durations:  []uint{100, 100, 100, 100, 100},
+        Disposals:  []uint{0, 1, 0, 1, 0},
+    }
+
+    expected := new(bytes.Buffer)
+    if err := EncodeAll(expected, ani, &Options{Concurrency: 1}); err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    for _, concurrency := range []int{1, 2, 4} {
+        pool := &testBufferPool{}
+        e := &Encoder{Options: &Options{Concurrency: concurrency}, BufferPool: pool}
+
+        buf := new(bytes.Buffer)
+        if err := e.EncodeAll(buf, ani); err != nil {
+            t.Fatalf("concurrency %v: unexpected error %v", concurrency, err)
+        }
+
+        if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+            t.Errorf("concurrency %v: output differs from EncodeAll", concurrency)
+        }
+
+        // every worker takes one buffer and keeps it for all of its frames
+        if pool.gets != pool.puts || pool.gets < 1 || pool.gets > concurrency {
+            t.Errorf("concurrency %v: expected up to %v gets and puts got %v gets and %v puts", concurrency, concurrency, pool.gets, pool.puts)
+        }
+    }
+}
+
+func TestEncoderEncodeTo(t *testing.T) {
+    img := generateTestImageNoise(40, 30, 5)
+    ani := &Animation{
+        Images:     []image.Image{img, generateTestImageNRGBA(16, 16, 64, true)},
+        Durations:  []uint{100, 100},
+        Disposals:  []uint{0, 0},
+    }
+
+    e := &Encoder{Options: &Options{UseExtendedFormat: true}}
+    failure := errors.New("disk full")
+
+    for id, tt := range []struct {
+        name        string
+        encode      func(w io.Writer) (int64, error)
+        invalid     func(w io.Writer) (int64, error)
+    }{
+        {
+            name:       "EncodeTo",
+            encode:     func(w io.Writer) (int64, error) { return e.EncodeTo(w, img) },
+            invalid:    func(w io.Writer) (int64, error) { return e.EncodeTo(w, nil) },
+        },
+        {
+            name:       "EncodeAllTo",
+            encode:     func(w io.Writer) (int64, error) { return e.EncodeAllTo(w, ani) },
+            invalid:    func(w io.Writer) (int64, error) {
+                return e.EncodeAllTo(w, &Animation{Images: []image.Image{img, nil}, Durations: []uint{0, 0}, Disposals: []uint{0, 0}})
+            },
+        },
+    }{
+        buf := new(bytes.Buffer)
+        n, err := tt.encode(buf)
+        if err != nil {
+            t.Fatalf("test %v %v: unexpected error %v", id, tt.name, err)
+        }
+
+        if n != int64(buf.Len()) {
+            t.Errorf("test %v %v: expected %v bytes written got %v", id, tt.name, buf.Len(), n)
+        }
+
+        // a failing writer reports the bytes it accepted
+        for _, limit := range []int{0, 7, buf.Len() - 1} {
+            n, err := tt.encode(&limitedWriter{limit: limit, err: failure})
+
+            var writeErr *WriteError
+            if !errors.As(err, &writeErr) || !errors.Is(err, failure) {
+                t.Errorf("test %v %v: expected a WriteError wrapping %v got %v", id, tt.name, failure, err)
+                continue
+            }
+
+            if n != int64(limit) || writeErr.Written != n {
+                t.Errorf("test %v %v: expected %v bytes written got %v and %v", id, tt.name, limit, n, writeErr.Written)
+            }
+        }
+
+        // an image that cannot be encoded writes nothing
+        buf.Reset()
+        n, err = tt.invalid(buf)
+        if err == nil || n != 0 || buf.Len() != 0 {
+            t.Errorf("test %v %v: expected an error and nothing written got %v, %v bytes reported and %v written", id, tt.name, err, n, buf.Len())
+        }
+    }
+}
@@ -0,0 +1,467 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "io"
+    "sort"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    "image/draw"
+    "image/color"
+    "image/gif"
+    //------------------------------
+    //errors
+    //------------------------------
+    "errors"
+)
+
+// FromGIF converts a decoded GIF animation into an Animation that can be encoded with EncodeAll.
+//
+// GIF frame rectangles become frame offsets on the WebP canvas and GIF delays (in 10 ms units)
+// become Durations. WebP frames must start at even offsets and have no "restore to previous"
+// disposal, so every frame is built from the difference between what a WebP decoder will show
+// and what the GIF should show at that moment. GIF disposal to background is mapped onto the
+// WebP dispose flag where the frame rectangle allows it, and restoring to the previous frame is
+// emulated by redrawing the restored area in the following frame without blending.
+//
+// Frames with at most 256 colors are returned as *image.Paletted, so they are encoded with the
+// color indexing transform.
+//
+// Parameters:
+//   g - The decoded GIF, as returned by gif.DecodeAll.
+//
+// Returns:
+//   The converted Animation or an error if the GIF has no frames.
+func FromGIF(g *gif.GIF) (*Animation, error) {
+    if g == nil || len(g.Image) == 0 {
+        return nil, errors.New("must provide at least one image")
+    }
+
+    canvasRect := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+    if canvasRect.Empty() {
+        canvasRect = image.Rectangle{}
+        for _, frame := range g.Image {
+            canvasRect.Max.X = max(frame.Bounds().Max.X, canvasRect.Max.X)
+            canvasRect.Max.Y = max(frame.Bounds().Max.Y, canvasRect.Max.Y)
+        }
+    }
+
+    ani := &Animation{
+        LoopCount:          gifLoopCount(g.LoopCount),
+        BackgroundColor:    gifBackgroundColor(g),
+    }
+
+    // want holds the GIF canvas, have holds the canvas as a WebP decoder will see it.
+    want := image.NewNRGBA(canvasRect)
+    have := image.NewNRGBA(canvasRect)
+
+    for i, frame := range g.Image {
+        r := frame.Bounds().Intersect(canvasRect)
+
+        var disposal byte
+        if i < len(g.Disposal) {
+            disposal = g.Disposal[i]
+        }
+
+        var previous *image.NRGBA
+        if disposal == gif.DisposalPrevious {
+            previous = image.NewNRGBA(r)
+            draw.Draw(previous, r, want, r.Min, draw.Src)
+        }
+
+        draw.Draw(want, r, frame, r.Min, draw.Over)
+
+        rect := r.Union(diffBounds(have, want))
+        if i == 0 {
+            rect = canvasRect
+        }
+
+        if rect.Empty() {
+            rect = image.Rect(0, 0, 1, 1)
+        }
+
+        // WebP specs requires frame offsets to be even
+        rect.Min.X &^= 1
+        rect.Min.Y &^= 1
+
+        img, blend := diffFrame(have, want, rect)
+        compositeFrame(have, img, blend == 0)
+
+        var dispose uint
+        switch disposal {
+        case gif.DisposalBackground:
+            clearFrame(want, r)
+            if rect.Eq(r) {
+                clearFrame(have, r)
+                dispose = 1
+            }
+        case gif.DisposalPrevious:
+            draw.Draw(want, r, previous, r.Min, draw.Src)
+        }
+
+        var delay int
+        if i < len(g.Delay) {
+            delay = max(g.Delay[i], 0)
+        }
+
+        ani.Images = append(ani.Images, img)
+        ani.Durations = append(ani.Durations, uint(delay) * 10)
+        ani.Disposals = append(ani.Disposals, dispose)
+        ani.Blends = append(ani.Blends, blend)
+    }
+
+    return ani, nil
+}
+
+// EncodeGIF converts a decoded GIF animation with FromGIF and writes it to the specified
+// io.Writer as a WebP animation.
+//
+// Parameters:
+//   w - The destination writer where the encoded WebP animation will be written.
+//   g - The decoded GIF, as returned by gif.DecodeAll.
+//   o - Pointer to Options containing additional encoding settings, may be nil.
+//
+// Returns:
+//   An error if the conversion or encoding fails.
+func EncodeGIF(w io.Writer, g *gif.GIF, o *Options) error {
+    ani, err := FromGIF(g)
+    if err != nil {
+        return err
+    }
+
+    return EncodeAll(w, ani, o)
+}
+
+// ToGIF converts an Animation into a GIF animation, for clients that cannot display WebP.
+//
+// The frames are composited onto the canvas with the WebP dispose and blend semantics, and
+// every GIF frame holds the complete canvas at that moment. Each frame is quantized to at most
+// 255 colors with median cut; palette index 0 is reserved for transparent pixels, which are
+// all pixels with an alpha value below 128. Durations are rounded to the 10 ms units of GIF.
+//
+// Parameters:
+//   ani - Pointer to Animation containing the frames and animation settings.
+//
+// Returns:
+//   The converted GIF or an error if the animation is invalid.
+func ToGIF(ani *Animation) (*gif.GIF, error) {
+    if ani == nil {
+        return nil, errors.New("must provide at least one image")
+    }
+
+    if err := validateAnimation(ani); err != nil {
+        return nil, err
+    }
+
+    for _, img := range ani.Images {
+        if img == nil {
+            return nil, errors.New("image is nil")
+        }
+    }
+
+    canvasRect := canvasBounds(ani.Images)
+    canvas := image.NewNRGBA(canvasRect)
+
+    bg := color.NRGBA{
+        R: uint8(ani.BackgroundColor >> 16),
+        G: uint8(ani.BackgroundColor >> 8),
+        B: uint8(ani.BackgroundColor),
+        A: uint8(ani.BackgroundColor >> 24),
+    }
+
+    g := &gif.GIF{
+        LoopCount:          webpLoopCount(ani.LoopCount),
+        BackgroundIndex:    0,
+        Config:             image.Config{
+            ColorModel:     color.Palette{bg},
+            Width:          canvasRect.Dx(),
+            Height:         canvasRect.Dy(),
+        },
+    }
+
+    for i, img := range ani.Images {
+        blend := ani.Blends == nil || ani.Blends[i] == 0
+        compositeFrame(canvas, img, blend)
+
+        g.Image = append(g.Image, quantize(canvas))
+        g.Delay = append(g.Delay, int(min((ani.Durations[i] + 5) / 10, 1 << 16 - 1)))
+        g.Disposal = append(g.Disposal, gif.DisposalBackground)
+
+        if ani.Disposals[i] != 0 {
+            clearFrame(canvas, img.Bounds())
+        }
+    }
+
+    return g, nil
+}
+
+func gifLoopCount(n int) uint16 {
+    // GIF counts repetitions after the first playback and uses -1 for a single playback,
+    // while WebP counts the total number of playbacks with 0 meaning infinite.
+    if n < 0 {
+        return 1
+    }
+
+    if n == 0 {
+        return 0
+    }
+
+    return uint16(min(n + 1, 1 << 16 - 1))
+}
+
+func webpLoopCount(n uint16) int {
+    if n == 0 {
+        return 0
+    }
+
+    if n == 1 {
+        return -1
+    }
+
+    return int(n) - 1
+}
+
+func gifBackgroundColor(g *gif.GIF) uint32 {
+    pal, ok := g.Config.ColorModel.(color.Palette)
+    if !ok || int(g.BackgroundIndex) >= len(pal) {
+        return 0
+    }
+
+    c := color.NRGBAModel.Convert(pal[g.BackgroundIndex]).(color.NRGBA)
+    return uint32(c.A) << 24 | uint32(c.R) << 16 | uint32(c.G) << 8 | uint32(c.B)
+}
+
+// diffBounds returns the smallest rectangle containing all pixels that differ between a and b.
+func diffBounds(a, b *image.NRGBA) image.Rectangle {
+    var r image.Rectangle
+
+    bounds := a.Bounds()
+    for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+        for x := bounds.Min.X; x < bounds.Max.X; x++ {
+            i := a.PixOffset(x, y)
+            j := b.PixOffset(x, y)
+
+            if [4]uint8(a.Pix[i : i + 4]) != [4]uint8(b.Pix[j : j + 4]) {
+                r = r.Union(image.Rect(x, y, x + 1, y + 1))
+            }
+        }
+    }
+
+    return r
+}
+
+// diffFrame builds a frame covering rect that turns the canvas have into want. If every
+// changed pixel is opaque the frame is alpha-blended and unchanged pixels are left transparent,
+// otherwise the frame overwrites the canvas.
+func diffFrame(have, want *image.NRGBA, rect image.Rectangle) (image.Image, uint) {
+    var blend uint
+    for y := rect.Min.Y; y < rect.Max.Y && blend == 0; y++ {
+        for x := rect.Min.X; x < rect.Max.X; x++ {
+            if have.NRGBAAt(x, y) != want.NRGBAAt(x, y) && want.NRGBAAt(x, y).A != 255 {
+                blend = 1
+                break
+            }
+        }
+    }
+
+    frame := image.NewNRGBA(rect)
+    for y := rect.Min.Y; y < rect.Max.Y; y++ {
+        for x := rect.Min.X; x < rect.Max.X; x++ {
+            c := want.NRGBAAt(x, y)
+            if blend == 0 && have.NRGBAAt(x, y) == c {
+                c = color.NRGBA{}
+            }
+
+            frame.SetNRGBA(x, y, c)
+        }
+    }
+
+    return toPaletted(frame), blend
+}
+
+// toPaletted returns img as an *image.Paletted if it holds at most 256 colors.
+func toPaletted(img *image.NRGBA) image.Image {
+    var pal color.Palette
+    index := make(map[color.NRGBA]uint8)
+
+    bounds := img.Bounds()
+    pix := make([]uint8, 0, bounds.Dx() * bounds.Dy())
+    for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+        for x := bounds.Min.X; x < bounds.Max.X; x++ {
+            c := img.NRGBAAt(x, y)
+
+            idx, ok := index[c]
+            if !ok {
+                if len(pal) == 256 {
+                    return img
+                }
+
+                idx = uint8(len(pal))
+                index[c] = idx
+                pal = append(pal, c)
+            }
+
+            pix = append(pix, idx)
+        }
+    }
+
+    return &image.Paletted{
+        Pix:        pix,
+        Stride:     bounds.Dx(),
+        Rect:       bounds,
+        Palette:    pal,
+    }
+}
+
+// quantize converts img to a paletted image with a transparent color at index 0 and
+// at most 255 other colors chosen with median cut.
+func quantize(img *image.NRGBA) *image.Paletted {
+    counts := make(map[color.NRGBA]int)
+
+    bounds := img.Bounds()
+    for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+        for x := bounds.Min.X; x < bounds.Max.X; x++ {
+            c := img.NRGBAAt(x, y)
+            if c.A >= 128 {
+                counts[color.NRGBA{c.R, c.G, c.B, 255}]++
+            }
+        }
+    }
+
+    colors := make([]colorCount, 0, len(counts))
+    for c, n := range counts {
+        colors = append(colors, colorCount{c, n})
+    }
+
+    // sort for a deterministic palette, map iteration order is random
+    sort.Slice(colors, func(i, j int) bool {
+        a, b := colors[i].c, colors[j].c
+        return uint32(a.R) << 16 | uint32(a.G) << 8 | uint32(a.B) < uint32(b.R) << 16 | uint32(b.G) << 8 | uint32(b.B)
+    })
+
+    pal := color.Palette{color.NRGBA{}}
+    for _, box := range medianCut(colors, 255) {
+        pal = append(pal, box.average())
+    }
+
+    dst := image.NewPaletted(bounds, pal)
+    lookup := make(map[color.NRGBA]uint8)
+    for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+        for x := bounds.Min.X; x < bounds.Max.X; x++ {
+            c := img.NRGBAAt(x, y)
+            if c.A < 128 {
+                continue
+            }
+
+            c.A = 255
+            idx, ok := lookup[c]
+            if !ok {
+                // skip the reserved transparent entry when searching the closest color
+                idx = uint8(pal[1:].Index(c) + 1)
+                lookup[c] = idx
+            }
+
+            dst.SetColorIndex(x, y, idx)
+        }
+    }
+
+    return dst
+}
+
+type colorCount struct {
+    c   color.NRGBA
+    n   int
+}
+
+type colorBox []colorCount
+
+func (b colorBox) channel(c color.NRGBA, ch int) uint8 {
+    return [3]uint8{c.R, c.G, c.B}[ch]
+}
+
+// widest returns the channel with the largest range of values in the box and that range.
+func (b colorBox) widest() (int, int) {
+    lo := [3]uint8{255, 255, 255}
+    hi := [3]uint8{0, 0, 0}
+    for _, cc := range b {
+        for ch := 0; ch < 3; ch++ {
+            lo[ch] = min(lo[ch], b.channel(cc.c, ch))
+            hi[ch] = max(hi[ch], b.channel(cc.c, ch))
+        }
+    }
+
+    best := 0
+    for ch := 1; ch < 3; ch++ {
+        if int(hi[ch]) - int(lo[ch]) > int(hi[best]) - int(lo[best]) {
+            best = ch
+        }
+    }
+
+    return best, int(hi[best]) - int(lo[best])
+}
+
+func (b colorBox) average() color.NRGBA {
+    var r, g, bl, n int
+    for _, cc := range b {
+        r += int(cc.c.R) * cc.n
+        g += int(cc.c.G) * cc.n
+        bl += int(cc.c.B) * cc.n
+        n += cc.n
+    }
+
+    return color.NRGBA{uint8(r / n), uint8(g / n), uint8(bl / n), 255}
+}
+
+// medianCut splits the colors into at most maxBoxes boxes, each time splitting the box with
+// the widest channel range at the weighted median of that channel.
+func medianCut(colors []colorCount, maxBoxes int) []colorBox {
+    if len(colors) == 0 {
+        return nil
+    }
+
+    boxes := []colorBox{colorBox(colors)}
+    for len(boxes) < maxBoxes {
+        split := -1
+        var splitRange int
+        for i, box := range boxes {
+            if len(box) < 2 {
+                continue
+            }
+
+            if _, r := box.widest(); r > splitRange {
+                split = i
+                splitRange = r
+            }
+        }
+
+        if split < 0 {
+            break
+        }
+
+        box := boxes[split]
+        ch, _ := box.widest()
+        sort.SliceStable(box, func(i, j int) bool {
+            return box.channel(box[i].c, ch) < box.channel(box[j].c, ch)
+        })
+
+        total := 0
+        for _, cc := range box {
+            total += cc.n
+        }
+
+        mid, sum := 1, box[0].n
+        for mid < len(box) - 1 && sum * 2 < total {
+            sum += box[mid].n
+            mid++
+        }
+
+        boxes[split] = box[:mid]
+        boxes = append(boxes, box[mid:])
+    }
+
+    return boxes
+}
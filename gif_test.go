@@ -0,0 +1,335 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "bytes"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    "image/draw"
+    "image/color"
+    "image/gif"
+    //------------------------------
+    //testing
+    //------------------------------
+    "testing"
+)
+
+func generateTestGIF() *gif.GIF {
+    pal := color.Palette{
+        color.RGBA{0, 0, 0, 0},
+        color.RGBA{255, 0, 0, 255},
+        color.RGBA{0, 255, 0, 255},
+        color.RGBA{0, 0, 255, 255},
+    }
+
+    newFrame := func(r image.Rectangle, idx uint8) *image.Paletted {
+        img := image.NewPaletted(r, pal)
+        for i := range img.Pix {
+            img.Pix[i] = idx
+            if i % 3 == 0 {
+                img.Pix[i] = 0
+            }
+        }
+        return img
+    }
+
+    base := image.NewPaletted(image.Rect(0, 0, 10, 8), pal)
+    for i := range base.Pix {
+        base.Pix[i] = uint8(1 + i % 3)
+    }
+
+    return &gif.GIF{
+        Image: []*image.Paletted{
+            base,
+            newFrame(image.Rect(2, 2, 6, 6), 2),     // disposed to background
+            newFrame(image.Rect(3, 1, 7, 5), 3),     // odd offset, restored to previous
+            newFrame(image.Rect(5, 3, 9, 7), 1),
+            newFrame(image.Rect(0, 0, 2, 2), 2),     // restored to previous on the last frame
+        },
+        Delay:      []int{10, 20, 5, 0, 7},
+        Disposal:   []byte{
+            gif.DisposalNone,
+            gif.DisposalBackground,
+            gif.DisposalPrevious,
+            gif.DisposalBackground,
+            gif.DisposalPrevious,
+        },
+        LoopCount:          0,
+        BackgroundIndex:    2,
+        Config:             image.Config{
+            ColorModel:     pal,
+            Width:          10,
+            Height:         8,
+        },
+    }
+}
+
+func TestFromGIF(t *testing.T) {
+    g := generateTestGIF()
+
+    ani, err := FromGIF(g)
+    if err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    if len(ani.Images) != len(g.Image) {
+        t.Fatalf("expected %v frames got %v", len(g.Image), len(ani.Images))
+    }
+
+    expectedDurations := []uint{100, 200, 50, 0, 70}
+    for i, d := range expectedDurations {
+        if ani.Durations[i] != d {
+            t.Errorf("frame %v: expected duration %v got %v", i, d, ani.Durations[i])
+        }
+    }
+
+    if ani.BackgroundColor != 0xff00ff00 {
+        t.Errorf("expected background color %08x got %08x", 0xff00ff00, ani.BackgroundColor)
+    }
+
+    if !ani.Images[0].Bounds().Eq(image.Rect(0, 0, 10, 8)) {
+        t.Errorf("expected first frame to cover the canvas got %v", ani.Images[0].Bounds())
+    }
+
+    expectedDisposals := []uint{0, 1, 0, 0, 0}
+    expectedBlends := []uint{0, 0, 0, 1, 1}
+    for i := range expectedDisposals {
+        if ani.Disposals[i] != expectedDisposals[i] || ani.Blends[i] != expectedBlends[i] {
+            t.Errorf("frame %v: expected dispose %v and blend %v got %v and %v", i,
+                expectedDisposals[i], expectedBlends[i], ani.Disposals[i], ani.Blends[i])
+        }
+    }
+
+    // play both animations side by side and compare the canvas after every frame
+    want := image.NewNRGBA(image.Rect(0, 0, 10, 8))
+    have := image.NewNRGBA(image.Rect(0, 0, 10, 8))
+    for i, frame := range g.Image {
+        img := ani.Images[i]
+        if img.Bounds().Min.X % 2 != 0 || img.Bounds().Min.Y % 2 != 0 {
+            t.Errorf("frame %v: expected even offsets got %v", i, img.Bounds().Min)
+        }
+
+        if _, ok := img.(*image.Paletted); !ok {
+            t.Errorf("frame %v: expected *image.Paletted got %T", i, img)
+        }
+
+        var previous *image.NRGBA
+        if g.Disposal[i] == gif.DisposalPrevious {
+            previous = image.NewNRGBA(want.Bounds())
+            copy(previous.Pix, want.Pix)
+        }
+
+        draw.Draw(want, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+        compositeFrame(have, img, ani.Blends[i] == 0)
+
+        if !bytes.Equal(want.Pix, have.Pix) {
+            t.Errorf("frame %v: canvas mismatch expected %v got %v", i, want.Pix, have.Pix)
+        }
+
+        switch g.Disposal[i] {
+        case gif.DisposalBackground:
+            clearFrame(want, frame.Bounds())
+        case gif.DisposalPrevious:
+            want = previous
+        }
+
+        if ani.Disposals[i] == 1 {
+            clearFrame(have, img.Bounds())
+        }
+    }
+}
+
+func TestFromGIFLoopCount(t *testing.T) {
+    for id, tt := range []struct {
+        loopCount   int
+        expected    uint16
+    }{
+        {0, 0},
+        {-1, 1},
+        {1, 2},
+        {1 << 16, 1 << 16 - 1},
+    }{
+        g := generateTestGIF()
+        g.LoopCount = tt.loopCount
+
+        ani, err := FromGIF(g)
+        if err != nil {
+            t.Errorf("test %v: unexpected error %v", id, err)
+            continue
+        }
+
+        if ani.LoopCount != tt.expected {
+            t.Errorf("test %v: expected loop count %v got %v", id, tt.expected, ani.LoopCount)
+        }
+    }
+}
+
+func TestFromGIFErrors(t *testing.T) {
+    for id, g := range []*gif.GIF{
+        nil,
+        &gif.GIF{},
+    }{
+        _, err := FromGIF(g)
+        if err == nil || err.Error() != "must provide at least one image" {
+            t.Errorf("test %v: expected error must provide at least one image got %v", id, err)
+        }
+    }
+}
+
+func TestEncodeGIF(t *testing.T) {
+    b := &bytes.Buffer{}
+    if err := EncodeGIF(b, generateTestGIF(), nil); err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    if string(b.Bytes()[0:4]) != "RIFF" || string(b.Bytes()[8:16]) != "WEBPVP8X" {
+        t.Errorf("expected WebP animation header got %v", b.Bytes()[:16])
+    }
+
+    if err := EncodeGIF(b, &gif.GIF{}, nil); err == nil {
+        t.Errorf("expected error got nil")
+    }
+}
+
+func TestToGIF(t *testing.T) {
+    frame1 := generateTestImageNRGBA(8, 8, 16, false)
+    frame2 := image.NewNRGBA(image.Rect(2, 2, 6, 6))
+    for i := range frame2.Pix {
+        frame2.Pix[i] = uint8(i * 16)
+    }
+
+    ani := &Animation{
+        Images:             []image.Image{frame1, frame2, frame1},
+        Durations:          []uint{100, 34, 5},
+        Disposals:          []uint{0, 1, 0},
+        Blends:             []uint{0, 1, 0},
+        LoopCount:          3,
+        BackgroundColor:    0x80ff0000,
+    }
+
+    g, err := ToGIF(ani)
+    if err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    if g.LoopCount != 2 {
+        t.Errorf("expected loop count 2 got %v", g.LoopCount)
+    }
+
+    if g.Config.Width != 8 || g.Config.Height != 8 {
+        t.Errorf("expected canvas 8x8 got %vx%v", g.Config.Width, g.Config.Height)
+    }
+
+    bg := g.Config.ColorModel.(color.Palette)[g.BackgroundIndex]
+    if bg != (color.NRGBA{255, 0, 0, 128}) {
+        t.Errorf("expected background color %v got %v", color.NRGBA{255, 0, 0, 128}, bg)
+    }
+
+    expectedDelays := []int{10, 3, 1}
+    for i, d := range expectedDelays {
+        if g.Delay[i] != d {
+            t.Errorf("frame %v: expected delay %v got %v", i, d, g.Delay[i])
+        }
+    }
+
+    canvas := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+    for i, img := range ani.Images {
+        compositeFrame(canvas, img, ani.Blends[i] == 0)
+
+        frame := g.Image[i]
+        if frame.Palette[0] != (color.NRGBA{}) {
+            t.Errorf("frame %v: expected transparent color at index 0 got %v", i, frame.Palette[0])
+        }
+
+        for y := 0; y < 8; y++ {
+            for x := 0; x < 8; x++ {
+                c := canvas.NRGBAAt(x, y)
+                if c.A < 128 {
+                    c = color.NRGBA{}
+                } else {
+                    c.A = 255
+                }
+
+                if frame.At(x, y) != c {
+                    t.Errorf("frame %v: pixel %v,%v expected %v got %v", i, x, y, c, frame.At(x, y))
+                }
+            }
+        }
+
+        if ani.Disposals[i] == 1 {
+            clearFrame(canvas, img.Bounds())
+        }
+    }
+
+    // the result must be accepted by the standard library GIF encoder
+    b := &bytes.Buffer{}
+    if err := gif.EncodeAll(b, g); err != nil {
+        t.Errorf("gif.EncodeAll: unexpected error %v", err)
+    }
+}
+
+func TestToGIFErrors(t *testing.T) {
+    for id, tt := range []struct {
+        ani             *Animation
+        expectedMsg     string
+    }{
+        {
+            nil,
+            "must provide at least one image",
+        },
+        {
+            &Animation{},
+            "must provide at least one image",
+        },
+        {
+            &Animation{
+                Images:     []image.Image{nil},
+                Durations:  []uint{0},
+                Disposals:  []uint{0},
+            },
+            "image is nil",
+        },
+    }{
+        _, err := ToGIF(tt.ani)
+        if err == nil || err.Error() != tt.expectedMsg {
+            t.Errorf("test %v: expected error %v got %v", id, tt.expectedMsg, err)
+        }
+    }
+}
+
+func TestQuantize(t *testing.T) {
+    img := image.NewNRGBA(image.Rect(0, 0, 64, 32))
+    for y := 0; y < 32; y++ {
+        for x := 0; x < 64; x++ {
+            img.SetNRGBA(x, y, color.NRGBA{uint8(x * 4), uint8(y * 8), uint8(x ^ y), uint8(x * 8)})
+        }
+    }
+
+    result := quantize(img)
+
+    if len(result.Palette) > 256 {
+        t.Fatalf("expected at most 256 colors got %v", len(result.Palette))
+    }
+
+    if result.Palette[0] != (color.NRGBA{}) {
+        t.Errorf("expected transparent color at index 0 got %v", result.Palette[0])
+    }
+
+    for y := 0; y < 32; y++ {
+        for x := 0; x < 64; x++ {
+            idx := result.ColorIndexAt(x, y)
+            if (img.NRGBAAt(x, y).A < 128) != (idx == 0) {
+                t.Errorf("pixel %v,%v: unexpected transparency for index %v", x, y, idx)
+            }
+        }
+    }
+
+    // quantizing must be deterministic
+    if !bytes.Equal(result.Pix, quantize(img).Pix) {
+        t.Errorf("expected identical results for identical input")
+    }
+}
@@ -4,133 +4,142 @@ import (
     //------------------------------
     //general
     //------------------------------
-    "container/heap"
+    "math/bits"
     "sort"
 )
 
+// huffmanCode is the code of a single symbol.
+//
+// Fields:
+//   - Symbol: The symbol the code belongs to.
+//   - Bits: The code in bitstream order. Canonical codes are read most significant bit first from
+//     the least significant bit first stream, so buildhuffmanCodes stores them reversed once per table.
+//   - Depth: The code length in bits, 0 for unused symbols and -1 if the symbol is the only one.
 type huffmanCode struct {
     Symbol  int
     Bits    int
     Depth   int
 }
 
-type node struct {
-    IsBranch    bool
-    Weight      int
-    Symbol      int
-    BranchLeft  *node
-    BranchRight *node
-}
+// buildhuffmanCodes returns the canonical Huffman codes for the symbols of histo, with code
+// lengths of at most maxDepth bits, see huffmanDepths.
+func buildhuffmanCodes(histo []int, maxDepth int) []huffmanCode {
+    codes := make([]huffmanCode, len(histo))
 
-type nodeHeap []*node
-func (h nodeHeap) Len() int             { return len(h) }
-func (h nodeHeap) Less(i, j int) bool   { return h[i].Weight < h[j].Weight }
-func (h nodeHeap) Swap(i, j int)        { h[i], h[j] = h[j], h[i] }
-func (h *nodeHeap) Push(x interface{})  { *h = append(*h, x.(*node)) }
-func (h *nodeHeap) Pop() interface{} {
-    old := *h
-    n := len(old)
-    x := old[n-1]
-    *h = old[0 : n-1]
-    return x
-}
+    depths := huffmanDepths(histo, maxDepth)
+    if depths == nil {
+        // a single symbol, or none at all, is coded with 0 bits
+        symbol := 0
+        for s, w := range histo {
+            if w > 0 {
+                symbol = s
+            }
+        }
 
-func buildHuffmanTree(histo []int, maxDepth int) *node {
-    sum := 0
-    for _, x := range histo {
-        sum += x
+        codes[symbol] = huffmanCode{symbol, 0, -1}
+        return codes
     }
 
-    minWeight := sum >> (maxDepth - 2)
-
-    nHeap := &nodeHeap{}
-    heap.Init(nHeap)
+    // canonical codes are assigned in order of depth and then symbol
+    var counts [16]int
+    for _, d := range depths {
+        counts[d]++
+    }
+    counts[0] = 0
 
-    for s, w := range histo {
-        if w > 0 {
-            if w < minWeight {
-                w = minWeight
-            }
+    var next [16]int
+    for d := 1; d < len(next); d++ {
+        next[d] = (next[d - 1] + counts[d - 1]) << 1
+    }
 
-            heap.Push(nHeap, &node{
-                Weight: w, 
-                Symbol: s,
-            })
+    for s, d := range depths {
+        if d > 0 {
+            codes[s] = huffmanCode{s, reverseBits(next[d], d), d}
+            next[d]++
         }
     }
-    
-    for nHeap.Len() < 1 {
-        heap.Push(nHeap, &node{
-            Weight: minWeight, 
-            Symbol: 0,
-        })
-    }
-    
-    for nHeap.Len() > 1 {
-        n1 := heap.Pop(nHeap).(*node)
-        n2 := heap.Pop(nHeap).(*node)
-        heap.Push(nHeap, &node{
-            IsBranch: true, 
-            Weight: n1.Weight + n2.Weight, 
-            BranchLeft: n1, 
-            BranchRight: n2,
-        })
-    }
-
-    return heap.Pop(nHeap).(*node)
-}
 
-func buildhuffmanCodes(histo []int, maxDepth int) []huffmanCode {
-    codes := make([]huffmanCode, len(histo))
+    return codes
+}
 
-    tree := buildHuffmanTree(histo, maxDepth)
-    if !tree.IsBranch {
-        codes[tree.Symbol] = huffmanCode{tree.Symbol, 0, -1}
-        return codes
+// huffmanDepths returns the code length of every symbol of histo, or nil if fewer than two symbols
+// are used. The lengths are optimal among all codes of at most maxDepth bits, which must be below
+// 16 and allow for all used symbols.
+//
+// The lengths are found with the package-merge algorithm: every used symbol is a coin with its
+// count as value on each of the maxDepth levels. Starting at the deepest level the cheapest coins
+// are paired into packages, which are merged into the coins of the level above, and the cheapest
+// 2n - 2 items of the top level are taken. The code length of a symbol is the number of levels on
+// which its coin ends up in the selection.
+func huffmanDepths(histo []int, maxDepth int) []int {
+    leaves := make([]int, 0, len(histo))
+    for s, w := range histo {
+        if w > 0 {
+            leaves = append(leaves, s)
+        }
     }
-    
-    var symbols []huffmanCode
-    setBitDepths(tree, &symbols, 0)
 
-    sort.Slice(symbols, func(i, j int) bool {
-        if symbols[i].Depth == symbols[j].Depth {
-            return symbols[i].Symbol < symbols[j].Symbol
-        }
+    n := len(leaves)
+    if n < 2 {
+        return nil
+    }
 
-        return symbols[i].Depth < symbols[j].Depth
+    sort.SliceStable(leaves, func(i, j int) bool {
+        return histo[leaves[i]] < histo[leaves[j]]
     })
 
-    bits := 0
-    prevDepth := 0
-    for _, sym := range symbols {
-        bits <<= (sym.Depth - prevDepth)
-        codes[sym.Symbol].Symbol = sym.Symbol
-        codes[sym.Symbol].Bits = bits
-        codes[sym.Symbol].Depth = sym.Depth
-        bits++
+    // isPackage records the order of the merged items of every level, the weights are only needed
+    // for the level below the one being built
+    size := 2 * n - 2
+    isPackage := make([][]bool, maxDepth)
+    weights := make([]int, 0, size)
+    merged := make([]int, 0, size)
+
+    for l := 0; l < maxDepth; l++ {
+        isPackage[l] = make([]bool, 0, size)
+
+        i, p := 0, 0
+        for len(merged) < size && (i < n || 2 * p + 1 < len(weights)) {
+            // on equal weights the coin is taken before the package
+            if 2 * p + 1 >= len(weights) || (i < n && histo[leaves[i]] <= weights[2 * p] + weights[2 * p + 1]) {
+                merged = append(merged, histo[leaves[i]])
+                isPackage[l] = append(isPackage[l], false)
+                i++
+            } else {
+                merged = append(merged, weights[2 * p] + weights[2 * p + 1])
+                isPackage[l] = append(isPackage[l], true)
+                p++
+            }
+        }
 
-        prevDepth = sym.Depth
+        weights, merged = merged, weights[:0]
     }
 
-    return codes
-}
-
-func setBitDepths(node *node, codes *[]huffmanCode, level int) {
-    if node == nil {
-        return
-    }
+    // walk down from the selection of the top level, the coins selected on a level are always
+    // the cheapest ones and each selected package selects two items of the level below
+    depths := make([]int, len(histo))
+    k := size
+    for l := maxDepth - 1; l >= 0 && k > 0; l-- {
+        packages := 0
+        for _, b := range isPackage[l][:k] {
+            if b {
+                packages++
+            }
+        }
 
-    if !node.IsBranch {
-        *codes = append(*codes, huffmanCode{
-            Symbol: node.Symbol,
-            Depth: level,
-        })
+        for _, s := range leaves[:k - packages] {
+            depths[s]++
+        }
 
-        return
+        k = 2 * packages
     }
 
-    setBitDepths(node.BranchLeft, codes, level + 1)
-    setBitDepths(node.BranchRight, codes, level + 1)
+    return depths
+}
+
+// reverseBits returns the lowest n bits of v in reverse order.
+func reverseBits(v, n int) int {
+    return int(bits.Reverse64(uint64(v)) >> (64 - n))
 }
 
 func writehuffmanCodes(w *bitWriter, codes []huffmanCode) {
@@ -176,7 +185,7 @@ func writehuffmanCodes(w *bitWriter, codes []huffmanCode) {
 func writeFullhuffmanCode(w *bitWriter, codes []huffmanCode) {
     histo := make([]int, 19)
     for _, c := range codes {
-        histo[c.Depth]++
+        histo[codeLength(c)]++
     }
 
     // lengthCodeOrder comes directly from the WebP specs!
@@ -196,12 +205,22 @@ func writeFullhuffmanCode(w *bitWriter, codes []huffmanCode) {
 
     lengths := buildhuffmanCodes(histo, 7)
     for i := 0; i < cnt; i++ {
-        w.writeBits(uint64(lengths[lengthCodeOrder[i]].Depth), 3)
+        w.writeBits(uint64(codeLength(lengths[lengthCodeOrder[i]])), 3)
     }
 
     w.writeBits(0, 1)
 
     for _, c := range codes {
-        w.writeCode(lengths[c.Depth])
+        w.writeCode(lengths[codeLength(c)])
     }
+}
+
+// codeLength returns the code length written for c. The only symbol of a code is coded with 0 bits
+// but must still be written with a non zero length, so it is given length 1.
+func codeLength(c huffmanCode) int {
+    if c.Depth < 0 {
+        return 1
+    }
+
+    return c.Depth
 }
\ No newline at end of file
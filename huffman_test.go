@@ -5,113 +5,200 @@ import (
     //general
     //------------------------------
     "bytes"
+    "reflect"
+    "sort"
+    "math/rand"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    decoderWebP "golang.org/x/image/webp"
     //------------------------------
     //testing
     //------------------------------
     "testing"
 )
 
-func TestBuildHuffmanTree(t *testing.T) {
+// kraftSum returns the sum of 2^(maxDepth - depth) over all used symbols, which is 2^maxDepth for
+// a complete code.
+func kraftSum(depths []int, maxDepth int) int {
+    sum := 0
+    for _, d := range depths {
+        if d > 0 {
+            sum += 1 << (maxDepth - d)
+        }
+    }
+
+    return sum
+}
+
+func TestHuffmanDepths(t *testing.T) {
     for id, tt := range []struct {
-        histo        []int
-        maxDepth    int
-        expectedTree *node // Expected structure of the Huffman tree
+        histo           []int
+        maxDepth        int
+        expectedDepths  []int
     }{
-        // Simple case with 2 symbols
+        {   // fewer than two symbols
+            histo:          []int{0, 10, 0},
+            maxDepth:       15,
+            expectedDepths: nil,
+        },
         {
-            histo:     []int{5, 10},
-            maxDepth: 4,
-            expectedTree: &node{
-                IsBranch: true,
-                Weight:   15,
-                BranchLeft: &node{
-                    IsBranch: false,
-                    Weight:   5,
-                    Symbol:   0,
-                },
-                BranchRight: &node{
-                    IsBranch: false,
-                    Weight:   10,
-                    Symbol:   1,
-                },
-            },
+            histo:          []int{},
+            maxDepth:       15,
+            expectedDepths: nil,
         },
-        // Histogram with more symbols
         {
-            histo:     []int{5, 9, 12, 13},
-            maxDepth: 5,
-            expectedTree: &node{
-                IsBranch: true,
-                Weight:   39,
-                BranchLeft: &node{
-                    IsBranch: true,
-                    Weight:   14,
-                    BranchLeft: &node{
-                        IsBranch: false,
-                        Weight:   5,
-                        Symbol:   0,
-                    },
-                    BranchRight: &node{
-                        IsBranch: false,
-                        Weight:   9,
-                        Symbol:   1,
-                    },
-                },
-                BranchRight: &node{
-                    IsBranch: true,
-                    Weight:   25,
-                    BranchLeft: &node{
-                        IsBranch: false,
-                        Weight:   12,
-                        Symbol:   2,
-                    },
-                    BranchRight: &node{
-                        IsBranch: false,
-                        Weight:   13,
-                        Symbol:   3,
-                    },
-                },
-            },
+            histo:          []int{5, 10},
+            maxDepth:       4,
+            expectedDepths: []int{1, 1},
         },
-        // Test case that triggers the for nHeap.Len() < 1 loop
         {
-            histo:     []int{}, // Empty histogram
-            maxDepth: 4,
-            expectedTree: &node{
-                IsBranch: false,
-                Weight:   0,
-                Symbol:   0,
-            },
+            histo:          []int{5, 9, 12, 13},
+            maxDepth:       5,
+            expectedDepths: []int{2, 2, 2, 2},
+        },
+        {   // unused symbols get no code
+            histo:          []int{5, 0, 9, 12, 0, 13, 1},
+            maxDepth:       15,
+            expectedDepths: []int{3, 0, 2, 2, 0, 2, 3},
+        },
+        {   // an unlimited Huffman code would be 1, 2, 3, 4, 5, 5 bits long
+            histo:          []int{16, 8, 4, 2, 1, 1},
+            maxDepth:       15,
+            expectedDepths: []int{1, 2, 3, 4, 5, 5},
         },
-        // Test case with all zero weights
         {
-            histo:     []int{0, 0, 0},
-            maxDepth: 4,
-            expectedTree: &node{
-                IsBranch: false,
-                Weight:   0,
-                Symbol:   0,
-            },
+            histo:          []int{16, 8, 4, 2, 1, 1},
+            maxDepth:       4,
+            expectedDepths: []int{1, 2, 4, 4, 4, 4},
+        },
+        {
+            histo:          []int{16, 8, 4, 2, 1, 1},
+            maxDepth:       3,
+            expectedDepths: []int{2, 2, 3, 3, 3, 3},
         },
+        {   // as many symbols as the limit allows
+            histo:          []int{100, 1, 1, 1},
+            maxDepth:       2,
+            expectedDepths: []int{2, 2, 2, 2},
+        },
+    } {
+        depths := huffmanDepths(tt.histo, tt.maxDepth)
+        if !reflect.DeepEqual(depths, tt.expectedDepths) {
+            t.Errorf("test %v: expected depths %v got %v", id, tt.expectedDepths, depths)
+        }
+    }
+}
+
+func TestHuffmanDepthsLimit(t *testing.T) {
+    // Fibonacci counts give the deepest possible Huffman tree
+    fib := []int{1, 1}
+    for len(fib) < 40 {
+        fib = append(fib, fib[len(fib) - 1] + fib[len(fib) - 2])
+    }
+
+    rnd := rand.New(rand.NewSource(1))
+    skewed := make([]int, 280)
+    for i := range skewed {
+        skewed[i] = rnd.Intn(1 << uint(rnd.Intn(24))) 
+    }
+
+    for id, tt := range []struct {
+        histo       []int
+        maxDepth    int
+    }{
+        {histo: fib, maxDepth: 15},
+        {histo: fib[:19], maxDepth: 7},
+        {histo: fib[:16], maxDepth: 15},
+        {histo: skewed, maxDepth: 15},
+        {histo: skewed[:19], maxDepth: 7},
     } {
-        resultTree := buildHuffmanTree(tt.histo, tt.maxDepth)
+        depths := huffmanDepths(tt.histo, tt.maxDepth)
+
+        for s, d := range depths {
+            if d > tt.maxDepth || (d == 0) != (tt.histo[s] == 0) {
+                t.Errorf("test %v: invalid depth %v for symbol %v with count %v", id, d, s, tt.histo[s])
+            }
+        }
+
+        if sum := kraftSum(depths, tt.maxDepth); sum != 1 << tt.maxDepth {
+            t.Errorf("test %v: expected a complete code got Kraft sum %v of %v", id, sum, 1 << tt.maxDepth)
+        }
+    }
+}
+
+func TestHuffmanDepthsOptimal(t *testing.T) {
+    cost := func(histo, depths []int) int {
+        c := 0
+        for s, d := range depths {
+            c += histo[s] * d
+        }
+
+        return c
+    }
 
-        var compareTrees func(a, b *node) bool
-        compareTrees = func(a, b *node) bool {
-            if a == nil && b == nil {
-                return true
+    // without a binding limit the cost equals that of a Huffman code, which is the sum of the
+    // weights of all merged nodes
+    rnd := rand.New(rand.NewSource(2))
+    for id := 0; id < 20; id++ {
+        histo := make([]int, 2 + rnd.Intn(40))
+        for i := range histo {
+            histo[i] = rnd.Intn(100)
+        }
+        histo[0]++
+        histo[1]++
+
+        var weights []int
+        for _, w := range histo {
+            if w > 0 {
+                weights = append(weights, w)
             }
-            if a == nil || b == nil {
-                return false
+        }
+
+        expected := 0
+        for len(weights) > 1 {
+            sort.Ints(weights)
+            w := weights[0] + weights[1]
+            expected += w
+            weights = append(weights[2:], w)
+        }
+
+        if c := cost(histo, huffmanDepths(histo, 15)); c != expected {
+            t.Errorf("test %v: expected cost %v got %v", id, expected, c)
+        }
+    }
+
+    // under a binding limit no complete code within the limit is cheaper, checked against all of them
+    for id, histo := range [][]int{
+        {40, 30, 2, 1, 1, 1},
+        {1, 2, 3, 5, 8, 13},
+        {100, 1, 1, 1, 1, 50},
+    } {
+        best := -1
+        depths := make([]int, len(histo))
+        for i := 0; i < 1 << (2 * len(histo)); i++ {
+            for s := range depths {
+                depths[s] = (i >> (2 * s)) & 3 + 1
             }
-            if a.IsBranch != b.IsBranch || a.Weight != b.Weight || a.Symbol != b.Symbol {
-                return false
+
+            if kraftSum(depths, 4) == 16 && (best < 0 || cost(histo, depths) < best) {
+                best = cost(histo, depths)
             }
-            return compareTrees(a.BranchLeft, b.BranchLeft) && compareTrees(a.BranchRight, b.BranchRight)
         }
 
-        if !compareTrees(resultTree, tt.expectedTree) {
-            t.Errorf("test %v: Huffman tree mismatch: got %+v, expected %+v", id, resultTree, tt.expectedTree)
+        for _, maxDepth := range []int{3, 4} {
+            if maxDepth == 3 {
+                // the enumeration above is for 4 bits, so 3 bits is only checked for completeness
+                if sum := kraftSum(huffmanDepths(histo, 3), 3); sum != 8 {
+                    t.Errorf("test %v: expected a complete code got Kraft sum %v", id, sum)
+                }
+                continue
+            }
+
+            if c := cost(histo, huffmanDepths(histo, maxDepth)); c != best {
+                t.Errorf("test %v: expected cost %v under a limit of %v bits got %v", id, best, maxDepth, c)
+            }
         }
     }
 }
@@ -144,10 +231,10 @@ func TestBuildhuffmanCodes(t *testing.T) {
             histo:     []int{5, 9, 12, 13, 1}, // Fifth symbol has lower weight, longer code
             maxDepth: 4,
             expectedBits: map[int]huffmanCode{
-                0: {Symbol: 0, Bits: 0b110, Depth: 3}, // Symbol 0 gets code '110'
-                1: {Symbol: 1, Bits: 0b0, Depth: 2},   // Symbol 1 gets code '0'
-                2: {Symbol: 2, Bits: 0b1, Depth: 2},   // Symbol 2 gets code '1'
-                3: {Symbol: 3, Bits: 0b10, Depth: 2},  // Symbol 3 gets code '10'
+                0: {Symbol: 0, Bits: 0b011, Depth: 3}, // Symbol 0 gets code '110', stored reversed
+                1: {Symbol: 1, Bits: 0b00, Depth: 2},  // Symbol 1 gets code '00'
+                2: {Symbol: 2, Bits: 0b10, Depth: 2},  // Symbol 2 gets code '01', stored reversed
+                3: {Symbol: 3, Bits: 0b01, Depth: 2},  // Symbol 3 gets code '10', stored reversed
                 4: {Symbol: 4, Bits: 0b111, Depth: 3}, // Symbol 4 gets code '111'
             },
         },
@@ -169,92 +256,21 @@ func TestBuildhuffmanCodes(t *testing.T) {
     }
 }
 
-func TestSetBitDepths(t *testing.T) {
+func TestReverseBits(t *testing.T) {
     for id, tt := range []struct {
-        tree           *node
-        expectedCodes  []huffmanCode
+        value       int
+        n           int
+        expected    int
     }{
-        // Test case with a nil node
-        {
-            tree:          nil, // Nil node
-            expectedCodes: []huffmanCode{}, // No codes generated
-        },
-        // Test case with a single node (no branches)
-        {
-            tree: &node{
-                IsBranch: false,
-                Weight:   5,
-                Symbol:   0,
-            },
-            expectedCodes: []huffmanCode{
-                {Symbol: 0, Depth: 0}, // Root node has depth 0
-            },
-        },
-        // Test case with a simple binary tree
-        {
-            tree: &node{
-                IsBranch: true,
-                Weight:   15,
-                BranchLeft: &node{
-                    IsBranch: false,
-                    Weight:   5,
-                    Symbol:   0,
-                },
-                BranchRight: &node{
-                    IsBranch: false,
-                    Weight:   10,
-                    Symbol:   1,
-                },
-            },
-            expectedCodes: []huffmanCode{
-                {Symbol: 0, Depth: 1}, // Left branch depth = 1
-                {Symbol: 1, Depth: 1}, // Right branch depth = 1
-            },
-        },
-        // Test case with a more complex tree
-        {
-            tree: &node{
-                IsBranch: true,
-                Weight:   30,
-                BranchLeft: &node{
-                    IsBranch: true,
-                    Weight:   15,
-                    BranchLeft: &node{
-                        IsBranch: false,
-                        Weight:   5,
-                        Symbol:   0,
-                    },
-                    BranchRight: &node{
-                        IsBranch: false,
-                        Weight:   10,
-                        Symbol:   1,
-                    },
-                },
-                BranchRight: &node{
-                    IsBranch: false,
-                    Weight:   15,
-                    Symbol:   2,
-                },
-            },
-            expectedCodes: []huffmanCode{
-                {Symbol: 0, Depth: 2},
-                {Symbol: 1, Depth: 2}, 
-                {Symbol: 2, Depth: 1},
-            },
-        },
+        {0b1, 1, 0b1},
+        {0b10, 2, 0b01},
+        {0b110, 3, 0b011},
+        {0b0011, 4, 0b1100},
+        {0b100000000000001, 15, 0b100000000000001},
+        {0b100000000000011, 15, 0b110000000000001},
     } {
-        var codes []huffmanCode
-        setBitDepths(tt.tree, &codes, 0)
-
-        if len(codes) != len(tt.expectedCodes) {
-            t.Errorf("test %v: depths mismatch: got %v, expected %v", id, len(codes), len(tt.expectedCodes))
-            continue
-        }
-
-        for i, expectedCode := range tt.expectedCodes {
-            if codes[i] != expectedCode {
-                t.Errorf("test %v: mismatch at index %v: got %+v, expected %+v", id, i, codes[i], expectedCode)
-            }
+        if r := reverseBits(tt.value, tt.n); r != tt.expected {
+            t.Errorf("test %v: expected %b got %b", id, tt.expected, r)
         }
     }
 }
@@ -313,17 +329,12 @@ func TestWritehuffmanCodes(t *testing.T) {
             expectedBufSize: 3,
         },
     } {
-        buffer := &bytes.Buffer{}
-        writer := &bitWriter{
-            Buffer:        buffer,
-            BitBuffer:     0,
-            BitBufferSize: 0,
-        }
-
+        writer := &bitWriter{}
         writehuffmanCodes(writer, tt.codes)
+        writer.writeThrough()
 
-        if !bytes.Equal(buffer.Bytes(), tt.expectedBits) {
-            t.Errorf("test %d: buffer mismatch\nexpected: %064b\n     got: %064b\n", id, tt.expectedBits, buffer.Bytes())
+        if !bytes.Equal(writer.Buffer, tt.expectedBits) {
+            t.Errorf("test %d: buffer mismatch\nexpected: %064b\n     got: %064b\n", id, tt.expectedBits, writer.Buffer)
         }
 
         if writer.BitBuffer != tt.expectedBitBuf {
@@ -335,3 +346,79 @@ func TestWritehuffmanCodes(t *testing.T) {
         }
     }
 }
+
+func TestWritehuffmanCodesRoundTrip(t *testing.T) {
+    fib := make([]int, 280)
+    fib[0], fib[1] = 1, 1
+    for i := 2; i < 30; i++ {
+        fib[i] = fib[i - 1] + fib[i - 2]
+    }
+
+    uniform := make([]int, 256)
+    for i := range uniform {
+        uniform[i] = 10
+    }
+
+    single := make([]int, 280)
+    single[270] = 5
+
+    for id, histo := range [][]int{
+        fib,        // code lengths up to 15 bits, whose own code would exceed 7 bits without a limit
+        uniform,    // every symbol has the same length, so the code length code has a single symbol
+        single,     // a single symbol that does not fit a simple code
+    } {
+        codes := buildhuffmanCodes(histo, 15)
+
+        w := &bitWriter{}
+        writehuffmanCodes(w, codes)
+        for s, c := range histo {
+            if c > 0 {
+                w.writeCode(codes[s])
+            }
+        }
+        w.alignByte()
+
+        if w.Err != nil {
+            t.Errorf("test %v: unexpected error %v", id, w.Err)
+            continue
+        }
+
+        d := &vp8lDecoder{br: bitReader{data: w.Buffer}}
+        h := &huffmanDecoder{}
+        if err := d.readHuffmanCode(h, len(histo)); err != nil {
+            t.Errorf("test %v: unexpected decode error %v", id, err)
+            continue
+        }
+
+        for s, c := range histo {
+            if c > 0 {
+                if v := h.decode(&d.br); v != uint32(s) {
+                    t.Errorf("test %v: expected symbol %v got %v", id, s, v)
+                }
+            }
+        }
+    }
+}
+
+func TestEncodeLongCodes(t *testing.T) {
+    // noise images need code lengths near the 15 bit limit
+    for id, img := range []*image.NRGBA{
+        generateTestImageNoise(300, 200, 1).(*image.NRGBA),
+        generateTestImageNoise(256, 256, 1).(*image.NRGBA),
+        generateTestImageNoise(500, 300, 3).(*image.NRGBA),
+    } {
+        buf := new(bytes.Buffer)
+        if err := Encode(buf, img, nil); err != nil {
+            t.Fatalf("test %v: unexpected error %v", id, err)
+        }
+
+        decoded, err := decoderWebP.Decode(buf)
+        if err != nil {
+            t.Fatalf("test %v: unexpected decode error %v", id, err)
+        }
+
+        if !reflect.DeepEqual(decoded.(*image.NRGBA).Pix, img.Pix) {
+            t.Errorf("test %v: decoded image differs from the input", id)
+        }
+    }
+}
@@ -0,0 +1,222 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "bytes"
+    "encoding/binary"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    "image/draw"
+    decoderWebP "golang.org/x/image/webp"
+    //------------------------------
+    //errors
+    //------------------------------
+    "errors"
+)
+
+// IncrementalDecoder decodes a still WebP image while its bytes are still arriving, similar to
+// the WebPIDecoder of libwebp.
+//
+// Data is passed in through Write, after which Image returns the rows decoded so far. VP8L images
+// are decoded in scanline order, so the image fills from the top as more data arrives. Lossy
+// images are handed to golang.org/x/image/webp and only become available once they are complete.
+//
+// Once the pixels of a VP8L image have started, every Write continues at the first pixel that was
+// not decoded, so the data may be written in blocks of any size, down to single bytes. The headers
+// and transform data in front of the pixels are decoded from their start until they are complete.
+type IncrementalDecoder struct {
+    data        []byte
+    dec         vp8lDecoder
+    img         *image.NRGBA
+    rows        int
+    complete    bool
+    err         error
+}
+
+// NewIncrementalDecoder returns an IncrementalDecoder waiting for the start of a WebP file.
+func NewIncrementalDecoder() *IncrementalDecoder {
+    return &IncrementalDecoder{}
+}
+
+// Write appends p to the data received so far and decodes as much of the image as possible.
+//
+// Running out of data is not an error. Errors caused by malformed data are returned and also
+// by every later call, data written after the end of the file is ignored.
+//
+// Parameters:
+//   p - The next bytes of the WebP file.
+//
+// Returns:
+//   The number of bytes consumed, which is len(p) unless an error occurred earlier, and an error if the data is malformed.
+func (d *IncrementalDecoder) Write(p []byte) (int, error) {
+    if d.err != nil {
+        return 0, d.err
+    }
+
+    if d.complete {
+        return len(p), nil
+    }
+
+    d.data = append(d.data, p...)
+    if d.err = d.decode(); d.err != nil {
+        return len(p), d.err
+    }
+
+    return len(p), nil
+}
+
+// Image returns the image decoded so far and the number of its rows that are complete, counted
+// from the top. The remaining rows are transparent black. The image is nil until the bitstream
+// header has arrived, and it is updated in place by later calls to Write.
+func (d *IncrementalDecoder) Image() (*image.NRGBA, int) {
+    return d.img, d.rows
+}
+
+// Finish ends decoding and returns the decoded image.
+//
+// If the file is incomplete the partially decoded image is returned together with ErrTruncated,
+// the image is nil if not even the bitstream header was received.
+//
+// Returns:
+//   The decoded image, and an error if the data was malformed or incomplete.
+func (d *IncrementalDecoder) Finish() (*image.NRGBA, error) {
+    if d.err != nil {
+        return d.img, d.err
+    }
+
+    if !d.complete {
+        return d.img, ErrTruncated
+    }
+
+    return d.img, nil
+}
+
+// decode walks the chunks received so far and decodes the image chunk, stopping without an
+// error at the first chunk that is incomplete.
+func (d *IncrementalDecoder) decode() error {
+    if len(d.data) < 12 {
+        return nil
+    }
+
+    if string(d.data[0:4]) != "RIFF" || string(d.data[8:12]) != "WEBP" {
+        return ErrInvalidRIFF
+    }
+
+    size := int64(binary.LittleEndian.Uint32(d.data[4:8]))
+    if size < 4 {
+        return ErrInvalidRIFF
+    }
+
+    // sizes are compared as 64 bit integers so crafted sizes cannot overflow
+    end := 8 + size
+    available := min(end, int64(len(d.data)))
+
+    for i := int64(12); i + 8 <= available; {
+        chunkSize := int64(binary.LittleEndian.Uint32(d.data[i + 4 : i + 8]))
+        if chunkSize > end - i - 8 {
+            return ErrInvalidChunk
+        }
+
+        payload := d.data[i + 8 : min(i + 8 + chunkSize, available)]
+        complete := int64(len(payload)) == chunkSize
+
+        switch string(d.data[i : i + 4]) {
+        case "VP8X":
+            if !complete {
+                return nil
+            }
+
+            if len(payload) < 10 {
+                return errors.New("invalid VP8X chunk")
+            }
+
+            if payload[0] & vp8xAnimation != 0 {
+                return errors.New("animated images are not supported")
+            }
+        case "ANIM", "ANMF":
+            return errors.New("animated images are not supported")
+        case "VP8L":
+            return d.decodeVP8L(payload, complete)
+        case "VP8 ":
+            if int64(len(d.data)) < end {
+                return nil
+            }
+
+            img, err := decoderWebP.Decode(bytes.NewReader(d.data[:end]))
+            if err != nil {
+                return err
+            }
+
+            b := img.Bounds()
+            d.img = image.NewNRGBA(b.Sub(b.Min))
+            draw.Draw(d.img, d.img.Bounds(), img, b.Min, draw.Src)
+            d.rows = b.Dy()
+            d.complete = true
+            return nil
+        default:
+            if !complete {
+                return nil
+            }
+        }
+
+        i += 8 + chunkSize + chunkSize & 1
+    }
+
+    if int64(len(d.data)) >= end {
+        return errors.New("missing image data")
+    }
+
+    return nil
+}
+
+// decodeVP8L decodes the part of a VP8L bitstream received so far into d.img. Once the main image
+// has started the decoder keeps its state and continues where the previous data ended, and only
+// the rows completed since the previous call are transformed.
+func (d *IncrementalDecoder) decodeVP8L(data []byte, complete bool) error {
+    var err error
+    if d.dec.main.started {
+        err = d.dec.resume(data)
+    } else {
+        if len(data) < 5 && !complete {
+            return nil
+        }
+
+        if err := d.dec.decodeHeader(data); err != nil {
+            return err
+        }
+
+        if d.img == nil {
+            d.img = image.NewNRGBA(image.Rect(0, 0, d.dec.width, d.dec.height))
+        }
+
+        err = d.dec.decodeStreams()
+    }
+
+    // a truncated stream still returns its complete rows, which are kept if the chunk turns out to be broken
+    if d.dec.main.started && (err == nil || err == ErrTruncated) {
+        rows := d.dec.height
+        if err == ErrTruncated {
+            rows = d.dec.decoded / d.dec.main.width
+        }
+
+        if rows > d.rows {
+            writeARGB(d.img, image.Point{0, d.rows}, d.dec.transformRows(d.rows, rows), d.dec.width, rows - d.rows)
+            d.rows = rows
+        }
+    }
+
+    if err == ErrTruncated && !complete {
+        return nil
+    }
+
+    if err != nil {
+        return err
+    }
+
+    d.complete = true
+    return nil
+}
@@ -0,0 +1,279 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "bytes"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    "image/color"
+    "image/draw"
+    decoderWebP "golang.org/x/image/webp"
+    //------------------------------
+    //errors
+    //------------------------------
+    "errors"
+    //------------------------------
+    //testing
+    //------------------------------
+    "testing"
+)
+
+func TestIncrementalDecoder(t *testing.T) {
+    for id, tt := range []struct {
+        img         image.Image
+        options     *Options
+        blockSize   int
+    }{
+        {generateTestImageNoise(40, 30, 7), nil, 1},
+        {generateTestImageNoise(40, 30, 8), nil, 97},
+        {generateTestImageNRGBA(64, 48, 64, true), &Options{UseExtendedFormat: true}, 13},
+        {generateTestImagePaletted(33, 21, 4), nil, 7},
+        {generateTestImagePaletted(33, 21, 100), nil, 5},
+    }{
+        buf := new(bytes.Buffer)
+        if err := Encode(buf, tt.img, tt.options); err != nil {
+            t.Fatalf("test %v: unexpected error %v", id, err)
+        }
+
+        expected := image.NewNRGBA(tt.img.Bounds())
+        draw.Draw(expected, expected.Bounds(), tt.img, tt.img.Bounds().Min, draw.Src)
+
+        d := NewIncrementalDecoder()
+        data := buf.Bytes()
+        lastRows, partial := 0, false
+        for i := 0; i < len(data); i += tt.blockSize {
+            if _, err := d.Write(data[i:min(i + tt.blockSize, len(data))]); err != nil {
+                t.Fatalf("test %v: unexpected error %v", id, err)
+            }
+
+            img, rows := d.Image()
+            if rows < lastRows {
+                t.Errorf("test %v: expected rows to grow from %v got %v", id, lastRows, rows)
+            }
+            lastRows = rows
+
+            if img == nil {
+                continue
+            }
+
+            partial = partial || rows > 0 && rows < expected.Rect.Dy()
+
+            // complete rows must be final and the rows below them must still be empty
+            n := rows * expected.Stride
+            if !bytes.Equal(img.Pix[:n], expected.Pix[:n]) {
+                t.Errorf("test %v: rows 0 to %v do not match the source image", id, rows)
+            }
+
+            if !bytes.Equal(img.Pix[n:], make([]byte, len(img.Pix) - n)) {
+                t.Errorf("test %v: rows below %v are not empty", id, rows)
+            }
+        }
+
+        if !partial {
+            t.Errorf("test %v: expected a partially decoded image before the end of the data", id)
+        }
+
+        img, err := d.Finish()
+        if err != nil {
+            t.Errorf("test %v: unexpected error %v", id, err)
+            continue
+        }
+
+        if !bytes.Equal(img.Pix, expected.Pix) {
+            t.Errorf("test %v: decoded image does not match the source image", id)
+        }
+
+        if n, err := d.Write([]byte{0, 0}); n != 2 || err != nil {
+            t.Errorf("test %v: expected data after the end to be ignored got %v, %v", id, n, err)
+        }
+    }
+}
+
+func TestIncrementalDecoderByteByByte(t *testing.T) {
+    // every byte continues the previous pixels, decoding from the start each time would take minutes
+    img := generateTestImageNoise(256, 256, 10)
+    buf := new(bytes.Buffer)
+    if err := Encode(buf, img, nil); err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    d := NewIncrementalDecoder()
+    for _, b := range buf.Bytes() {
+        if _, err := d.Write([]byte{b}); err != nil {
+            t.Fatalf("unexpected error %v", err)
+        }
+    }
+
+    result, err := d.Finish()
+    if err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    if !bytes.Equal(result.Pix, img.(*image.NRGBA).Pix) {
+        t.Errorf("decoded image does not match the source image")
+    }
+}
+
+func TestIncrementalDecoderTransformOrder(t *testing.T) {
+    // the encoder writes the color indexing transform first, so a stream whose predictor works
+    // on the expanded image is built by hand, from an image with three left predicted residuals
+    width, height := 37, 29
+    img := image.NewNRGBA(image.Rect(0, 0, width, height))
+    for y := 0; y < height; y++ {
+        for x := 0; x < width; x++ {
+            img.SetNRGBA(x, y, color.NRGBA{uint8((x + y) * 7), uint8(3 * y), 0, 255})
+        }
+    }
+
+    pixels, _ := flatten(img)
+    residuals := make([]color.NRGBA, width * height)
+    for y := 0; y < height; y++ {
+        for x := 0; x < width; x++ {
+            p := pixels[y * width + x]
+            d := applyFilter(pixels, width, x, y, 1)
+            residuals[y * width + x] = color.NRGBA{p.R - d.R, p.G - d.G, p.B - d.B, p.A - d.A}
+        }
+    }
+
+    w := &bitWriter{}
+    writeBitStreamHeader(w, img.Bounds(), false)
+
+    w.writeBits(1, 1)
+    w.writeBits(uint64(transformPredict), 2)
+    w.writeBits(0, 3)       // 4x4 tiles
+    modes := make([]color.NRGBA, subSampleSize(width, 2) * subSampleSize(height, 2))
+    for i := range modes {
+        modes[i] = color.NRGBA{G: 1, A: 255}
+    }
+    writeImageData(w, modes, subSampleSize(width, 2), subSampleSize(height, 2), false, 0, 1, defaultMatchFinder, nil)
+
+    pal, pw, err := applyPaletteTransform(&residuals, width, height)
+    if err != nil || len(pal) != 3 {
+        t.Fatalf("expected a palette of 3 colors got %v, %v", len(pal), err)
+    }
+
+    w.writeBits(1, 1)
+    w.writeBits(uint64(transformColorIndexing), 2)
+    w.writeBits(uint64(len(pal) - 1), 8)
+    writeImageData(w, pal, len(pal), 1, false, 0, 1, defaultMatchFinder, nil)
+
+    w.writeBits(0, 1)
+    writeImageData(w, residuals, pw, height, true, 0, 1, defaultMatchFinder, nil)
+    w.alignByte()
+
+    chunks := new(bytes.Buffer)
+    writeChunk(chunks, "VP8L", w.Buffer)
+    buf := new(bytes.Buffer)
+    writeRIFF(buf, chunks)
+
+    expected, err := decoderWebP.Decode(bytes.NewReader(buf.Bytes()))
+    if err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    if !bytes.Equal(expected.(*image.NRGBA).Pix, img.Pix) {
+        t.Fatalf("hand built stream does not hold the source image")
+    }
+
+    d := NewIncrementalDecoder()
+    for i, b := range buf.Bytes() {
+        if _, err := d.Write([]byte{b}); err != nil {
+            t.Fatalf("unexpected error %v after %v bytes", err, i + 1)
+        }
+
+        result, rows := d.Image()
+        if n := rows * img.Stride; result != nil && !bytes.Equal(result.Pix[:n], img.Pix[:n]) {
+            t.Fatalf("rows 0 to %v do not match the source image after %v bytes", rows, i + 1)
+        }
+    }
+
+    result, err := d.Finish()
+    if err != nil || !bytes.Equal(result.Pix, img.Pix) {
+        t.Errorf("expected the source image got error %v", err)
+    }
+}
+
+func TestIncrementalDecoderTruncated(t *testing.T) {
+    img := generateTestImageNoise(50, 40, 9)
+    buf := new(bytes.Buffer)
+    Encode(buf, img, nil)
+
+    expected := image.NewNRGBA(img.Bounds())
+    draw.Draw(expected, expected.Bounds(), img, image.Point{}, draw.Src)
+
+    d := NewIncrementalDecoder()
+    d.Write(buf.Bytes()[:buf.Len() * 2 / 3])
+
+    result, err := d.Finish()
+    if err != ErrTruncated {
+        t.Fatalf("expected err as %v got %v", ErrTruncated, err)
+    }
+
+    _, rows := d.Image()
+    if result == nil || rows == 0 || rows == 40 {
+        t.Fatalf("expected a partially decoded image got %v rows", rows)
+    }
+
+    n := rows * expected.Stride
+    if !bytes.Equal(result.Pix[:n], expected.Pix[:n]) {
+        t.Errorf("rows 0 to %v do not match the source image", rows)
+    }
+
+    if result, err := NewIncrementalDecoder().Finish(); result != nil || err != ErrTruncated {
+        t.Errorf("expected nil image and %v got %v, %v", ErrTruncated, result, err)
+    }
+}
+
+func TestIncrementalDecoderErrors(t *testing.T) {
+    animated := new(bytes.Buffer)
+    EncodeAll(animated, &Animation{
+        Images:     []image.Image{generateTestImageNRGBA(8, 8, 64, false), generateTestImageNRGBA(8, 8, 64, false)},
+        Durations:  []uint{100, 100},
+        Disposals:  []uint{0, 0},
+    }, nil)
+
+    for id, tt := range []struct {
+        input       []byte
+        expectedErr error
+    }{
+        {[]byte("RIFX\x04\x00\x00\x00WEBP"), ErrInvalidRIFF},
+        {[]byte("RIFF\x10\x00\x00\x00WEBPVP8L\x10\x00\x00\x00"), ErrInvalidChunk},
+        {[]byte("RIFF\x0c\x00\x00\x00WEBPXXXX\x00\x00\x00\x00"), errors.New("missing image data")},
+        {animated.Bytes(), errors.New("animated images are not supported")},
+        {[]byte("RIFF\x12\x00\x00\x00WEBPVP8L\x05\x00\x00\x00\x2e\x00\x00\x00\x00\x00"), errors.New("invalid VP8L header")},
+    }{
+        d := NewIncrementalDecoder()
+        _, err := d.Write(tt.input)
+        if err == nil || err.Error() != tt.expectedErr.Error() {
+            t.Errorf("test %v: expected err as %v got %v", id, tt.expectedErr, err)
+            continue
+        }
+
+        // errors are sticky
+        if _, err := d.Write([]byte{0}); err == nil || err.Error() != tt.expectedErr.Error() {
+            t.Errorf("test %v: expected err as %v got %v", id, tt.expectedErr, err)
+        }
+
+        if _, err := d.Finish(); err == nil || err.Error() != tt.expectedErr.Error() {
+            t.Errorf("test %v: expected err as %v got %v", id, tt.expectedErr, err)
+        }
+    }
+}
+
+func FuzzIncrementalDecoder(f *testing.F) {
+    fuzzSeeds(f)
+    f.Fuzz(func(t *testing.T, data []byte) {
+        d := NewIncrementalDecoder()
+        for i := 0; i < len(data); i += 16 {
+            if _, err := d.Write(data[i:min(i + 16, len(data))]); err != nil {
+                return
+            }
+        }
+
+        d.Finish()
+    })
+}
@@ -0,0 +1,238 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "io"
+    "encoding/binary"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    //------------------------------
+    //errors
+    //------------------------------
+    "errors"
+)
+
+// Info describes the structure of a WebP file without decoding its pixels.
+//
+// Fields:
+//   - Lossless: True if every frame is encoded with VP8L.
+//   - Lossy: True if at least one frame is encoded with VP8.
+//   - Animated: True if the file is an animation.
+//   - Extended: True if the file uses the extended format (VP8X).
+//   - Width, Height: Size of the canvas.
+//   - Flags: The feature flags of the VP8X chunk, 0 if there is none.
+//   - LoopCount: Number of times an animation repeats; 0 means infinite looping.
+//   - BackgroundColor: Canvas background color of an animation in BGRA order.
+//   - Frames: The frames of the file, a still image has a single frame covering the canvas.
+//   - HasICC, HasEXIF, HasXMP: True if the file contains an ICCP, EXIF or XMP chunk.
+type Info struct {
+    Lossless            bool
+    Lossy               bool
+    Animated            bool
+    Extended            bool
+    Width               int
+    Height              int
+    Flags               byte
+    LoopCount           uint16
+    BackgroundColor     uint32
+    Frames              []FrameInfo
+    HasICC              bool
+    HasEXIF             bool
+    HasXMP              bool
+}
+
+// FrameInfo describes a single frame of a WebP file.
+//
+// Fields:
+//   - Bounds: Area of the canvas covered by the frame.
+//   - Duration: Display time of an animation frame in milliseconds.
+//   - Disposal: Disposal method of an animation frame; 0 = keep, 1 = clear to background.
+//   - Blend: Blending method of an animation frame; 0 = alpha-blend, 1 = overwrite.
+//   - Lossless: True if the frame is encoded with VP8L.
+//   - HasAlpha: True if the frame has an ALPH chunk or its VP8L header sets the alpha hint.
+//   - VP8L: The VP8L header fields of a lossless frame, nil for lossy frames.
+type FrameInfo struct {
+    Bounds      image.Rectangle
+    Duration    uint
+    Disposal    uint
+    Blend       uint
+    Lossless    bool
+    HasAlpha    bool
+    VP8L        *VP8LHeader
+}
+
+// VP8LHeader holds the fields of the 5 byte header at the start of a VP8L bitstream.
+//
+// Fields:
+//   - Width, Height: Size of the image.
+//   - AlphaHint: The alpha_is_used bit; a hint that the image may contain transparent pixels.
+//   - Version: The version number, which is 0 for all valid files.
+type VP8LHeader struct {
+    Width       int
+    Height      int
+    AlphaHint   bool
+    Version     int
+}
+
+// ReadInfo reads a WebP file from the provided io.Reader and describes its structure.
+//
+// Only container chunks and bitstream headers are interpreted, pixel data is never decoded,
+// which makes it suitable for routing or filtering files cheaply.
+//
+// Parameters:
+//   r - The source io.Reader containing the WebP file.
+//
+// Returns:
+//   The Info describing the file or an error if the file is malformed.
+func ReadInfo(r io.Reader) (*Info, error) {
+    chunks, err := ParseChunks(r)
+    if err != nil {
+        return nil, err
+    }
+
+    return parseInfo(chunks)
+}
+
+func parseInfo(chunks []Chunk) (*Info, error) {
+    info := &Info{}
+
+    if len(chunks) > 0 && chunks[0].FourCC == "VP8X" {
+        vp8x := chunks[0].Payload()
+        if len(vp8x) < 10 {
+            return nil, errors.New("invalid VP8X chunk")
+        }
+
+        info.Extended = true
+        info.Flags = vp8x[0]
+        info.Animated = vp8x[0] & vp8xAnimation != 0
+        info.Width = int(read24(vp8x[4:7])) + 1
+        info.Height = int(read24(vp8x[7:10])) + 1
+    }
+
+    for _, c := range chunks {
+        switch c.FourCC {
+        case "ICCP":
+            info.HasICC = true
+        case "EXIF":
+            info.HasEXIF = true
+        case "XMP ":
+            info.HasXMP = true
+        case "ANIM":
+            if len(c.Payload()) < 6 {
+                return nil, errors.New("invalid ANIM chunk")
+            }
+
+            info.BackgroundColor = binary.LittleEndian.Uint32(c.Payload()[0:4])
+            info.LoopCount = binary.LittleEndian.Uint16(c.Payload()[4:6])
+        case "ANMF":
+            f, err := parseMuxFrame(c)
+            if err != nil {
+                return nil, err
+            }
+
+            frame, err := f.info()
+            if err != nil {
+                return nil, err
+            }
+
+            frame.Bounds = image.Rectangle{Min: f.Offset, Max: f.Offset.Add(f.size)}
+            frame.Duration = f.Duration
+            frame.Disposal = f.Disposal
+            frame.Blend = f.Blend
+
+            info.Frames = append(info.Frames, frame)
+        }
+    }
+
+    if !info.Animated {
+        frame, err := parseFrameInfo(chunks)
+        if err != nil {
+            return nil, err
+        }
+
+        if !info.Extended {
+            info.Width = frame.Bounds.Dx()
+            info.Height = frame.Bounds.Dy()
+        }
+
+        info.Frames = []FrameInfo{frame}
+    }
+
+    if len(info.Frames) == 0 {
+        return nil, errors.New("missing image data")
+    }
+
+    info.Lossless = true
+    for _, f := range info.Frames {
+        info.Lossless = info.Lossless && f.Lossless
+        info.Lossy = info.Lossy || !f.Lossless
+    }
+
+    return info, nil
+}
+
+// parseFrameInfo describes the image data found in a list of chunks, which
+// are either the top-level chunks of a still image or the chunks of an ANMF frame.
+func parseFrameInfo(chunks []Chunk) (FrameInfo, error) {
+    var frame FrameInfo
+    for _, c := range chunks {
+        switch c.FourCC {
+        case "ALPH":
+            frame.HasAlpha = true
+        case "VP8 ":
+            w, h, err := parseVP8Header(c.Payload())
+            if err != nil {
+                return frame, err
+            }
+
+            frame.Bounds = image.Rect(0, 0, w, h)
+            return frame, nil
+        case "VP8L":
+            header, err := parseVP8LHeader(c.Payload())
+            if err != nil {
+                return frame, err
+            }
+
+            frame.Bounds = image.Rect(0, 0, header.Width, header.Height)
+            frame.Lossless = true
+            frame.HasAlpha = header.AlphaHint
+            frame.VP8L = header
+            return frame, nil
+        }
+    }
+
+    return frame, errors.New("missing image data")
+}
+
+func parseVP8LHeader(data []byte) (*VP8LHeader, error) {
+    if len(data) < 5 || data[0] != 0x2f {
+        return nil, errors.New("invalid VP8L header")
+    }
+
+    bits := binary.LittleEndian.Uint32(data[1:5])
+    return &VP8LHeader{
+        Width:      int(bits & 0x3fff) + 1,
+        Height:     int(bits >> 14 & 0x3fff) + 1,
+        AlphaHint:  bits >> 28 & 1 == 1,
+        Version:    int(bits >> 29),
+    }, nil
+}
+
+func parseVP8Header(data []byte) (int, int, error) {
+    // a key frame starts with a 3 byte frame tag followed by the start code 0x9d 0x01 0x2a
+    if len(data) < 10 || data[0] & 1 != 0 || data[3] != 0x9d || data[4] != 0x01 || data[5] != 0x2a {
+        return 0, 0, errors.New("invalid VP8 header")
+    }
+
+    w := int(binary.LittleEndian.Uint16(data[6:8]) & 0x3fff)
+    h := int(binary.LittleEndian.Uint16(data[8:10]) & 0x3fff)
+    if w == 0 || h == 0 {
+        return 0, 0, errors.New("invalid VP8 header")
+    }
+
+    return w, h, nil
+}
@@ -0,0 +1,203 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "bytes"
+    "reflect"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    //------------------------------
+    //testing
+    //------------------------------
+    "testing"
+)
+
+func TestReadInfo(t *testing.T) {
+    still := &bytes.Buffer{}
+    Encode(still, generateTestImageNRGBA(8, 16, 64, false), nil)
+
+    extended := &bytes.Buffer{}
+    Encode(extended, generateTestImageNRGBA(8, 16, 64, true), &Options{UseExtendedFormat: true})
+
+    animated := &bytes.Buffer{}
+    EncodeAll(animated, &Animation{
+        Images:             []image.Image{
+            generateTestImageNRGBA(8, 8, 64, false),
+            generateTestImageNRGBA(4, 4, 64, true).(*image.NRGBA).SubImage(image.Rect(2, 2, 4, 4)),
+        },
+        Durations:          []uint{100, 250},
+        Disposals:          []uint{0, 1},
+        Blends:             []uint{1, 0},
+        LoopCount:          7,
+        BackgroundColor:    0xff123456,
+    }, nil)
+
+    // a lossy image with an ALPH chunk and metadata, only the VP8 frame header is needed
+    buf := &bytes.Buffer{}
+    writeChunkVP8XFlags(buf, image.Rect(0, 0, 20, 10), vp8xAlpha | vp8xICC | vp8xEXIF | vp8xXMP)
+    writeChunk(buf, "ICCP", []byte("icc"))
+    writeChunk(buf, "ALPH", []byte{0x00})
+    writeChunk(buf, "VP8 ", []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a, 20, 0x00, 10, 0x00})
+    writeChunk(buf, "EXIF", []byte("exif"))
+    writeChunk(buf, "XMP ", []byte("xmp"))
+    lossy := &bytes.Buffer{}
+    writeRIFF(lossy, buf)
+
+    for id, tt := range []struct {
+        input       []byte
+        expected    *Info
+    }{
+        {
+            still.Bytes(),
+            &Info{
+                Lossless:   true,
+                Width:      8,
+                Height:     16,
+                Frames:     []FrameInfo{
+                    {
+                        Bounds:     image.Rect(0, 0, 8, 16),
+                        Lossless:   true,
+                        VP8L:       &VP8LHeader{Width: 8, Height: 16},
+                    },
+                },
+            },
+        },
+        {
+            extended.Bytes(),
+            &Info{
+                Lossless:   true,
+                Extended:   true,
+                Width:      8,
+                Height:     16,
+                Flags:      vp8xAlpha,
+                Frames:     []FrameInfo{
+                    {
+                        Bounds:     image.Rect(0, 0, 8, 16),
+                        Lossless:   true,
+                        HasAlpha:   true,
+                        VP8L:       &VP8LHeader{Width: 8, Height: 16, AlphaHint: true},
+                    },
+                },
+            },
+        },
+        {
+            animated.Bytes(),
+            &Info{
+                Lossless:           true,
+                Animated:           true,
+                Extended:           true,
+                Width:              8,
+                Height:             8,
+                Flags:              vp8xAnimation | vp8xAlpha,
+                LoopCount:          7,
+                BackgroundColor:    0xff123456,
+                Frames:             []FrameInfo{
+                    {
+                        Bounds:     image.Rect(0, 0, 8, 8),
+                        Duration:   100,
+                        Blend:      1,
+                        Lossless:   true,
+                        VP8L:       &VP8LHeader{Width: 8, Height: 8},
+                    },
+                    {
+                        Bounds:     image.Rect(2, 2, 4, 4),
+                        Duration:   250,
+                        Disposal:   1,
+                        Lossless:   true,
+                        HasAlpha:   true,
+                        VP8L:       &VP8LHeader{Width: 2, Height: 2, AlphaHint: true},
+                    },
+                },
+            },
+        },
+        {
+            lossy.Bytes(),
+            &Info{
+                Lossy:      true,
+                Extended:   true,
+                Width:      20,
+                Height:     10,
+                Flags:      vp8xAlpha | vp8xICC | vp8xEXIF | vp8xXMP,
+                Frames:     []FrameInfo{
+                    {
+                        Bounds:     image.Rect(0, 0, 20, 10),
+                        HasAlpha:   true,
+                    },
+                },
+                HasICC:     true,
+                HasEXIF:    true,
+                HasXMP:     true,
+            },
+        },
+    }{
+        info, err := ReadInfo(bytes.NewReader(tt.input))
+        if err != nil {
+            t.Errorf("test %v: unexpected error %v", id, err)
+            continue
+        }
+
+        if !reflect.DeepEqual(info, tt.expected) {
+            t.Errorf("test %v: expected info as %+v got %+v", id, tt.expected, info)
+        }
+    }
+}
+
+func TestReadInfoErrors(t *testing.T) {
+    build := func(chunks ...[]byte) []byte {
+        buf := &bytes.Buffer{}
+        for _, c := range chunks {
+            writeChunk(buf, string(c[:4]), c[4:])
+        }
+
+        out := &bytes.Buffer{}
+        writeRIFF(out, buf)
+        return out.Bytes()
+    }
+
+    for id, tt := range []struct {
+        input       []byte
+        expectedMsg string
+    }{
+        {
+            []byte("not a WebP file!"),
+            "invalid RIFF header",
+        },
+        {
+            build([]byte("VP8X\x00")),
+            "invalid VP8X chunk",
+        },
+        {
+            build([]byte("EXIFdata")),
+            "missing image data",
+        },
+        {
+            build([]byte("VP8L\x2e\x00\x00\x00\x00")),
+            "invalid VP8L header",
+        },
+        {
+            build([]byte("VP8 \x01\x00\x00\x9d\x01\x2a\x01\x00\x01\x00")),
+            "invalid VP8 header",
+        },
+        {
+            build([]byte("VP8X\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00"), []byte("ANIM\x00")),
+            "invalid ANIM chunk",
+        },
+        {
+            build([]byte("VP8X\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00"), []byte("ANMF\x00")),
+            "invalid ANMF chunk",
+        },
+        {
+            build([]byte("VP8X\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00")),
+            "missing image data",
+        },
+    }{
+        _, err := ReadInfo(bytes.NewReader(tt.input))
+        if err == nil || err.Error() != tt.expectedMsg {
+            t.Errorf("test %v: expected error %v got %v", id, tt.expectedMsg, err)
+        }
+    }
+}
@@ -0,0 +1,446 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "math"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image/color"
+)
+
+const (
+    // maxWindowSize is the largest backward reference distance per WebP specs, distance
+    // codes above 120 store the distance plus 120 in 20 bits.
+    maxWindowSize = 1 << 20 - 120
+    // maxMatchLength is the longest backward reference per WebP specs.
+    maxMatchLength = 4096
+    // localCandidates is the number of 2D distance codes that are tried at every pixel.
+    localCandidates = 16
+    // lazyMatchLength is the match length from which a match is taken without checking
+    // whether the next pixel starts a longer one.
+    lazyMatchLength = 64
+)
+
+// matchFinder holds the settings of the backward reference search, see Options.
+type matchFinder struct {
+    hashBits    int
+    chainDepth  int
+    window      int
+}
+
+var defaultMatchFinder = matchFinder{hashBits: 16, chainDepth: 32, window: maxWindowSize}
+
+func (o *Options) matchFinder() matchFinder {
+    m := defaultMatchFinder
+    if o == nil {
+        return m
+    }
+
+    if o.HashBits > 0 {
+        m.hashBits = min(max(o.HashBits, 8), 20)
+    }
+
+    if o.ChainDepth > 0 {
+        m.chainDepth = o.ChainDepth
+    }
+
+    if o.WindowSize > 0 {
+        m.window = min(o.WindowSize, maxWindowSize)
+    }
+
+    return m
+}
+
+// lz77 converts pixels to tokens, see encodeImageData.
+//
+// Fields:
+//   - head, prev: Hash chains of three pixel sequences, holding positions plus one so that 0 ends a chain.
+//   - inserted: Number of positions added to the hash chains.
+//   - local, localCount: Distinct distances of the first 2D distance codes for the image width.
+//   - costs: Estimated bits of every symbol, nil while the first parse decides by match length only.
+type lz77 struct {
+    matchFinder
+
+    pixels      []color.NRGBA
+    width       int
+    head        []int32
+    prev        []int32
+    inserted    int
+
+    cache       []color.NRGBA
+    cacheBits   int
+    tokens      []uint32
+    cnt         int
+
+    local       [localCandidates]int
+    localCount  int
+
+    costs       *costModel
+}
+
+// costModel holds the estimated number of bits of the symbols of the five prefix codes and the
+// average bits of a literal pixel, derived from the histograms of an earlier parse.
+type costModel struct {
+    symbols     [5][]float64
+    literal     float64
+}
+
+func newCostModel(histos [][]int) *costModel {
+    c := &costModel{}
+    for i, histo := range histos {
+        total := 0
+        for _, n := range histo {
+            total += n
+        }
+
+        // a symbol that was not used is assumed to be rarer than any used one
+        c.symbols[i] = make([]float64, len(histo))
+        for s, n := range histo {
+            if n == 0 {
+                c.symbols[i][s] = math.Log2(float64(total + 1)) + 1
+            } else {
+                c.symbols[i][s] = math.Log2(float64(total) / float64(n))
+            }
+        }
+    }
+
+    literals := 0
+    for i := 0; i < 4; i++ {
+        for s, n := range histos[i][:256] {
+            c.literal += float64(n) * c.symbols[i][s]
+            if i == 0 {
+                literals += n
+            }
+        }
+    }
+
+    c.literal /= float64(max(literals, 1))
+
+    return c
+}
+
+// encodeImageData converts pixels to a stream of literal, cache and backward reference tokens.
+//
+// Every pixel first tries the nearest 2D distance codes, which cover the pixels to the left and
+// in the rows above and have the cheapest codes, and then follows the hash chain of the three
+// pixels starting at it.
+//
+// The pixels are parsed twice. The first parse takes a match unless the next pixel starts a longer
+// one. Its symbol statistics estimate the bits of every literal and match, so the second parse only
+// takes a match that is cheaper than the literals it covers, and only defers it to the next pixel
+// if a literal plus the next match is cheaper.
+//
+// The stream is stored in the scratch memory of b, which may be nil, and is valid until b is used again.
+func encodeImageData(pixels []color.NRGBA, width, height, colorCacheBits int, m matchFinder, b *encodeBuffers) []uint32 {
+    if b == nil {
+        b = &encodeBuffers{}
+    }
+
+    // a literal or cache token covers one pixel and a backward reference of two tokens at least
+    // three pixels, so the stream never needs more tokens than there are pixels
+    b.head = resizeBuffer(b.head, 1 << m.hashBits)
+    b.prev = resizeBuffer(b.prev, len(pixels))
+    b.cache = resizeBuffer(b.cache, 1 << colorCacheBits)
+    b.tokens = resizeBuffer(b.tokens, len(pixels))
+
+    // prev and the token stream are always written before they are read, the hash chains and
+    // the color cache are cleared by reset before every parse
+    z := &lz77{
+        matchFinder:    m,
+        pixels:         pixels,
+        width:          width,
+        head:           b.head,
+        prev:           b.prev,
+        cache:          b.cache,
+        cacheBits:      colorCacheBits,
+        tokens:         b.tokens,
+    }
+
+    for code := 1; code <= len(distanceMap) && z.localCount < localCandidates; code++ {
+        d := planeDistance(width, code)
+        if d <= z.window && !z.isLocal(d) {
+            z.local[z.localCount] = d
+            z.localCount++
+        }
+    }
+
+    // a parse that only repeats the previous pixel wins on images with few colors, where the
+    // hash chains find many short matches whose distances cost more than the pixels they cover
+    rle := *z
+    rle.chainDepth = 0
+    rle.local = [localCandidates]int{1}
+    rle.localCount = 1
+
+    // both parses share the buffers of z, so the winner is parsed again if it was not the last
+    if rle.parseTwice(b) < z.parseTwice(b) {
+        rle.reset()
+        rle.parse()
+        return rle.tokens[:rle.cnt]
+    }
+
+    return z.tokens[:z.cnt]
+}
+
+// parseTwice parses the pixels taking every match first, and again with the costs estimated from
+// the symbols of the first parse. It returns the estimated bits of the second parse.
+func (z *lz77) parseTwice(b *encodeBuffers) int {
+    z.costs = nil
+    z.reset()
+    z.parse()
+
+    z.costs = newCostModel(computeHistograms(z.pixels, z.tokens[:z.cnt], z.cacheBits, 1, b))
+    z.reset()
+    z.parse()
+
+    return estimateBits(computeHistograms(z.pixels, z.tokens[:z.cnt], z.cacheBits, 1, b))
+}
+
+// reset empties the hash chains, the color cache and the token stream for a new parse.
+func (z *lz77) reset() {
+    clear(z.head)
+    clear(z.cache)
+    z.inserted = 0
+    z.cnt = 0
+}
+
+// estimateBits returns the number of bits of a token stream coded with the Huffman codes of its
+// histograms, including the codes themselves and the extra bits of the length and distance prefixes.
+func estimateBits(histos [][]int) int {
+    w := &bitWriter{}
+    bits := 0
+    for i, histo := range histos {
+        codes := buildhuffmanCodes(histo, 15)
+        writehuffmanCodes(w, codes)
+
+        for s, n := range histo {
+            // the only symbol of a code is coded with 0 bits
+            bits += n * max(0, codes[s].Depth)
+            if i == 4 {
+                bits += n * prefixEncodeBits(s)
+            } else if i == 0 && s >= 256 && s < 256 + 24 {
+                bits += n * prefixEncodeBits(s - 256)
+            }
+        }
+    }
+
+    return bits + len(w.Buffer) * 8 + w.BitBufferSize
+}
+
+// parse converts the pixels to tokens, deciding by the estimated costs once they are known.
+func (z *lz77) parse() {
+    for i := 0; i < len(z.pixels); {
+        length, dist := z.find(i)
+
+        // lazy matching: a literal is written instead if the next pixel starts a longer match
+        for length >= 3 && length < lazyMatchLength && i + 1 < len(z.pixels) {
+            next, nextDist := z.find(i + 1)
+            if next <= length {
+                break
+            }
+
+            // both choices are compared over the pixels covered by the next match
+            if z.costs != nil && z.literalCost(i) + z.matchCost(next, nextDist) >= z.matchCost(length, dist) + z.literalsCost(i + length, i + 1 + next) {
+                break
+            }
+
+            z.literal(i)
+            i++
+            length, dist = next, nextDist
+        }
+
+        // Only use the match if it is at least 3 pixels long per WebP specs.
+        if length < 3 || z.costs != nil && z.matchCost(length, dist) >= z.literalsCost(i, i + length) {
+            z.literal(i)
+            i++
+            continue
+        }
+
+        z.reference(i, length, dist)
+        i += length
+    }
+}
+
+// literalCost returns the estimated bits of writing pixel i as a literal or cache token.
+func (z *lz77) literalCost(i int) float64 {
+    p := z.pixels[i]
+    if z.cacheBits > 0 {
+        if hash := hash(p, z.cacheBits); i > 0 && z.cache[hash] == p {
+            return z.costs.symbols[0][256 + 24 + hash]
+        }
+    }
+
+    c := &z.costs.symbols
+    return c[0][p.G] + c[1][p.R] + c[2][p.B] + c[3][p.A]
+}
+
+// literalsCost returns the estimated bits of writing the pixels [i, end) as literals.
+func (z *lz77) literalsCost(i, end int) float64 {
+    var cost float64
+    for ; i < end; i++ {
+        cost += z.literalCost(i)
+    }
+
+    return cost
+}
+
+// matchCost returns the estimated bits of a backward reference, including its extra bits.
+func (z *lz77) matchCost(length, dist int) float64 {
+    s, _ := prefixEncodeCode(length)
+    cost := z.costs.symbols[0][256 + s] + float64(prefixEncodeBits(s))
+
+    s, _ = prefixEncodeCode(distanceCode(dist, z.width))
+    return cost + z.costs.symbols[4][s] + float64(prefixEncodeBits(s))
+}
+
+// better reports whether a match of length l at distance d is preferred over the best one so far.
+// Without costs the longer match wins, otherwise the match that saves the most bits over
+// writing its pixels as average literals.
+func (z *lz77) better(l, d, best, bestDist int) bool {
+    if z.costs == nil || best == 0 {
+        return l > best
+    }
+
+    return float64(l) * z.costs.literal - z.matchCost(l, d) > float64(best) * z.costs.literal - z.matchCost(best, bestDist)
+}
+
+func (z *lz77) isLocal(d int) bool {
+    for _, l := range z.local[:z.localCount] {
+        if l == d {
+            return true
+        }
+    }
+
+    return false
+}
+
+// hash returns the hash chain of the three pixels starting at i.
+func (z *lz77) hash(i int) uint32 {
+    h := hash(z.pixels[i + 0], z.hashBits)
+    h ^= hash(z.pixels[i + 1], z.hashBits) * 0x9e3779b9
+    h ^= hash(z.pixels[i + 2], z.hashBits) * 0x85ebca6b
+    return h & (1 << z.hashBits - 1)
+}
+
+// insert adds the positions before end to the hash chains.
+func (z *lz77) insert(end int) {
+    end = min(end, len(z.pixels) - 2)
+    for ; z.inserted < end; z.inserted++ {
+        h := z.hash(z.inserted)
+        z.prev[z.inserted] = z.head[h]
+        z.head[h] = int32(z.inserted + 1)
+    }
+}
+
+// find returns the longest match at position i and its distance. Among matches of the same
+// length the one found first wins, which favours the 2D distance codes and then the nearest
+// positions of the hash chain.
+func (z *lz77) find(i int) (int, int) {
+    z.insert(i)
+
+    maxLength := min(maxMatchLength, len(z.pixels) - i)
+    if maxLength < 3 {
+        return 0, 0
+    }
+
+    best, bestDist := 0, 0
+    for _, d := range z.local[:z.localCount] {
+        if d > i {
+            continue
+        }
+
+        if l := matchLength(z.pixels[i:i + maxLength], z.pixels[i - d:]); l >= 3 && z.better(l, d, best, bestDist) {
+            best, bestDist = l, d
+        }
+    }
+
+    // a position that was looked at before is already the head of its own chain
+    cur := int(z.head[z.hash(i)]) - 1
+    if cur == i {
+        cur = int(z.prev[cur]) - 1
+    }
+
+    for j := 0; j < z.chainDepth && cur >= 0 && i - cur <= z.window && best < maxLength; j++ {
+        // a candidate can only be longer if it also matches the pixel after the best match
+        if z.pixels[cur + best] == z.pixels[i + best] {
+            if l := matchLength(z.pixels[i:i + maxLength], z.pixels[cur:]); l > best && z.better(l, i - cur, best, bestDist) {
+                best, bestDist = l, i - cur
+            }
+        }
+
+        cur = int(z.prev[cur]) - 1
+    }
+
+    z.insert(i + 1)
+    return best, bestDist
+}
+
+// matchLength returns the number of leading pixels of a that are equal in b.
+func matchLength(a, b []color.NRGBA) int {
+    b = b[:len(a)]
+    for i := range a {
+        if a[i] != b[i] {
+            return i
+        }
+    }
+
+    return len(a)
+}
+
+func (z *lz77) literal(i int) {
+    p := z.pixels[i]
+    if z.cacheBits > 0 {
+        hash := hash(p, z.cacheBits)
+
+        if i > 0 && z.cache[hash] == p {
+            z.tokens[z.cnt] = tokenCache | hash
+            z.cnt++
+            return
+        }
+
+        z.cache[hash] = p
+    }
+
+    z.tokens[z.cnt] = tokenLiteral
+    z.cnt++
+}
+
+func (z *lz77) reference(i, length, dist int) {
+    if z.cacheBits > 0 {
+        for _, p := range z.pixels[i:i + length] {
+            z.cache[hash(p, z.cacheBits)] = p
+        }
+    }
+
+    z.tokens[z.cnt + 0] = tokenCopy | uint32(length)
+    z.tokens[z.cnt + 1] = uint32(distanceCode(dist, z.width))
+    z.cnt += 2
+}
+
+// distanceCode maps a distance in pixels to its distance code, using the 2D codes for pixels
+// close to the current one.
+func distanceCode(dist, width int) int {
+    var distances = [128]int{
+        96,   73,  55,  39,  23,  13,   5,  1,  255, 255, 255, 255, 255, 255, 255, 255,
+        101,  78,  58,  42,  26,  16,   8,  2,    0,   3,  9,   17,  27,  43,  59,  79,
+        102,  86,  62,  46,  32,  20,  10,  6,    4,   7,  11,  21,  33,  47,  63,  87,
+        105,  90,  70,  52,  37,  28,  18,  14,  12,  15,  19,  29,  38,  53,  71,  91,
+        110,  99,  82,  66,  48,  35,  30,  24,  22,  25,  31,  36,  49,  67,  83, 100,
+        115, 108,  94,  76,  64,  50,  44,  40,  34,  41,  45,  51,  65,  77,  95, 109,
+        118, 113, 103,  92,  80,  68,  60,  56,  54,  57,  61,  69,  81,  93, 104, 114,
+        119, 116, 111, 106,  97,  88,  84,  74,  72,  75,  85,  89,  98, 107, 112, 117,
+    }
+
+    y := dist / width
+    x := dist - y * width
+
+    if x <= 8 && y < 8 {
+        return distances[y * 16 + 8 - x] + 1
+    } else if x > width - 8 && y < 7 {
+        return distances[(y + 1) * 16 + 8 + (width - x)] + 1
+    }
+
+    return dist + 120
+}
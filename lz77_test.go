@@ -0,0 +1,188 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "bytes"
+    "reflect"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    "image/color"
+    //------------------------------
+    //testing
+    //------------------------------
+    "testing"
+)
+
+// replayTokens rebuilds the pixels of a token stream and returns the largest distance used.
+func replayTokens(pixels []color.NRGBA, tokens []uint32, width int) ([]color.NRGBA, int) {
+    out := make([]color.NRGBA, 0, len(pixels))
+    maxDist := 0
+
+    for k := 0; k < len(tokens); k++ {
+        switch tokens[k] & tokenKind {
+        case tokenLiteral, tokenCache:
+            out = append(out, pixels[len(out)])
+        case tokenCopy:
+            length := int(tokens[k] &^ tokenKind)
+            dist := planeDistance(width, int(tokens[k + 1]))
+            k++
+
+            maxDist = max(maxDist, dist)
+            for i := 0; i < length; i++ {
+                out = append(out, out[len(out) - dist])
+            }
+        }
+    }
+
+    return out, maxDist
+}
+
+func TestMatchFinderOptions(t *testing.T) {
+    for id, tt := range []struct {
+        options     *Options
+        expected    matchFinder
+    }{
+        {
+            options:    nil,
+            expected:   defaultMatchFinder,
+        },
+        {
+            options:    &Options{},
+            expected:   matchFinder{hashBits: 16, chainDepth: 32, window: maxWindowSize},
+        },
+        {
+            options:    &Options{HashBits: 12, ChainDepth: 100, WindowSize: 4096},
+            expected:   matchFinder{hashBits: 12, chainDepth: 100, window: 4096},
+        },
+        {   // out of range values are clamped
+            options:    &Options{HashBits: 2, ChainDepth: 1, WindowSize: 1 << 24},
+            expected:   matchFinder{hashBits: 8, chainDepth: 1, window: maxWindowSize},
+        },
+        {
+            options:    &Options{HashBits: 30},
+            expected:   matchFinder{hashBits: 20, chainDepth: 32, window: maxWindowSize},
+        },
+        {   // negative values fall back to the defaults
+            options:    &Options{HashBits: -1, ChainDepth: -1, WindowSize: -1},
+            expected:   defaultMatchFinder,
+        },
+    } {
+        if m := tt.options.matchFinder(); m != tt.expected {
+            t.Errorf("test %v: expected %+v got %+v", id, tt.expected, m)
+        }
+    }
+}
+
+func TestEncodeImageDataMatchFinder(t *testing.T) {
+    pixels, err := flatten(generateTestImageNoise(64, 48, 5))
+    if err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    for id, tt := range []struct {
+        finder      matchFinder
+        maxDist     int
+    }{
+        {finder: defaultMatchFinder, maxDist: maxWindowSize},
+        {finder: matchFinder{hashBits: 8, chainDepth: 1, window: maxWindowSize}, maxDist: maxWindowSize},
+        {finder: matchFinder{hashBits: 20, chainDepth: 256, window: maxWindowSize}, maxDist: maxWindowSize},
+        {finder: matchFinder{hashBits: 16, chainDepth: 32, window: 64}, maxDist: 64},
+        {finder: matchFinder{hashBits: 16, chainDepth: 32, window: 1}, maxDist: 1},
+    } {
+        for _, cacheBits := range []int{0, 4} {
+            tokens := encodeImageData(pixels, 64, 48, cacheBits, tt.finder, nil)
+
+            out, maxDist := replayTokens(pixels, tokens, 64)
+            if !reflect.DeepEqual(out, pixels) {
+                t.Errorf("test %v: token stream does not rebuild the pixels", id)
+                continue
+            }
+
+            if maxDist > tt.maxDist {
+                t.Errorf("test %v: expected distances up to %v got %v", id, tt.maxDist, maxDist)
+            }
+        }
+    }
+
+    // rows repeat two rows further down, so a window of two rows finds them
+    long := encodeImageData(pixels, 64, 48, 0, matchFinder{hashBits: 16, chainDepth: 32, window: 128}, nil)
+    short := encodeImageData(pixels, 64, 48, 0, matchFinder{hashBits: 16, chainDepth: 32, window: 127}, nil)
+    if len(long) >= len(short) {
+        t.Errorf("expected fewer tokens with a window of two rows got %v and %v", len(long), len(short))
+    }
+}
+
+func TestEncodeMatchFinderRoundTrip(t *testing.T) {
+    img := generateTestImageNoise(50, 40, 6)
+
+    for id, o := range []*Options{
+        {HashBits: 8, ChainDepth: 1},
+        {HashBits: 20, ChainDepth: 512},
+        {WindowSize: 10},
+    } {
+        buf := new(bytes.Buffer)
+        if err := Encode(buf, img, o); err != nil {
+            t.Fatalf("test %v: unexpected error %v", id, err)
+        }
+
+        decoded, err := Decode(buf)
+        if err != nil {
+            t.Fatalf("test %v: unexpected decode error %v", id, err)
+        }
+
+        if !reflect.DeepEqual(decoded.(*image.NRGBA).Pix, img.(*image.NRGBA).Pix) {
+            t.Errorf("test %v: decoded image differs from the input", id)
+        }
+    }
+}
+
+func TestDistanceCode(t *testing.T) {
+    for id, tt := range []struct {
+        dist        int
+        width       int
+        expected    int
+    }{
+        {dist: 1, width: 100, expected: 2},         // pixel to the left
+        {dist: 100, width: 100, expected: 1},       // pixel above
+        {dist: 101, width: 100, expected: 3},       // pixel above left
+        {dist: 99, width: 100, expected: 4},        // pixel above right
+        {dist: 5000, width: 100, expected: 5120},   // too far for a 2D code
+    } {
+        code := distanceCode(tt.dist, tt.width)
+        if code != tt.expected {
+            t.Errorf("test %v: expected code %v got %v", id, tt.expected, code)
+        }
+
+        if d := planeDistance(tt.width, code); d != tt.dist {
+            t.Errorf("test %v: expected code %v to map back to distance %v got %v", id, code, tt.dist, d)
+        }
+    }
+}
+
+func TestEncodeLazyMatchPalette(t *testing.T) {
+    // few colors give short matches whose distances cost more than the literals they cover, which
+    // the lazy matching of the default options must not take over cheaper literals
+    for id, img := range []image.Image{
+        generateTestImagePaletted(16, 16, 16),
+        generateTestImagePaletted(50, 40, 4),
+        generateTestImagePaletted(75, 100, 2),
+    } {
+        var sizes []int
+        for _, o := range []*Options{nil, {ChainDepth: 1, HashBits: 8, WindowSize: 1}} {
+            buf := new(bytes.Buffer)
+            if err := Encode(buf, img, o); err != nil {
+                t.Fatalf("test %v: unexpected error %v", id, err)
+            }
+
+            sizes = append(sizes, buf.Len())
+        }
+
+        if sizes[0] > sizes[1] {
+            t.Errorf("test %v: expected the default options to be no larger than the weakest got %v and %v bytes", id, sizes[0], sizes[1])
+        }
+    }
+}
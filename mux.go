@@ -0,0 +1,489 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "io"
+    "bytes"
+    "encoding/binary"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    //------------------------------
+    //errors
+    //------------------------------
+    "errors"
+)
+
+// Mux assembles and disassembles WebP containers without decoding or encoding pixel data.
+//
+// A Mux is read from an existing file with NewMux, or built from scratch by filling in a zero
+// value. Encode serializes it again and regenerates the VP8X chunk, its feature flags and the
+// RIFF size from the frames and metadata it holds, so metadata can be stripped or injected and
+// frames replaced while the compressed bitstreams are copied byte-for-byte.
+//
+// Fields:
+//   - Frames: The frames of the file in display order; a still image has exactly one frame.
+//   - Animated: True if the file is an animation.
+//   - Extended: True to write a VP8X chunk even when no feature requires one.
+//   - LoopCount: Number of times an animation repeats; 0 means infinite looping.
+//   - BackgroundColor: Canvas background color of an animation in BGRA order.
+//   - ICCP, EXIF, XMP: Payloads of the metadata chunks, nil if the chunk is absent.
+//   - Chunks: Unknown chunks in file order, written after all other chunks.
+type Mux struct {
+    Frames              []*MuxFrame
+    Animated            bool
+    Extended            bool
+    LoopCount           uint16
+    BackgroundColor     uint32
+    ICCP                []byte
+    EXIF                []byte
+    XMP                 []byte
+    Chunks              []Chunk
+
+    canvas              image.Rectangle
+}
+
+// MuxFrame is a single frame of a Mux, holding the raw payloads of its chunks.
+//
+// Fields:
+//   - Offset: Position of an animation frame on the canvas, both coordinates must be even.
+//   - Duration: Display time of an animation frame in milliseconds.
+//   - Disposal: Disposal method of an animation frame; 0 = keep, 1 = clear to background.
+//   - Blend: Blending method of an animation frame; 0 = alpha-blend, 1 = overwrite.
+//   - Lossless: True if Bitstream is a VP8L bitstream, false if it is a VP8 bitstream.
+//   - Bitstream: The payload of the VP8L or VP8 chunk.
+//   - Alpha: The payload of the ALPH chunk of a lossy frame, nil if there is none.
+type MuxFrame struct {
+    Offset      image.Point
+    Duration    uint
+    Disposal    uint
+    Blend       uint
+    Lossless    bool
+    Bitstream   []byte
+    Alpha       []byte
+
+    size        image.Point
+    chunks      []Chunk
+}
+
+// NewMux reads a WebP file from the provided io.Reader and splits it into its parts.
+//
+// The canvas size of an animation is kept, so re-encoding an unmodified Mux never shrinks
+// the canvas even if no frame reaches its edges.
+//
+// Parameters:
+//   r - The source io.Reader containing the WebP file.
+//
+// Returns:
+//   A Mux holding the frames, settings and chunks of the file, or an error if the file is malformed.
+func NewMux(r io.Reader) (*Mux, error) {
+    chunks, err := ParseChunks(r)
+    if err != nil {
+        return nil, err
+    }
+
+    m := &Mux{}
+
+    if len(chunks) > 0 && chunks[0].FourCC == "VP8X" {
+        d := chunks[0].Payload()
+        if len(d) < 10 {
+            return nil, errors.New("invalid VP8X chunk")
+        }
+
+        m.Extended = true
+        m.Animated = d[0] & vp8xAnimation != 0
+        m.canvas = image.Rect(0, 0, int(read24(d[4:7])) + 1, int(read24(d[7:10])) + 1)
+        chunks = chunks[1:]
+    }
+
+    var still []Chunk
+    var hasANIM bool
+    for _, c := range chunks {
+        switch c.FourCC {
+        case "VP8X":
+            return nil, errors.New("duplicate VP8X chunk")
+        case "ICCP":
+            m.ICCP = c.Payload()
+        case "EXIF":
+            m.EXIF = c.Payload()
+        case "XMP ":
+            m.XMP = c.Payload()
+        case "ANIM":
+            if len(c.Payload()) < 6 {
+                return nil, errors.New("invalid ANIM chunk")
+            }
+
+            m.BackgroundColor = binary.LittleEndian.Uint32(c.Payload()[0:4])
+            m.LoopCount = binary.LittleEndian.Uint16(c.Payload()[4:6])
+            hasANIM = true
+        case "ANMF":
+            f, err := parseMuxFrame(c)
+            if err != nil {
+                return nil, err
+            }
+
+            m.Frames = append(m.Frames, f)
+        case "ALPH", "VP8 ", "VP8L":
+            still = append(still, c)
+        default:
+            m.Chunks = append(m.Chunks, c)
+        }
+    }
+
+    if m.Animated && !hasANIM {
+        return nil, errors.New("missing ANIM chunk")
+    }
+
+    if !m.Animated {
+        f := &MuxFrame{}
+        if err := f.setChunks(still); err != nil {
+            return nil, err
+        }
+
+        m.Frames = []*MuxFrame{f}
+    }
+
+    if len(m.Frames) == 0 {
+        return nil, errors.New("missing image data")
+    }
+
+    return m, nil
+}
+
+// parseMuxFrame parses an ANMF chunk: the frame header, including the frame size it declares,
+// and the chunks holding the image data of the frame.
+func parseMuxFrame(c Chunk) (*MuxFrame, error) {
+    d := c.Payload()
+    if len(d) < 16 {
+        return nil, errors.New("invalid ANMF chunk")
+    }
+
+    f := &MuxFrame{
+        // WebP specs stores frame offsets divided by 2
+        Offset:     image.Pt(int(read24(d[0:3])) * 2, int(read24(d[3:6])) * 2),
+        size:       image.Pt(int(read24(d[6:9])) + 1, int(read24(d[9:12])) + 1),
+        Duration:   uint(read24(d[12:15])),
+        Disposal:   uint(d[15] & 1),
+        Blend:      uint(d[15] >> 1 & 1),
+    }
+
+    chunks, err := parseChunks(d[16:], c.Offset + 8 + 16)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := f.setChunks(chunks); err != nil {
+        return nil, err
+    }
+
+    return f, nil
+}
+
+// info describes the image data of the frame, see parseFrameInfo.
+func (f *MuxFrame) info() (FrameInfo, error) {
+    chunks := []Chunk{{FourCC: "VP8 ", Size: uint32(len(f.Bitstream)), data: f.Bitstream}}
+    if f.Lossless {
+        chunks[0].FourCC = "VP8L"
+    }
+
+    if f.Alpha != nil {
+        chunks = append([]Chunk{{FourCC: "ALPH", Size: uint32(len(f.Alpha)), data: f.Alpha}}, chunks...)
+    }
+
+    return parseFrameInfo(chunks)
+}
+
+// setChunks fills in the frame from the chunks that make up its image data.
+func (f *MuxFrame) setChunks(chunks []Chunk) error {
+    var found bool
+    for _, c := range chunks {
+        switch {
+        case c.FourCC == "ALPH" && !found:
+            f.Alpha = c.Payload()
+        case (c.FourCC == "VP8 " || c.FourCC == "VP8L") && !found:
+            f.Lossless = c.FourCC == "VP8L"
+            f.Bitstream = c.Payload()
+            found = true
+        default:
+            f.chunks = append(f.chunks, c)
+        }
+    }
+
+    if !found {
+        return errors.New("missing image data")
+    }
+
+    return nil
+}
+
+// AddChunk adds an unknown chunk that is written after all other chunks.
+//
+// Parameters:
+//   fourCC - The four character code of the chunk, which must not be one defined by the WebP container specification.
+//   data   - The payload of the chunk.
+//
+// Returns:
+//   An error if fourCC is not 4 characters long or is reserved.
+func (m *Mux) AddChunk(fourCC string, data []byte) error {
+    if len(fourCC) != 4 {
+        return errors.New("fourCC must be 4 characters long")
+    }
+
+    switch fourCC {
+    case "VP8X", "VP8 ", "VP8L", "ALPH", "ANIM", "ANMF", "ICCP", "EXIF", "XMP ":
+        return errors.New("fourCC is reserved")
+    }
+
+    m.Chunks = append(m.Chunks, Chunk{
+        FourCC: fourCC,
+        Size:   uint32(len(data)),
+        data:   data,
+    })
+
+    return nil
+}
+
+// AppendFrame encodes img losslessly and adds it as the last frame of the Mux.
+//
+// Parameters:
+//   img      - The frame to add, positioned on the canvas by its bounds.
+//   duration - Display time of the frame in milliseconds.
+//   disposal - Disposal method after display; 0 = keep, 1 = clear to background.
+//   blend    - Blending method; 0 = alpha-blend onto the canvas, 1 = overwrite the canvas.
+//
+// Returns:
+//   An error if the frame fails to encode.
+func (m *Mux) AppendFrame(img image.Image, duration, disposal, blend uint) error {
+    b := getBuffers(nil)
+    stream, _, err := writeBitStream(img, nil, b)
+    putBuffers(nil, b)
+
+    if err != nil {
+        return err
+    }
+
+    m.Frames = append(m.Frames, &MuxFrame{
+        Offset:     img.Bounds().Min,
+        Duration:   duration,
+        Disposal:   disposal,
+        Blend:      blend,
+        Lossless:   true,
+        Bitstream:  stream.Bytes(),
+        size:       img.Bounds().Size(),
+    })
+
+    return nil
+}
+
+// Size returns the size of the frame from its bitstream header.
+func (f *MuxFrame) Size() (image.Point, error) {
+    if f.Lossless {
+        header, err := parseVP8LHeader(f.Bitstream)
+        if err != nil {
+            return image.Point{}, err
+        }
+
+        return image.Pt(header.Width, header.Height), nil
+    }
+
+    w, h, err := parseVP8Header(f.Bitstream)
+    if err != nil {
+        return image.Point{}, err
+    }
+
+    return image.Pt(w, h), nil
+}
+
+// hasAlpha reports whether the frame is marked as containing transparent pixels.
+func (f *MuxFrame) hasAlpha() bool {
+    if f.Lossless {
+        header, err := parseVP8LHeader(f.Bitstream)
+        return err == nil && header.AlphaHint
+    }
+
+    return f.Alpha != nil
+}
+
+func (f *MuxFrame) writeChunks(buf *bytes.Buffer) {
+    if f.Alpha != nil && !f.Lossless {
+        writeChunk(buf, "ALPH", f.Alpha)
+    }
+
+    if f.Lossless {
+        writeChunk(buf, "VP8L", f.Bitstream)
+    } else {
+        writeChunk(buf, "VP8 ", f.Bitstream)
+    }
+
+    for _, c := range f.chunks {
+        writeChunk(buf, c.FourCC, c.Payload())
+    }
+}
+
+// Encode writes the container to the specified io.Writer in WebP format.
+//
+// Parameters:
+//   w - The destination writer where the WebP file will be written.
+//
+// Returns:
+//   An error if the frames are missing or invalid, or if a still image has more than one frame,
+//   or a *WriteError if writing to the io.Writer fails.
+func (m *Mux) Encode(w io.Writer) error {
+    if len(m.Frames) == 0 {
+        return errors.New("must provide at least one image")
+    }
+
+    if !m.Animated && len(m.Frames) > 1 {
+        return errors.New("still image must have exactly one frame")
+    }
+
+    data := &bytes.Buffer{}
+
+    canvas := m.canvas
+    var hasAlpha bool
+    for _, f := range m.Frames {
+        size, err := f.Size()
+        if err != nil {
+            return err
+        }
+
+        hasAlpha = hasAlpha || f.hasAlpha()
+
+        if !m.Animated {
+            canvas = image.Rectangle{Max: size}
+            f.writeChunks(data)
+            continue
+        }
+
+        if f.Offset.X < 0 || f.Offset.Y < 0 || f.Offset.X % 2 != 0 || f.Offset.Y % 2 != 0 {
+            return errors.New("frame offsets must be even and positive")
+        }
+
+        bounds := image.Rectangle{Min: f.Offset, Max: f.Offset.Add(size)}
+        if err := validateFrameBounds(bounds); err != nil {
+            return err
+        }
+
+        canvas.Max.X = max(bounds.Max.X, canvas.Max.X)
+        canvas.Max.Y = max(bounds.Max.Y, canvas.Max.Y)
+
+        frame := &bytes.Buffer{}
+        f.writeChunks(frame)
+
+        duration := min(f.Duration, 1 << 24 - 1)
+        if err := writeChunkANMFHeader(data, frame.Len(), bounds, duration, min(f.Disposal, 1), min(f.Blend, 1)); err != nil {
+            return err
+        }
+
+        data.Write(frame.Bytes())
+    }
+
+    _, err := m.write(w, canvas, hasAlpha, data.Bytes())
+    return err
+}
+
+// write wraps the serialized image data in a container, adding the VP8X chunk when needed
+// with feature flags derived from the metadata and chunks of the Mux.
+//
+// The RIFF size is computed up front, so the header, metadata and data are written to w
+// directly without assembling the file in memory. It returns the number of bytes written, write
+// errors are returned as a *WriteError.
+func (m *Mux) write(w io.Writer, canvas image.Rectangle, hasAlpha bool, data ...[]byte) (int64, error) {
+    var flags byte
+    if m.Animated {
+        flags |= vp8xAnimation
+    }
+
+    if hasAlpha {
+        flags |= vp8xAlpha
+    }
+
+    if m.ICCP != nil {
+        flags |= vp8xICC
+    }
+
+    if m.EXIF != nil {
+        flags |= vp8xEXIF
+    }
+
+    if m.XMP != nil {
+        flags |= vp8xXMP
+    }
+
+    // a simple file can only hold an opaque VP8 image or a VP8L image, anything
+    // else such as alpha or metadata needs the extended format
+    extended := m.Extended || len(m.Chunks) > 0 || flags & ^byte(vp8xAlpha) != 0
+    if hasAlpha && !m.Animated && len(m.Frames) > 0 && !m.Frames[0].Lossless {
+        extended = true
+    }
+
+    var size int64
+    if extended {
+        size += chunkSize(10)
+    }
+
+    if m.ICCP != nil {
+        size += chunkSize(len(m.ICCP))
+    }
+
+    if m.Animated {
+        size += chunkSize(6)
+    }
+
+    for _, d := range data {
+        size += int64(len(d))
+    }
+
+    if m.EXIF != nil {
+        size += chunkSize(len(m.EXIF))
+    }
+
+    if m.XMP != nil {
+        size += chunkSize(len(m.XMP))
+    }
+
+    for _, c := range m.Chunks {
+        size += chunkSize(len(c.Payload()))
+    }
+
+    // the RIFF size field counts the WEBP form type and is limited to 32 bits
+    if 4 + size > 1 << 32 - 1 {
+        return 0, errors.New("file exceeds the maximum RIFF size")
+    }
+
+    rw := &riffWriter{w: w}
+    writeRIFFHeader(rw, size)
+
+    if extended {
+        writeChunkVP8XFlags(rw, canvas, flags)
+    }
+
+    if m.ICCP != nil {
+        writeChunk(rw, "ICCP", m.ICCP)
+    }
+
+    if m.Animated {
+        writeChunkANIM(rw, m.BackgroundColor, m.LoopCount)
+    }
+
+    for _, d := range data {
+        rw.Write(d)
+    }
+
+    if m.EXIF != nil {
+        writeChunk(rw, "EXIF", m.EXIF)
+    }
+
+    if m.XMP != nil {
+        writeChunk(rw, "XMP ", m.XMP)
+    }
+
+    for _, c := range m.Chunks {
+        writeChunk(rw, c.FourCC, c.Payload())
+    }
+
+    return rw.n, rw.result()
+}
@@ -0,0 +1,236 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "bytes"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    //------------------------------
+    //testing
+    //------------------------------
+    "testing"
+)
+
+func TestMux(t *testing.T) {
+    still := &bytes.Buffer{}
+    Encode(still, generateTestImageNRGBA(8, 8, 64, true), nil)
+
+    extended := &bytes.Buffer{}
+    Encode(extended, generateTestImageNRGBA(8, 8, 64, true), &Options{UseExtendedFormat: true})
+
+    ani := &Animation{
+        Images:             []image.Image{generateTestImageNRGBA(8, 8, 64, false), generateTestImageNRGBA(8, 8, 64, true)},
+        Durations:          []uint{100, 200},
+        Disposals:          []uint{0, 1},
+        LoopCount:          3,
+        BackgroundColor:    0xff00ff00,
+    }
+
+    animated := &bytes.Buffer{}
+    EncodeAll(animated, ani, nil)
+
+    // the same animation with metadata and an unknown chunk
+    chunks, _ := parseRIFF(animated.Bytes())
+    buf := &bytes.Buffer{}
+    writeChunkVP8XFlags(buf, image.Rect(0, 0, 8, 8), vp8xAnimation | vp8xAlpha | vp8xICC | vp8xEXIF | vp8xXMP)
+    writeChunk(buf, "ICCP", []byte("icc"))
+    for _, c := range chunks[1:] {
+        writeChunk(buf, c.FourCC, c.Payload())
+    }
+    writeChunk(buf, "EXIF", []byte("exif"))
+    writeChunk(buf, "XMP ", []byte("xmp"))
+    writeChunk(buf, "ABCD", []byte("unknown"))
+    metadata := &bytes.Buffer{}
+    writeRIFF(metadata, buf)
+
+    for id, tt := range []struct {
+        input       []byte
+        edit        func(m *Mux) error
+        expected    []byte
+    }{
+        {   // unmodified files are written byte-for-byte
+            still.Bytes(),
+            func(m *Mux) error { return nil },
+            still.Bytes(),
+        },
+        {
+            extended.Bytes(),
+            func(m *Mux) error { return nil },
+            extended.Bytes(),
+        },
+        {
+            animated.Bytes(),
+            func(m *Mux) error { return nil },
+            animated.Bytes(),
+        },
+        {
+            metadata.Bytes(),
+            func(m *Mux) error { return nil },
+            metadata.Bytes(),
+        },
+        {   // stripping metadata and unknown chunks
+            metadata.Bytes(),
+            func(m *Mux) error {
+                m.ICCP, m.EXIF, m.XMP, m.Chunks = nil, nil, nil, nil
+                return nil
+            },
+            animated.Bytes(),
+        },
+        {   // injecting metadata
+            animated.Bytes(),
+            func(m *Mux) error {
+                m.ICCP, m.EXIF, m.XMP = []byte("icc"), []byte("exif"), []byte("xmp")
+                return m.AddChunk("ABCD", []byte("unknown"))
+            },
+            metadata.Bytes(),
+        },
+        {   // a still image without the extended format option does not need a VP8X chunk
+            extended.Bytes(),
+            func(m *Mux) error {
+                m.Extended = false
+                return nil
+            },
+            still.Bytes(),
+        },
+    }{
+        m, err := NewMux(bytes.NewReader(tt.input))
+        if err != nil {
+            t.Errorf("test %v: unexpected error %v", id, err)
+            continue
+        }
+
+        if err := tt.edit(m); err != nil {
+            t.Errorf("test %v: unexpected error %v", id, err)
+            continue
+        }
+
+        output := &bytes.Buffer{}
+        if err := m.Encode(output); err != nil {
+            t.Errorf("test %v: unexpected error %v", id, err)
+            continue
+        }
+
+        if !bytes.Equal(output.Bytes(), tt.expected) {
+            t.Errorf("test %v: output mismatch", id)
+        }
+    }
+}
+
+func TestMuxFrames(t *testing.T) {
+    ani := &Animation{
+        Images:     []image.Image{generateTestImageNRGBA(8, 8, 64, false), generateTestImageNRGBA(8, 8, 64, true)},
+        Durations:  []uint{100, 200},
+        Disposals:  []uint{0, 1},
+    }
+
+    input := &bytes.Buffer{}
+    EncodeAll(input, ani, nil)
+
+    m, err := NewMux(bytes.NewReader(input.Bytes()))
+    if err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    if len(m.Frames) != 2 || !m.Animated {
+        t.Fatalf("expected an animation with 2 frames got %v frames", len(m.Frames))
+    }
+
+    for i, f := range m.Frames {
+        stream, _, _ := writeBitStream(ani.Images[i], nil, nil)
+        if !f.Lossless || !bytes.Equal(f.Bitstream, stream.Bytes()) {
+            t.Errorf("frame %v: bitstream mismatch", i)
+        }
+
+        if f.Duration != ani.Durations[i] || f.Disposal != ani.Disposals[i] {
+            t.Errorf("frame %v: expected duration %v and disposal %v got %v and %v", i, ani.Durations[i], ani.Disposals[i], f.Duration, f.Disposal)
+        }
+    }
+
+    // reordering frames and moving one across the canvas grows the canvas
+    m.Frames[0], m.Frames[1] = m.Frames[1], m.Frames[0]
+    m.Frames[1].Offset = image.Pt(4, 2)
+
+    output := &bytes.Buffer{}
+    if err := m.Encode(output); err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    info, err := ReadInfo(output)
+    if err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    if info.Width != 12 || info.Height != 10 {
+        t.Errorf("expected canvas 12x10 got %vx%v", info.Width, info.Height)
+    }
+
+    if info.Frames[0].Duration != 200 || info.Frames[1].Bounds != image.Rect(4, 2, 12, 10) {
+        t.Errorf("expected reordered frames got %+v", info.Frames)
+    }
+
+    // a lossy frame with alpha needs the extended format
+    lossy := &Mux{Frames: []*MuxFrame{{
+        Bitstream:  []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a, 20, 0x00, 10, 0x00},
+        Alpha:      []byte{0x00},
+    }}}
+
+    output.Reset()
+    if err := lossy.Encode(output); err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    chunks, _ := parseRIFF(output.Bytes())
+    if len(chunks) != 3 || chunks[0].FourCC != "VP8X" || chunks[1].FourCC != "ALPH" || chunks[2].FourCC != "VP8 " {
+        t.Fatalf("expected chunks VP8X, ALPH and VP8 got %v", chunks)
+    }
+
+    if flags := chunks[0].Payload()[0]; flags != vp8xAlpha {
+        t.Errorf("expected VP8X flags %08b got %08b", vp8xAlpha, flags)
+    }
+}
+
+func TestMuxErrors(t *testing.T) {
+    frame := &MuxFrame{Lossless: true, Bitstream: []byte{0x2f, 0x00, 0x00, 0x00, 0x00}}
+
+    for id, tt := range []struct {
+        mux         *Mux
+        fourCC      string
+        expectedMsg string
+    }{
+        {&Mux{}, "ABCD", "must provide at least one image"},
+        {&Mux{Frames: []*MuxFrame{frame, frame}}, "ABCD", "still image must have exactly one frame"},
+        {&Mux{Frames: []*MuxFrame{{Lossless: true}}}, "ABCD", "invalid VP8L header"},
+        {&Mux{Frames: []*MuxFrame{{Bitstream: []byte{0x00}}}}, "ABCD", "invalid VP8 header"},
+        {&Mux{Animated: true, Frames: []*MuxFrame{{Offset: image.Pt(1, 0), Lossless: true, Bitstream: frame.Bitstream}}}, "ABCD", "frame offsets must be even and positive"},
+        {&Mux{Animated: true, Frames: []*MuxFrame{{Offset: image.Pt(1 << 26, 0), Lossless: true, Bitstream: frame.Bitstream}}}, "ABCD", "frame exceeds the maximum canvas size"},
+        {&Mux{Frames: []*MuxFrame{frame}}, "ABC", "fourCC must be 4 characters long"},
+        {&Mux{Frames: []*MuxFrame{frame}}, "EXIF", "fourCC is reserved"},
+    }{
+        err := tt.mux.AddChunk(tt.fourCC, nil)
+        if err == nil {
+            err = tt.mux.Encode(&bytes.Buffer{})
+        }
+
+        if err == nil || err.Error() != tt.expectedMsg {
+            t.Errorf("test %v: expected error %v got %v", id, tt.expectedMsg, err)
+        }
+    }
+
+    for id, tt := range []struct {
+        input       []byte
+        expectedMsg string
+    }{
+        {[]byte("RIFF\x04\x00\x00\x00WEBP"), "missing image data"},
+        {[]byte("RIFF\x0c\x00\x00\x00WEBPEXIF\x00\x00\x00\x00"), "missing image data"},
+        {[]byte("RIFF\x0e\x00\x00\x00WEBPVP8X\x01\x00\x00\x00\x00\x00"), "invalid VP8X chunk"},
+    }{
+        _, err := NewMux(bytes.NewReader(tt.input))
+        if err == nil || err.Error() != tt.expectedMsg {
+            t.Errorf("test %v: expected error %v got %v", id, tt.expectedMsg, err)
+        }
+    }
+}
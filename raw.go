@@ -0,0 +1,144 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "io"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    "image/color"
+    //------------------------------
+    //errors
+    //------------------------------
+    "errors"
+)
+
+// PixelLayout describes the byte order of the pixels in a raw pixel buffer passed to EncodeRGBA.
+type PixelLayout int
+
+const (
+    // LayoutRGB stores 3 bytes per pixel; red, green and blue. Pixels are opaque.
+    LayoutRGB                   = PixelLayout(0)
+    // LayoutRGBA stores 4 bytes per pixel; red, green, blue and straight alpha.
+    LayoutRGBA                  = PixelLayout(1)
+    // LayoutBGRA stores 4 bytes per pixel; blue, green, red and straight alpha.
+    // This is the memory order of VP8L's 32-bit ARGB pixels on little-endian machines.
+    LayoutBGRA                  = PixelLayout(2)
+    // LayoutARGB stores 4 bytes per pixel; straight alpha, red, green and blue, the order of VP8L's ARGB pixels.
+    LayoutARGB                  = PixelLayout(3)
+    // LayoutRGBAPremultiplied is LayoutRGBA with the colors premultiplied by alpha, as in image.RGBA.
+    LayoutRGBAPremultiplied     = PixelLayout(4)
+    // LayoutBGRAPremultiplied is LayoutBGRA with the colors premultiplied by alpha.
+    LayoutBGRAPremultiplied     = PixelLayout(5)
+    // LayoutARGBPremultiplied is LayoutARGB with the colors premultiplied by alpha.
+    LayoutARGBPremultiplied     = PixelLayout(6)
+)
+
+// bytesPerPixel returns the size of a pixel in bytes and the offsets of the red, green, blue
+// and alpha bytes within it. The alpha offset is -1 for layouts without alpha.
+func (l PixelLayout) bytesPerPixel() (int, [4]int, error) {
+    switch l {
+    case LayoutRGB:
+        return 3, [4]int{0, 1, 2, -1}, nil
+    case LayoutRGBA, LayoutRGBAPremultiplied:
+        return 4, [4]int{0, 1, 2, 3}, nil
+    case LayoutBGRA, LayoutBGRAPremultiplied:
+        return 4, [4]int{2, 1, 0, 3}, nil
+    case LayoutARGB, LayoutARGBPremultiplied:
+        return 4, [4]int{1, 2, 3, 0}, nil
+    }
+
+    return 0, [4]int{}, errors.New("invalid pixel layout")
+}
+
+func (l PixelLayout) premultiplied() bool {
+    return l == LayoutRGBAPremultiplied || l == LayoutBGRAPremultiplied || l == LayoutARGBPremultiplied
+}
+
+// EncodeRGBA writes a raw pixel buffer to the specified io.Writer in WebP format.
+//
+// The pixels are converted straight into the VP8L pipeline without wrapping the buffer in an
+// image.Image, so frames from video decoders or GPU readbacks can be encoded without an extra copy.
+// The result is the same as encoding the equivalent *image.NRGBA with Encode. Premultiplied
+// colors are converted to straight alpha with the same rounding as color.NRGBAModel.
+//
+// Parameters:
+//   w      - The destination writer where the encoded WebP image will be written.
+//   pix    - The pixel buffer, rows from top to bottom.
+//   width  - Width of the image in pixels.
+//   height - Height of the image in pixels.
+//   stride - Distance between the starts of two rows in bytes, at least width times the pixel size.
+//   layout - The byte order of the pixels.
+//   o      - Pointer to Options containing encoding settings, may be nil.
+//
+// Returns:
+//   An error if the buffer does not match the size and layout, encoding fails,
+//   or a *WriteError if writing to the io.Writer fails.
+func EncodeRGBA(w io.Writer, pix []byte, width, height, stride int, layout PixelLayout, o *Options) error {
+    b := getBuffers(nil)
+    defer putBuffers(nil, b)
+
+    pixels, err := flattenRaw(pix, width, height, stride, layout, b)
+    if err != nil {
+        return err
+    }
+
+    stream, hasAlpha, err := writePixelBitStream(pixels, width, height, false, o, b)
+
+    if err != nil {
+        return err
+    }
+
+    m := &Mux{Extended: o != nil && o.UseExtendedFormat}
+    _, err = m.write(w, image.Rect(0, 0, width, height), hasAlpha, chunkHeader("VP8L", stream.Len()), stream.Bytes())
+    return err
+}
+
+// flattenRaw converts a raw pixel buffer to a slice of NRGBA pixels in scanline order, stored in
+// the scratch memory of buffers.
+func flattenRaw(pix []byte, width, height, stride int, layout PixelLayout, buffers *encodeBuffers) ([]color.NRGBA, error) {
+    size, offsets, err := layout.bytesPerPixel()
+    if err != nil {
+        return nil, err
+    }
+
+    if err := validateImageSize(width, height); err != nil {
+        return nil, err
+    }
+
+    if stride < width * size {
+        return nil, errors.New("invalid stride")
+    }
+
+    if len(pix) < (height - 1) * stride + width * size {
+        return nil, errors.New("pixel buffer too small")
+    }
+
+    // every pixel is overwritten below, so the buffer does not need to be cleared
+    buffers.pixels = resizeBuffer(buffers.pixels, width * height)
+    pixels := buffers.pixels
+
+    r, g, b, a := offsets[0], offsets[1], offsets[2], offsets[3]
+    premultiplied := layout.premultiplied()
+
+    for y := 0; y < height; y++ {
+        row := pix[y * stride:][:width * size]
+        dst := pixels[y * width:][:width]
+        for x := range dst {
+            p := row[x * size:][:size]
+            switch {
+            case a < 0:
+                dst[x] = color.NRGBA{p[r], p[g], p[b], 255}
+            case premultiplied:
+                dst[x] = unpremultiply(p[r], p[g], p[b], p[a])
+            default:
+                dst[x] = color.NRGBA{p[r], p[g], p[b], p[a]}
+            }
+        }
+    }
+
+    return pixels, nil
+}
@@ -0,0 +1,113 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "bytes"
+    "math/rand"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    //------------------------------
+    //testing
+    //------------------------------
+    "testing"
+)
+
+func TestEncodeRGBA(t *testing.T) {
+    rnd := rand.New(rand.NewSource(1))
+    width, height := 23, 17
+
+    straight := image.NewNRGBA(image.Rect(0, 0, width, height))
+    rnd.Read(straight.Pix)
+
+    premultiplied := image.NewRGBA(image.Rect(0, 0, width, height))
+    for i := 0; i < len(premultiplied.Pix); i += 4 {
+        a := uint8(rnd.Intn(256))
+        premultiplied.Pix[i + 0] = uint8(rnd.Intn(int(a) + 1))
+        premultiplied.Pix[i + 1] = uint8(rnd.Intn(int(a) + 1))
+        premultiplied.Pix[i + 2] = uint8(rnd.Intn(int(a) + 1))
+        premultiplied.Pix[i + 3] = a
+    }
+
+    opaque := image.NewNRGBA(straight.Rect)
+    copy(opaque.Pix, straight.Pix)
+    for i := 3; i < len(opaque.Pix); i += 4 {
+        opaque.Pix[i] = 255
+    }
+
+    for id, tt := range []struct {
+        layout      PixelLayout
+        src         []uint8     // pixels in RGBA order
+        order       []int       // position of each output byte in the RGBA pixel
+        expected    image.Image
+    }{
+        {LayoutRGB, opaque.Pix, []int{0, 1, 2}, opaque},
+        {LayoutRGBA, straight.Pix, []int{0, 1, 2, 3}, straight},
+        {LayoutBGRA, straight.Pix, []int{2, 1, 0, 3}, straight},
+        {LayoutARGB, straight.Pix, []int{3, 0, 1, 2}, straight},
+        {LayoutRGBAPremultiplied, premultiplied.Pix, []int{0, 1, 2, 3}, premultiplied},
+        {LayoutBGRAPremultiplied, premultiplied.Pix, []int{2, 1, 0, 3}, premultiplied},
+        {LayoutARGBPremultiplied, premultiplied.Pix, []int{3, 0, 1, 2}, premultiplied},
+    }{
+        // rows are padded to test the stride
+        size := len(tt.order)
+        stride := width * size + 5
+        pix := make([]byte, stride * (height - 1) + width * size)
+        for y := 0; y < height; y++ {
+            for x := 0; x < width; x++ {
+                for i, c := range tt.order {
+                    pix[y * stride + x * size + i] = tt.src[(y * width + x) * 4 + c]
+                }
+            }
+        }
+
+        for _, o := range []*Options{nil, {UseExtendedFormat: true}} {
+            expected := new(bytes.Buffer)
+            if err := Encode(expected, tt.expected, o); err != nil {
+                t.Fatalf("test %v: unexpected error %v", id, err)
+            }
+
+            buf := new(bytes.Buffer)
+            if err := EncodeRGBA(buf, pix, width, height, stride, tt.layout, o); err != nil {
+                t.Errorf("test %v: unexpected error %v", id, err)
+                continue
+            }
+
+            if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+                t.Errorf("test %v: output does not match Encode of the equivalent image", id)
+            }
+        }
+    }
+}
+
+func TestEncodeRGBAErrors(t *testing.T) {
+    pix := make([]byte, 4 * 4 * 4)
+
+    for id, tt := range []struct {
+        width       int
+        height      int
+        stride      int
+        layout      PixelLayout
+        expectedMsg string
+    }{
+        {4, 4, 16, PixelLayout(7), "invalid pixel layout"},
+        {4, 4, 15, LayoutRGBA, "invalid stride"},
+        {4, 5, 16, LayoutRGBA, "pixel buffer too small"},
+        {4, 4, 17, LayoutRGBA, "pixel buffer too small"},
+        {0, 4, 16, LayoutRGBA, "invalid image size"},
+        {1 << 14 + 1, 1, 1 << 16 + 4, LayoutRGBA, "invalid image size"},
+    }{
+        err := EncodeRGBA(new(bytes.Buffer), pix, tt.width, tt.height, tt.stride, tt.layout, nil)
+        if err == nil || err.Error() != tt.expectedMsg {
+            t.Errorf("test %v: expected error %v got %v", id, tt.expectedMsg, err)
+        }
+    }
+
+    // the last row only needs to hold its pixels, not a full stride
+    if err := EncodeRGBA(new(bytes.Buffer), make([]byte, 3 * 20 + 16), 4, 4, 20, LayoutRGBA, nil); err != nil {
+        t.Errorf("unexpected error %v", err)
+    }
+}
@@ -5,15 +5,18 @@ import (
     //general
     //------------------------------
     "io"
+    "fmt"
     "bytes"
-    "encoding/binary"
     //------------------------------
     //imaging
     //------------------------------
     "image"
+    "image/color"
+    "image/draw"
     //------------------------------
     //errors
     //------------------------------
+    "errors"
     decoderWebP "golang.org/x/image/webp"
 )
 
@@ -27,13 +30,21 @@ func init() {
 // This function is a wrapper around the underlying WebP decode package (golang.org/x/image/webp).
 // It supports both lossy and lossless WebP formats, decoding the image accordingly.
 //
+// The container is read and its chunks are walked with bounds checks before it is decoded,
+// so malformed containers are reported as ErrInvalidRIFF, ErrTruncated or ErrInvalidChunk.
+//
 // Parameters:
 //   r - The source io.Reader containing the WebP encoded image.
 //
 // Returns:
 //   The decoded image as image.Image or an error if the decoding fails.
 func Decode(r io.Reader) (image.Image, error) {
-    return decoderWebP.Decode(r)
+    data, err := readWebP(r)
+    if err != nil {
+        return nil, err
+    }
+
+    return decoderWebP.Decode(bytes.NewReader(data))
 }
 
 // DecodeConfig reads the image configuration from the provided io.Reader without fully decoding the image.
@@ -42,13 +53,348 @@ func Decode(r io.Reader) (image.Image, error) {
 // provides access to the image's metadata, such as its dimensions and color model.
 // It is useful for obtaining image information before performing a full decode.
 //
+// The container is read and checked like in Decode, so malformed containers are reported as
+// ErrInvalidRIFF, ErrTruncated or ErrInvalidChunk.
+//
 // Parameters:
 //   r - The source io.Reader containing the WebP encoded image.
 //
 // Returns:
 //   An image.Config containing the image's dimensions and color model, or an error if the configuration cannot be retrieved
 func DecodeConfig(r io.Reader) (image.Config, error) {
-    return decoderWebP.DecodeConfig(r)
+    data, err := readWebP(r)
+    if err != nil {
+        return image.Config{}, err
+    }
+
+    return decoderWebP.DecodeConfig(bytes.NewReader(data))
+}
+
+// readWebP reads a WebP file with readRIFF and checks its chunks with parseRIFF.
+func readWebP(r io.Reader) ([]byte, error) {
+    data, err := readRIFF(r, 0)
+    if err != nil {
+        return nil, err
+    }
+
+    if _, err := parseRIFF(data); err != nil {
+        return nil, err
+    }
+
+    return data, nil
+}
+
+// ErrLimitExceeded is returned when a file exceeds one of the limits set in DecodeOptions.
+var ErrLimitExceeded = errors.New("decode limit exceeded")
+
+// DecodeOptions holds resource limits for decoding untrusted files and the choice of the returned image type.
+//
+// Limits are checked against the RIFF header, the VP8X and ANMF chunks and the bitstream
+// headers while the file is read, before the payload following each header is buffered, so
+// a file exceeding a limit is rejected without reading it completely. A limit of 0 disables the check.
+//
+// Paletted and Compact only apply to still lossless images, which are then decoded natively.
+// Other images are returned as decoded by golang.org/x/image/webp.
+//
+// Fields:
+//   - MaxPixels: Maximum number of pixels of any single image or animation frame.
+//   - MaxFrames: Maximum number of frames of an animation.
+//   - MaxCanvasArea: Maximum number of pixels of the canvas.
+//   - MaxInputBytes: Maximum size of the file in bytes, checked before the file is read.
+//   - Paletted: Return an *image.Paletted if the image is stored with the color indexing transform,
+//     as Encode does for *image.Paletted input. The palette is recovered from the transform.
+//   - Compact: Return the tightest fitting type the pixels allow; *image.Gray for opaque gray
+//     images, *image.RGBA for other opaque images and *image.NRGBA otherwise.
+type DecodeOptions struct {
+    MaxPixels       int
+    MaxFrames       int
+    MaxCanvasArea   int
+    MaxInputBytes   int64
+    Paletted        bool
+    Compact         bool
+}
+
+// checkInput compares the file size given by the RIFF header against MaxInputBytes.
+func (o *DecodeOptions) checkInput(size int64) error {
+    if o == nil || o.MaxInputBytes <= 0 || size <= o.MaxInputBytes {
+        return nil
+    }
+
+    return fmt.Errorf("%w: file size of %v bytes exceeds MaxInputBytes of %v", ErrLimitExceeded, size, o.MaxInputBytes)
+}
+
+// checkFrames compares the number of frames read so far against MaxFrames.
+func (o *DecodeOptions) checkFrames(frames int) error {
+    if o == nil || o.MaxFrames <= 0 || frames <= o.MaxFrames {
+        return nil
+    }
+
+    return fmt.Errorf("%w: %v frames exceed MaxFrames of %v", ErrLimitExceeded, frames, o.MaxFrames)
+}
+
+// checkCanvas compares the canvas size against MaxCanvasArea.
+func (o *DecodeOptions) checkCanvas(width, height int) error {
+    // areas are computed as 64 bit integers, a VP8X canvas can hold up to 2^48 pixels
+    if o == nil || o.MaxCanvasArea <= 0 || int64(width) * int64(height) <= int64(o.MaxCanvasArea) {
+        return nil
+    }
+
+    return fmt.Errorf("%w: canvas of %vx%v exceeds MaxCanvasArea of %v", ErrLimitExceeded, width, height, o.MaxCanvasArea)
+}
+
+// checkPixels compares the size of a single image or animation frame against MaxPixels.
+func (o *DecodeOptions) checkPixels(width, height int) error {
+    if o == nil || o.MaxPixels <= 0 || int64(width) * int64(height) <= int64(o.MaxPixels) {
+        return nil
+    }
+
+    return fmt.Errorf("%w: image of %vx%v exceeds MaxPixels of %v", ErrLimitExceeded, width, height, o.MaxPixels)
+}
+
+// DecodeWithOptions reads a WebP image from the provided io.Reader and returns it as an image.Image,
+// rejecting files that exceed the limits in o before decoding them.
+//
+// Apart from the limits it behaves like Decode, errors caused by a limit wrap ErrLimitExceeded
+// and can be detected with errors.Is.
+//
+// Parameters:
+//   r - The source io.Reader containing the WebP encoded image.
+//   o - The limits to apply, or nil for no limits.
+//
+// Returns:
+//   The decoded image as image.Image or an error if a limit is exceeded or the decoding fails.
+func DecodeWithOptions(r io.Reader, o *DecodeOptions) (image.Image, error) {
+    // the headers are checked against the limits while the file is copied into data, so
+    // the payload of a chunk is only buffered once the headers before it passed the limits
+    buf := &bytes.Buffer{}
+    h := &headerReader{r: io.TeeReader(r, buf), limits: o}
+    if _, err := h.config(); err != nil {
+        return nil, err
+    }
+
+    data := buf.Bytes()
+    chunks, err := parseRIFF(data)
+    if err != nil {
+        return nil, err
+    }
+
+    info, err := parseInfo(chunks)
+    if err != nil {
+        return nil, err
+    }
+
+    if o != nil && (o.Paletted || o.Compact) && !info.Animated {
+        for _, c := range chunks {
+            if c.FourCC == "VP8L" {
+                return decodeLossless(c.Payload(), o)
+            }
+        }
+    }
+
+    return decoderWebP.Decode(bytes.NewReader(data))
+}
+
+// decodeLossless decodes a VP8L bitstream natively into the image type selected by o.
+func decodeLossless(data []byte, o *DecodeOptions) (image.Image, error) {
+    d := vp8lDecoderPool.Get().(*vp8lDecoder)
+    defer vp8lDecoderPool.Put(d)
+
+    d.keepIndices = o.Paletted
+    defer func() {
+        d.keepIndices = false
+    }()
+
+    if err := d.decodeHeader(data); err != nil {
+        return nil, err
+    }
+
+    pixels, err := d.decodeImage()
+    if err != nil {
+        return nil, err
+    }
+
+    bounds := image.Rect(0, 0, d.width, d.height)
+    if d.palette != nil {
+        return newPaletted(bounds, d.indices, d.palette), nil
+    }
+
+    if o.Compact {
+        return newCompact(bounds, pixels), nil
+    }
+
+    img := image.NewNRGBA(bounds)
+    writeARGB(img, image.Point{}, pixels, d.width, d.height)
+    return img, nil
+}
+
+// newPaletted creates an *image.Paletted from palette indices and ARGB palette entries.
+// Indices beyond the palette decode as transparent black, so the palette is extended to cover them.
+func newPaletted(bounds image.Rectangle, indices []uint8, palette []uint32) *image.Paletted {
+    colors := len(palette)
+    for _, i := range indices {
+        colors = max(colors, int(i) + 1)
+    }
+
+    pal := make(color.Palette, colors)
+    for i := range pal {
+        var p uint32
+        if i < len(palette) {
+            p = palette[i]
+        }
+
+        pal[i] = color.NRGBA{uint8(p >> 16), uint8(p >> 8), uint8(p), uint8(p >> 24)}
+    }
+
+    img := image.NewPaletted(bounds, pal)
+    copy(img.Pix, indices)
+    return img
+}
+
+// newCompact creates the smallest image type that holds the ARGB pixels without loss.
+func newCompact(bounds image.Rectangle, pixels []uint32) image.Image {
+    opaque, gray := true, true
+    for _, p := range pixels {
+        if p >> 24 != 0xff {
+            opaque = false
+            break
+        }
+
+        if gray && (p >> 16 & 0xff != p & 0xff || p >> 8 & 0xff != p & 0xff) {
+            gray = false
+        }
+    }
+
+    switch {
+    case opaque && gray:
+        img := image.NewGray(bounds)
+        for i, p := range pixels {
+            img.Pix[i] = uint8(p)
+        }
+        return img
+    case opaque:
+        img := image.NewRGBA(bounds)
+        writeARGB(img, image.Point{}, pixels, bounds.Dx(), bounds.Dy())
+        return img
+    }
+
+    img := image.NewNRGBA(bounds)
+    writeARGB(img, image.Point{}, pixels, bounds.Dx(), bounds.Dy())
+    return img
+}
+
+// DecodeInto reads a still WebP image from the provided io.Reader and draws it onto dst.
+//
+// The image is placed with its top left corner at the given point and clipped to the bounds of dst,
+// replacing the pixels it covers. Lossless images are decoded natively and written straight into
+// *image.NRGBA and *image.RGBA destinations, other destinations are filled through their Set method.
+// Lossy images are decoded by golang.org/x/image/webp and then drawn onto dst.
+// Internal scratch buffers are pooled and reused between calls.
+//
+// Parameters:
+//   r   - The source io.Reader containing the WebP encoded image.
+//   dst - The destination image.
+//   at  - The position of the top left corner of the decoded image in dst.
+//
+// Returns:
+//   An error if the decoding fails or the file is an animation.
+func DecodeInto(r io.Reader, dst draw.Image, at image.Point) error {
+    data, chunks, _, err := readStillImage(r)
+    if err != nil {
+        return err
+    }
+
+    return decodeInto(data, chunks, dst, at)
+}
+
+// DecodeNRGBA reads a still WebP image from the provided io.Reader into a reusable *image.NRGBA.
+//
+// If dst is large enough its pixel buffer is reused and its bounds are set to those of the
+// image, otherwise a new image is allocated. Passing the result of a previous call as dst
+// allows decoding many images without allocating pixel memory for each.
+//
+// Parameters:
+//   r   - The source io.Reader containing the WebP encoded image.
+//   dst - The image to reuse, or nil to allocate a new one.
+//
+// Returns:
+//   The decoded image, which is dst if it could be reused, or an error if the decoding fails.
+func DecodeNRGBA(r io.Reader, dst *image.NRGBA) (*image.NRGBA, error) {
+    data, chunks, info, err := readStillImage(r)
+    if err != nil {
+        return nil, err
+    }
+
+    bounds := image.Rectangle{Max: info.Frames[0].Bounds.Size()}
+    size := 4 * bounds.Dx() * bounds.Dy()
+    if dst == nil || cap(dst.Pix) < size {
+        dst = image.NewNRGBA(bounds)
+    } else {
+        dst.Pix = dst.Pix[:size]
+        dst.Stride = 4 * bounds.Dx()
+        dst.Rect = bounds
+    }
+
+    if err := decodeInto(data, chunks, dst, image.Point{}); err != nil {
+        return nil, err
+    }
+
+    return dst, nil
+}
+
+// readStillImage reads a WebP file and checks that it holds a single image.
+func readStillImage(r io.Reader) ([]byte, []Chunk, *Info, error) {
+    data, err := readRIFF(r, 0)
+    if err != nil {
+        return nil, nil, nil, err
+    }
+
+    chunks, err := parseRIFF(data)
+    if err != nil {
+        return nil, nil, nil, err
+    }
+
+    info, err := parseInfo(chunks)
+    if err != nil {
+        return nil, nil, nil, err
+    }
+
+    if info.Animated {
+        return nil, nil, nil, errors.New("animated images are not supported")
+    }
+
+    return data, chunks, info, nil
+}
+
+func decodeInto(data []byte, chunks []Chunk, dst draw.Image, at image.Point) error {
+    for _, c := range chunks {
+        if c.FourCC != "VP8L" {
+            continue
+        }
+
+        d := vp8lDecoderPool.Get().(*vp8lDecoder)
+        defer vp8lDecoderPool.Put(d)
+
+        if err := d.decodeHeader(c.Payload()); err != nil {
+            return err
+        }
+
+        pixels, err := d.decodeImage()
+        if err != nil {
+            return err
+        }
+
+        writeARGB(dst, at, pixels, d.width, d.height)
+        return nil
+    }
+
+    img, err := decoderWebP.Decode(bytes.NewReader(data))
+    if err != nil {
+        return err
+    }
+
+    b := img.Bounds()
+    draw.Draw(dst, b.Sub(b.Min).Add(at), img, b.Min, draw.Src)
+    return nil
 }
 
 // DecodeIgnoreAlphaFlag reads a WebP image from the provided io.Reader and returns it as an image.Image.
@@ -59,31 +405,35 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 // This function is a wrapper around the underlying WebP decode package (golang.org/x/image/webp).
 // It supports both lossy and lossless WebP formats, decoding the image accordingly.
 //
+// The input is read up to the size given in its RIFF header and its chunks are walked with bounds
+// checks, so malformed containers are reported as ErrInvalidRIFF, ErrTruncated or ErrInvalidChunk.
+//
 // Parameters:
 //   r - The source io.Reader containing the WebP encoded image.
 //
 // Returns:
 //   The decoded image as image.Image or an error if the decoding fails.
 func DecodeIgnoreAlphaFlag(r io.Reader) (image.Image, error) {
-    data, err := io.ReadAll(r)
+    data, err := readRIFF(r, 0)
     if err != nil {
         return nil, err
     }
 
-    if len(data) >= 30 && string(data[8:16]) == "WEBPVP8X" {
-        for i := 30; i + 8 < len(data); {
+    chunks, err := parseRIFF(data)
+    if err != nil {
+        return nil, err
+    }
+
+    if len(chunks) > 0 && chunks[0].FourCC == "VP8X" && chunks[0].Size >= 1 {
+        for _, c := range chunks[1:] {
             // Detect VP8L chunk, which handles transparency internally.
             // The x/image/webp package misinterprets this, so we clear the alpha flag.
-            if string(data[i: i + 4]) == "VP8L" {
-                flags := binary.LittleEndian.Uint32(data[20:24])
-                flags &^= 0x00000010
-                binary.LittleEndian.PutUint32(data[20:24], flags)
+            if c.FourCC == "VP8L" {
+                data[chunks[0].Offset + 8] &^= vp8xAlpha
                 break
             }
-
-            i += 8 + int(binary.LittleEndian.Uint32(data[i + 4: i + 8]))
         }
     }
 
     return decoderWebP.Decode(bytes.NewReader(data))
-}
\ No newline at end of file
+}
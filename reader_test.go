@@ -4,6 +4,7 @@ import (
     //------------------------------
     //general
     //------------------------------
+    "fmt"
     "bytes"
     "encoding/binary"
     //------------------------------
@@ -13,6 +14,10 @@ import (
     "image/color"
     "image/draw"
     //------------------------------
+    //errors
+    //------------------------------
+    "errors"
+    //------------------------------
     //testing
     //------------------------------
     "testing"
@@ -59,7 +64,7 @@ func TestDecode(t *testing.T) {
         {
             nil,    // if nil is used create a non-webp buffer
             false,
-            "riff: missing RIFF chunk header",
+            "invalid RIFF header",
         },
     }{
 
@@ -147,7 +152,7 @@ func TestDecodeConfig(t *testing.T) {
             color.GrayModel,
             0,
             0,
-            "riff: missing RIFF chunk header",
+            "invalid RIFF header",
         },
     }{
 
@@ -190,6 +195,41 @@ func TestDecodeConfig(t *testing.T) {
     }
 }
 
+func TestDecodeErrors(t *testing.T) {
+    still := new(bytes.Buffer)
+    Encode(still, generateTestImageNRGBA(8, 16, 64, false), nil)
+
+    for id, tt := range []struct {
+        input       []byte
+        expectedErr error
+    }{
+        {   // a file cut off inside its image data
+            still.Bytes()[:still.Len() - 4],
+            ErrTruncated,
+        },
+        {   // a file cut off inside its RIFF header
+            still.Bytes()[:10],
+            ErrInvalidRIFF,
+        },
+        {   // a chunk size larger than the file
+            []byte("RIFF\x0c\x00\x00\x00WEBPVP8L\xff\xff\xff\xff"),
+            ErrInvalidChunk,
+        },
+        {   // a chunk size that would overflow when added to the offset
+            []byte("RIFF\x1e\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x10\x00\x00\x00\x00\x00\x00\x00\x00\x00VP8L\xf0\xff\xff\xff"),
+            ErrInvalidChunk,
+        },
+    }{
+        if _, err := Decode(bytes.NewReader(tt.input)); !errors.Is(err, tt.expectedErr) {
+            t.Errorf("test %v: Decode expected err as %v got %v", id, tt.expectedErr, err)
+        }
+
+        if _, err := DecodeConfig(bytes.NewReader(tt.input)); !errors.Is(err, tt.expectedErr) {
+            t.Errorf("test %v: DecodeConfig expected err as %v got %v", id, tt.expectedErr, err)
+        }
+    }
+}
+
 func TestDecodeIgnoreAlphaFlag(t *testing.T) {
     for id, tt := range []struct {
         useExtendedFormat       bool
@@ -275,4 +315,360 @@ func TestDecodeIgnoreAlphaFlagSearchChunk(t *testing.T) {
         t.Errorf("expected err as nil got %v", err)
         return
     }
-}
\ No newline at end of file
+}
+func TestDecodeIgnoreAlphaFlagErrors(t *testing.T) {
+    for id, tt := range []struct {
+        input       []byte
+        expectedErr error
+    }{
+        {
+            []byte("RIFF"),
+            ErrInvalidRIFF,
+        },
+        {
+            []byte("RIFF\x02\x00\x00\x00WEBP"),
+            ErrInvalidRIFF,
+        },
+        {   // a RIFF size larger than the input
+            []byte("RIFF\xff\xff\xff\xffWEBPVP8X\x0a\x00\x00\x00"),
+            ErrTruncated,
+        },
+        {   // a chunk size that would overflow when added to the offset
+            []byte("RIFF\x1e\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x10\x00\x00\x00\x00\x00\x00\x00\x00\x00VP8L\xf0\xff\xff\xff"),
+            ErrInvalidChunk,
+        },
+        {   // a truncated chunk header
+            []byte("RIFF\x0a\x00\x00\x00WEBPVP8X\x0a\x00"),
+            ErrInvalidChunk,
+        },
+    }{
+        _, err := DecodeIgnoreAlphaFlag(bytes.NewReader(tt.input))
+        if !errors.Is(err, tt.expectedErr) {
+            t.Errorf("test %v: expected err as %v got %v", id, tt.expectedErr, err)
+        }
+    }
+}
+
+func TestDecodeWithOptions(t *testing.T) {
+    still := new(bytes.Buffer)
+    Encode(still, generateTestImageNRGBA(8, 16, 64, false), nil)
+
+    animated := new(bytes.Buffer)
+    EncodeAll(animated, &Animation{
+        Images:     []image.Image{
+            generateTestImageNRGBA(16, 16, 64, false),
+            generateTestImageNRGBA(4, 4, 64, false),
+            generateTestImageNRGBA(4, 4, 64, false),
+        },
+        Durations:  []uint{100, 100, 100},
+        Disposals:  []uint{0, 0, 0},
+    }, nil)
+
+    // a VP8L header claiming the maximum size of 16384x16384 without any image data
+    bomb := []byte("RIFF\x12\x00\x00\x00WEBPVP8L\x05\x00\x00\x00\x2f\xff\xff\xff\x0f\x00")
+
+    for id, tt := range []struct {
+        input       []byte
+        options     *DecodeOptions
+        expectedErr error
+    }{
+        {still.Bytes(), nil, nil},
+        {still.Bytes(), &DecodeOptions{}, nil},
+        {still.Bytes(), &DecodeOptions{MaxPixels: 128, MaxFrames: 1, MaxCanvasArea: 128, MaxInputBytes: int64(still.Len())}, nil},
+        {still.Bytes(), &DecodeOptions{MaxPixels: 127}, ErrLimitExceeded},
+        {still.Bytes(), &DecodeOptions{MaxCanvasArea: 127}, ErrLimitExceeded},
+        {still.Bytes(), &DecodeOptions{MaxInputBytes: int64(still.Len() - 1)}, ErrLimitExceeded},
+        {animated.Bytes(), &DecodeOptions{MaxFrames: 2}, ErrLimitExceeded},
+        {animated.Bytes(), &DecodeOptions{MaxCanvasArea: 255}, ErrLimitExceeded},
+        {animated.Bytes(), &DecodeOptions{MaxPixels: 255}, ErrLimitExceeded},
+        {bomb, &DecodeOptions{MaxPixels: 1 << 24}, ErrLimitExceeded},
+        {[]byte("RIFF\xff\xff\xff\xffWEBP"), &DecodeOptions{MaxInputBytes: 1 << 20}, ErrLimitExceeded},
+    }{
+        img, err := DecodeWithOptions(bytes.NewReader(tt.input), tt.options)
+        if !errors.Is(err, tt.expectedErr) {
+            t.Errorf("test %v: expected err as %v got %v", id, tt.expectedErr, err)
+            continue
+        }
+
+        if err == nil && img.Bounds() != image.Rect(0, 0, 8, 16) {
+            t.Errorf("test %v: expected bounds as %v got %v", id, image.Rect(0, 0, 8, 16), img.Bounds())
+        }
+    }
+}
+
+func TestDecodeWithOptionsStreaming(t *testing.T) {
+    frame := generateTestImageNoise(64, 64, 1)
+
+    animated := new(bytes.Buffer)
+    EncodeAll(animated, &Animation{
+        Images:     []image.Image{frame, frame, frame, frame},
+        Durations:  []uint{100, 100, 100, 100},
+        Disposals:  []uint{0, 0, 0, 0},
+    }, nil)
+
+    for id, tt := range []struct {
+        options     *DecodeOptions
+        maxRead     int
+    }{
+        // the first frame header is rejected before its payload is read
+        {&DecodeOptions{MaxPixels: 64 * 64 - 1}, 128},
+        // the third frame header is rejected before its payload is read
+        {&DecodeOptions{MaxFrames: 2}, animated.Len() / 2 + 128},
+    }{
+        r := bytes.NewReader(animated.Bytes())
+        if _, err := DecodeWithOptions(r, tt.options); !errors.Is(err, ErrLimitExceeded) {
+            t.Errorf("test %v: expected err as %v got %v", id, ErrLimitExceeded, err)
+            continue
+        }
+
+        if read := animated.Len() - r.Len(); read > tt.maxRead {
+            t.Errorf("test %v: expected at most %v bytes to be read got %v", id, tt.maxRead, read)
+        }
+    }
+}
+
+func TestDecodeWithOptionsImageType(t *testing.T) {
+    gray := image.NewGray(image.Rect(0, 0, 9, 7))
+    for i := range gray.Pix {
+        gray.Pix[i] = uint8(i * 11)
+    }
+
+    opaque := generateTestImageNRGBA(9, 7, 64, false)
+    transparent := generateTestImageNRGBA(9, 7, 64, true)
+
+    for id, tt := range []struct {
+        img         image.Image
+        options     *DecodeOptions
+        expected    string
+    }{
+        {generateTestImagePaletted(13, 5, 2), &DecodeOptions{Paletted: true}, "*image.Paletted"},
+        {generateTestImagePaletted(13, 5, 4), &DecodeOptions{Paletted: true, Compact: true}, "*image.Paletted"},
+        {generateTestImagePaletted(13, 5, 16), &DecodeOptions{Paletted: true}, "*image.Paletted"},
+        {generateTestImagePaletted(13, 5, 65), &DecodeOptions{Paletted: true}, "*image.Paletted"},
+        {generateTestImagePaletted(13, 5, 16), &DecodeOptions{Compact: true}, "*image.NRGBA"},
+        {generateTestImagePaletted(13, 5, 16), nil, "*image.NRGBA"},
+        {opaque, &DecodeOptions{Paletted: true}, "*image.NRGBA"},
+        {gray, &DecodeOptions{Compact: true}, "*image.Gray"},
+        {opaque, &DecodeOptions{Compact: true}, "*image.RGBA"},
+        {transparent, &DecodeOptions{Compact: true}, "*image.NRGBA"},
+    }{
+        buf := new(bytes.Buffer)
+        if err := Encode(buf, tt.img, nil); err != nil {
+            t.Fatalf("test %v: unexpected error %v", id, err)
+        }
+
+        img, err := DecodeWithOptions(buf, tt.options)
+        if err != nil {
+            t.Errorf("test %v: unexpected error %v", id, err)
+            continue
+        }
+
+        if typ := fmt.Sprintf("%T", img); typ != tt.expected {
+            t.Errorf("test %v: expected image type as %v got %v", id, tt.expected, typ)
+        }
+
+        b := tt.img.Bounds()
+        for y := b.Min.Y; y < b.Max.Y; y++ {
+            for x := b.Min.X; x < b.Max.X; x++ {
+                c1 := color.NRGBAModel.Convert(tt.img.At(x, y))
+                c2 := color.NRGBAModel.Convert(img.At(x - b.Min.X, y - b.Min.Y))
+                if c1 != c2 {
+                    t.Errorf("test %v: expected color at (%v, %v) as %v got %v", id, x, y, c1, c2)
+                    return
+                }
+            }
+        }
+
+        // the recovered palette holds the colors used by the source, without additions
+        if p, ok := img.(*image.Paletted); ok {
+            used := make(map[color.Color]bool)
+            for _, i := range tt.img.(*image.Paletted).Pix {
+                used[color.NRGBAModel.Convert(tt.img.(*image.Paletted).Palette[i])] = true
+            }
+
+            if len(p.Palette) != len(used) {
+                t.Errorf("test %v: expected palette with %v colors got %v", id, len(used), len(p.Palette))
+            }
+        }
+    }
+}
+
+func TestNewPaletted(t *testing.T) {
+    // indices beyond the palette decode as transparent black
+    img := newPaletted(image.Rect(0, 0, 3, 1), []uint8{0, 1, 3}, []uint32{0xff102030, 0x80405060})
+
+    expected := color.Palette{
+        color.NRGBA{0x10, 0x20, 0x30, 0xff},
+        color.NRGBA{0x40, 0x50, 0x60, 0x80},
+        color.NRGBA{},
+        color.NRGBA{},
+    }
+
+    if len(img.Palette) != len(expected) {
+        t.Fatalf("expected palette length as %v got %v", len(expected), len(img.Palette))
+    }
+
+    for i := range expected {
+        if img.Palette[i] != expected[i] {
+            t.Errorf("expected palette entry %v as %v got %v", i, expected[i], img.Palette[i])
+        }
+    }
+
+    if !bytes.Equal(img.Pix, []uint8{0, 1, 3}) {
+        t.Errorf("expected indices as %v got %v", []uint8{0, 1, 3}, img.Pix)
+    }
+}
+
+func TestDecodeInto(t *testing.T) {
+    img := generateTestImageNRGBA(8, 6, 64, true)
+    buf := new(bytes.Buffer)
+    Encode(buf, img, nil)
+
+    background := color.NRGBA{10, 20, 30, 40}
+
+    for id, tt := range []struct {
+        dst         draw.Image
+        at          image.Point
+    }{
+        {image.NewNRGBA(image.Rect(0, 0, 8, 6)), image.Point{}},
+        {image.NewNRGBA(image.Rect(0, 0, 12, 12)), image.Point{3, 4}},
+        {image.NewNRGBA(image.Rect(-2, -2, 5, 5)), image.Point{-3, 1}},
+        {image.NewRGBA(image.Rect(0, 0, 12, 12)), image.Point{2, 2}},
+        {image.NewRGBA64(image.Rect(0, 0, 12, 12)), image.Point{1, 3}},
+    }{
+        draw.Draw(tt.dst, tt.dst.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+
+        expected := image.NewRGBA64(tt.dst.Bounds())
+        draw.Draw(expected, expected.Bounds(), tt.dst, tt.dst.Bounds().Min, draw.Src)
+        draw.Draw(expected, img.Bounds().Add(tt.at), img, image.Point{}, draw.Src)
+
+        if err := DecodeInto(bytes.NewReader(buf.Bytes()), tt.dst, tt.at); err != nil {
+            t.Errorf("test %v: unexpected error %v", id, err)
+            continue
+        }
+
+        for y := expected.Bounds().Min.Y; y < expected.Bounds().Max.Y; y++ {
+            for x := expected.Bounds().Min.X; x < expected.Bounds().Max.X; x++ {
+                if tt.dst.At(x, y) != tt.dst.ColorModel().Convert(expected.At(x, y)) {
+                    t.Errorf("test %v: pixel mismatch at (%v, %v) expected %v got %v", id, x, y, expected.At(x, y), tt.dst.At(x, y))
+                    return
+                }
+            }
+        }
+    }
+
+    animated := new(bytes.Buffer)
+    EncodeAll(animated, &Animation{
+        Images:     []image.Image{img, img},
+        Durations:  []uint{100, 100},
+        Disposals:  []uint{0, 0},
+    }, nil)
+
+    expectedErr := "animated images are not supported"
+    err := DecodeInto(animated, image.NewNRGBA(image.Rect(0, 0, 8, 6)), image.Point{})
+    if err == nil || err.Error() != expectedErr {
+        t.Errorf("expected err as %v got %v", expectedErr, err)
+    }
+}
+
+func TestDecodeNRGBA(t *testing.T) {
+    large := new(bytes.Buffer)
+    Encode(large, generateTestImageNRGBA(16, 16, 64, true), nil)
+
+    small := new(bytes.Buffer)
+    Encode(small, generateTestImageNRGBA(5, 3, 32, false), nil)
+
+    var dst *image.NRGBA
+    var pix []uint8
+    for id, tt := range []struct {
+        input       []byte
+        reused      bool
+    }{
+        {large.Bytes(), false},
+        {small.Bytes(), true},
+        {large.Bytes(), true},
+    }{
+        img, err := DecodeNRGBA(bytes.NewReader(tt.input), dst)
+        if err != nil {
+            t.Fatalf("test %v: unexpected error %v", id, err)
+        }
+
+        if tt.reused != (dst != nil && &img.Pix[:1][0] == &pix[0]) {
+            t.Errorf("test %v: expected buffer reuse as %v", id, tt.reused)
+        }
+
+        expected, err := Decode(bytes.NewReader(tt.input))
+        if err != nil {
+            t.Fatalf("test %v: unexpected error %v", id, err)
+        }
+
+        if img.Bounds() != expected.Bounds() || !bytes.Equal(img.Pix, expected.(*image.NRGBA).Pix) {
+            t.Errorf("test %v: decoded image does not match Decode", id)
+        }
+
+        dst, pix = img, img.Pix
+    }
+
+    _, err := DecodeNRGBA(bytes.NewReader([]byte("RIFF")), nil)
+    if !errors.Is(err, ErrInvalidRIFF) {
+        t.Errorf("expected err as %v got %v", ErrInvalidRIFF, err)
+    }
+}
+
+func fuzzSeeds(f *testing.F) {
+    for _, useAlpha := range []bool{false, true} {
+        for _, useExtendedFormat := range []bool{false, true} {
+            buf := new(bytes.Buffer)
+            Encode(buf, generateTestImageNRGBA(8, 8, 64, useAlpha), &Options{UseExtendedFormat: useExtendedFormat})
+            f.Add(buf.Bytes())
+        }
+    }
+
+    buf := new(bytes.Buffer)
+    EncodeAll(buf, &Animation{
+        Images:     []image.Image{generateTestImageNRGBA(8, 8, 64, false), generateTestImageNRGBA(8, 8, 64, true)},
+        Durations:  []uint{100, 100},
+        Disposals:  []uint{0, 1},
+    }, nil)
+    f.Add(buf.Bytes())
+
+    f.Add([]byte("RIFF\xff\xff\xff\xffWEBPVP8X\xff\xff\xff\xff"))
+    f.Add([]byte("RIFF\x1e\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x10\x00\x00\x00\x00\x00\x00\x00\x00\x00VP8L\xf0\xff\xff\xff"))
+}
+
+func FuzzDecode(f *testing.F) {
+    fuzzSeeds(f)
+    f.Fuzz(func(t *testing.T, data []byte) {
+        img, err := Decode(bytes.NewReader(data))
+        if err == nil && img == nil {
+            t.Errorf("expected an image or an error")
+        }
+    })
+}
+
+func FuzzDecodeConfig(f *testing.F) {
+    fuzzSeeds(f)
+    f.Fuzz(func(t *testing.T, data []byte) {
+        DecodeConfig(bytes.NewReader(data))
+    })
+}
+
+func FuzzDecodeIgnoreAlphaFlag(f *testing.F) {
+    fuzzSeeds(f)
+    f.Fuzz(func(t *testing.T, data []byte) {
+        img, err := DecodeIgnoreAlphaFlag(bytes.NewReader(data))
+        if err == nil && img == nil {
+            t.Errorf("expected an image or an error")
+        }
+    })
+}
+
+func FuzzDecodeNRGBA(f *testing.F) {
+    fuzzSeeds(f)
+    f.Fuzz(func(t *testing.T, data []byte) {
+        img, err := DecodeNRGBA(bytes.NewReader(data), nil)
+        if err == nil && img == nil {
+            t.Errorf("expected an image or an error")
+        }
+    })
+}
@@ -4,8 +4,9 @@ import (
     //------------------------------
     //general
     //------------------------------
-    "math"
     "slices"
+    "sync"
+    "sync/atomic"
     //------------------------------
     //imaging
     //------------------------------
@@ -26,67 +27,91 @@ const (
     transformColorIndexing  = transform(3)     
 )
 
-func applyPredictTransform(pixels []color.NRGBA, width, height int) (int, int, int, []color.NRGBA) {
+// applyPredictTransform replaces pixels by their residuals, using the scratch memory of b, which may be nil.
+func applyPredictTransform(pixels []color.NRGBA, width, height, concurrency int, b *encodeBuffers) (int, int, int, []color.NRGBA) {
+    if b == nil {
+        b = &encodeBuffers{}
+    }
+
     tileBits := 4
     tileSize := 1 << tileBits
     bw := (width + tileSize - 1) / tileSize
     bh := (height + tileSize - 1) / tileSize
 
+    // The residuals of a row of tiles are predicted from the original pixels of the row above it,
+    // so the picked residuals are kept in deltas and only written back over the pixels once the
+    // next row of tiles has been predicted. Every delta and residual is written before it is
+    // read, so reused buffers are not cleared.
     blocks := make([]color.NRGBA, bw * bh)
-    deltas := make([]color.NRGBA, width * height)
-    
-    accum := [][]int{
-        make([]int, 256),
-        make([]int, 256),
-        make([]int, 256),
-        make([]int, 256),
-        make([]int, 40),
-    }
-
-    histos := make([][]int, len(accum))
-    for i := range accum {
-        histos[i] = make([]int, len(accum[i]))
+    b.deltas = resizeBuffer(b.deltas, min(tileSize, height) * width)
+    deltas := b.deltas
+    pendingY := -1
+
+    // The entropy of a mode is estimated from the histograms of the residuals picked so far
+    // plus the residuals of the tile. Only the sum of squared counts is needed, so it is kept
+    // up to date for the picked residuals and the change caused by a tile is computed from
+    // the bins the tile touches.
+    var accum, counts [4][256]int
+    var accumSquares [4]int
+    accumSum := 0
+
+    // Predictions only depend on the original pixels, so the residuals of all 14 modes
+    // are computed in parallel, one row of tiles at a time. Picking the best mode depends
+    // on the modes picked for earlier tiles and stays sequential, which keeps the output
+    // identical for any number of workers.
+    residuals := b.residuals[:]
+    for i := range residuals {
+        residuals[i] = resizeBuffer(residuals[i], min(tileSize, height) * width)
     }
 
     for y := 0; y < bh; y++ {
+        startY := y << tileBits
+        endY := min((y + 1) << tileBits, height)
+
+        parallelFor(bw, concurrency, func(x int) {
+            for i := 0; i < 14; i++ {
+                predictResiduals(residuals[i], pixels, width, i, x << tileBits, min((x + 1) << tileBits, width), startY, endY)
+            }
+        })
+
+        if pendingY >= 0 {
+            copy(pixels[pendingY * width : startY * width], deltas)
+        }
+        pendingY = startY
+
         for x := 0; x < bw; x++ {
             mx := min((x + 1) << tileBits, width)
-            my := min((y + 1) << tileBits, height)
+            n := (mx - x << tileBits) * (endY - startY)
 
             var best int
             var bestEntropy float64
             for i := 0; i < 14; i++ {
-                for j := range accum {
-                    copy(histos[j], accum[j])
+                for ty := 0; ty < endY - startY; ty++ {
+                    for _, r := range residuals[i][ty * width + x << tileBits : ty * width + mx] {
+                        counts[0][r.R]++
+                        counts[1][r.G]++
+                        counts[2][r.B]++
+                        counts[3][r.A]++
+                    }
                 }
 
-                for tx := x << tileBits; tx < mx; tx++ {
-                    for ty := y << tileBits; ty < my; ty++ {
-                        d := applyFilter(pixels, width, tx, ty, i)
-
-                        off := ty * width + tx
-                        histos[0][int(uint8(pixels[off].R - d.R))]++
-                        histos[1][int(uint8(pixels[off].G - d.G))]++
-                        histos[2][int(uint8(pixels[off].B - d.B))]++
-                        histos[3][int(uint8(pixels[off].A - d.A))]++
+                // the touched bins are visited again to add their change and clear the counts,
+                // a bin that is visited twice adds nothing the second time
+                squares := accumSquares
+                for ty := 0; ty < endY - startY; ty++ {
+                    for _, r := range residuals[i][ty * width + x << tileBits : ty * width + mx] {
+                        squares[0] += squaresDelta(&accum[0], &counts[0], r.R)
+                        squares[1] += squaresDelta(&accum[1], &counts[1], r.G)
+                        squares[2] += squaresDelta(&accum[2], &counts[2], r.B)
+                        squares[3] += squaresDelta(&accum[3], &counts[3], r.A)
                     }
                 }
 
+                sum := float64(accumSum + n)
+
                 var total float64
-                for _, histo := range histos {
-                    sum := 0
-                    sumSquares := 0
-                
-                    for _, count := range histo {
-                        sum += count
-                        sumSquares += count * count
-                    }
-                
-                    if sum == 0 {
-                        continue
-                    }
-                
-                    total += 1.0 - float64(sumSquares) / (float64(sum) * float64(sum))    
+                for c := range squares {
+                    total += 1.0 - float64(squares[c]) / (sum * sum)
                 }
 
                 if i == 0 || total < bestEntropy {
@@ -95,121 +120,215 @@ func applyPredictTransform(pixels []color.NRGBA, width, height int) (int, int, i
                 }
             }
 
-            for tx := x << tileBits; tx < mx; tx++ {
-                for ty := y << tileBits; ty < my; ty++ {
-                    d := applyFilter(pixels, width, tx, ty, best)
-                    
-                    off := ty * width + tx
-                    deltas[off] = color.NRGBA{
-                        R: uint8(pixels[off].R - d.R),
-                        G: uint8(pixels[off].G - d.G),
-                        B: uint8(pixels[off].B - d.B),
-                        A: uint8(pixels[off].A - d.A),
-                    }
-
-                    accum[0][int(uint8(pixels[off].R - d.R))]++
-                    accum[1][int(uint8(pixels[off].G - d.G))]++
-                    accum[2][int(uint8(pixels[off].B - d.B))]++
-                    accum[3][int(uint8(pixels[off].A - d.A))]++
+            for ty := 0; ty < endY - startY; ty++ {
+                row := residuals[best][ty * width + x << tileBits : ty * width + mx]
+                copy(deltas[ty * width + x << tileBits:], row)
+
+                // (n + 1)^2 - n^2 = 2n + 1
+                for _, r := range row {
+                    accumSquares[0] += 2 * accum[0][r.R] + 1
+                    accumSquares[1] += 2 * accum[1][r.G] + 1
+                    accumSquares[2] += 2 * accum[2][r.B] + 1
+                    accumSquares[3] += 2 * accum[3][r.A] + 1
+                    accum[0][r.R]++
+                    accum[1][r.G]++
+                    accum[2][r.B]++
+                    accum[3][r.A]++
                 }
             }
 
+            accumSum += n
             blocks[y * bw + x] = color.NRGBA{0, byte(best), 0, 255}
         }
     }
-    
-    copy(pixels, deltas)
-    
+
+    if pendingY >= 0 {
+        copy(pixels[pendingY * width : height * width], deltas)
+    }
+
     return tileBits, bw, bh, blocks
 }
 
-func applyFilter(pixels []color.NRGBA, width, x, y, prediction int) color.NRGBA {
-    if x == 0 && y == 0 {
-        return color.NRGBA{0, 0, 0, 255}
-    } else if x == 0 {
-        return pixels[(y - 1) * width + x]
-    } else if y == 0 {
-        return pixels[y * width + (x - 1)]
+// squaresDelta returns the change of the sum of squared counts of histo when the count of bin v
+// is added to it. The count is cleared, so the bin adds nothing when it is visited again.
+func squaresDelta(histo, counts *[256]int, v uint8) int {
+    k := counts[v]
+    delta := 2 * histo[v] * k + k * k
+    counts[v] = 0
+    return delta
+}
+
+// predictResiduals writes the residuals of a predictor mode for columns [x0, x1) of rows [y0, y1)
+// to dst, which holds rows of the image width starting at row y0. Each mode runs its own loop,
+// the first row and column are predicted from the left and top pixel as the WebP specs require.
+func predictResiduals(dst, pixels []color.NRGBA, width, mode, x0, x1, y0, y1 int) {
+    black := color.NRGBA{0, 0, 0, 255}
+
+    for y := y0; y < y1; y++ {
+        row := pixels[y * width : (y + 1) * width]
+        out := dst[(y - y0) * width : (y - y0 + 1) * width]
+
+        x := x0
+        if y == 0 {
+            if x == 0 {
+                out[0] = subPixels(row[0], black)
+                x++
+            }
+
+            for ; x < x1; x++ {
+                out[x] = subPixels(row[x], row[x - 1])
+            }
+
+            continue
+        }
+
+        // the top right pixel of the last column is the first pixel of the current row
+        top := pixels[(y - 1) * width : y * width + 1]
+        if x == 0 {
+            out[0] = subPixels(row[0], top[0])
+            x++
+        }
+
+        switch mode {
+        case 0:
+            for ; x < x1; x++ {
+                out[x] = subPixels(row[x], black)
+            }
+        case 1:
+            for ; x < x1; x++ {
+                out[x] = subPixels(row[x], row[x - 1])
+            }
+        case 2:
+            for ; x < x1; x++ {
+                out[x] = subPixels(row[x], top[x])
+            }
+        case 3:
+            for ; x < x1; x++ {
+                out[x] = subPixels(row[x], top[x + 1])
+            }
+        case 4:
+            for ; x < x1; x++ {
+                out[x] = subPixels(row[x], top[x - 1])
+            }
+        case 5:
+            for ; x < x1; x++ {
+                out[x] = subPixels(row[x], averageNRGBA(averageNRGBA(row[x - 1], top[x + 1]), top[x]))
+            }
+        case 6:
+            for ; x < x1; x++ {
+                out[x] = subPixels(row[x], averageNRGBA(row[x - 1], top[x - 1]))
+            }
+        case 7:
+            for ; x < x1; x++ {
+                out[x] = subPixels(row[x], averageNRGBA(row[x - 1], top[x]))
+            }
+        case 8:
+            for ; x < x1; x++ {
+                out[x] = subPixels(row[x], averageNRGBA(top[x - 1], top[x]))
+            }
+        case 9:
+            for ; x < x1; x++ {
+                out[x] = subPixels(row[x], averageNRGBA(top[x], top[x + 1]))
+            }
+        case 10:
+            for ; x < x1; x++ {
+                out[x] = subPixels(row[x], averageNRGBA(averageNRGBA(row[x - 1], top[x - 1]), averageNRGBA(top[x], top[x + 1])))
+            }
+        case 11:
+            for ; x < x1; x++ {
+                out[x] = subPixels(row[x], selectNRGBA(top[x], row[x - 1], top[x - 1]))
+            }
+        case 12:
+            for ; x < x1; x++ {
+                out[x] = subPixels(row[x], clampAddSubtractFullNRGBA(row[x - 1], top[x], top[x - 1]))
+            }
+        case 13:
+            for ; x < x1; x++ {
+                out[x] = subPixels(row[x], clampAddSubtractHalfNRGBA(averageNRGBA(row[x - 1], top[x]), top[x - 1]))
+            }
+        }
     }
-    
-    t := pixels[(y - 1) * width + x]
-    l := pixels[y * width + (x - 1)]
-
-    tl := pixels[(y - 1) * width + (x - 1)]
-    tr := pixels[(y - 1) * width + (x + 1)]
-
-    avarage2 := func(a, b color.NRGBA) color.NRGBA {
-        return color.NRGBA {
-            uint8((int(a.R) + int(b.R)) / 2), 
-            uint8((int(a.G) + int(b.G)) / 2),  
-            uint8((int(a.B) + int(b.B)) / 2),  
-            uint8((int(a.A) + int(b.A)) / 2),
+}
+
+// parallelFor calls fn for every index in [0, n) using at most workers goroutines.
+func parallelFor(n, workers int, fn func(i int)) {
+    if workers <= 1 || n <= 1 {
+        for i := 0; i < n; i++ {
+            fn(i)
         }
+        return
     }
 
-    filters := []func(t, l, tl, tr color.NRGBA) color.NRGBA {
-        func(t, l, tl, tr color.NRGBA) color.NRGBA { return color.NRGBA{0, 0, 0, 255} },
-        func(t, l, tl, tr color.NRGBA) color.NRGBA { return l },
-        func(t, l, tl, tr color.NRGBA) color.NRGBA { return t },
-        func(t, l, tl, tr color.NRGBA) color.NRGBA { return tr },
-        func(t, l, tl, tr color.NRGBA) color.NRGBA { return tl },
-        func(t, l, tl, tr color.NRGBA) color.NRGBA {
-            return avarage2(avarage2(l, tr), t)
-        },
-        func(t, l, tl, tr color.NRGBA) color.NRGBA {
-            return avarage2(l, tl)
-        },
-        func(t, l, tl, tr color.NRGBA) color.NRGBA {
-            return avarage2(l, t)
-        },
-        func(t, l, tl, tr color.NRGBA) color.NRGBA {
-            return avarage2(tl, t)
-        },
-        func(t, l, tl, tr color.NRGBA) color.NRGBA {
-            return avarage2(t, tr)
-        },
-        func(t, l, tl, tr color.NRGBA) color.NRGBA {
-            return avarage2(avarage2(l, tl), avarage2(t, tr))
-        },
-        func(t, l, tl, tr color.NRGBA) color.NRGBA { 
-            pr := float64(l.R) + float64(t.R) - float64(tl.R)
-            pg := float64(l.G) + float64(t.G) - float64(tl.G)
-            pb := float64(l.B) + float64(t.B) - float64(tl.B)
-            pa := float64(l.A) + float64(t.A) - float64(tl.A)
-
-            // Manhattan distances to estimates for left and top pixels.
-            pl := math.Abs(pa - float64(l.A)) + math.Abs(pr - float64(l.R)) + 
-                  math.Abs(pg - float64(l.G)) + math.Abs(pb - float64(l.B))
-            pt := math.Abs(pa - float64(t.A)) + math.Abs(pr - float64(t.R)) + 
-                  math.Abs(pg - float64(t.G)) + math.Abs(pb - float64(t.B))
-
-            if pl < pt {
-                return l
+    var next atomic.Int64
+    var wg sync.WaitGroup
+    for w := 0; w < min(workers, n); w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := int(next.Add(1)) - 1; i < n; i = int(next.Add(1)) - 1 {
+                fn(i)
             }
+        }()
+    }
 
-            return t
-        },
-        func(t, l, tl, tr color.NRGBA) color.NRGBA {
-            return color.NRGBA{
-                uint8(max(min(int(l.R) + int(t.R) - int(tl.R), 255), 0)),
-                uint8(max(min(int(l.G) + int(t.G) - int(tl.G), 255), 0)),
-                uint8(max(min(int(l.B) + int(t.B) - int(tl.B), 255), 0)),
-                uint8(max(min(int(l.A) + int(t.A) - int(tl.A), 255), 0)),
-            }
-        },
-        func(t, l, tl, tr color.NRGBA) color.NRGBA {
-            a := avarage2(l, t)
-
-            return color.NRGBA{
-                uint8(max(min(int(a.R) + (int(a.R) - int(tl.R)) / 2, 255), 0)),
-                uint8(max(min(int(a.G) + (int(a.G) - int(tl.G)) / 2, 255), 0)),
-                uint8(max(min(int(a.B) + (int(a.B) - int(tl.B)) / 2, 255), 0)),
-                uint8(max(min(int(a.A) + (int(a.A) - int(tl.A)) / 2, 255), 0)),
-            }
-        },
+    wg.Wait()
+}
+
+// subPixels returns the residual of p for the prediction d, each channel wraps around modulo 256.
+func subPixels(p, d color.NRGBA) color.NRGBA {
+    return color.NRGBA{p.R - d.R, p.G - d.G, p.B - d.B, p.A - d.A}
+}
+
+func averageNRGBA(a, b color.NRGBA) color.NRGBA {
+    return color.NRGBA{
+        uint8((uint32(a.R) + uint32(b.R)) >> 1),
+        uint8((uint32(a.G) + uint32(b.G)) >> 1),
+        uint8((uint32(a.B) + uint32(b.B)) >> 1),
+        uint8((uint32(a.A) + uint32(b.A)) >> 1),
     }
-    
-    return filters[prediction](t, l, tl, tr)
+}
+
+// selectNRGBA picks l or t, whichever is closer to the estimate l + t - tl by Manhattan distance.
+// The distance to l reduces to the distance between t and tl, and the distance to t to the one between l and tl.
+func selectNRGBA(t, l, tl color.NRGBA) color.NRGBA {
+    pl := absDiff(t.A, tl.A) + absDiff(t.R, tl.R) + absDiff(t.G, tl.G) + absDiff(t.B, tl.B)
+    pt := absDiff(l.A, tl.A) + absDiff(l.R, tl.R) + absDiff(l.G, tl.G) + absDiff(l.B, tl.B)
+
+    if pl < pt {
+        return l
+    }
+
+    return t
+}
+
+func absDiff(a, b uint8) int {
+    if a < b {
+        return int(b - a)
+    }
+
+    return int(a - b)
+}
+
+func clampAddSubtractFullNRGBA(a, b, c color.NRGBA) color.NRGBA {
+    return color.NRGBA{
+        clamp255(int(a.R) + int(b.R) - int(c.R)),
+        clamp255(int(a.G) + int(b.G) - int(c.G)),
+        clamp255(int(a.B) + int(b.B) - int(c.B)),
+        clamp255(int(a.A) + int(b.A) - int(c.A)),
+    }
+}
+
+func clampAddSubtractHalfNRGBA(a, b color.NRGBA) color.NRGBA {
+    return color.NRGBA{
+        clamp255(int(a.R) + (int(a.R) - int(b.R)) / 2),
+        clamp255(int(a.G) + (int(a.G) - int(b.G)) / 2),
+        clamp255(int(a.B) + (int(a.B) - int(b.B)) / 2),
+        clamp255(int(a.A) + (int(a.A) - int(b.A)) / 2),
+    }
+}
+
+func clamp255(v int) uint8 {
+    return uint8(max(min(v, 255), 0))
 }
 
 func applyColorTransform(pixels []color.NRGBA, width, height int) (int, int, int, []color.NRGBA) {
@@ -292,7 +411,8 @@ func applyPaletteTransform(pixels *[]color.NRGBA, width, height int) ([]color.NR
     
     pw := (width + size - 1) / size
 
-    packed := make([]color.NRGBA, pw * height)
+    // pixels are packed in place, a packed pixel is never stored after the pixels it is made of
+    packed := (*pixels)[:pw * height]
     for y := 0; y < height; y++ {
         for x := 0; x < pw; x++ {
             pack := 0
@@ -68,7 +68,7 @@ func TestApplyPredictTransform(t *testing.T) {
             continue
         }
 
-        tileBit, bw, bh, blocks := applyPredictTransform(pixels, tt.width, tt.height)
+        tileBit, bw, bh, blocks := applyPredictTransform(pixels, tt.width, tt.height, 1, nil)
 
         if bw != tt.expectedBlockWidth {
             t.Errorf("test %v: expected block width as %v got %v", id, tt.expectedBlockWidth, bw)
@@ -106,6 +106,104 @@ func TestApplyPredictTransform(t *testing.T) {
     }
 }
 
+func TestApplyPredictTransformConcurrency(t *testing.T) {
+    img := generateTestImageNRGBA(70, 45, 3.7, true)
+
+    expected, err := flatten(img)
+    if err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    _, _, _, expectedBlocks := applyPredictTransform(expected, 70, 45, 1, nil)
+
+    for _, concurrency := range []int{2, 3, 8, 100} {
+        pixels, _ := flatten(img)
+        _, _, _, blocks := applyPredictTransform(pixels, 70, 45, concurrency, nil)
+
+        if !reflect.DeepEqual(blocks, expectedBlocks) {
+            t.Errorf("concurrency %v: expected blocks as %v got %v", concurrency, expectedBlocks, blocks)
+        }
+
+        if !reflect.DeepEqual(pixels, expected) {
+            t.Errorf("concurrency %v: residuals differ from sequential transform", concurrency)
+        }
+    }
+}
+
+func TestParallelFor(t *testing.T) {
+    for id, tt := range []struct {
+        n       int
+        workers int
+    }{
+        {0, 4},
+        {1, 4},
+        {10, 1},
+        {10, 3},
+        {3, 10},
+        {1000, 8},
+    }{
+        counts := make([]int, tt.n)
+        parallelFor(tt.n, tt.workers, func(i int) {
+            counts[i]++
+        })
+
+        for i, c := range counts {
+            if c != 1 {
+                t.Errorf("test %v: expected index %v to be visited once got %v", id, i, c)
+            }
+        }
+    }
+}
+
+// applyFilter returns the prediction of a predictor mode for the pixel at x, y. It computes every
+// pixel on its own from the image, which makes it the reference predictResiduals is checked against.
+func applyFilter(pixels []color.NRGBA, width, x, y, prediction int) color.NRGBA {
+    if x == 0 && y == 0 {
+        return color.NRGBA{0, 0, 0, 255}
+    } else if x == 0 {
+        return pixels[(y - 1) * width + x]
+    } else if y == 0 {
+        return pixels[y * width + (x - 1)]
+    }
+
+    t := pixels[(y - 1) * width + x]
+    l := pixels[y * width + (x - 1)]
+
+    tl := pixels[(y - 1) * width + (x - 1)]
+    tr := pixels[(y - 1) * width + (x + 1)]
+
+    switch prediction {
+    case 1:
+        return l
+    case 2:
+        return t
+    case 3:
+        return tr
+    case 4:
+        return tl
+    case 5:
+        return averageNRGBA(averageNRGBA(l, tr), t)
+    case 6:
+        return averageNRGBA(l, tl)
+    case 7:
+        return averageNRGBA(l, t)
+    case 8:
+        return averageNRGBA(tl, t)
+    case 9:
+        return averageNRGBA(t, tr)
+    case 10:
+        return averageNRGBA(averageNRGBA(l, tl), averageNRGBA(t, tr))
+    case 11:
+        return selectNRGBA(t, l, tl)
+    case 12:
+        return clampAddSubtractFullNRGBA(l, t, tl)
+    case 13:
+        return clampAddSubtractHalfNRGBA(averageNRGBA(l, t), tl)
+    }
+
+    return color.NRGBA{0, 0, 0, 255}
+}
+
 func TestApplyFilter(t *testing.T) {
     pixels := []color.NRGBA{
         {R: 100, G: 100, B: 100, A: 255}, {R: 50, G: 50, B: 50, A: 255}, {R: 25, G: 25, B: 25, A: 255},
@@ -152,6 +250,37 @@ func TestApplyFilter(t *testing.T) {
     }
 }
 
+func TestPredictResiduals(t *testing.T) {
+    width, height := 37, 21
+    pixels, _ := flatten(generateTestImageNoise(width, height, 11))
+
+    for id, tt := range []struct {
+        x0, x1, y0, y1 int
+    }{
+        {0, 37, 0, 21},     // whole image, including the first row and column
+        {0, 16, 0, 16},     // first tile
+        {16, 32, 16, 21},   // inner tile
+        {32, 37, 5, 9},     // last column, whose top right pixel wraps to the current row
+    }{
+        for mode := 0; mode < 14; mode++ {
+            dst := make([]color.NRGBA, (tt.y1 - tt.y0) * width)
+            predictResiduals(dst, pixels, width, mode, tt.x0, tt.x1, tt.y0, tt.y1)
+
+            for y := tt.y0; y < tt.y1; y++ {
+                for x := tt.x0; x < tt.x1; x++ {
+                    p := pixels[y * width + x]
+                    d := applyFilter(pixels, width, x, y, mode)
+                    expected := color.NRGBA{p.R - d.R, p.G - d.G, p.B - d.B, p.A - d.A}
+
+                    if got := dst[(y - tt.y0) * width + x]; got != expected {
+                        t.Errorf("test %v: mode %v at %v, %v expected %v got %v", id, mode, x, y, expected, got)
+                    }
+                }
+            }
+        }
+    }
+}
+
 func TestApplyColorTransform(t *testing.T) {
     for id, tt := range []struct {
         width                   int
@@ -0,0 +1,447 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "io"
+    "fmt"
+    "encoding/binary"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    //------------------------------
+    //errors
+    //------------------------------
+    "errors"
+)
+
+// Severity classifies a Problem reported by Validate.
+type Severity int
+
+const (
+    // SeverityWarning marks deviations from the specification that most decoders tolerate.
+    SeverityWarning     = Severity(0)
+    // SeverityError marks violations that make a file invalid or that decoders are known to reject.
+    SeverityError       = Severity(1)
+)
+
+func (s Severity) String() string {
+    if s == SeverityError {
+        return "error"
+    }
+
+    return "warning"
+}
+
+// Problem describes a single spec violation found by Validate.
+//
+// Fields:
+//   - Severity: Whether the problem is a warning or an error.
+//   - Offset: Position in the file, in bytes, of the chunk or header the problem refers to.
+//   - Message: A description of the problem.
+type Problem struct {
+    Severity    Severity
+    Offset      int64
+    Message     string
+}
+
+func (p Problem) String() string {
+    return fmt.Sprintf("%v at offset %v: %v", p.Severity, p.Offset, p.Message)
+}
+
+// Validate reads a WebP file from the provided io.Reader and checks it against the container specification.
+//
+// Validation continues after a problem is found wherever possible, so a single call reports
+// every problem in the file. The pixel data is not decoded; only the container, the chunk
+// headers and the VP8 and VP8L bitstream headers are checked.
+//
+// Parameters:
+//   r - The source io.Reader containing the WebP file.
+//
+// Returns:
+//   The problems found in file order, or nil if the file conforms to the specification.
+//   A failure to read from r is reported as an error at the offset where reading stopped.
+func Validate(r io.Reader) []Problem {
+    return ValidateWithOptions(r, nil)
+}
+
+// ValidateWithOptions checks a WebP file like Validate, reading at most MaxInputBytes of o.
+//
+// Only the bytes given by the RIFF header are kept in memory, trailing data is counted while
+// it is read. A file larger than MaxInputBytes is reported as an error without reading its
+// payload. The other fields of o are ignored.
+//
+// Parameters:
+//   r - The source io.Reader containing the WebP file.
+//   o - The limits to apply, or nil for no limits.
+//
+// Returns:
+//   The problems found in file order, or nil if the file conforms to the specification.
+func ValidateWithOptions(r io.Reader, o *DecodeOptions) []Problem {
+    var maxBytes int64
+    if o != nil {
+        maxBytes = o.MaxInputBytes
+    }
+
+    v := &validator{}
+
+    // an invalid header and truncated data are reported by validate from the bytes read
+    data, err := readRIFF(r, maxBytes)
+    switch {
+    case err == nil:
+    case err == ErrInvalidRIFF, err == ErrTruncated:
+        v.validate(data, 0)
+        return v.problems
+    case errors.Is(err, ErrLimitExceeded):
+        v.add(SeverityError, 4, "%v", err)
+        return v.problems
+    default:
+        v.add(SeverityError, int64(len(data)), "read failed: " + err.Error())
+        return v.problems
+    }
+
+    trailing, err := io.Copy(io.Discard, r)
+    if err != nil {
+        v.add(SeverityError, int64(len(data)) + trailing, "read failed: " + err.Error())
+        return v.problems
+    }
+
+    v.validate(data, trailing)
+    return v.problems
+}
+
+type validator struct {
+    problems    []Problem
+}
+
+func (v *validator) add(severity Severity, offset int64, format string, args ...any) {
+    v.problems = append(v.problems, Problem{
+        Severity:   severity,
+        Offset:     offset,
+        Message:    fmt.Sprintf(format, args...),
+    })
+}
+
+// validate checks the bytes of a file, which were followed by trailing bytes after the RIFF chunk.
+func (v *validator) validate(data []byte, trailing int64) {
+    if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+        v.add(SeverityError, 0, "invalid RIFF header")
+        return
+    }
+
+    size := int64(binary.LittleEndian.Uint32(data[4:8]))
+    end := int64(len(data))
+    if size < 4 {
+        v.add(SeverityError, 4, "RIFF size %v is smaller than the WEBP signature", size)
+        return
+    } else if size + 8 > end {
+        v.add(SeverityError, 4, "RIFF size %v exceeds the file length of %v bytes", size, end - 8)
+    } else if trailing > 0 {
+        v.add(SeverityWarning, 4, "%v bytes of trailing data after the RIFF chunk", trailing)
+    }
+
+    if size & 1 != 0 {
+        v.add(SeverityWarning, 4, "RIFF size %v is odd", size)
+    }
+
+    chunks := v.scanChunks(data[12:end], 12)
+    if len(chunks) == 0 {
+        v.add(SeverityError, 12, "missing image data")
+        return
+    }
+
+    if chunks[0].FourCC == "VP8X" {
+        v.validateExtended(chunks)
+    } else {
+        v.validateSimple(chunks)
+    }
+}
+
+// scanChunks splits a list of chunks like parseChunks, but reports problems instead of failing
+// and returns the chunks that could be read before the list became unreadable.
+func (v *validator) scanChunks(data []byte, offset int64) []Chunk {
+    var chunks []Chunk
+
+    for i := 0; i < len(data); {
+        at := offset + int64(i)
+        if len(data) - i < 8 {
+            v.add(SeverityError, at, "truncated chunk header")
+            break
+        }
+
+        size := int64(binary.LittleEndian.Uint32(data[i + 4 : i + 8]))
+        if size > int64(len(data) - i - 8) {
+            v.add(SeverityError, at, "%q chunk size %v exceeds the remaining %v bytes", data[i : i + 4], size, len(data) - i - 8)
+            break
+        }
+
+        chunks = append(chunks, Chunk{
+            FourCC: string(data[i : i + 4]),
+            Offset: at,
+            Size:   uint32(size),
+            data:   data[i + 8 : i + 8 + int(size)],
+        })
+
+        i += 8 + int(size)
+        if size & 1 != 0 {
+            if i == len(data) {
+                v.add(SeverityError, at, "%q chunk with odd size %v is missing its padding byte", data[at - offset : at - offset + 4], size)
+                break
+            }
+
+            if data[i] != 0 {
+                v.add(SeverityWarning, offset + int64(i), "padding byte is not zero")
+            }
+
+            i++
+        }
+    }
+
+    return chunks
+}
+
+func (v *validator) validateSimple(chunks []Chunk) {
+    c := chunks[0]
+    switch c.FourCC {
+    case "VP8 ", "VP8L":
+        v.validateImage(c)
+    default:
+        v.add(SeverityError, c.Offset, "expected VP8X, VP8 or VP8L chunk, found %q", c.FourCC)
+    }
+
+    for _, c := range chunks[1:] {
+        v.add(SeverityError, c.Offset, "%q chunk is not allowed without a VP8X chunk", c.FourCC)
+    }
+}
+
+func (v *validator) validateExtended(chunks []Chunk) {
+    vp8x := chunks[0]
+    if len(vp8x.Payload()) < 10 {
+        v.add(SeverityError, vp8x.Offset, "VP8X chunk size %v is smaller than 10", vp8x.Size)
+        return
+    }
+
+    d := vp8x.Payload()
+    flags := d[0]
+    canvas := image.Rect(0, 0, int(read24(d[4:7])) + 1, int(read24(d[7:10])) + 1)
+
+    if flags & 0xc1 != 0 {
+        v.add(SeverityWarning, vp8x.Offset, "reserved VP8X flag bits are set")
+    }
+
+    if d[1] != 0 || d[2] != 0 || d[3] != 0 {
+        v.add(SeverityWarning, vp8x.Offset, "reserved VP8X bytes are not zero")
+    }
+
+    if uint64(canvas.Dx()) * uint64(canvas.Dy()) > 1 << 32 - 1 {
+        v.add(SeverityError, vp8x.Offset, "canvas of %vx%v exceeds 2^32 - 1 pixels", canvas.Dx(), canvas.Dy())
+    }
+
+    animated := flags & vp8xAnimation != 0
+
+    var present byte
+    var hasANIM, hasFrame, hasImage, hasALPH, alpha bool
+    for _, c := range chunks[1:] {
+        switch c.FourCC {
+        case "VP8X":
+            v.add(SeverityError, c.Offset, "duplicate VP8X chunk")
+        case "ICCP":
+            if present & vp8xICC != 0 {
+                v.add(SeverityError, c.Offset, "duplicate ICCP chunk")
+            } else if hasANIM || hasFrame || hasImage || hasALPH {
+                v.add(SeverityError, c.Offset, "ICCP chunk must precede the ANIM chunk and image data")
+            }
+            present |= vp8xICC
+        case "EXIF":
+            present |= vp8xEXIF
+        case "XMP ":
+            present |= vp8xXMP
+        case "ANIM":
+            if !animated {
+                v.add(SeverityError, c.Offset, "ANIM chunk in a file without the VP8X animation flag")
+            } else if hasANIM {
+                v.add(SeverityError, c.Offset, "duplicate ANIM chunk")
+            } else if hasFrame {
+                v.add(SeverityError, c.Offset, "ANIM chunk must precede the ANMF chunks")
+            }
+
+            if len(c.Payload()) < 6 {
+                v.add(SeverityError, c.Offset, "ANIM chunk size %v is smaller than 6", c.Size)
+            }
+            hasANIM = true
+        case "ANMF":
+            if !animated {
+                v.add(SeverityError, c.Offset, "ANMF chunk in a file without the VP8X animation flag")
+            } else if !hasANIM {
+                v.add(SeverityError, c.Offset, "ANMF chunk before the ANIM chunk")
+            }
+
+            alpha = v.validateFrame(c, canvas) || alpha
+            hasFrame = true
+        case "ALPH":
+            if animated {
+                v.add(SeverityError, c.Offset, "ALPH chunk outside of an ANMF chunk in an animation")
+            } else if hasALPH {
+                v.add(SeverityError, c.Offset, "duplicate ALPH chunk")
+            } else if hasImage {
+                v.add(SeverityError, c.Offset, "ALPH chunk must precede the image data")
+            }
+            hasALPH = true
+        case "VP8 ", "VP8L":
+            if animated {
+                v.add(SeverityError, c.Offset, "%q chunk outside of an ANMF chunk in an animation", c.FourCC)
+                break
+            } else if hasImage {
+                v.add(SeverityError, c.Offset, "duplicate image data")
+                break
+            }
+
+            hasImage = true
+            header, bounds, ok := v.validateImage(c)
+            if !ok {
+                break
+            }
+
+            if bounds != canvas {
+                v.add(SeverityError, c.Offset, "image size %vx%v does not match the canvas size %vx%v",
+                    bounds.Dx(), bounds.Dy(), canvas.Dx(), canvas.Dy())
+            }
+
+            if c.FourCC == "VP8L" {
+                alpha = header.AlphaHint
+                if hasALPH {
+                    v.add(SeverityWarning, c.Offset, "ALPH chunk is ignored for VP8L image data")
+                }
+            } else {
+                alpha = hasALPH
+            }
+        }
+    }
+
+    if animated {
+        if !hasANIM {
+            v.add(SeverityError, vp8x.Offset, "VP8X animation flag is set but the ANIM chunk is missing")
+        }
+
+        if !hasFrame {
+            v.add(SeverityError, vp8x.Offset, "VP8X animation flag is set but there are no ANMF chunks")
+        }
+    } else if !hasImage {
+        v.add(SeverityError, vp8x.Offset, "missing image data")
+    }
+
+    for _, f := range []struct {
+        flag    byte
+        fourCC  string
+    }{
+        {vp8xICC, "ICCP"},
+        {vp8xEXIF, "EXIF"},
+        {vp8xXMP, "XMP "},
+    }{
+        if flags & f.flag != 0 && present & f.flag == 0 {
+            v.add(SeverityWarning, vp8x.Offset, "VP8X flag for %q is set but the chunk is missing", f.fourCC)
+        } else if flags & f.flag == 0 && present & f.flag != 0 {
+            v.add(SeverityWarning, vp8x.Offset, "%q chunk is present but its VP8X flag is not set", f.fourCC)
+        }
+    }
+
+    if alpha && flags & vp8xAlpha == 0 {
+        v.add(SeverityWarning, vp8x.Offset, "image data has alpha but the VP8X alpha flag is not set")
+    }
+}
+
+// validateFrame checks an ANMF chunk against the canvas and reports whether the frame has alpha.
+func (v *validator) validateFrame(c Chunk, canvas image.Rectangle) bool {
+    d := c.Payload()
+    if len(d) < 16 {
+        v.add(SeverityError, c.Offset, "ANMF chunk size %v is smaller than 16", c.Size)
+        return false
+    }
+
+    // WebP specs stores frame offsets divided by 2
+    x := int(read24(d[0:3])) * 2
+    y := int(read24(d[3:6])) * 2
+    bounds := image.Rect(x, y, x + int(read24(d[6:9])) + 1, y + int(read24(d[9:12])) + 1)
+
+    if !bounds.In(canvas) {
+        v.add(SeverityError, c.Offset, "frame %v exceeds the canvas %v", bounds, canvas)
+    }
+
+    if d[15] & 0xfc != 0 {
+        v.add(SeverityWarning, c.Offset, "reserved ANMF flag bits are set")
+    }
+
+    var hasImage, hasALPH, alpha bool
+    for _, fc := range v.scanChunks(d[16:], c.Offset + 8 + 16) {
+        switch fc.FourCC {
+        case "ALPH":
+            if hasALPH {
+                v.add(SeverityError, fc.Offset, "duplicate ALPH chunk")
+            } else if hasImage {
+                v.add(SeverityError, fc.Offset, "ALPH chunk must precede the image data")
+            }
+            hasALPH = true
+        case "VP8 ", "VP8L":
+            if hasImage {
+                v.add(SeverityError, fc.Offset, "duplicate image data")
+                break
+            }
+
+            hasImage = true
+            header, size, ok := v.validateImage(fc)
+            if !ok {
+                break
+            }
+
+            if size.Dx() != bounds.Dx() || size.Dy() != bounds.Dy() {
+                v.add(SeverityError, fc.Offset, "image size %vx%v does not match the frame size %vx%v",
+                    size.Dx(), size.Dy(), bounds.Dx(), bounds.Dy())
+            }
+
+            if fc.FourCC == "VP8L" {
+                alpha = header.AlphaHint
+            } else {
+                alpha = hasALPH
+            }
+        default:
+            // unknown chunks are allowed at the end of the frame data
+            if !hasImage {
+                v.add(SeverityWarning, fc.Offset, "unexpected %q chunk in ANMF chunk", fc.FourCC)
+            }
+        }
+    }
+
+    if !hasImage {
+        v.add(SeverityError, c.Offset, "ANMF chunk is missing image data")
+    }
+
+    return alpha
+}
+
+// validateImage checks the bitstream header of a VP8 or VP8L chunk and returns the image size.
+func (v *validator) validateImage(c Chunk) (*VP8LHeader, image.Rectangle, bool) {
+    if c.FourCC == "VP8 " {
+        w, h, err := parseVP8Header(c.Payload())
+        if err != nil {
+            v.add(SeverityError, c.Offset, "%v", err)
+            return nil, image.Rectangle{}, false
+        }
+
+        return nil, image.Rect(0, 0, w, h), true
+    }
+
+    d := c.Payload()
+    if len(d) < 5 || d[0] != 0x2f {
+        v.add(SeverityError, c.Offset, "invalid VP8L signature")
+        return nil, image.Rectangle{}, false
+    }
+
+    header, _ := parseVP8LHeader(d)
+    if header.Version != 0 {
+        v.add(SeverityError, c.Offset, "invalid VP8L version %v", header.Version)
+    }
+
+    return header, image.Rect(0, 0, header.Width, header.Height), true
+}
@@ -0,0 +1,223 @@
+package nativewebp
+
+import (
+    //------------------------------
+    //general
+    //------------------------------
+    "fmt"
+    "bytes"
+    "io"
+    "reflect"
+    //------------------------------
+    //imaging
+    //------------------------------
+    "image"
+    //------------------------------
+    //errors
+    //------------------------------
+    "errors"
+    //------------------------------
+    //testing
+    //------------------------------
+    "testing"
+)
+
+func TestValidate(t *testing.T) {
+    build := func(chunks ...[]byte) []byte {
+        buf := &bytes.Buffer{}
+        for _, c := range chunks {
+            writeChunk(buf, string(c[:4]), c[4:])
+        }
+
+        out := &bytes.Buffer{}
+        writeRIFF(out, buf)
+        return out.Bytes()
+    }
+
+    vp8x := func(flags byte, w, h int) []byte {
+        buf := &bytes.Buffer{}
+        writeChunkVP8XFlags(buf, image.Rect(0, 0, w, h), flags)
+        return append([]byte("VP8X"), buf.Bytes()[8:]...)
+    }
+
+    anmf := func(x, y, w, h int, frame []byte) []byte {
+        buf := &bytes.Buffer{}
+        writeChunkANMFHeader(buf, len(frame), image.Rect(x, y, x + w, y + h), 100, 0, 0)
+        return append(append([]byte("ANMF"), buf.Bytes()[8:]...), frame...)
+    }
+
+    still := &bytes.Buffer{}
+    Encode(still, generateTestImageNRGBA(8, 8, 64, false), nil)
+    stream := still.Bytes()[20:]
+
+    extended := &bytes.Buffer{}
+    Encode(extended, generateTestImageNRGBA(8, 8, 64, true), &Options{UseExtendedFormat: true})
+
+    animated := &bytes.Buffer{}
+    EncodeAll(animated, &Animation{
+        Images:     []image.Image{generateTestImageNRGBA(8, 8, 64, false), generateTestImageNRGBA(8, 8, 64, true)},
+        Durations:  []uint{100, 100},
+        Disposals:  []uint{0, 0},
+    }, nil)
+
+    vp8 := []byte("VP8 \x10\x02\x00\x9d\x01\x2a\x08\x00\x08\x00")
+    vp8l := append([]byte("VP8L"), stream...)
+    frame := append([]byte("VP8L\x00\x00\x00\x00"), stream...)
+    frame[4] = byte(len(stream))
+
+    for id, tt := range []struct {
+        input       []byte
+        expected    []Problem
+    }{
+        {still.Bytes(), nil},
+        {extended.Bytes(), nil},
+        {animated.Bytes(), nil},
+        {build(vp8x(vp8xICC | vp8xEXIF, 8, 8), []byte("ICCPicc"), vp8, []byte("EXIFexif")), nil},
+        {
+            []byte("RIFX\x04\x00\x00\x00WEBP"),
+            []Problem{{SeverityError, 0, "invalid RIFF header"}},
+        },
+        {
+            append(still.Bytes(), 0, 0),
+            []Problem{{SeverityWarning, 4, "2 bytes of trailing data after the RIFF chunk"}},
+        },
+        {
+            still.Bytes()[:still.Len() - 2],
+            []Problem{
+                {SeverityError, 4, fmt.Sprintf("RIFF size %v exceeds the file length of %v bytes", still.Len() - 8, still.Len() - 10)},
+                {SeverityError, 12, fmt.Sprintf("\"VP8L\" chunk size %v exceeds the remaining %v bytes", len(stream), len(stream) - 2)},
+                {SeverityError, 12, "missing image data"},
+            },
+        },
+        {
+            []byte("RIFF\x0f\x00\x00\x00WEBPABCD\x03\x00\x00\x00xyz"),
+            []Problem{
+                {SeverityWarning, 4, "RIFF size 15 is odd"},
+                {SeverityError, 12, "\"ABCD\" chunk with odd size 3 is missing its padding byte"},
+                {SeverityError, 12, "expected VP8X, VP8 or VP8L chunk, found \"ABCD\""},
+            },
+        },
+        {
+            build(vp8l, []byte("EXIFexif")),
+            []Problem{{SeverityError, 20 + int64(len(stream)) + int64(len(stream) & 1), "\"EXIF\" chunk is not allowed without a VP8X chunk"}},
+        },
+        {
+            build([]byte("VP8L\x2f\x07\xc0\x00\x20")),
+            []Problem{{SeverityError, 12, "invalid VP8L version 1"}},
+        },
+        {
+            build([]byte("VP8L\x2e\x07\xc0\x00\x00")),
+            []Problem{{SeverityError, 12, "invalid VP8L signature"}},
+        },
+        {
+            build(vp8x(vp8xICC, 8, 8), vp8, []byte("ICCPicc")),
+            []Problem{{SeverityError, 48, "ICCP chunk must precede the ANIM chunk and image data"}},
+        },
+        {
+            build(vp8x(0, 8, 8), []byte("EXIFexif"), []byte("ALPH\x00"), vp8),
+            []Problem{
+                {SeverityWarning, 12, "\"EXIF\" chunk is present but its VP8X flag is not set"},
+                {SeverityWarning, 12, "image data has alpha but the VP8X alpha flag is not set"},
+            },
+        },
+        {
+            build(vp8x(vp8xXMP, 16, 8), vp8),
+            []Problem{
+                {SeverityError, 30, "image size 8x8 does not match the canvas size 16x8"},
+                {SeverityWarning, 12, "VP8X flag for \"XMP \" is set but the chunk is missing"},
+            },
+        },
+        {
+            build(vp8x(vp8xAnimation, 8, 8), []byte("ANIM\x00\x00\x00\x00\x00\x00"), anmf(2, 0, 8, 8, frame)),
+            []Problem{{SeverityError, 44, "frame (2,0)-(10,8) exceeds the canvas (0,0)-(8,8)"}},
+        },
+        {
+            build(vp8x(vp8xAnimation, 8, 8), []byte("ANIM\x00\x00\x00\x00\x00\x00"), anmf(0, 0, 4, 8, frame)),
+            []Problem{{SeverityError, 68, "image size 8x8 does not match the frame size 4x8"}},
+        },
+        {
+            build(vp8x(vp8xAnimation, 8, 8), anmf(0, 0, 8, 8, frame)),
+            []Problem{
+                {SeverityError, 30, "ANMF chunk before the ANIM chunk"},
+                {SeverityError, 12, "VP8X animation flag is set but the ANIM chunk is missing"},
+            },
+        },
+        {
+            build(vp8x(0, 8, 8), []byte("ANIM\x00\x00\x00\x00\x00\x00")),
+            []Problem{
+                {SeverityError, 30, "ANIM chunk in a file without the VP8X animation flag"},
+                {SeverityError, 12, "missing image data"},
+            },
+        },
+    }{
+        problems := Validate(bytes.NewReader(tt.input))
+        if !reflect.DeepEqual(problems, tt.expected) {
+            t.Errorf("test %v: expected problems as %v got %v", id, tt.expected, problems)
+        }
+    }
+}
+
+// failingReader returns the bytes of data and then err.
+type failingReader struct {
+    data    []byte
+    err     error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+    if len(r.data) == 0 {
+        return 0, r.err
+    }
+
+    n := copy(p, r.data)
+    r.data = r.data[n:]
+    return n, nil
+}
+
+func TestValidateWithOptions(t *testing.T) {
+    still := &bytes.Buffer{}
+    Encode(still, generateTestImageNRGBA(8, 8, 64, false), nil)
+    size := int64(still.Len())
+
+    failure := errors.New("connection reset")
+
+    for id, tt := range []struct {
+        input       io.Reader
+        options     *DecodeOptions
+        expected    []Problem
+    }{
+        {bytes.NewReader(still.Bytes()), &DecodeOptions{MaxInputBytes: size}, nil},
+        {
+            bytes.NewReader(still.Bytes()),
+            &DecodeOptions{MaxInputBytes: size - 1},
+            []Problem{{SeverityError, 4, fmt.Sprintf("decode limit exceeded: file size of %v bytes exceeds MaxInputBytes of %v", size, size - 1)}},
+        },
+        {   // trailing data is counted, not limited
+            io.MultiReader(bytes.NewReader(still.Bytes()), bytes.NewReader(make([]byte, 3000))),
+            &DecodeOptions{MaxInputBytes: size},
+            []Problem{{SeverityWarning, 4, "3000 bytes of trailing data after the RIFF chunk"}},
+        },
+        {
+            &failingReader{data: still.Bytes()[:30], err: failure},
+            nil,
+            []Problem{{SeverityError, 30, "read failed: connection reset"}},
+        },
+        {
+            &failingReader{data: append(still.Bytes(), 0, 0), err: failure},
+            nil,
+            []Problem{{SeverityError, size + 2, "read failed: connection reset"}},
+        },
+        {   // a header claiming 4 GB does not make validation read or allocate more than is there
+            bytes.NewReader([]byte("RIFF\xfe\xff\xff\xffWEBPVP8L\x00\x00\x00\x00")),
+            nil,
+            []Problem{
+                {SeverityError, 4, "RIFF size 4294967294 exceeds the file length of 12 bytes"},
+                {SeverityError, 12, "invalid VP8L signature"},
+            },
+        },
+    }{
+        problems := ValidateWithOptions(tt.input, tt.options)
+        if !reflect.DeepEqual(problems, tt.expected) {
+            t.Errorf("test %v: expected problems as %v got %v", id, tt.expected, problems)
+        }
+    }
+}
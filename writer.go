@@ -5,8 +5,11 @@ import (
     //general
     //------------------------------
     "io"
+    "fmt"
     "bytes"
     "encoding/binary"
+    "runtime"
+    "sync"
     //------------------------------
     //imaging
     //------------------------------
@@ -21,15 +24,58 @@ import (
 
 // Options holds configuration settings for WebP encoding.
 //
-// Currently, it provides a flag to enable the extended WebP format (VP8X),
-// which allows for metadata support such as EXIF, ICC color profiles, and XMP.
+// It provides a flag to enable the extended WebP format (VP8X), which allows for
+// metadata support such as EXIF, ICC color profiles, and XMP, and controls how
+// many goroutines the encoder may use.
 //
 // Fields:
 //   - UseExtendedFormat: If true, wraps the VP8L frame inside a VP8X container
 //     to enable metadata support. This does not affect image compression or
 //     encoding itself, as VP8L remains the encoding format.
+//   - Concurrency: Maximum number of goroutines used for encoding. EncodeAll encodes
+//     up to this many frames in parallel, and within an image the predictor transform
+//     tiles and the symbol histograms are computed in parallel. 0 uses
+//     runtime.GOMAXPROCS(0), 1 encodes sequentially. The output is identical for every value.
+//   - Dither: How *image.NRGBA64, *image.RGBA64 and *image.Gray16 images are reduced to
+//     the 8 bits per channel of VP8L. The default DitherNone truncates like draw.Draw.
+//   - OnReducedPrecision: Optional function called with the source image when a 16-bit image
+//     holds values that 8 bits cannot represent. EncodeAll may call it from several goroutines.
+//   - HashBits: Size of the hash table used to find backward references, as a power of two
+//     between 8 and 20. 0 uses 16.
+//   - ChainDepth: Maximum number of earlier positions with the same hash that are compared
+//     for each pixel. Higher values compress better but encode slower. 0 uses 32.
+//   - WindowSize: Maximum distance of a backward reference in pixels, up to the 2^20 - 120
+//     allowed by the WebP specs. 0 uses the maximum.
 type Options struct {
     UseExtendedFormat   bool
+    Concurrency         int
+    Dither              Dither
+    OnReducedPrecision  func(img image.Image)
+    HashBits            int
+    ChainDepth          int
+    WindowSize          int
+}
+
+func (o *Options) concurrency() int {
+    if o == nil || o.Concurrency <= 0 {
+        return runtime.GOMAXPROCS(0)
+    }
+
+    return o.Concurrency
+}
+
+func (o *Options) dither() Dither {
+    if o == nil {
+        return DitherNone
+    }
+
+    return o.Dither
+}
+
+func (o *Options) reportReducedPrecision(img image.Image) {
+    if o != nil && o.OnReducedPrecision != nil {
+        o.OnReducedPrecision(img)
+    }
 }
 
 // Animation holds configuration settings for WebP animations.
@@ -41,12 +87,15 @@ type Options struct {
 //   - Images: A list of frames to be displayed in sequence.
 //   - Durations: Timing for each frame in milliseconds, matching the Images slice.
 //   - Disposals: Disposal methods for frames after display; 0 = keep, 1 = clear to background.
+//   - Blends: Blending methods for frames; 0 = alpha-blend onto the canvas, 1 = overwrite the canvas.
+//     This field is optional, when nil all frames are alpha-blended.
 //   - LoopCount: Number of times the animation should repeat; 0 means infinite looping.
 //   - BackgroundColor: Canvas background color in BGRA order, used for clear operations.
 type Animation struct {
 	Images              []image.Image
 	Durations           []uint
 	Disposals           []uint
+	Blends              []uint
 	LoopCount           uint16
 	BackgroundColor     uint32
 }
@@ -59,6 +108,10 @@ type Animation struct {
 //
 // Note: VP8L already supports transparency, so VP8X is **not required** for alpha support.
 //
+// Memory: besides the source image and the compressed output, encoding needs at most 12 bytes
+// per pixel (the flattened pixels, the hash chain and the token stream) plus about 1 KB per pixel
+// of image width for the predictor search. The scratch memory is pooled, see Encoder.
+//
 // Parameters:
 //   w   - The destination writer where the encoded WebP image will be written.
 //   img - The input image to be encoded.
@@ -67,30 +120,9 @@ type Animation struct {
 //           extended WebP features like metadata.
 //
 // Returns:
-//   An error if encoding fails or writing to the io.Writer encounters an issue.
+//   An error if encoding fails, or a *WriteError if writing to the io.Writer fails.
 func Encode(w io.Writer, img image.Image, o *Options) error {
-    stream, hasAlpha, err := writeBitStream(img)
-    if err != nil {
-        return err
-    }
-
-    buf := &bytes.Buffer{}
-
-    if o != nil && o.UseExtendedFormat {
-        writeChunkVP8X(buf, img.Bounds(), hasAlpha, false)
-    }
-
-    buf.Write([]byte("VP8L"))
-    binary.Write(buf, binary.LittleEndian, uint32(stream.Len()))
-    buf.Write(stream.Bytes())
-
-    w.Write([]byte("RIFF"))
-    binary.Write(w, binary.LittleEndian, uint32(4 + buf.Len()))
-
-    w.Write([]byte("WEBP"))
-    w.Write(buf.Bytes())
-
-    return nil
+    return (&Encoder{Options: o}).Encode(w, img)
 }
 
 // EncodeAll writes the provided animation sequence to the specified io.Writer in WebP format.
@@ -108,58 +140,132 @@ func Encode(w io.Writer, img image.Image, o *Options) error {
 //         - Images: List of frames to encode.
 //         - Durations: Display times for each frame in milliseconds.
 //         - Disposals: Disposal methods after frame display (keep or clear).
+//         - Blends: Optional blending methods for the frames (alpha-blend or overwrite).
 //         - LoopCount: Number of times the animation should loop (0 = infinite).
 //         - BackgroundColor: Background color for the canvas, used when clearing.
 //   o   - Pointer to Options containing additional encoding settings:
 //         - UseExtendedFormat: Currently unused for animations, but accepted for consistency.
 //
 // Returns:
-//   An error if encoding fails or writing to the io.Writer encounters an issue.
+//   An error if encoding fails, or a *WriteError if writing to the io.Writer fails.
 func EncodeAll(w io.Writer, ani *Animation, o *Options) error {
-    frames, alpha, err := writeFrames(ani)
-    if err != nil {
-        return err
+    return (&Encoder{Options: o}).EncodeAll(w, ani)
+}
+
+// WriteError is returned by the encoding functions when writing to the io.Writer fails.
+//
+// The file is written as it is assembled, so a failed write can leave a partial file behind.
+//
+// Fields:
+//   - Written: Number of bytes written before the failure.
+//   - Err: The error returned by the io.Writer, or io.ErrShortWrite if it accepted fewer bytes without an error.
+type WriteError struct {
+    Written     int64
+    Err         error
+}
+
+func (e *WriteError) Error() string {
+    return fmt.Sprintf("write failed after %v bytes: %v", e.Written, e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+    return e.Err
+}
+
+// riffWriter counts the bytes written to w and keeps the first error, after which
+// all writes are skipped. This allows writing a file without checking every write.
+type riffWriter struct {
+    w       io.Writer
+    n       int64
+    err     error
+}
+
+func (rw *riffWriter) Write(p []byte) (int, error) {
+    if rw.err != nil {
+        return 0, rw.err
+    }
+
+    n, err := rw.w.Write(p)
+    rw.n += int64(n)
+    if err == nil && n < len(p) {
+        err = io.ErrShortWrite
     }
 
+    rw.err = err
+    return n, err
+}
+
+// result returns the first error as a *WriteError, or nil if every write succeeded.
+func (rw *riffWriter) result() error {
+    if rw.err != nil {
+        return &WriteError{Written: rw.n, Err: rw.err}
+    }
+
+    return nil
+}
+
+// canvasBounds returns the canvas needed to display all frames at their offsets.
+func canvasBounds(images []image.Image) image.Rectangle {
     var bounds image.Rectangle
-    for _, img := range ani.Images {
+    for _, img := range images {
         bounds.Max.X = max(img.Bounds().Max.X, bounds.Max.X)
         bounds.Max.Y = max(img.Bounds().Max.Y, bounds.Max.Y)
     }
 
-    buf := &bytes.Buffer{}
+    return bounds
+}
 
-    writeChunkVP8X(buf, bounds, alpha, true)
+func writeAnimation(w io.Writer, bounds image.Rectangle, hasAlpha bool, backgroundColor uint32, loopCount uint16, frames *bytes.Buffer) (int64, error) {
+    m := &Mux{
+        Animated:           true,
+        LoopCount:          loopCount,
+        BackgroundColor:    backgroundColor,
+    }
 
-    buf.Write([]byte("ANIM"))
-    binary.Write(buf, binary.LittleEndian, uint32(6))
-    binary.Write(buf, binary.LittleEndian, uint32(ani.BackgroundColor))
-    binary.Write(buf, binary.LittleEndian, uint16(ani.LoopCount))
+    return m.write(w, bounds, hasAlpha, frames.Bytes())
+}
 
-    buf.Write(frames.Bytes())
+func writeRIFF(w io.Writer, buf *bytes.Buffer) error {
+    rw := &riffWriter{w: w}
+    writeRIFFHeader(rw, int64(buf.Len()))
+    rw.Write(buf.Bytes())
 
-    w.Write([]byte("RIFF"))
-    binary.Write(w, binary.LittleEndian, uint32(4 + buf.Len()))
+    return rw.result()
+}
 
+// writeRIFFHeader writes the RIFF header of a file whose chunks take size bytes.
+func writeRIFFHeader(w io.Writer, size int64) {
+    w.Write([]byte("RIFF"))
+    binary.Write(w, binary.LittleEndian, uint32(4 + size))
     w.Write([]byte("WEBP"))
-    w.Write(buf.Bytes())
-
-    return nil
 }
 
-func writeChunkVP8X(buf *bytes.Buffer, bounds image.Rectangle, flagAlpha, flagAni bool) {
-    buf.Write([]byte("VP8X"))
-    binary.Write(buf, binary.LittleEndian, uint32(10))
+// VP8X feature flags as defined by the WebP specs.
+const (
+    vp8xAnimation   = 1 << 1
+    vp8xXMP         = 1 << 2
+    vp8xEXIF        = 1 << 3
+    vp8xAlpha       = 1 << 4
+    vp8xICC         = 1 << 5
+)
 
+func writeChunkVP8X(buf *bytes.Buffer, bounds image.Rectangle, flagAlpha, flagAni bool) {
     var flags byte
     if flagAni {
-        flags |= 1 << 1
+        flags |= vp8xAnimation
     }
 
     if flagAlpha {
-        flags |= 1 << 4
+        flags |= vp8xAlpha
     }
 
+    writeChunkVP8XFlags(buf, bounds, flags)
+}
+
+func writeChunkVP8XFlags(buf io.Writer, bounds image.Rectangle, flags byte) {
+    buf.Write([]byte("VP8X"))
+    binary.Write(buf, binary.LittleEndian, uint32(10))
+
     binary.Write(buf, binary.LittleEndian, flags)
     buf.Write([]byte{0x00, 0x00, 0x00})
 
@@ -170,81 +276,270 @@ func writeChunkVP8X(buf *bytes.Buffer, bounds image.Rectangle, flagAlpha, flagAn
     buf.Write([]byte{byte(dy), byte(dy >> 8), byte(dy >> 16)})
 }
 
-func writeFrames(ani *Animation) (*bytes.Buffer, bool, error) {
+func writeChunkANIM(buf io.Writer, backgroundColor uint32, loopCount uint16) {
+    buf.Write([]byte("ANIM"))
+    binary.Write(buf, binary.LittleEndian, uint32(6))
+    binary.Write(buf, binary.LittleEndian, uint32(backgroundColor))
+    binary.Write(buf, binary.LittleEndian, uint16(loopCount))
+}
+
+func writeChunkANMF(buf *bytes.Buffer, stream *bytes.Buffer, bounds image.Rectangle, duration, disposal, blend uint) error {
+    if err := writeChunkANMFHeader(buf, 8 + stream.Len(), bounds, duration, disposal, blend); err != nil {
+        return err
+    }
+
+    w := &bitWriter{}
+    w.writeBytes([]byte("VP8L"))
+    w.writeBits(uint64(stream.Len()), 32)
+    w.alignByte()
+
+    if w.Err != nil {
+        return w.Err
+    }
+
+    buf.Write(w.Buffer)
+    buf.Write(stream.Bytes())
+    return nil
+}
+
+// writeChunkANMFHeader writes the ANMF chunk header, the frame data of dataSize bytes must follow.
+// Nothing is written if a value does not fit its field, see validateFrameBounds.
+func writeChunkANMFHeader(buf *bytes.Buffer, dataSize int, bounds image.Rectangle, duration, disposal, blend uint) error {
+    if bounds.Min.X < 0 || bounds.Min.Y < 0 {
+        return errors.New("frame offsets must not be negative")
+    }
+
+    w := &bitWriter{}
+    w.writeBytes([]byte("ANMF"))
+    w.writeBits(uint64(16 + dataSize), 32)
+
+    // WebP specs requires frame offsets to be divided by 2
+    w.writeBits(uint64(bounds.Min.X / 2), 24)
+    w.writeBits(uint64(bounds.Min.Y / 2), 24)
+
+    w.writeBits(uint64(bounds.Dx() - 1), 24)
+    w.writeBits(uint64(bounds.Dy() - 1), 24)
+
+    w.writeBits(uint64(duration), 24)
+    w.writeBits(uint64(disposal), 1)
+    w.writeBits(uint64(blend), 1)
+    w.writeBits(uint64(0), 6)
+    w.alignByte()
+
+    if w.Err != nil {
+        return w.Err
+    }
+
+    buf.Write(w.Buffer)
+    return nil
+}
+
+// validateFrameBounds checks that a frame fits the 24-bit offset and size fields of an ANMF chunk
+// and a canvas of at most 2^24 pixels in each direction.
+func validateFrameBounds(bounds image.Rectangle) error {
+    if bounds.Min.X < 0 || bounds.Min.Y < 0 {
+        return errors.New("frame offsets must not be negative")
+    }
+
+    if bounds.Max.X > 1 << 24 || bounds.Max.Y > 1 << 24 {
+        return errors.New("frame exceeds the maximum canvas size")
+    }
+
+    return nil
+}
+
+func writeChunk(buf io.Writer, fourCC string, data []byte) {
+    buf.Write(chunkHeader(fourCC, len(data)))
+    buf.Write(data)
+
+    // WebP specs requires chunks with an odd size to be padded
+    if len(data) % 2 != 0 {
+        buf.Write([]byte{0x00})
+    }
+}
+
+// chunkHeader returns the header of a chunk with a payload of the given size.
+func chunkHeader(fourCC string, size int) []byte {
+    return binary.LittleEndian.AppendUint32([]byte(fourCC), uint32(size))
+}
+
+// chunkSize returns the number of bytes a chunk with a payload of the given size takes in a file.
+func chunkSize(size int) int64 {
+    return int64(8 + size + size % 2)
+}
+
+func validateAnimation(ani *Animation) error {
     if len(ani.Images) == 0 {
-        return nil, false, errors.New("must provide at least one image")
+        return errors.New("must provide at least one image")
     }
 
     if len(ani.Images) != len(ani.Durations) {
-        return nil, false, errors.New("mismatched image and durations lengths")
+        return errors.New("mismatched image and durations lengths")
     }
 
     if len(ani.Images) != len(ani.Disposals) {
-        return nil, false, errors.New("mismatched image and disposals lengths")
+        return errors.New("mismatched image and disposals lengths")
+    }
+
+    if ani.Blends != nil && len(ani.Images) != len(ani.Blends) {
+        return errors.New("mismatched image and blends lengths")
     }
 
+    return nil
+}
+
+func writeFrames(ani *Animation, o *Options, pool EncoderBufferPool) (*bytes.Buffer, bool, error) {
+    if err := validateAnimation(ani); err != nil {
+        return nil, false, err
+    }
+
+    // the frame settings are clamped into copies, so the caller's Animation is left untouched
+    durations := make([]uint, len(ani.Images))
+    disposals := make([]uint, len(ani.Images))
+    blends := make([]uint, len(ani.Images))
+
     for i := 0; i < len(ani.Images); i++ {
-        ani.Durations[i] = min(ani.Durations[i], 1 << 24 - 1)
-        ani.Disposals[i] = min(ani.Disposals[i], 1)
+        // nil images are reported by writeBitStream
+        if ani.Images[i] != nil {
+            if err := validateFrameBounds(ani.Images[i].Bounds()); err != nil {
+                return nil, false, err
+            }
+        }
+
+        durations[i] = min(ani.Durations[i], 1 << 24 - 1)
+        disposals[i] = min(ani.Disposals[i], 1)
+        if ani.Blends != nil {
+            blends[i] = min(ani.Blends[i], 1)
+        }
+    }
+
+    streams := make([]*bytes.Buffer, len(ani.Images))
+    alphas := make([]bool, len(ani.Images))
+    errs := make([]error, len(ani.Images))
+
+    // frames are independent, so they are encoded by a bounded pool of workers
+    // and assembled in order afterwards. Workers left over when there are fewer
+    // frames than workers are used inside the frames.
+    concurrency := o.concurrency()
+    workers := min(max(concurrency, 1), len(ani.Images))
+
+    frameOptions := &Options{}
+    if o != nil {
+        *frameOptions = *o
+    }
+    frameOptions.Concurrency = max(concurrency / workers, 1)
+
+    jobs := make(chan int)
+    var wg sync.WaitGroup
+    for n := 0; n < workers; n++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+
+            b := getBuffers(pool)
+            defer putBuffers(pool, b)
+
+            for i := range jobs {
+                streams[i], alphas[i], errs[i] = writeBitStream(ani.Images[i], frameOptions, b)
+            }
+        }()
+    }
+
+    for i := range ani.Images {
+        jobs <- i
     }
 
+    close(jobs)
+    wg.Wait()
+
     buf := &bytes.Buffer{}
     
     var hasAlpha bool
     for i, img := range ani.Images {
-        stream, alpha, err := writeBitStream(img)
-        if err != nil {
-            return nil, false, err
+        if errs[i] != nil {
+            return nil, false, errs[i]
         }
     
-        hasAlpha = hasAlpha || alpha
+        hasAlpha = hasAlpha || alphas[i]
 
-        w := &bitWriter{Buffer: buf}
-        w.writeBytes([]byte("ANMF"))
-        w.writeBits(uint64(16 + 8 + stream.Len()), 32)
-    
-        // WebP specs requires frame offsets to be divided by 2
-        w.writeBits(uint64(img.Bounds().Min.X / 2), 24)
-        w.writeBits(uint64(img.Bounds().Min.Y / 2), 24)
-    
-        w.writeBits(uint64(img.Bounds().Dx() - 1), 24)
-        w.writeBits(uint64(img.Bounds().Dy() - 1), 24)
-    
-        w.writeBits(uint64(ani.Durations[i]), 24)
-        w.writeBits(uint64(ani.Disposals[i]), 1)
-        w.writeBits(uint64(0), 1)
-        w.writeBits(uint64(0), 6)
-    
-        w.writeBytes([]byte("VP8L"))
-        w.writeBits(uint64(stream.Len()), 32)
-        w.Buffer.Write(stream.Bytes())
+        err := writeChunkANMF(buf, streams[i], img.Bounds(), durations[i], disposals[i], blends[i])
+        if err != nil {
+            return nil, false, err
+        }
     }
 
     return buf, hasAlpha, nil
 }
 
-func writeBitStream(img image.Image) (*bytes.Buffer, bool, error) {
+// writeBitStream encodes img as a VP8L bitstream using the scratch memory of b, which may be nil.
+func writeBitStream(img image.Image, o *Options, b *encodeBuffers) (*bytes.Buffer, bool, error) {
     if img == nil {
         return nil, false, errors.New("image is nil")
     }
 
-    if img.Bounds().Dx() < 1 || img.Bounds().Dy() < 1 {
-        return nil, false, errors.New("invalid image size")
+    if err := validateImageSize(img.Bounds().Dx(), img.Bounds().Dy()); err != nil {
+        return nil, false, err
     }
 
-    if img.Bounds().Dx() > 1 << 14 || img.Bounds().Dy() > 1 << 14 {
-        return nil, false, errors.New("invalid image size")
+    _, isIndexed := img.(*image.Paletted)
+    width, height := img.Bounds().Dx(), img.Bounds().Dy()
+
+    if b == nil {
+        b = &encodeBuffers{}
     }
 
-    _, isIndexed := img.(*image.Paletted)
+    if isHighBitDepth(img) && (o.dither() == DitherOrdered || o.dither() == DitherErrorDiffusion) {
+        pixels, reduced := reduceBitDepth(img, o.dither(), b)
+        if reduced {
+            o.reportReducedPrecision(img)
+        }
+
+        return writePixelBitStream(pixels, width, height, false, o, b)
+    }
+
+    if isHighBitDepth(img) && o != nil && o.OnReducedPrecision != nil && precisionReduced(img) {
+        o.reportReducedPrecision(img)
+    }
 
-    rgba := image.NewNRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
-    draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+    // common image types are converted by flatten directly, other types are drawn a few rows at a time
+    var pixels []color.NRGBA
+    if canFlatten(img) {
+        var err error
+        if pixels, err = flattenInto(b.pixels, img); err != nil {
+            return nil, false, err
+        }
+    } else {
+        pixels = drawPixels(b.pixels, img)
+    }
+
+    b.pixels = pixels
+    return writePixelBitStream(pixels, width, height, isIndexed, o, b)
+}
+
+func validateImageSize(width, height int) error {
+    if width < 1 || height < 1 {
+        return errors.New("invalid image size")
+    }
 
-    b := &bytes.Buffer{}
-    s := &bitWriter{Buffer: b}
+    if width > 1 << 14 || height > 1 << 14 {
+        return errors.New("invalid image size")
+    }
+
+    return nil
+}
 
-    writeBitStreamHeader(s, rgba.Bounds(), !rgba.Opaque())
+// writePixelBitStream encodes flattened pixels as a VP8L bitstream, padded to an even length.
+func writePixelBitStream(pixels []color.NRGBA, width, height int, isIndexed bool, o *Options, buffers *encodeBuffers) (*bytes.Buffer, bool, error) {
+    hasAlpha := false
+    for _, p := range pixels {
+        if p.A != 255 {
+            hasAlpha = true
+            break
+        }
+    }
+
+    s := &bitWriter{}
+    writeBitStreamHeader(s, image.Rect(0, 0, width, height), hasAlpha)
 
     var transforms [4]bool
     transforms[transformPredict] = !isIndexed
@@ -252,18 +547,21 @@ func writeBitStream(img image.Image) (*bytes.Buffer, bool, error) {
     transforms[transformSubGreen] = !isIndexed
     transforms[transformColorIndexing] = isIndexed
 
-    err := writeBitStreamData(s, rgba, 4, transforms)
+    err := writeBitStreamPixels(s, pixels, width, height, 4, transforms, o.concurrency(), o.matchFinder(), buffers)
     if err != nil {
         return nil, false, err
     }
     
     s.alignByte()
+    if s.Err != nil {
+        return nil, false, s.Err
+    }
 
-    if b.Len() % 2 != 0 {
-        b.Write([]byte{0x00})
+    if len(s.Buffer) % 2 != 0 {
+        s.Buffer = append(s.Buffer, 0x00)
     }
 
-    return b, !rgba.Opaque(), nil
+    return bytes.NewBuffer(s.Buffer), hasAlpha, nil
 }
 
 func writeBitStreamHeader(w *bitWriter, bounds image.Rectangle, hasAlpha bool) {
@@ -281,15 +579,9 @@ func writeBitStreamHeader(w *bitWriter, bounds image.Rectangle, hasAlpha bool) {
     w.writeBits(0, 3)
 }
 
-func writeBitStreamData(w *bitWriter, img image.Image, colorCacheBits int, transforms [4]bool) error {
-    pixels, err := flatten(img)
-    if err != nil {
-        return err
-    }
-
-    width := img.Bounds().Dx()
-    height := img.Bounds().Dy()
-
+// writeBitStreamPixels writes the transforms and image data of flattened pixels, the pixels are modified in place.
+// Scratch memory is taken from b, which may be nil.
+func writeBitStreamPixels(w *bitWriter, pixels []color.NRGBA, width, height, colorCacheBits int, transforms [4]bool, concurrency int, m matchFinder, b *encodeBuffers) error {
     if transforms[transformColorIndexing] {
         w.writeBits(1, 1)
         w.writeBits(3, 2)
@@ -302,7 +594,7 @@ func writeBitStreamData(w *bitWriter, img image.Image, colorCacheBits int, trans
         width = pw
        
         w.writeBits(uint64(len(pal) - 1), 8);
-        writeImageData(w, pal, len(pal), 1, false, colorCacheBits);
+        writeImageData(w, pal, len(pal), 1, false, colorCacheBits, concurrency, m, b);
     }
 
     if transforms[transformSubGreen] {
@@ -319,26 +611,27 @@ func writeBitStreamData(w *bitWriter, img image.Image, colorCacheBits int, trans
         bits, bw, bh, blocks := applyColorTransform(pixels, width, height)
 
         w.writeBits(uint64(bits - 2), 3);
-        writeImageData(w, blocks, bw, bh, false, colorCacheBits)
+        writeImageData(w, blocks, bw, bh, false, colorCacheBits, concurrency, m, b)
     }
 
     if transforms[transformPredict] {
         w.writeBits(1, 1)
         w.writeBits(0, 2)
 
-        bits, bw, bh, blocks := applyPredictTransform(pixels, width, height)
+        bits, bw, bh, blocks := applyPredictTransform(pixels, width, height, concurrency, b)
 
         w.writeBits(uint64(bits - 2), 3);
-        writeImageData(w, blocks, bw, bh, false, colorCacheBits)
+        writeImageData(w, blocks, bw, bh, false, colorCacheBits, concurrency, m, b)
     }
 
     w.writeBits(0, 1) // end of transform
-    writeImageData(w, pixels, width, height, true, colorCacheBits)
+    writeImageData(w, pixels, width, height, true, colorCacheBits, concurrency, m, b)
 
     return nil
 }
 
-func writeImageData(w *bitWriter, pixels []color.NRGBA, width, height int, isRecursive bool, colorCacheBits int) {
+// writeImageData writes the entropy coded pixels, counting the symbols with up to concurrency goroutines.
+func writeImageData(w *bitWriter, pixels []color.NRGBA, width, height int, isRecursive bool, colorCacheBits, concurrency int, m matchFinder, b *encodeBuffers) {
     if colorCacheBits > 0 {
         w.writeBits(1, 1)
         w.writeBits(uint64(colorCacheBits), 4) 
@@ -350,8 +643,8 @@ func writeImageData(w *bitWriter, pixels []color.NRGBA, width, height int, isRec
         w.writeBits(0, 1)
     }
 
-    encoded := encodeImageData(pixels, width, height, colorCacheBits)
-    histos := computeHistograms(encoded, colorCacheBits)
+    tokens := encodeImageData(pixels, width, height, colorCacheBits, m, b)
+    histos := computeHistograms(pixels, tokens, colorCacheBits, concurrency, b)
 
     var codes [][]huffmanCode
     for i := 0; i < 5; i++ {
@@ -362,135 +655,47 @@ func writeImageData(w *bitWriter, pixels []color.NRGBA, width, height int, isRec
         writehuffmanCodes(w, c)
     }
 
-    for i := 0; i < len(encoded); i ++ {
-        w.writeCode(codes[0][encoded[i + 0]])
-        if encoded[i + 0] < 256 {
-            w.writeCode(codes[1][encoded[i + 1]])
-            w.writeCode(codes[2][encoded[i + 2]])
-            w.writeCode(codes[3][encoded[i + 3]])
-            i += 3
-        } else if encoded[i + 0] < 256 + 24 {
-            cnt := prefixEncodeBits(int(encoded[i + 0]) - 256)
-            w.writeBits(uint64(encoded[i + 1]), cnt);
-
-            w.writeCode(codes[4][encoded[i + 2]])
-
-            cnt = prefixEncodeBits(int(encoded[i + 2]))
-            w.writeBits(uint64(encoded[i + 3]), cnt);
-            i += 3
+    pos := 0
+    for i := 0; i < len(tokens); i++ {
+        t := tokens[i]
+        switch t & tokenKind {
+        case tokenLiteral:
+            p := pixels[pos]
+            w.writeCode(codes[0][p.G])
+            w.writeCode(codes[1][p.R])
+            w.writeCode(codes[2][p.B])
+            w.writeCode(codes[3][p.A])
+            pos++
+        case tokenCache:
+            w.writeCode(codes[0][256 + 24 + t &^ tokenKind])
+            pos++
+        case tokenCopy:
+            length := int(t &^ tokenKind)
+            s, l := prefixEncodeCode(length)
+            w.writeCode(codes[0][256 + s])
+            w.writeBits(uint64(l), prefixEncodeBits(s))
+
+            i++
+            s, l = prefixEncodeCode(int(tokens[i]))
+            w.writeCode(codes[4][s])
+            w.writeBits(uint64(l), prefixEncodeBits(s))
+            pos += length
         }
     }
 }
 
-func encodeImageData(pixels []color.NRGBA, width, height, colorCacheBits int) []int {
-    head := make([]int, 1 << 14)
-    prev := make([]int, len(pixels))
-    cache := make([]color.NRGBA, 1 << colorCacheBits)
-
-    encoded := make([]int, len(pixels) * 4)
-    cnt := 0
-
-    var distances = []int {
-        96,   73,  55,  39,  23,  13,   5,  1,  255, 255, 255, 255, 255, 255, 255, 255,
-        101,  78,  58,  42,  26,  16,   8,  2,    0,   3,  9,   17,  27,  43,  59,  79,
-        102,  86,  62,  46,  32,  20,  10,  6,    4,   7,  11,  21,  33,  47,  63,  87,
-        105,  90,  70,  52,  37,  28,  18,  14,  12,  15,  19,  29,  38,  53,  71,  91,
-        110,  99,  82,  66,  48,  35,  30,  24,  22,  25,  31,  36,  49,  67,  83, 100,
-        115, 108,  94,  76,  64,  50,  44,  40,  34,  41,  45,  51,  65,  77,  95, 109,
-        118, 113, 103,  92,  80,  68,  60,  56,  54,  57,  61,  69,  81,  93, 104, 114,
-        119, 116, 111, 106,  97,  88,  84,  74,  72,  75,  85,  89,  98, 107, 112, 117,
-    }
-
-    for i := 0; i < len(pixels); i++ {
-        if i + 2 < len(pixels) {
-            h := hash(pixels[i + 0], 14)
-            h ^= hash(pixels[i + 1], 14) * 0x9e3779b9
-            h ^= hash(pixels[i + 2], 14) * 0x85ebca6b
-            h = h % (1 << 14)
-
-            cur := head[h] - 1
-            prev[i] = head[h]
-            head[h] = i + 1
-
-            dis := 0
-            streak := 0
-            for j := 0; j < 8; j++ {
-                // 1 << 20: sliding window size is 2^20 (1,048,576) per WebP specs.
-                // 120: reserved margin for offset adjustments.
-                if cur == -1 || i - cur >= 1 << 20 - 120 {
-                    break
-                }
-
-                l := 0
-                // Limit the maximum match length to 4096 pixels per WebP specs.
-                for i + l < len(pixels) && l < 4096 {
-                    if pixels[i + l] != pixels[cur + l] {
-                        break
-                    }
-                    l++
-                }
-
-                if l > streak {
-                    streak = l
-                    dis = i - cur
-                }
-
-                cur = prev[cur] - 1
-            }
-
-            // Only use the match if it is at least 3 pixels long per WebP specs.
-            if streak >= 3 {
-                for j := 0; j < streak; j++ {
-                    h := hash(pixels[i + j], colorCacheBits)
-                    cache[h] = pixels[i + j]
-                }
-                
-                y := dis / width
-                x := dis - y * width
-            
-                code := dis + 120
-                if x <= 8 && y < 8 {
-                    code = distances[y * 16 + 8 - x] + 1
-                } else if x > width - 8 && y < 7 {
-                    code = distances[(y + 1) * 16 + 8 + (width - x)] + 1
-                }
-
-                s, l := prefixEncodeCode(streak)
-                encoded[cnt + 0] = int(s + 256)
-                encoded[cnt + 1] = int(l)
-
-                s, l = prefixEncodeCode(code)
-                encoded[cnt + 2] = int(s)
-                encoded[cnt + 3] = int(l)
-                cnt += 4
-    
-                i += streak - 1
-                continue
-            }
-        }
-
-        p := pixels[i]
-        if colorCacheBits > 0 {
-            hash := hash(p, colorCacheBits)
-
-            if i > 0 && cache[hash] == p {
-                encoded[cnt] = int(hash + 256 + 24)
-                cnt++
-                continue
-            }
-
-            cache[hash] = p
-        }
-
-        encoded[cnt+0] = int(p.G)
-        encoded[cnt+1] = int(p.R)
-        encoded[cnt+2] = int(p.B)
-        encoded[cnt+3] = int(p.A)
-        cnt += 4
-    }
-
-    return encoded[:cnt]
-}
+// Kinds of the tokens written by encodeImageData. Each token is a uint32 with its kind in the top
+// two bits, which keeps the stream at 4 bytes per pixel or less:
+//   - tokenLiteral: The next pixel is written as a literal, its color is read from the pixels.
+//   - tokenCache: The next pixel is written as the color cache index held in the low bits.
+//   - tokenCopy: A backward reference of the length held in the low bits, followed by a second
+//     token holding the distance code.
+const (
+    tokenLiteral    = uint32(0 << 30)
+    tokenCache      = uint32(1 << 30)
+    tokenCopy       = uint32(2 << 30)
+    tokenKind       = uint32(3 << 30)
+)
 
 func prefixEncodeCode(n int) (int, int) {
     if n <= 5 {
@@ -525,57 +730,243 @@ func hash(c color.NRGBA, shifts int) uint32 {
     return (x * 0x1e35a7bd) >> (32 - min(shifts, 32))
 }
 
-func computeHistograms(pixels []int, colorCacheBits int) [][]int {
+// computeHistograms counts the symbols of the five prefix codes for the tokens of pixels in the
+// scratch memory of b, which may be nil. Long token streams are split into chunks that are counted
+// by up to concurrency goroutines and then summed in order.
+func computeHistograms(pixels []color.NRGBA, tokens []uint32, colorCacheBits, concurrency int, b *encodeBuffers) [][]int {
+    if b == nil {
+        b = &encodeBuffers{}
+    }
+
     c := 0
     if colorCacheBits > 0 {
         c = 1 << colorCacheBits
     }
 
-    histos := [][]int{
-        make([]int, 256 + 24 + c),
-        make([]int, 256),
-        make([]int, 256),
-        make([]int, 256),
-        make([]int, 40),
-    }
-
-    for i := 0; i < len(pixels); i++ {
-        histos[0][pixels[i]]++
-        if(pixels[i] < 256) {
-            histos[1][pixels[i + 1]]++
-            histos[2][pixels[i + 2]]++
-            histos[3][pixels[i + 3]]++
-            i += 3
-        } else if pixels[i] < 256 + 24 {
-            histos[4][pixels[i + 2]]++
-            i += 3
+    sizes := []int{256 + 24 + c, 256, 256, 256, 40}
+    for i, size := range sizes {
+        b.histos[i] = resizeBuffer(b.histos[i], size)
+        clear(b.histos[i])
+    }
+
+    histos := b.histos[:]
+
+    // chunks are only worth their extra histograms for long streams
+    chunks := min(max(concurrency, 1), len(tokens) / minHistogramChunk)
+    if chunks <= 1 {
+        countSymbols(histos, pixels, tokens)
+        return histos
+    }
+
+    // a chunk must start at a token, not at the distance of a copy, and needs to know its first pixel
+    type chunk struct {
+        token, pos  int
+    }
+
+    starts := make([]chunk, 1, chunks + 1)
+    size := (len(tokens) + chunks - 1) / chunks
+    pos := 0
+    for i := 0; i < len(tokens); i++ {
+        if i >= len(starts) * size {
+            starts = append(starts, chunk{i, pos})
+        }
+
+        t := tokens[i]
+        switch t & tokenKind {
+        case tokenLiteral, tokenCache:
+            pos++
+        case tokenCopy:
+            pos += int(t &^ tokenKind)
+            i++
+        }
+    }
+    starts = append(starts, chunk{len(tokens), pos})
+
+    // the first chunk counts into histos, the others into their own histograms
+    b.chunkHistos = resizeBuffer(b.chunkHistos, len(starts) - 2)
+    for k := range b.chunkHistos {
+        for i, size := range sizes {
+            b.chunkHistos[k][i] = resizeBuffer(b.chunkHistos[k][i], size)
+            clear(b.chunkHistos[k][i])
+        }
+    }
+
+    parallelFor(len(starts) - 1, concurrency, func(k int) {
+        h := histos
+        if k > 0 {
+            h = b.chunkHistos[k - 1][:]
+        }
+
+        countSymbols(h, pixels[starts[k].pos:], tokens[starts[k].token:starts[k + 1].token])
+    })
+
+    for _, h := range b.chunkHistos {
+        for i := range histos {
+            for s, n := range h[i] {
+                histos[i][s] += n
+            }
         }
     }
 
     return histos
 }
 
+// minHistogramChunk is the smallest number of tokens counted by a goroutine of computeHistograms.
+const minHistogramChunk = 1 << 16
+
+// countSymbols adds the symbols of tokens to histos, the first token starts at the first of pixels.
+func countSymbols(histos [][]int, pixels []color.NRGBA, tokens []uint32) {
+    pos := 0
+    for i := 0; i < len(tokens); i++ {
+        t := tokens[i]
+        switch t & tokenKind {
+        case tokenLiteral:
+            p := pixels[pos]
+            histos[0][p.G]++
+            histos[1][p.R]++
+            histos[2][p.B]++
+            histos[3][p.A]++
+            pos++
+        case tokenCache:
+            histos[0][256 + 24 + t &^ tokenKind]++
+            pos++
+        case tokenCopy:
+            length := int(t &^ tokenKind)
+            s, _ := prefixEncodeCode(length)
+            histos[0][256 + s]++
+
+            i++
+            s, _ = prefixEncodeCode(int(tokens[i]))
+            histos[4][s]++
+            pos += length
+        }
+    }
+}
+
+// canFlatten reports whether flatten can convert the image type directly.
+func canFlatten(img image.Image) bool {
+    switch img.(type) {
+    case *image.NRGBA, *image.RGBA, *image.Gray, *image.YCbCr, *image.Paletted:
+        return true
+    }
+
+    return false
+}
+
+// flatten converts an image to a slice of NRGBA pixels in scanline order, starting at the
+// top left corner of its bounds. Each supported type is read directly from its pixel buffer,
+// giving the same colors as drawing it onto an *image.NRGBA with draw.Draw.
 func flatten(img image.Image) ([]color.NRGBA, error) {
-    w := img.Bounds().Dx()
-    h := img.Bounds().Dy()
+    return flattenInto(nil, img)
+}
 
-    rgba, ok := img.(*image.NRGBA)
-    if !ok {
+// flattenInto converts img like flatten, reusing the memory of dst if it is large enough.
+func flattenInto(dst []color.NRGBA, img image.Image) ([]color.NRGBA, error) {
+    b := img.Bounds()
+    w := b.Dx()
+    h := b.Dy()
+
+    if !canFlatten(img) {
         return nil, errors.New("unsupported image format")
     }
 
-    pixels := make([]color.NRGBA, w * h)
-    for y := 0; y < h; y++ {
-        for x := 0; x < w; x++ {
-            i := rgba.PixOffset(x, y)
-            s := rgba.Pix[i : i + 4 : i + 4]
+    // every pixel is overwritten below, so dst does not need to be cleared
+    pixels := resizeBuffer(dst, w * h)
+
+    switch img := img.(type) {
+    case *image.NRGBA:
+        for y := 0; y < h; y++ {
+            row := img.Pix[img.PixOffset(b.Min.X, b.Min.Y + y):][:4 * w]
+            dst := pixels[y * w:][:w]
+            for x := range dst {
+                s := row[4 * x : 4 * x + 4 : 4 * x + 4]
+                dst[x] = color.NRGBA{s[0], s[1], s[2], s[3]}
+            }
+        }
+    case *image.RGBA:
+        for y := 0; y < h; y++ {
+            row := img.Pix[img.PixOffset(b.Min.X, b.Min.Y + y):][:4 * w]
+            dst := pixels[y * w:][:w]
+            for x := range dst {
+                s := row[4 * x : 4 * x + 4 : 4 * x + 4]
+                dst[x] = unpremultiply(s[0], s[1], s[2], s[3])
+            }
+        }
+    case *image.Gray:
+        for y := 0; y < h; y++ {
+            row := img.Pix[img.PixOffset(b.Min.X, b.Min.Y + y):][:w]
+            dst := pixels[y * w:][:w]
+            for x, v := range row {
+                dst[x] = color.NRGBA{v, v, v, 255}
+            }
+        }
+    case *image.YCbCr:
+        // converted through color.YCbCr.RGBA like draw.Draw does, which differs slightly from color.YCbCrToRGB
+        for y := 0; y < h; y++ {
+            dst := pixels[y * w:][:w]
+            for x := range dst {
+                yi := img.YOffset(b.Min.X + x, b.Min.Y + y)
+                ci := img.COffset(b.Min.X + x, b.Min.Y + y)
+                r, g, bl, _ := color.YCbCr{img.Y[yi], img.Cb[ci], img.Cr[ci]}.RGBA()
+                dst[x] = color.NRGBA{uint8(r >> 8), uint8(g >> 8), uint8(bl >> 8), 255}
+            }
+        }
+    case *image.Paletted:
+        // indices beyond the palette are encoded as transparent black
+        var palette [256]color.NRGBA
+        for i, c := range img.Palette[:min(len(img.Palette), 256)] {
+            palette[i] = color.NRGBAModel.Convert(c).(color.NRGBA)
+        }
 
-            pixels[y * w + x].R = uint8(s[0])
-            pixels[y * w + x].G = uint8(s[1])
-            pixels[y * w + x].B = uint8(s[2])
-            pixels[y * w + x].A = uint8(s[3])
+        for y := 0; y < h; y++ {
+            row := img.Pix[img.PixOffset(b.Min.X, b.Min.Y + y):][:w]
+            dst := pixels[y * w:][:w]
+            for x, i := range row {
+                dst[x] = palette[i]
+            }
         }
     }
 
     return pixels, nil
+}
+
+// drawPixels converts any image like flatten by drawing it onto a small *image.NRGBA a few rows at
+// a time, which avoids holding a second copy of the whole image. The memory of dst is reused if
+// it is large enough.
+func drawPixels(dst []color.NRGBA, img image.Image) []color.NRGBA {
+    b := img.Bounds()
+    w := b.Dx()
+    h := b.Dy()
+
+    pixels := resizeBuffer(dst, w * h)
+    strip := image.NewNRGBA(image.Rect(0, 0, w, min(h, 16)))
+
+    for y := 0; y < h; y += strip.Rect.Dy() {
+        rows := strip.SubImage(image.Rect(0, 0, w, min(h - y, strip.Rect.Dy()))).(*image.NRGBA)
+        draw.Draw(rows, rows.Bounds(), img, image.Pt(b.Min.X, b.Min.Y + y), draw.Src)
+
+        // an *image.NRGBA is always flattened without an error
+        flattenInto(pixels[y * w : (y + rows.Rect.Dy()) * w], rows)
+    }
+
+    return pixels
+}
+
+// unpremultiply converts a premultiplied 8-bit color to NRGBA with the same rounding as color.NRGBAModel.
+func unpremultiply(r, g, b, a uint8) color.NRGBA {
+    switch a {
+    case 0xff:
+        return color.NRGBA{r, g, b, a}
+    case 0:
+        return color.NRGBA{}
+    }
+
+    // channels are extended to 16 bits first, as color.RGBA.RGBA does
+    a16 := uint32(a) * 0x101
+    return color.NRGBA{
+        R: uint8(uint32(r) * 0x101 * 0xffff / a16 >> 8),
+        G: uint8(uint32(g) * 0x101 * 0xffff / a16 >> 8),
+        B: uint8(uint32(b) * 0x101 * 0xffff / a16 >> 8),
+        A: a,
+    }
 }
\ No newline at end of file
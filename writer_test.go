@@ -4,13 +4,20 @@ import (
     //------------------------------
     //general
     //------------------------------
+    "io"
     "bytes"
     "reflect"
+    "math/rand"
     //------------------------------
     //imaging
     //------------------------------
     "image"
     "image/color"
+    "image/draw"
+    //------------------------------
+    //errors
+    //------------------------------
+    "errors"
     //------------------------------
     //testing
     //------------------------------
@@ -90,69 +97,68 @@ func TestEncode(t *testing.T) {
             generateTestImageNRGBA(8, 8, 64, true),
             false,
             []byte {
-                0x52, 0x49, 0x46, 0x46, 0xd0, 0x00, 0x00, 0x00, 
+                0x52, 0x49, 0x46, 0x46, 0xce, 0x00, 0x00, 0x00, 
                 0x57, 0x45, 0x42, 0x50, 0x56, 0x50, 0x38, 0x4c, 
-                0xc4, 0x00, 0x00, 0x00, 0x2f, 0x07, 0xc0, 0x01, 
+                0xc2, 0x00, 0x00, 0x00, 0x2f, 0x07, 0xc0, 0x01, 
                 0x10, 0x8d, 0x52, 0x09, 0x22, 0xfa, 0x1f, 0x12, 
-                0x06, 0x04, 0x1b, 0x89, 0x09, 0x00, 0x00, 0x00, 
+                0x04, 0x04, 0xdb, 0x26, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x50, 0xee, 0x15, 0x00, 
-                0x80, 0xb2, 0x3e, 0x37, 0x78, 0x04, 0xc8, 0x34, 
-                0xeb, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x40, 0xd9, 0x0d, 0x00, 0x80, 
+                0xf2, 0x9e, 0x1d, 0x86, 0x00, 0xd9, 0x64, 0x0f, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x70, 0x02, 0x64, 0x9a, 0x75, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x22, 
+                0x40, 0x36, 0x59, 0x01, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x38, 0x01, 0x32, 0xcd, 
-                0x0f, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x18, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0xc0, 0x05, 0x10, 0xc4, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0xe0, 0x04, 0x08, 0x70, 0x2e, 0xa8, 0x24, 0x55, 
-                0xed, 0x0d, 0x88, 0x96, 0xf9, 0x6e, 0x56, 0x6b, 
-                0xf3, 0x35, 0x1e, 0x1d, 0x7d, 0x5f, 0x38, 0xdc, 
-                0x7e, 0xbc, 0x41, 0xc6, 0x5a, 0x36, 0xeb, 0x03,
+                0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 0x09, 0x10, 
+                0x40, 0x2e, 0x28, 0x24, 0xb5, 0x92, 0x67, 0xd8, 
+                0xda, 0xae, 0xcf, 0x78, 0xb4, 0x51, 0x9f, 0xc6, 
+                0x52, 0x53, 0x5c, 0x73, 0x73, 0x7c, 0x54, 0x21, 
+                0xbf, 0xb5, 0x9c, 0xd6, 0x07, 0x00,
             },
         },
         {
             generateTestImageNRGBA(8, 8, 64, true),
             true,
             []byte {
-                0x52, 0x49, 0x46, 0x46, 0xe2, 0x00, 0x00, 0x00, 
+                0x52, 0x49, 0x46, 0x46, 0xe0, 0x00, 0x00, 0x00, 
                 0x57, 0x45, 0x42, 0x50, 0x56, 0x50, 0x38, 0x58, 
                 0x0a, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 
                 0x07, 0x00, 0x00, 0x07, 0x00, 0x00, 0x56, 0x50, 
-                0x38, 0x4c, 0xc4, 0x00, 0x00, 0x00, 0x2f, 0x07, 
+                0x38, 0x4c, 0xc2, 0x00, 0x00, 0x00, 0x2f, 0x07, 
                 0xc0, 0x01, 0x10, 0x8d, 0x52, 0x09, 0x22, 0xfa, 
-                0x1f, 0x12, 0x06, 0x04, 0x1b, 0x89, 0x09, 0x00, 
+                0x1f, 0x12, 0x04, 0x04, 0xdb, 0x26, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x50, 0xee, 
-                0x15, 0x00, 0x80, 0xb2, 0x3e, 0x37, 0x78, 0x04, 
-                0xc8, 0x34, 0xeb, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 0xd9, 0x0d, 
+                0x00, 0x80, 0xf2, 0x9e, 0x1d, 0x86, 0x00, 0xd9, 
+                0x64, 0x0f, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x70, 0x02, 0x64, 0x9a, 0x75, 0x00, 
+                0x00, 0x22, 0x40, 0x36, 0x59, 0x01, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x38, 0x01, 
-                0x32, 0xcd, 0x0f, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x18, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0xc0, 0x05, 0x10, 0xc4, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0xe0, 0x04, 0x08, 0x70, 0x2e, 0xa8, 
-                0x24, 0x55, 0xed, 0x0d, 0x88, 0x96, 0xf9, 0x6e, 
-                0x56, 0x6b, 0xf3, 0x35, 0x1e, 0x1d, 0x7d, 0x5f, 
-                0x38, 0xdc, 0x7e, 0xbc, 0x41, 0xc6, 0x5a, 0x36, 
-                0xeb, 0x03,
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 
+                0x09, 0x10, 0x40, 0x2e, 0x28, 0x24, 0xb5, 0x92, 
+                0x67, 0xd8, 0xda, 0xae, 0xcf, 0x78, 0xb4, 0x51, 
+                0x9f, 0xc6, 0x52, 0x53, 0x5c, 0x73, 0x73, 0x7c, 
+                0x54, 0x21, 0xbf, 0xb5, 0x9c, 0xd6, 0x07, 0x00,
             },
         },
     }{
@@ -199,6 +205,49 @@ func TestEncodeAllErrors(t *testing.T) {
             },
             "mismatched image and disposals lengths",
         },
+        {
+            &Animation {
+                Images: []image.Image{
+                    image.NewNRGBA(image.Rect(-4, 0, 4, 4)),
+                },
+                Durations: []uint {
+                    100,
+                },
+                Disposals: []uint {
+                    0,
+                },
+            },
+            "frame offsets must not be negative",
+        },
+        {
+            &Animation {
+                Images: []image.Image{
+                    generateTestImageNRGBA(4, 4, 64, true),
+                    image.NewNRGBA(image.Rect(1 << 26, 0, 1 << 26 + 4, 4)),
+                },
+                Durations: []uint {
+                    100, 100,
+                },
+                Disposals: []uint {
+                    0, 0,
+                },
+            },
+            "frame exceeds the maximum canvas size",
+        },
+        {
+            &Animation {
+                Images: []image.Image{
+                    image.NewNRGBA(image.Rect(0, 1 << 24 - 2, 4, 1 << 24 + 2)),
+                },
+                Durations: []uint {
+                    100,
+                },
+                Disposals: []uint {
+                    0,
+                },
+            },
+            "frame exceeds the maximum canvas size",
+        },
     }{
         b := &bytes.Buffer{}
 
@@ -247,26 +296,26 @@ func TestEncodeAll(t *testing.T) {
                 0x64, 0x00, 0x00, 0x01, 0x56, 0x50, 0x38, 0x4c, 
                 0xac, 0x00, 0x00, 0x00, 0x2f, 0x03, 0xc0, 0x00, 
                 0x10, 0x8d, 0x52, 0x17, 0x22, 0xfa, 0x1f, 0x12, 
-                0x04, 0x64, 0xd8, 0x26, 0x05, 0x00, 0x00, 0x00, 
+                0x03, 0x04, 0xd3, 0x2c, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x05, 0x00, 0x00, 0x80, 
-                0x1e, 0xd8, 0x21, 0x40, 0xa6, 0x59, 0x07, 0x00, 
+                0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0xec, 
+                0xc0, 0x83, 0x00, 0xd9, 0x64, 0x05, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0x0b, 0x20, 
-                0x92, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x17, 0x40, 0x24, 
+                0x0d, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x0b, 0x20, 0x12, 0x03, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 
+                0x16, 0x40, 0x24, 0x06, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x06, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x04, 0x72, 0xba, 0xc0, 
-                0x93, 0x87, 0xb5, 0xe5, 0xab, 0xec, 0x7e, 0x3c,
+                0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x08, 0x88, 0xe8, 0x03, 0x8e, 
+                0x59, 0x98, 0xcd, 0xb4, 0x8a, 0xbf, 0x78, 0x00,
             },
         },
         {
@@ -285,7 +334,7 @@ func TestEncodeAll(t *testing.T) {
                 },
             },
             []byte {
-                0x52, 0x49, 0x46, 0x46, 0xd4, 0x01, 0x00, 0x00, 
+                0x52, 0x49, 0x46, 0x46, 0xd2, 0x01, 0x00, 0x00, 
                 0x57, 0x45, 0x42, 0x50, 0x56, 0x50, 0x38, 0x58, 
                 0x0a, 0x00, 0x00, 0x00, 0x12, 0x00, 0x00, 0x00, 
                 0x07, 0x00, 0x00, 0x07, 0x00, 0x00, 0x41, 0x4e, 
@@ -296,55 +345,55 @@ func TestEncodeAll(t *testing.T) {
                 0xc8, 0x00, 0x00, 0x00, 0x56, 0x50, 0x38, 0x4c, 
                 0xac, 0x00, 0x00, 0x00, 0x2f, 0x03, 0xc0, 0x00, 
                 0x10, 0x8d, 0x52, 0x17, 0x22, 0xfa, 0x1f, 0x12, 
-                0x04, 0x64, 0xd8, 0x26, 0x05, 0x00, 0x00, 0x00, 
+                0x03, 0x04, 0xd3, 0x2c, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x05, 0x00, 0x00, 0x80, 
-                0x1e, 0xd8, 0x21, 0x40, 0xa6, 0x59, 0x07, 0x00, 
+                0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0xec, 
+                0xc0, 0x83, 0x00, 0xd9, 0x64, 0x05, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0x0b, 0x20, 
-                0x92, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x17, 0x40, 0x24, 
+                0x0d, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x0b, 0x20, 0x12, 0x03, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 
+                0x16, 0x40, 0x24, 0x06, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x06, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x04, 0x72, 0xba, 0xc0, 
-                0x93, 0x87, 0xb5, 0xe5, 0xab, 0xec, 0x7e, 0x3c, 
-                0x41, 0x4e, 0x4d, 0x46, 0xdc, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x08, 0x88, 0xe8, 0x03, 0x8e, 
+                0x59, 0x98, 0xcd, 0xb4, 0x8a, 0xbf, 0x78, 0x00, 
+                0x41, 0x4e, 0x4d, 0x46, 0xda, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x07, 0x00, 
                 0x00, 0x07, 0x00, 0x00, 0x64, 0x00, 0x00, 0x01, 
-                0x56, 0x50, 0x38, 0x4c, 0xc4, 0x00, 0x00, 0x00, 
+                0x56, 0x50, 0x38, 0x4c, 0xc2, 0x00, 0x00, 0x00, 
                 0x2f, 0x07, 0xc0, 0x01, 0x10, 0x8d, 0x52, 0x09, 
-                0x22, 0xfa, 0x1f, 0x12, 0x06, 0x04, 0x1b, 0x89, 
-                0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x22, 0xfa, 0x1f, 0x12, 0x04, 0x04, 0xdb, 0x26, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x50, 0xee, 0x15, 0x00, 0x80, 0xb2, 0x3e, 0x37, 
-                0x78, 0x04, 0xc8, 0x34, 0xeb, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 
+                0xd9, 0x0d, 0x00, 0x80, 0xf2, 0x9e, 0x1d, 0x86, 
+                0x00, 0xd9, 0x64, 0x0f, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x70, 0x02, 0x64, 0x9a, 
-                0x75, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x22, 0x40, 0x36, 0x59, 0x01, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x38, 0x01, 0x32, 0xcd, 0x0f, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x18, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 0x05, 
+                0x10, 0xc4, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0xe0, 0x04, 0x08, 0x70, 
-                0x2e, 0xa8, 0x24, 0x55, 0xed, 0x0d, 0x88, 0x96, 
-                0xf9, 0x6e, 0x56, 0x6b, 0xf3, 0x35, 0x1e, 0x1d, 
-                0x7d, 0x5f, 0x38, 0xdc, 0x7e, 0xbc, 0x41, 0xc6, 
-                0x5a, 0x36, 0xeb, 0x03, 
+                0x00, 0xc0, 0x09, 0x10, 0x40, 0x2e, 0x28, 0x24, 
+                0xb5, 0x92, 0x67, 0xd8, 0xda, 0xae, 0xcf, 0x78, 
+                0xb4, 0x51, 0x9f, 0xc6, 0x52, 0x53, 0x5c, 0x73, 
+                0x73, 0x7c, 0x54, 0x21, 0xbf, 0xb5, 0x9c, 0xd6, 
+                0x07, 0x00,
             },
         },
     }{
@@ -359,6 +408,114 @@ func TestEncodeAll(t *testing.T) {
     }
 }
 
+// limitedWriter accepts limit bytes and then fails, or reports a short write without an error if err is nil.
+type limitedWriter struct {
+    limit   int
+    err     error
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+    n := min(len(p), w.limit)
+    w.limit -= n
+    if n < len(p) {
+        return n, w.err
+    }
+
+    return n, nil
+}
+
+func TestEncodeWriteErrors(t *testing.T) {
+    img := generateTestImageNRGBA(16, 16, 64, true)
+    ani := &Animation{
+        Images:     []image.Image{img, img},
+        Durations:  []uint{100, 100},
+        Disposals:  []uint{0, 0},
+    }
+
+    failure := errors.New("disk full")
+
+    for id, tt := range []struct {
+        name        string
+        encode      func(w io.Writer) error
+    }{
+        {"Encode", func(w io.Writer) error {
+            return Encode(w, img, nil)
+        }},
+        {"Encode extended", func(w io.Writer) error {
+            return Encode(w, img, &Options{UseExtendedFormat: true})
+        }},
+        {"EncodeAll", func(w io.Writer) error {
+            return EncodeAll(w, ani, nil)
+        }},
+        {"AnimationEncoder", func(w io.Writer) error {
+            e := NewAnimationEncoder(w, 0, 0, nil)
+            e.AddFrame(img, 0)
+            return e.Close()
+        }},
+        {"Mux", func(w io.Writer) error {
+            m := &Mux{XMP: []byte("xmp"), Frames: []*MuxFrame{{Lossless: true, Bitstream: []byte{0x2f, 0x00, 0x00, 0x00, 0x00}}}}
+            return m.Encode(w)
+        }},
+    }{
+        full := new(bytes.Buffer)
+        if err := tt.encode(full); err != nil {
+            t.Fatalf("test %v %v: unexpected error %v", id, tt.name, err)
+        }
+
+        // failures are checked in the header, in the middle of the data and on the last byte
+        for _, limit := range []int{0, 5, full.Len() / 2, full.Len() - 1} {
+            for _, expectedErr := range []error{failure, nil} {
+                err := tt.encode(&limitedWriter{limit: limit, err: expectedErr})
+
+                if expectedErr == nil {
+                    expectedErr = io.ErrShortWrite
+                }
+
+                var writeErr *WriteError
+                if !errors.As(err, &writeErr) || !errors.Is(err, expectedErr) {
+                    t.Errorf("test %v %v: expected a WriteError wrapping %v got %v", id, tt.name, expectedErr, err)
+                    continue
+                }
+
+                if writeErr.Written != int64(limit) {
+                    t.Errorf("test %v %v: expected written bytes as %v got %v", id, tt.name, limit, writeErr.Written)
+                }
+            }
+        }
+
+        // the RIFF size is computed before the chunks are written and must match them
+        if size := int(full.Bytes()[4]) | int(full.Bytes()[5]) << 8 | int(full.Bytes()[6]) << 16; size != full.Len() - 8 {
+            t.Errorf("test %v %v: expected RIFF size as %v got %v", id, tt.name, full.Len() - 8, size)
+        }
+
+        if _, err := ParseChunks(bytes.NewReader(full.Bytes())); err != nil {
+            t.Errorf("test %v %v: unexpected error %v", id, tt.name, err)
+        }
+    }
+}
+
+func TestWriteChunkANMFHeaderErrors(t *testing.T) {
+    for id, tt := range []struct {
+        bounds      image.Rectangle
+        dataSize    int
+    }{
+        {image.Rect(-1, 0, 4, 4), 10},                      // halving alone would hide the negative offset
+        {image.Rect(0, -4, 4, 4), 10},
+        {image.Rect(1 << 26, 0, 1 << 26 + 4, 4), 10},       // offset too large for 24 bits
+        {image.Rect(0, 0, 1 << 25, 4), 10},                 // width too large for 24 bits
+        {image.Rect(0, 0, 4, 4), 1 << 32},                  // chunk too large for 32 bits
+    }{
+        buf := &bytes.Buffer{}
+        if err := writeChunkANMFHeader(buf, tt.dataSize, tt.bounds, 100, 0, 0); err == nil {
+            t.Errorf("test %v: expected error got nil", id)
+        }
+
+        if buf.Len() != 0 {
+            t.Errorf("test %v: expected nothing written got %v bytes", id, buf.Len())
+        }
+    }
+}
+
 func TestWriteChunkVP8X(t *testing.T) {
     for id, tt := range []struct {
         bounds       image.Rectangle
@@ -461,6 +618,24 @@ func TestWriteFramesErrors(t *testing.T) {
             },
             "mismatched image and disposals lengths",
         },
+        {
+            &Animation {
+                Images: []image.Image{
+                    frame,
+                },
+                Durations: []uint {
+                    100,
+                },
+                Disposals: []uint {
+                    1,
+                },
+                Blends: []uint {
+                    0,
+                    1,
+                },
+            },
+            "mismatched image and blends lengths",
+        },
         {
             // Note: although this test is grouped with writeFrames error tests,
             // it specifically targets an error inside writeBitStream, which is called by writeFrames
@@ -478,7 +653,7 @@ func TestWriteFramesErrors(t *testing.T) {
             "invalid image size",
         },
     }{
-        _, _, err := writeFrames(tt.ani)
+        _, _, err := writeFrames(tt.ani, &Options{Concurrency: 1}, nil)
         if err == nil {
             t.Errorf("test %v: expected error %v got nil", id, tt.expectedMsg)
             continue
@@ -515,34 +690,33 @@ func TestWriteFrames(t *testing.T) {
             },
             expectedAlpha: false,
             expectedBits: []byte{
-                0x41, 0x4e, 0x4d, 0x46, 0xd2, 0x00, 0x00, 0x00, 
+                0x41, 0x4e, 0x4d, 0x46, 0xce, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0b, 0x00, 
                 0x00, 0x0b, 0x00, 0x00, 0x64, 0x00, 0x00, 0x01, 
-                0x56, 0x50, 0x38, 0x4c, 0xba, 0x00, 0x00, 0x00, 
+                0x56, 0x50, 0x38, 0x4c, 0xb6, 0x00, 0x00, 0x00, 
                 0x2f, 0x0b, 0xc0, 0x02, 0x00, 0x8d, 0x52, 0x09, 
                 0x22, 0xfa, 0x1f, 0x12, 0x06, 0x04, 0xd8, 0x86, 
                 0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0xa0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0xa0, 0xc9, 0x06, 0x00, 0x20, 0x07, 0xce, 
-                0xbf, 0x22, 0x40, 0xa6, 0x19, 0x00, 0x00, 0x00, 
+                0x00, 0xa0, 0x89, 0x02, 0x00, 0xc8, 0x81, 0xf3, 
+                0xaf, 0x08, 0x90, 0x4d, 0x06, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0xe0, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x80, 0x03, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x20, 0xd3, 
-                0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x38, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x60, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x80, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0xc2, 0x00, 0xe1, 0x28, 0xde, 0x8e, 0x02, 
-                0x00, 0x00, 0x00, 0x40, 0x58, 0x1a, 0xa7, 0xba, 
-                0x36, 0xc1, 0x6b, 0x97, 0x85, 0xd7, 0x8e, 0xba, 
-                0xd6, 0xef, 0x94, 0x1f, 0x21, 0xba, 0x37, 0xfc, 
-                0x8d, 0xa0, 0x07, 0x1b, 0x0e, 0x3d, 0xcc, 0xe5, 
-                0xe4, 0x83, 0x05, 0xb4, 0xa5, 0x90, 0xf6, 0x55, 
-                0x0f, 0xa5, 0xc6, 0x59, 0x3a, 0x62, 0x6d, 0xf8, 
-                0x1b, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x64, 0x93, 
+                0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x0c, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x20, 0x08, 0x10, 0x41, 0xfc, 0x61, 0x00, 0x00, 
+                0x00, 0x00, 0x84, 0xa5, 0x70, 0xaa, 0x2b, 0x1b, 
+                0xbc, 0xf6, 0x58, 0x78, 0xed, 0x5e, 0xab, 0xf6, 
+                0x3b, 0xe5, 0x23, 0x64, 0xc4, 0x6f, 0x04, 0x3d, 
+                0xd8, 0x70, 0xe8, 0x61, 0x2e, 0x27, 0x1f, 0x2c, 
+                0xa0, 0x2d, 0x85, 0xb4, 0xaf, 0xf6, 0x50, 0xda, 
+                0x3a, 0x47, 0x23, 0x19, 0xf1, 0x1b,
             },
         },
         {
@@ -562,71 +736,70 @@ func TestWriteFrames(t *testing.T) {
             },
             expectedAlpha: true,
             expectedBits: []byte{
-                0x41, 0x4e, 0x4d, 0x46, 0xd2, 0x00, 0x00, 0x00, 
+                0x41, 0x4e, 0x4d, 0x46, 0xce, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0b, 0x00, 
                 0x00, 0x0b, 0x00, 0x00, 0x64, 0x00, 0x00, 0x00, 
-                0x56, 0x50, 0x38, 0x4c, 0xba, 0x00, 0x00, 0x00, 
+                0x56, 0x50, 0x38, 0x4c, 0xb6, 0x00, 0x00, 0x00, 
                 0x2f, 0x0b, 0xc0, 0x02, 0x00, 0x8d, 0x52, 0x09, 
                 0x22, 0xfa, 0x1f, 0x12, 0x06, 0x04, 0xd8, 0x86, 
                 0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0xa0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0xa0, 0xc9, 0x06, 0x00, 0x20, 0x07, 0xce, 
-                0xbf, 0x22, 0x40, 0xa6, 0x19, 0x00, 0x00, 0x00, 
+                0x00, 0xa0, 0x89, 0x02, 0x00, 0xc8, 0x81, 0xf3, 
+                0xaf, 0x08, 0x90, 0x4d, 0x06, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0xe0, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x80, 0x03, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x20, 0xd3, 
-                0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x38, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x60, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x80, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0xc2, 0x00, 0xe1, 0x28, 0xde, 0x8e, 0x02, 
-                0x00, 0x00, 0x00, 0x40, 0x58, 0x1a, 0xa7, 0xba, 
-                0x36, 0xc1, 0x6b, 0x97, 0x85, 0xd7, 0x8e, 0xba, 
-                0xd6, 0xef, 0x94, 0x1f, 0x21, 0xba, 0x37, 0xfc, 
-                0x8d, 0xa0, 0x07, 0x1b, 0x0e, 0x3d, 0xcc, 0xe5, 
-                0xe4, 0x83, 0x05, 0xb4, 0xa5, 0x90, 0xf6, 0x55, 
-                0x0f, 0xa5, 0xc6, 0x59, 0x3a, 0x62, 0x6d, 0xf8, 
-                0x1b, 0x00, 0x41, 0x4e, 0x4d, 0x46, 0xfc, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x0f, 0x00, 0x00, 0x0f, 0x00, 0x00, 0x14, 0x00, 
-                0x00, 0x00, 0x56, 0x50, 0x38, 0x4c, 0xe4, 0x00, 
-                0x00, 0x00, 0x2f, 0x0f, 0xc0, 0x03, 0x10, 0x8d, 
-                0x52, 0x09, 0x22, 0xfa, 0x1f, 0x12, 0x06, 0x04, 
-                0x1b, 0x89, 0xc9, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x64, 0x93, 
+                0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x0c, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x20, 0x08, 0x10, 0x41, 0xfc, 0x61, 0x00, 0x00, 
+                0x00, 0x00, 0x84, 0xa5, 0x70, 0xaa, 0x2b, 0x1b, 
+                0xbc, 0xf6, 0x58, 0x78, 0xed, 0x5e, 0xab, 0xf6, 
+                0x3b, 0xe5, 0x23, 0x64, 0xc4, 0x6f, 0x04, 0x3d, 
+                0xd8, 0x70, 0xe8, 0x61, 0x2e, 0x27, 0x1f, 0x2c, 
+                0xa0, 0x2d, 0x85, 0xb4, 0xaf, 0xf6, 0x50, 0xda, 
+                0x3a, 0x47, 0x23, 0x19, 0xf1, 0x1b, 0x41, 0x4e, 
+                0x4d, 0x46, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x0f, 0x00, 0x00, 0x0f, 
+                0x00, 0x00, 0x14, 0x00, 0x00, 0x00, 0x56, 0x50, 
+                0x38, 0x4c, 0xe0, 0x00, 0x00, 0x00, 0x2f, 0x0f, 
+                0xc0, 0x03, 0x10, 0x8d, 0x52, 0x09, 0x22, 0xfa, 
+                0x1f, 0x12, 0x06, 0x04, 0xe5, 0x0a, 0x79, 0x01, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x40, 0xf9, 0xff, 0x3a, 0x36, 0x00, 
-                0x38, 0xd6, 0xe7, 0x07, 0x43, 0x80, 0x4c, 0xb3, 
-                0x0e, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0xa3, 
+                0xed, 0x1a, 0x05, 0x00, 0x9f, 0x2e, 0x0a, 0x42, 
+                0x80, 0x6c, 0xb2, 0x02, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x27, 0x40, 0xa6, 0x59, 0x07, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x80, 0x13, 0x20, 0x9b, 0xac, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x80, 0x13, 0x20, 0xd3, 0xfc, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xe0, 0x04, 
+                0xc8, 0x26, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x70, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x0c, 0x10, 0x68, 0x83, 0x0f, 0xe1, 0x09, 0x00, 
-                0x00, 0x00, 0xce, 0x01, 0x21, 0x26, 0x57, 0x49, 
-                0xae, 0xdf, 0xe0, 0xbb, 0xa1, 0x65, 0xb5, 0x32, 
-                0x41, 0xd6, 0x3b, 0x5a, 0x33, 0x41, 0xca, 0xf9, 
-                0xcd, 0x62, 0xef, 0xce, 0x03, 0x98, 0x1e, 0x7d, 
-                0x6f, 0x4f, 0xce, 0xc5, 0xed, 0xeb, 0xc1, 0x71, 
-                0x66, 0x93, 0x55, 0x76, 0xcb, 0x56, 0x76, 0xfb, 
-                0x20, 0x65, 0xf7, 0xfd, 0x18, 0x00, 
+                0x00, 0x00, 0x80, 0x01, 0xb2, 0x6d, 0xf0, 0x22, 
+                0x30, 0x07, 0x00, 0x00, 0x80, 0x13, 0x20, 0x8c, 
+                0x72, 0x6d, 0x92, 0xad, 0xec, 0xfe, 0x2c, 0xa8, 
+                0x55, 0x5f, 0x36, 0x90, 0x7e, 0xaf, 0xbe, 0xd9, 
+                0x40, 0xc6, 0xfc, 0x16, 0xef, 0x05, 0xcc, 0x8a, 
+                0xb5, 0x7b, 0x95, 0x93, 0xc8, 0xbe, 0x72, 0xc4, 
+                0x22, 0x6f, 0x64, 0xf9, 0x46, 0xf6, 0x60, 0x0e, 
+                0x3e, 0xee, 0x39, 0x9f, 0x01, 0x00,
             },
         },
     }{
         
-        buffer, alpha, err := writeFrames(tt.ani)
+        buffer, alpha, err := writeFrames(tt.ani, &Options{Concurrency: 1}, nil)
         if err != nil {
             t.Errorf("test %v: unexpected error %v", id, err)
             continue
@@ -644,6 +817,82 @@ func TestWriteFrames(t *testing.T) {
     }
 }
 
+func TestWriteFramesClamp(t *testing.T) {
+    ani := &Animation{
+        Images:     []image.Image{generateTestImageNRGBA(4, 4, 64, false)},
+        Durations:  []uint{1 << 25},
+        Disposals:  []uint{3},
+        Blends:     []uint{2},
+    }
+
+    buffer, _, err := writeFrames(ani, &Options{Concurrency: 1}, nil)
+    if err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    // the written frame holds the clamped values
+    d := buffer.Bytes()[8:]
+    if duration := read24(d[12:15]); duration != 1 << 24 - 1 {
+        t.Errorf("expected duration %v got %v", 1 << 24 - 1, duration)
+    }
+
+    if flags := d[15]; flags != 0x03 {
+        t.Errorf("expected disposal and blend flags %08b got %08b", 0x03, flags)
+    }
+
+    // the caller's settings are left untouched
+    if ani.Durations[0] != 1 << 25 || ani.Disposals[0] != 3 || ani.Blends[0] != 2 {
+        t.Errorf("expected input to be unchanged got durations %v disposals %v blends %v", ani.Durations, ani.Disposals, ani.Blends)
+    }
+}
+
+func TestWriteFramesConcurrency(t *testing.T) {
+    var images []image.Image
+    var durations, disposals []uint
+    for i := 0; i < 12; i++ {
+        images = append(images, generateTestImageNRGBA(8 + i, 16 - i, float64(8 * i), i % 2 == 0))
+        durations = append(durations, uint(10 * i))
+        disposals = append(disposals, uint(i % 2))
+    }
+
+    ani := &Animation{
+        Images:     images,
+        Durations:  durations,
+        Disposals:  disposals,
+    }
+
+    expected, expectedAlpha, err := writeFrames(ani, &Options{Concurrency: 1}, nil)
+    if err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    for _, concurrency := range []int{2, 5, 12, 64} {
+        buffer, alpha, err := writeFrames(ani, &Options{Concurrency: concurrency}, nil)
+        if err != nil {
+            t.Errorf("concurrency %v: unexpected error %v", concurrency, err)
+            continue
+        }
+
+        if alpha != expectedAlpha {
+            t.Errorf("concurrency %v: expected alpha as %v got %v", concurrency, expectedAlpha, alpha)
+        }
+
+        if !bytes.Equal(buffer.Bytes(), expected.Bytes()) {
+            t.Errorf("concurrency %v: output differs from sequential encoding", concurrency)
+        }
+    }
+
+    // the error of the first failing frame is reported
+    ani.Images[3] = nil
+    ani.Images[7] = image.NewNRGBA(image.Rectangle{})
+    for _, concurrency := range []int{1, 4} {
+        _, _, err := writeFrames(ani, &Options{Concurrency: concurrency}, nil)
+        if err == nil || err.Error() != "image is nil" {
+            t.Errorf("concurrency %v: expected error image is nil got %v", concurrency, err)
+        }
+    }
+}
+
 func TestWriteBitStreamHeader(t *testing.T) {
     for id, tt := range []struct {
         bounds       image.Rectangle
@@ -681,17 +930,12 @@ func TestWriteBitStreamHeader(t *testing.T) {
             },
         },
     }{
-        buffer := &bytes.Buffer{}
-        writer := &bitWriter{
-            Buffer:        buffer,
-            BitBuffer:     0,
-            BitBufferSize: 0,
-        }
-
+        writer := &bitWriter{}
         writeBitStreamHeader(writer, tt.bounds, tt.hasAlpha)
+        writer.writeThrough()
 
-        if !bytes.Equal(buffer.Bytes(), tt.expectedBits) {
-            t.Errorf("test %d: buffer mismatch expected: %v got: %v\n", id, tt.expectedBits, buffer.Bytes())
+        if !bytes.Equal(writer.Buffer, tt.expectedBits) {
+            t.Errorf("test %d: buffer mismatch expected: %v got: %v\n", id, tt.expectedBits, writer.Buffer)
             continue
         }
     }
@@ -715,7 +959,7 @@ func TestWritBitStreamErrors(t *testing.T) {
             "invalid image size",
         },
     }{
-        _, _, err := writeBitStream(tt.img)
+        _, _, err := writeBitStream(tt.img, nil, nil)
         if err == nil {
             t.Errorf("test %v: expected error %v got nil", id, tt.expectedMsg)
             continue
@@ -739,30 +983,30 @@ func TestWriteBitStream(t *testing.T) {
             true,
             []byte {
                 0x2f, 0x07, 0xc0, 0x01, 0x10, 0x8d, 0x52, 0x09, 
-                0x22, 0xfa, 0x1f, 0x12, 0x06, 0x04, 0x1b, 0x89, 
-                0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x22, 0xfa, 0x1f, 0x12, 0x04, 0x04, 0xdb, 0x26, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x50, 0xee, 0x15, 0x00, 0x80, 0xb2, 0x3e, 0x37, 
-                0x78, 0x04, 0xc8, 0x34, 0xeb, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 
+                0xd9, 0x0d, 0x00, 0x80, 0xf2, 0x9e, 0x1d, 0x86, 
+                0x00, 0xd9, 0x64, 0x0f, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x70, 0x02, 0x64, 0x9a, 
-                0x75, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x22, 0x40, 0x36, 0x59, 0x01, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x38, 0x01, 0x32, 0xcd, 0x0f, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x18, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 0x05, 
+                0x10, 0xc4, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0xe0, 0x04, 0x08, 0x70, 
-                0x2e, 0xa8, 0x24, 0x55, 0xed, 0x0d, 0x88, 0x96, 
-                0xf9, 0x6e, 0x56, 0x6b, 0xf3, 0x35, 0x1e, 0x1d, 
-                0x7d, 0x5f, 0x38, 0xdc, 0x7e, 0xbc, 0x41, 0xc6, 
-                0x5a, 0x36, 0xeb, 0x03,
+                0x00, 0xc0, 0x09, 0x10, 0x40, 0x2e, 0x28, 0x24, 
+                0xb5, 0x92, 0x67, 0xd8, 0xda, 0xae, 0xcf, 0x78, 
+                0xb4, 0x51, 0x9f, 0xc6, 0x52, 0x53, 0x5c, 0x73, 
+                0x73, 0x7c, 0x54, 0x21, 0xbf, 0xb5, 0x9c, 0xd6, 
+                0x07, 0x00,
             },
         },
         {
@@ -776,24 +1020,23 @@ func TestWriteBitStream(t *testing.T) {
                 0x0a, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x38, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x80, 0x0f, 0x00, 0x00, 0x72, 0xe0, 0x58, 0x87, 
-                0x00, 0x99, 0x66, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x80, 0x03, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x1c, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x40, 0x80, 0x4c, 0x13, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xe0, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0x01, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0e, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x88, 
-                0x25, 0x90, 0xb4, 0xae, 0xfa, 0x93, 0x45, 0x45, 
-                0x39, 0x0e, 0x1b, 0x62, 0x86, 0xe9, 0x8e, 0x75, 
-                0xda, 0x14, 0xfd, 0xf8, 0xe2, 0x91, 0x21, 0x28, 
-                0x61, 0xf8, 0x8f, 0x67, 0x2d, 0xdb, 0x1d, 0xdd, 
-                0x00, 0x00, 
+                0x00, 0xd9, 0x64, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x0e, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x20, 0x40, 0x36, 0x39, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x20, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x62, 
+                0x09, 0x24, 0xad, 0xab, 0x7a, 0xb2, 0xe8, 0x51, 
+                0x8e, 0x8f, 0x0d, 0x31, 0xc3, 0x74, 0xc7, 0x3a, 
+                0x6d, 0x3a, 0x75, 0x9c, 0x78, 0x64, 0x08, 0x4a, 
+                0x18, 0xfe, 0xe3, 0x59, 0xcb, 0x76, 0x47, 0x37,
             },
         },
     }{
-        b, alpha, err := writeBitStream(tt.img)
+        b, alpha, err := writeBitStream(tt.img, nil, nil)
         if err != nil {
             t.Errorf("test %v: unexpected error %v", id, err)
             continue
@@ -813,7 +1056,7 @@ func TestWriteBitStream(t *testing.T) {
     }
 }
 
-func TestWriteBitStreamDataErrors(t *testing.T) {
+func TestWriteBitStreamPixelsErrors(t *testing.T) {
     imgpal := image.NewNRGBA(image.Rect(0, 0, 257, 1))
     for i := 0; i < 257; i++ {
         imgpal.Set(i, 0, color.NRGBA{
@@ -829,21 +1072,19 @@ func TestWriteBitStreamDataErrors(t *testing.T) {
         transforms  [4]bool
         expectedMsg string
     }{
-        {
-            image.NewRGBA(image.Rectangle{}),
-            [4]bool{ false, false, false, false, },
-            "unsupported image format",
-        },
         {
             imgpal,
             [4]bool{ false, false, false, true, },
             "palette exceeds 256 colors",
         },
     }{
-        b := &bytes.Buffer{}
-        s := &bitWriter{Buffer: b}
+        pixels, err := flatten(tt.img)
+        if err != nil {
+            t.Fatalf("test %v: unexpected error %v", id, err)
+        }
 
-        err := writeBitStreamData(s, tt.img, 0, tt.transforms)
+        s := &bitWriter{}
+        err = writeBitStreamPixels(s, pixels, tt.img.Bounds().Dx(), tt.img.Bounds().Dy(), 0, tt.transforms, 1, defaultMatchFinder, &encodeBuffers{})
         if err == nil {
             t.Errorf("test %v: expected error %v got nil", id, tt.expectedMsg)
             continue
@@ -856,7 +1097,7 @@ func TestWriteBitStreamDataErrors(t *testing.T) {
     }
 }
 
-func TestWriteBitStreamData(t *testing.T) {
+func TestWriteBitStreamPixels(t *testing.T) {
     img := generateTestImageNRGBA(8, 8, 64, true)
 
     for id, tt := range []struct {
@@ -873,30 +1114,26 @@ func TestWriteBitStreamData(t *testing.T) {
             },
             0,
             []byte{
-                0x85, 0x00, 0x22, 0x09, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0xc5, 0xfc, 0x0b, 0x20, 0x92, 0x06, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x98, 0x01, 0x00, 0x80, 0x00, 
-                0x22, 0x69, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x0b, 0x20, 0x92, 
+                0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0xb0, 0x00, 0x22, 0x69, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0xb0, 0x00, 0x82, 0x08, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xe8, 
-                0x02, 0x30, 0x2d, 0x1b, 0x54, 0x56, 0x55, 0x9b, 
-                0xc0, 0xb6, 0x2a, 0x41, 0x75, 0xd5, 0x6a, 0x56, 
-                0x55, 0x83, 0x4a, 0xdb, 0x32, 0xd7, 0x4a, 0x00, 
-                0x58, 0x8e, 0x07, 0xc9, 0x54, 0x9a, 0x05, 0x3c, 
-                0x97, 0x04, 0xe9, 0xd4, 0xca, 0xa6, 0xd2, 0x20, 
-                0xc9, 0x73, 0xec, 0x9a, 0x04,                
+                0x0b, 0x20, 0x88, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x80, 0x00, 0xa6, 0x65, 0x83, 0xe5, 
+                0x6a, 0x6d, 0x02, 0xdb, 0x5a, 0x82, 0xf5, 0xca, 
+                0xb2, 0x81, 0xb9, 0x5a, 0x83, 0xa5, 0x6d, 0x99, 
+                0x60, 0xbd, 0x5a, 0x02, 0xc0, 0x72, 0x3c, 0x28, 
+                0xab, 0x9a, 0x05, 0x3c, 0x57, 0x82, 0xba, 0xe2, 
+                0x78, 0xc0, 0x56, 0x35, 0x28, 0x79, 0x8e, 0x05, 
+                0x75, 0x55,
             },
         },
         {
@@ -908,34 +1145,34 @@ func TestWriteBitStreamData(t *testing.T) {
             },
             8,
             []byte{
-                0x15, 0x21, 0x20, 0xd8, 0x36, 0x05, 0x00, 0x00, 
+                0x15, 0x21, 0x20, 0x20, 0x27, 0x0f, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0xc6, 0x00, 0x00, 
-                0x40, 0x00, 0x00, 0x07, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x1c, 0x66, 0x00, 0x00, 0x00, 
-                0x00, 0x03, 0x00, 0x00, 0x80, 0x3b, 0x00, 0x00, 
-                0x00, 0xc0, 0x01, 0x00, 0x00, 0x83, 0x3b, 0x00, 
-                0x00, 0x00, 0xc0, 0x01, 0x02, 0x88, 0xa4, 0x01, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x8c, 0x01, 0x00, 
+                0x80, 0x03, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x08, 0x66, 0x00, 0x00, 0x00, 
+                0x00, 0x03, 0x00, 0x00, 0x80, 0x04, 0x00, 0x00, 
+                0x00, 0x10, 0x00, 0x00, 0x60, 0x90, 0x00, 0x00, 
+                0x00, 0x00, 0x02, 0x08, 0x20, 0x92, 0x06, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 0x02, 
-                0x88, 0xe4, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0b, 0x20, 
+                0x92, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0xc0, 0x02, 0x08, 0x22, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0xa0, 0x0b, 0x12, 0x3a, 
-                0x75, 0xe9, 0xc6, 0xa2, 0x25, 0xcb, 0xc1, 0x5d, 
-                0xc5, 0x3f, 0xae, 0x71, 0x3e, 0x75, 0x57, 0xb8, 
-                0x16, 0xc8, 0xca, 0xc9, 0x63, 0x68, 0x64, 0x9c, 
-                0xbc, 0xdd, 0xcc, 0xe1, 0x9a, 0x63, 0xd2, 0x6f, 
-                0xa7, 0x6b,                
+                0x00, 0x0b, 0x20, 0x88, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x80, 0x2e, 0x48, 0xe8, 0xd4, 
+                0xa5, 0x1b, 0x8b, 0x96, 0x2c, 0x07, 0x77, 0x15, 
+                0xff, 0xb8, 0xc6, 0xf9, 0xd4, 0x5d, 0xe1, 0x5a, 
+                0x20, 0x2b, 0x27, 0x8f, 0xa1, 0x91, 0x71, 0xf2, 
+                0x76, 0x33, 0x87, 0x6b, 0x8e, 0x49, 0xbf, 0x9d, 
+                0xae,
             },
         },
         { 
@@ -947,31 +1184,27 @@ func TestWriteBitStreamData(t *testing.T) {
             },
             0,
             []byte{
-                0x93, 0x0a, 0x64, 0x07, 0xfa, 0x1f, 0x10, 0x40, 
-                0x24, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x33, 0x00, 0x00, 0x10, 0x40, 0x24, 0x0d, 
+                0x93, 0x0a, 0x64, 0x07, 0xfa, 0x1f, 0x98, 0x7f, 
+                0x01, 0x44, 0xd2, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x26, 
-                0x40, 0xa6, 0x69, 0x07, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x60, 0x01, 0x04, 0x71, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x80, 0x0b, 0x20, 0x88, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0x2e, 0x10, 
-                0xa6, 0x65, 0x13, 0xc5, 0x52, 0xd9, 0x24, 0x6c, 
-                0xab, 0x48, 0x94, 0x4b, 0xab, 0x59, 0x2a, 0x13, 
-                0x45, 0xdb, 0x32, 0xd7, 0x22, 0x41, 0x70, 0x79, 
-                0x7c, 0x22, 0x33, 0x2b, 0x9b, 0x4b, 0xf0, 0x79, 
-                0x99, 0x44, 0x76, 0xd6, 0xca, 0xcd, 0xca, 0x26, 
-                0x32, 0xf9, 0x3c, 0xee, 0x9a, 0x49,
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x28, 0x80, 0x20, 
+                0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x02, 0xb0, 0xda, 0xec, 0xc0, 0x74, 0x36, 0xb7, 
+                0x02, 0x76, 0xdb, 0x14, 0x98, 0xcf, 0x6c, 0x76, 
+                0xc0, 0x3a, 0x9b, 0x03, 0x53, 0xbb, 0xcd, 0x0a, 
+                0xcc, 0x67, 0x53, 0x00, 0x60, 0x39, 0x1e, 0x28, 
+                0xab, 0x9a, 0x05, 0x78, 0xae, 0x04, 0xea, 0x8a, 
+                0xe3, 0x01, 0xb6, 0xaa, 0x81, 0x92, 0xe7, 0x58, 
+                0xa0, 0xae, 0x4a,
             },
         },
         {
@@ -984,34 +1217,34 @@ func TestWriteBitStreamData(t *testing.T) {
             8,
             []byte{
                 0x53, 0xac, 0x40, 0x76, 0xa0, 0xff, 0x21, 0x42, 
-                0x40, 0xb0, 0x6d, 0x0a, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x40, 0x40, 0x4e, 0x1e, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x8c, 0x01, 0x00, 0x80, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x80, 0x03, 0x00, 0x00, 
-                0x00, 0x00, 0x0c, 0x00, 0x00, 0x38, 0x0c, 0x06, 
-                0x00, 0x00, 0x00, 0x1c, 0x00, 0x00, 0x00, 0x87, 
-                0x03, 0x00, 0x00, 0x00, 0x07, 0x00, 0x00, 0x06, 
-                0x87, 0x03, 0x04, 0x10, 0x49, 0x03, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x18, 0x03, 0x00, 0x00, 0x07, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 
+                0x00, 0x00, 0x18, 0x00, 0x00, 0x10, 0x0c, 0x06, 
+                0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x80, 0x20, 
+                0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x60, 0x10, 
+                0x04, 0x10, 0x40, 0x24, 0x0d, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x80, 0x09, 0x90, 0x69, 
-                0xbe, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x26, 0x40, 0x36, 0x69, 
+                0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0xe0, 0x02, 0x08, 0x22, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0xa0, 0x0b, 0x32, 0x34, 0xb5, 
-                0xb4, 0xb1, 0x68, 0xc9, 0x72, 0xf2, 0x76, 0xf1, 
-                0x8f, 0x6b, 0x9e, 0x4f, 0xbd, 0x9d, 0xae, 0x05, 
-                0x72, 0xe5, 0xc9, 0xc7, 0xa4, 0x29, 0xd3, 0xc1, 
-                0x5d, 0xcd, 0x1c, 0xae, 0x31, 0x26, 0x7d, 0x57, 
-                0xb8, 0x36,            
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 
+                0x05, 0x10, 0x44, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x40, 0x17, 0x64, 0x68, 0x6a, 0x69, 
+                0x63, 0xd1, 0x92, 0xe5, 0xe4, 0xed, 0xe2, 0x1f, 
+                0xd7, 0x3c, 0x9f, 0x7a, 0x3b, 0x5d, 0x0b, 0x24, 
+                0xa5, 0xa4, 0x31, 0xd7, 0x3c, 0xf3, 0x83, 0xbb, 
+                0x9a, 0x39, 0x5c, 0x63, 0x4c, 0xfa, 0xae, 0x70, 
+                0x6d,
             },
         },
         {
@@ -1023,29 +1256,26 @@ func TestWriteBitStreamData(t *testing.T) {
             },
             0,
             []byte{
-                0x91, 0x12, 0x44, 0xf4, 0x3f, 0x60, 0x80, 0x6c, 
-                0x9b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x91, 0x12, 0x44, 0xf4, 0x3f, 0x30, 0xff, 0x02, 
+                0x88, 0xa4, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x65, 0x77, 0x00, 0x00, 0x04, 0x10, 0x49, 
-                0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 
-                0x05, 0x10, 0x49, 0x03, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0xc0, 0x02, 0x88, 0xa4, 0x01, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x80, 0x09, 0x90, 0x69, 0x7e, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x60, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0xc0, 0x04, 0xc8, 0x26, 
+                0x0b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x70, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x27, 
-                0x40, 0xc0, 0x0d, 0x80, 0x08, 0x00, 0x06, 0x43, 
-                0x58, 0x69, 0x0f, 0x08, 0x43, 0x65, 0x7b, 0x78, 
-                0x08, 0x9d, 0x9e, 0x0e, 0xb3, 0x6c, 0x16, 0x1b, 
-                0x5d, 0xaf, 0xbb, 0xbd, 0x3e,
+                0x40, 0x60, 0x76, 0x1c, 0x97, 0xe7, 0x38, 0x6e, 
+                0x07, 0x04, 0x13, 0x20, 0xc0, 0x11, 0xa0, 0x81, 
+                0x00, 0xe1, 0x80, 0x60, 0x02, 0x04, 0x72, 0x9d, 
+                0xa6, 0x03, 0xcb, 0x58, 0x7c, 0x40, 0xf0, 0x02, 
+                0x04, 0x38, 0x02, 0xf4, 0x20, 0x40, 0x38, 0x20, 
+                0x78, 0x01,
             },
         },
         {
@@ -1057,34 +1287,33 @@ func TestWriteBitStreamData(t *testing.T) {
             },
             8,
             []byte{
-                0x51, 0x2c, 0x41, 0x44, 0xff, 0x43, 0xc4, 0x80, 
-                0x60, 0x23, 0x31, 0x01, 0x00, 0x00, 0x00, 0x00, 
+                0x51, 0x2c, 0x41, 0x44, 0xff, 0x43, 0x84, 0x80, 
+                0x60, 0xdb, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0xca, 0xbd, 0x02, 0x00, 0x50, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x60, 
-                0x05, 0x00, 0x80, 0x07, 0x00, 0x00, 0x00, 0x00, 
-                0xe0, 0x00, 0x00, 0x60, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1e, 0x00, 
-                0x00, 0x40, 0x00, 0x91, 0x1c, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x28, 0xbb, 0x01, 0x00, 0x50, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xe0, 0x05, 
+                0x00, 0x80, 0x03, 0x00, 0x00, 0x00, 0x00, 0x30, 
+                0x00, 0x00, 0x38, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x80, 0x01, 0x00, 0x00, 
+                0x08, 0x20, 0x92, 0x07, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x58, 0x00, 0x91, 0x34, 
+                0x00, 0x00, 0x00, 0x09, 0x20, 0x92, 0x06, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x98, 
-                0x00, 0x99, 0xe6, 0x07, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0b, 0x20, 
+                0x88, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x70, 0x02, 0x04, 0x72, 0x16, 
-                0xa9, 0x90, 0x52, 0x7b, 0x43, 0x44, 0x98, 0xef, 
-                0x66, 0xc5, 0xe6, 0x6b, 0x3c, 0x0c, 0xef, 0x0b, 
-                0xc3, 0xf6, 0xd3, 0x0d, 0x3a, 0xd6, 0xba, 0x59, 
-                0x1f,
+                0x80, 0x13, 0x20, 0x10, 0x21, 0x52, 0x58, 0x4a, 
+                0xc9, 0x33, 0xd9, 0xda, 0xf5, 0x19, 0x8f, 0x46, 
+                0x7d, 0x1a, 0xcb, 0xcf, 0x73, 0x0d, 0x03, 0x9f, 
+                0xae, 0x90, 0x6e, 0x2d, 0xd1, 0xfa,
             },
         },
         {
@@ -1096,30 +1325,26 @@ func TestWriteBitStreamData(t *testing.T) {
             },
             0,
             []byte{
-                0x8d, 0x94, 0x20, 0xa2, 0xff, 0x01, 0x03, 0x64, 
-                0xdb, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x28, 0xbb, 0x03, 0x00, 0x40, 0x80, 0x4c, 
-                0xb3, 0x0e, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x8d, 0x94, 0x20, 0xa2, 0xff, 0x81, 0xf9, 0x27, 
+                0x40, 0x36, 0xd9, 0x03, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x27, 0x40, 0xa6, 0xd9, 0x0f, 0x00, 0x00, 
+                0x00, 0x00, 0x80, 0x08, 0x90, 0x4d, 0x56, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x11, 0x20, 0xd3, 
-                0xfc, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0xc0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x4e, 0x80, 0x80, 0x3b, 0x00, 0xa2, 0x06, 
-                0xc0, 0xc1, 0x10, 0xd6, 0xd6, 0x1e, 0x10, 0x86, 
-                0xda, 0xb6, 0x87, 0x87, 0x50, 0xa9, 0xa9, 0x30, 
-                0x97, 0x9b, 0x8b, 0x8c, 0xbc, 0xd7, 0xf9, 0x5e, 
-                0x1f,
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x70, 0x02, 
+                0x64, 0x93, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x38, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x20, 0x30, 0x77, 0x1c, 0x97, 0x6f, 
+                0xc7, 0x71, 0x77, 0x40, 0x70, 0x0b, 0x10, 0xe0, 
+                0x08, 0xd0, 0x0d, 0x02, 0x84, 0x03, 0x82, 0x5b, 
+                0x80, 0x40, 0xae, 0x52, 0x54, 0xe0, 0x72, 0x5c, 
+                0x74, 0x40, 0xd0, 0x03, 0x04, 0x38, 0x02, 0xd4, 
+                0x21, 0x40, 0x38, 0x20, 0xe8, 0x01,
             },
         },
         {
@@ -1131,34 +1356,34 @@ func TestWriteBitStreamData(t *testing.T) {
             },
             8,
             []byte{
-                0x8d, 0x62, 0x09, 0x22, 0xfa, 0x1f, 0x22, 0x06, 
-                0x04, 0x1b, 0x89, 0x09, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x8d, 0x62, 0x09, 0x22, 0xfa, 0x1f, 0x22, 0x04, 
+                0x04, 0xdb, 0x26, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x50, 0xee, 0x15, 0x00, 0x80, 
-                0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x2b, 0x00, 0x00, 0x3c, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x07, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf0, 0x00, 
-                0x00, 0x00, 0x04, 0xc8, 0x34, 0xeb, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x40, 0xd9, 0x0d, 0x00, 0x80, 0x02, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x2f, 
+                0x00, 0x00, 0x1c, 0x00, 0x00, 0x00, 0x00, 0x80, 
+                0x01, 0x00, 0xc0, 0x01, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 
+                0x80, 0x00, 0xd9, 0x64, 0x0f, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x70, 0x02, 0x64, 
-                0x9a, 0x75, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x22, 0x40, 0x36, 0x59, 
+                0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x38, 0x01, 0x32, 0xcd, 0x0f, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x18, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0xe0, 0x04, 0x08, 
-                0x70, 0x2e, 0xa8, 0x24, 0x55, 0xed, 0x0d, 0x88, 
-                0x96, 0xf9, 0x6e, 0x56, 0x6b, 0xf3, 0x35, 0x1e, 
-                0x1d, 0x7d, 0x5f, 0x38, 0xdc, 0x7e, 0xbc, 0x41, 
-                0xc6, 0x5a, 0x36, 0xeb,
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 
+                0x05, 0x10, 0xc4, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0xc0, 0x09, 0x10, 0x40, 0x2e, 0x28, 
+                0x24, 0xb5, 0x92, 0x67, 0xd8, 0xda, 0xae, 0xcf, 
+                0x78, 0xb4, 0x51, 0x9f, 0xc6, 0x52, 0x53, 0x5c, 
+                0x73, 0x73, 0x7c, 0x54, 0x21, 0xbf, 0xb5, 0x9c, 
+                0xd6,
             },
         },
         {   // paletted image
@@ -1170,46 +1395,51 @@ func TestWriteBitStreamData(t *testing.T) {
             },
             4,
             []byte{
-                0x67, 0x48, 0x04, 0xc8, 0x34, 0x1d, 0x00, 0x00, 
+                0x67, 0x48, 0x04, 0xc8, 0x26, 0x0f, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x1c, 0x00, 0x00, 
-                0x00, 0x06, 0x00, 0x01, 0x44, 0xd2, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 
+                0x00, 0x03, 0x80, 0x00, 0x22, 0x69, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x60, 0x01, 0x44, 
-                0xd2, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0xb0, 0x00, 0x22, 
+                0x69, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x60, 0x01, 0x44, 0x32, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x60, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x40, 0x00, 0x00, 0x00, 0x00, 
+                0xb0, 0x00, 0x22, 0x19, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x30, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x80, 0x88, 0xda, 0xb1, 0x07, 
-                0x33, 0x7e, 0x90, 0x20, 0x20, 0x00, 0x24, 0x66, 
-                0x62, 0x10, 0x00, 0x00, 0x01, 0x00, 0x03, 0x80, 
-                0x01, 0x00, 0xc0, 0x00, 0xc0, 0x00, 0x04, 0x00, 
-                0x00, 0x30, 0x00, 0x30, 0x20, 0x00, 0x00, 0x00, 
-                0x0c, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0xe2, 0x9f, 0x9e, 0x23, 
-                0xfa, 0x1f, 0x18, 0x53, 0x71, 0xe4, 0xf3, 0xc5, 
-                0x6d, 0x74, 0xa6, 0x72, 0x93, 0x01, 0x35, 0x74, 
-                0xe5, 0x27, 0x1f, 0x6c,  
+                0x00, 0x00, 0x00, 0x40, 0x44, 0xed, 0xd8, 0x83, 
+                0x19, 0x3f, 0x48, 0x10, 0x10, 0x00, 0x12, 0x33, 
+                0x31, 0x08, 0x00, 0x80, 0x00, 0x80, 0x01, 0xc0, 
+                0x00, 0x00, 0x60, 0x00, 0x60, 0x00, 0x02, 0x00, 
+                0x00, 0x18, 0x00, 0x18, 0x10, 0x00, 0x00, 0x00, 
+                0x06, 0x00, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x00, 0x00, 0x00, 0x00, 0xf1, 0x4f, 0xcf, 0x11, 
+                0xfd, 0x0f, 0x8c, 0xa9, 0x38, 0xf2, 0xf9, 0xe2, 
+                0x36, 0x3a, 0x53, 0xb9, 0xc9, 0x80, 0x1a, 0xba, 
+                0xf2, 0x93, 0x0f, 0xb6,
             },
         },
     }{
-        b := &bytes.Buffer{}
-        s := &bitWriter{Buffer: b}
+        // the pixels are transformed in place, so every test starts from a fresh copy
+        pixels, err := flatten(img)
+        if err != nil {
+            t.Fatalf("test %v: unexpected error %v", id, err)
+        }
 
-        err := writeBitStreamData(s, img, tt.colorCacheBits, tt.transforms)
+        s := &bitWriter{}
+        err = writeBitStreamPixels(s, pixels, 8, 8, tt.colorCacheBits, tt.transforms, 1, defaultMatchFinder, &encodeBuffers{})
         if err != nil {
-            t.Fatalf("test %v: writeBitStreamData returned error: %v", id, err)
+            t.Fatalf("test %v: writeBitStreamPixels returned error: %v", id, err)
         }
 
-        result := b.Bytes()
+        s.writeThrough()
+        result := s.Buffer
 
         if !bytes.Equal(result, tt.expectedBytes) {
             t.Errorf("test %v: BitStream mismatch. Got %s, expected %s", id, result, tt.expectedBytes)
@@ -1239,9 +1469,9 @@ func TestWriteImageData(t *testing.T) {
             expectedBits: []byte{
                 0x45, 0x00, 0x91, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x30, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 
+                0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0x4f, 
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0x4e, 
                 0x86, 0x7c, 0x19, 0xcb, 0xfe, 0x47,
             },
         },
@@ -1273,10 +1503,10 @@ func TestWriteImageData(t *testing.T) {
             expectedBits: []byte{
                 0x85, 0x00, 0x22, 0x01, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x60, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
+                0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
                 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 
-                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x9f, 
-                0x0c, 0xf9, 0x32, 0x96, 0xfd, 0x8f, 0xd4,
+                0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x9d, 
+                0x0c, 0xf9, 0x32, 0x96, 0xfd, 0x8f, 0x3c,
             },
         },
         {
@@ -1295,17 +1525,12 @@ func TestWriteImageData(t *testing.T) {
             },
         },
     } {
-        buffer := &bytes.Buffer{}
-        writer := &bitWriter{
-            Buffer:        buffer,
-            BitBuffer:     0,
-            BitBufferSize: 0,
-        }
+        writer := &bitWriter{}
+        writeImageData(writer, tt.inputPixels, tt.width, tt.height, tt.isRecursive, tt.colorCacheBits, 1, defaultMatchFinder, nil)
+        writer.writeThrough()
 
-        writeImageData(writer, tt.inputPixels, tt.width, tt.height, tt.isRecursive, tt.colorCacheBits)
-
-        if !bytes.Equal(buffer.Bytes(), tt.expectedBits) {
-            t.Errorf("test %d: buffer mismatch\nexpected: %v got: %v", id, tt.expectedBits, buffer.Bytes())
+        if !bytes.Equal(writer.Buffer, tt.expectedBits) {
+            t.Errorf("test %d: buffer mismatch\nexpected: %v got: %v", id, tt.expectedBits, writer.Buffer)
             continue
         }
     }
@@ -1317,7 +1542,7 @@ func TestEncodeImageData(t *testing.T) {
         width           int
         height          int
         colorCacheBits  int
-        expectedEncoded []int
+        expectedEncoded []uint32
     }{
         {   //cached encoding
             inputPixels: []color.NRGBA{
@@ -1328,10 +1553,10 @@ func TestEncodeImageData(t *testing.T) {
             width: 3,
             height: 1,
             colorCacheBits: 2,
-            expectedEncoded: []int{
-                50, 100, 150, 255, // First pixel
-                100, 200, 50, 255, // Second pixel
-                256 + 24 + 3,       // Cached first pixel (hash index 0)
+            expectedEncoded: []uint32{
+                tokenLiteral,       // First pixel
+                tokenLiteral,       // Second pixel
+                tokenCache | 3,     // Cached first pixel (hash index 3)
             },
         },
         {   //full RGBA encoding
@@ -1343,14 +1568,54 @@ func TestEncodeImageData(t *testing.T) {
             width: 3,
             height: 1,
             colorCacheBits: 0,
-            expectedEncoded: []int{
-                50, 100, 150, 255,
-                100, 200, 50, 255, 
-                50, 100, 150, 255,  
+            expectedEncoded: []uint32{
+                tokenLiteral,
+                tokenLiteral,
+                tokenLiteral,
+            },
+        },
+        {   //backward reference
+            inputPixels: func() []color.NRGBA {
+                pixels := make([]color.NRGBA, 64)
+                for i := range pixels {
+                    c := uint8(i % 8)
+                    pixels[i] = color.NRGBA{R: 30 * c, G: 20 * c, B: 10 * c, A: 255}
+                }
+                return pixels
+            }(),
+            width: 64,
+            height: 1,
+            colorCacheBits: 0,
+            expectedEncoded: []uint32{
+                tokenLiteral, tokenLiteral, tokenLiteral, tokenLiteral,
+                tokenLiteral, tokenLiteral, tokenLiteral, tokenLiteral,
+                tokenCopy | 56,     // Copy of the remaining 56 pixels
+                97,                 // Distance 8 on the same row, code from the distance table
+            },
+        },
+        {   //short backward reference costs more than its literals
+            inputPixels: []color.NRGBA{
+                {R: 100, G: 50, B: 150, A: 255},
+                {R: 200, G: 100, B: 50, A: 255},
+                {R: 100, G: 50, B: 150, A: 255},
+                {R: 200, G: 100, B: 50, A: 255},
+                {R: 100, G: 50, B: 150, A: 255},
+                {R: 200, G: 100, B: 50, A: 255},
+            },
+            width: 6,
+            height: 1,
+            colorCacheBits: 0,
+            expectedEncoded: []uint32{
+                tokenLiteral,
+                tokenLiteral,
+                tokenLiteral,
+                tokenLiteral,
+                tokenLiteral,
+                tokenLiteral,
             },
         },
     } {
-        encoded := encodeImageData(tt.inputPixels, tt.width, tt.height, tt.colorCacheBits)
+        encoded := encodeImageData(tt.inputPixels, tt.width, tt.height, tt.colorCacheBits, defaultMatchFinder, nil)
 
         if !reflect.DeepEqual(encoded, tt.expectedEncoded) {
             t.Errorf("test %d: encoded data mismatch\nexpected: %+v\n     got: %+v", id, tt.expectedEncoded, encoded)
@@ -1541,18 +1806,22 @@ func TestHash(t *testing.T) {
 }
 
 func TestComputeHistograms(t *testing.T) {
+    literals := []color.NRGBA{
+        {R: 0x01, G: 0xff, B: 0x00, A: 0xff},
+        {R: 0xff, G: 0x00, B: 0x00, A: 0xff},
+        {R: 0x01, G: 0x01, B: 0xff, A: 0xff},
+    }
+
     for id, tt := range []struct {
-        pixels         []int
+        pixels         []color.NRGBA
+        tokens         []uint32
         colorCacheBits int
         expectedSizes  []int
         expectedCounts []map[int]int
     }{
         {
-            pixels: []int{
-                0xff, 0x01, 0x00, 0xff,
-                0x00, 0xff, 0x00, 0xff,
-                0x01, 0x01, 0xff, 0xff,
-            },
+            pixels: literals,
+            tokens: []uint32{tokenLiteral, tokenLiteral, tokenLiteral},
             colorCacheBits: 0,
             expectedSizes:  []int{256 + 24, 256, 256, 256, 40},
             expectedCounts: []map[int]int{
@@ -1564,15 +1833,12 @@ func TestComputeHistograms(t *testing.T) {
             },
         },
         {
-            pixels: []int{
-                0xff, 0x01, 0x00, 0xff, 
-                0x00, 0xff, 0x00, 0xff,
-                0x01, 0x01, 0xff, 0xff,
-            },
+            pixels: append(literals, literals[0]),
+            tokens: []uint32{tokenLiteral, tokenLiteral, tokenLiteral, tokenCache | 3},
             colorCacheBits: 4,
             expectedSizes:  []int{256 + 24 + (1 << 4), 256, 256, 256, 40},
             expectedCounts: []map[int]int{
-                {0: 1, 1: 1, 255: 1}, // histos[0]
+                {0: 1, 1: 1, 255: 1, 256 + 24 + 3: 1}, // histos[0]
                 {0: 0, 1: 2, 255: 1}, // histos[1]
                 {0: 2, 1: 0, 255: 1}, // histos[2]
                 {0: 0, 1: 0, 255: 3}, // histos[3]
@@ -1580,24 +1846,23 @@ func TestComputeHistograms(t *testing.T) {
             },
         },
         {
-            pixels: []int{
-                0x104, 0x01, 0x02, 0x03, // over 256
-                0xff, 0x01, 0x00, 0xff, 
-                0x00, 0xff, 0x00, 0xff,
-                0x01, 0x01, 0xff, 0xff,
+            pixels: append(make([]color.NRGBA, 5), literals...),
+            tokens: []uint32{
+                tokenCopy | 5, 3, // length prefix 4, distance prefix 2
+                tokenLiteral, tokenLiteral, tokenLiteral,
             },
             colorCacheBits: 4,
             expectedSizes:  []int{256 + 24 + (1 << 4), 256, 256, 256, 40},
             expectedCounts: []map[int]int{
-                {0: 1, 1: 1, 255: 1}, // histos[0]
+                {0: 1, 1: 1, 255: 1, 256 + 4: 1}, // histos[0]
                 {0: 0, 1: 2, 255: 1}, // histos[1]
                 {0: 2, 1: 0, 255: 1}, // histos[2]
                 {0: 0, 1: 0, 255: 3}, // histos[3]
-                {2: 1},               // histos[4] (unused in this case)
+                {2: 1},               // histos[4]
             },
         },
     }{
-        histos := computeHistograms(tt.pixels, tt.colorCacheBits)
+        histos := computeHistograms(tt.pixels, tt.tokens, tt.colorCacheBits, 1, nil)
 
         for i, histo := range histos {
             if len(histo) != tt.expectedSizes[i] {
@@ -1617,6 +1882,50 @@ func TestComputeHistograms(t *testing.T) {
     }
 }
 
+func TestComputeHistogramsConcurrency(t *testing.T) {
+    // the noise has enough tokens for several chunks, and its copies cross the chunk boundaries
+    pixels, err := flatten(generateTestImageNoise(400, 600, 11))
+    if err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    tokens := encodeImageData(pixels, 400, 600, 4, defaultMatchFinder, nil)
+    if len(tokens) < 2 * minHistogramChunk {
+        t.Fatalf("expected at least %v tokens got %v", 2 * minHistogramChunk, len(tokens))
+    }
+
+    expected := computeHistograms(pixels, tokens, 4, 1, nil)
+
+    b := &encodeBuffers{}
+    for _, concurrency := range []int{2, 3, 8, 100, 2} {
+        histos := computeHistograms(pixels, tokens, 4, concurrency, b)
+
+        if !reflect.DeepEqual(histos, expected) {
+            t.Errorf("concurrency %v: histograms differ from sequential counting", concurrency)
+        }
+    }
+}
+
+func TestEncodeConcurrency(t *testing.T) {
+    img := generateTestImageNoise(400, 600, 12)
+
+    expected := new(bytes.Buffer)
+    if err := Encode(expected, img, &Options{Concurrency: 1}); err != nil {
+        t.Fatalf("unexpected error %v", err)
+    }
+
+    for _, concurrency := range []int{2, 3, 16} {
+        buf := new(bytes.Buffer)
+        if err := Encode(buf, img, &Options{Concurrency: concurrency}); err != nil {
+            t.Fatalf("concurrency %v: unexpected error %v", concurrency, err)
+        }
+
+        if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+            t.Errorf("concurrency %v: output differs from sequential encoding", concurrency)
+        }
+    }
+}
+
 func TestFlatten(t *testing.T) {
     for id, tt := range []struct {
         width       int
@@ -1658,7 +1967,7 @@ func TestFlatten(t *testing.T) {
 
         var testImage image.Image = img
         if tt.expectError {
-            testImage = image.NewGray(img.Bounds())
+            testImage = image.NewCMYK(img.Bounds())
         }
 
         pixels, err := flatten(testImage)
@@ -1695,4 +2004,111 @@ func TestFlatten(t *testing.T) {
             }
         }
     }
-}
\ No newline at end of file
+}
+
+func TestFlattenImageTypes(t *testing.T) {
+    rnd := rand.New(rand.NewSource(1))
+    bounds := image.Rect(3, 5, 40, 31)
+
+    nrgba := image.NewNRGBA(image.Rect(0, 0, 50, 40))
+    rnd.Read(nrgba.Pix)
+
+    rgba := image.NewRGBA(bounds)
+    for i := 0; i < len(rgba.Pix); i += 4 {
+        // premultiplied colors never exceed their alpha
+        a := uint8(rnd.Intn(256))
+        rgba.Pix[i + 0] = uint8(rnd.Intn(int(a) + 1))
+        rgba.Pix[i + 1] = uint8(rnd.Intn(int(a) + 1))
+        rgba.Pix[i + 2] = uint8(rnd.Intn(int(a) + 1))
+        rgba.Pix[i + 3] = a
+    }
+
+    gray := image.NewGray(bounds)
+    rnd.Read(gray.Pix)
+
+    var ycbcrs []image.Image
+    for _, ratio := range []image.YCbCrSubsampleRatio{image.YCbCrSubsampleRatio444, image.YCbCrSubsampleRatio422, image.YCbCrSubsampleRatio420} {
+        img := image.NewYCbCr(image.Rect(0, 0, 50, 40), ratio)
+        rnd.Read(img.Y)
+        rnd.Read(img.Cb)
+        rnd.Read(img.Cr)
+        ycbcrs = append(ycbcrs, img, img.SubImage(image.Rect(1, 3, 44, 38)))
+    }
+
+    paletted := generateTestImagePaletted(50, 40, 16).(*image.Paletted)
+    paletted.Palette[3] = color.RGBA{0x40, 0x20, 0x10, 0x80}
+
+    for id, img := range append([]image.Image{
+        nrgba,
+        nrgba.SubImage(bounds),
+        rgba,
+        gray,
+        gray.SubImage(image.Rect(4, 6, 9, 30)),
+        paletted,
+        paletted.SubImage(bounds),
+    }, ycbcrs...) {
+        pixels, err := flatten(img)
+        if err != nil {
+            t.Errorf("test %v: unexpected error %v", id, err)
+            continue
+        }
+
+        drawn := image.NewNRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+        draw.Draw(drawn, drawn.Bounds(), img, img.Bounds().Min, draw.Src)
+
+        expected, _ := flatten(drawn)
+        if !reflect.DeepEqual(pixels, expected) {
+            t.Errorf("test %v: pixels of %T do not match draw.Draw", id, img)
+            continue
+        }
+
+        // the direct paths must not change the encoded output
+        if _, ok := img.(*image.Paletted); ok {
+            continue
+        }
+
+        b1, alpha1, err1 := writeBitStream(img, nil, nil)
+        b2, alpha2, err2 := writeBitStream(drawn, nil, nil)
+        if err1 != nil || err2 != nil || alpha1 != alpha2 || !bytes.Equal(b1.Bytes(), b2.Bytes()) {
+            t.Errorf("test %v: encoded %T does not match the encoded *image.NRGBA", id, img)
+        }
+    }
+
+    // indices beyond the palette are transparent black
+    img := image.NewPaletted(image.Rect(0, 0, 2, 1), color.Palette{color.White})
+    img.Pix[1] = 5
+
+    pixels, _ := flatten(img)
+    if pixels[0] != (color.NRGBA{255, 255, 255, 255}) || pixels[1] != (color.NRGBA{}) {
+        t.Errorf("expected pixels as white and transparent black got %v", pixels)
+    }
+}
+
+func TestDrawPixels(t *testing.T) {
+    rnd := rand.New(rand.NewSource(3))
+
+    cmyk := image.NewCMYK(image.Rect(0, 0, 37, 45))
+    rnd.Read(cmyk.Pix)
+
+    // the memory of dst is reused, so a larger buffer filled with other pixels is passed in
+    dst := make([]color.NRGBA, 50 * 50)
+    for i := range dst {
+        dst[i] = color.NRGBA{1, 2, 3, 4}
+    }
+
+    for id, img := range []image.Image{
+        cmyk,
+        cmyk.SubImage(image.Rect(3, 5, 30, 40)),
+        cmyk.SubImage(image.Rect(0, 0, 37, 16)),
+        cmyk.SubImage(image.Rect(2, 7, 3, 8)),
+    }{
+        drawn := image.NewNRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+        draw.Draw(drawn, drawn.Bounds(), img, img.Bounds().Min, draw.Src)
+        expected, _ := flatten(drawn)
+
+        pixels := drawPixels(dst, img)
+        if !reflect.DeepEqual(pixels, expected) {
+            t.Errorf("test %v: pixels do not match draw.Draw", id)
+        }
+    }
+}